@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/els0r/dynip-ng/pkg/agent"
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/listener"
+	"github.com/els0r/dynip-ng/pkg/listener/state"
+	"github.com/els0r/dynip-ng/pkg/logging"
+	"github.com/els0r/dynip-ng/pkg/update"
+	"github.com/spf13/cobra"
+)
+
+// agentCmd represents the agent command
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Report the IP to a central dynip-ng server",
+	Long: `Listens for changes on interface and reports the IP to a central
+dynip-ng server. The server updates the destinations configured for
+the agent, so that no provider credentials are needed on the agent's host.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		// we quit on encountering SIGTERM or SIGINT
+		sigExitChan := make(chan os.Signal, 1)
+		signal.Notify(sigExitChan, syscall.SIGTERM, os.Interrupt)
+
+		// parse config
+		config, err := cfg.ParseFile(cfgPath)
+		if err != nil {
+			return err
+		}
+		if config.Agent == nil {
+			return fmt.Errorf("no agent configuration provided")
+		}
+
+		// initialize logger
+		err = logging.Init(config.Logging)
+		if err != nil {
+			return err
+		}
+		logging.Get().Debug("Initialized logger")
+
+		// publish the counters of the destinations
+		stopMetrics, err := startMetrics(config.Metrics)
+		if err != nil {
+			return fmt.Errorf("failed to start metrics server: %s", err)
+		}
+		defer stopMetrics()
+
+		// the report to the server comes first. Local destinations are optional
+		reporter, err := agent.NewReporter(config.Agent)
+		if err != nil {
+			return err
+		}
+		updaters, err := update.NewUpdaters(config.Destinations)
+		if err != nil {
+			return err
+		}
+		updaters = append([]update.Updater{reporter}, updaters...)
+		logging.Get().Debug("Initialized agent reporter")
+
+		// prepare the state
+		state, err := state.New(config.State)
+		if err != nil {
+			return fmt.Errorf("failed to create state: %s", err)
+		}
+		logging.Get().Debug("Initialized state tracking")
+
+		// create listener
+		var l *listener.Listener
+		l, err = listener.New(config.Listen, state, updaters...)
+		if err != nil {
+			return fmt.Errorf("failed to create listener: %s", err)
+		}
+		defer waitForNotifiers(l)
+
+		// and run it
+		logging.Get().Debug("Spawning listener")
+		stop := l.Run()
+
+		// listen for the exit signal and stop the listener
+		<-sigExitChan
+		stop <- struct{}{}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(agentCmd)
+}
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/logging"
+)
+
+// MetricsPath is the path the expvar counters are served on
+const MetricsPath = "/debug/vars"
+
+// startMetrics serves the expvar counters, among them the ones of the destinations, if
+// a metrics listener is configured. The returned function shuts the server down
+func startMetrics(config *cfg.MetricsConfig) (func(), error) {
+	if config == nil {
+		return func() {}, nil
+	}
+
+	lis, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, expvar.Handler())
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		err := srv.Serve(lis)
+		if err != nil && err != http.ErrServerClosed {
+			logging.Get().Errorf("metrics server stopped: %s", err)
+		}
+	}()
+	logging.Get().Infof("serving metrics on http://%s%s", lis.Addr(), MetricsPath)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}, nil
+}
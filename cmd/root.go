@@ -18,6 +18,11 @@ import (
 	"os"
 
 	"github.com/spf13/cobra"
+
+	// register the destinations implemented outside of package update
+	_ "github.com/els0r/dynip-ng/pkg/mqtt"
+	_ "github.com/els0r/dynip-ng/pkg/notify"
+	_ "github.com/els0r/dynip-ng/pkg/plugin"
 )
 
 var cfgPath string
@@ -31,17 +36,45 @@ var rootCmd = &cobra.Command{
 Destinations
 ============
 
+Destinations are configured as a list of entries with a type, an optional
+name and the settings of that type. A mapping from types to settings is
+accepted as well
+
 Cloudflare
 ----------
 
 The user is expected to have a Cloudflare account and a valid API key.
-See config section
+Several named accounts, each with their own credentials and zones, can be
+configured as a list. See config section
 
 File
 ----
 
 Take a source template (with a placeholder for an IP) and write the rendered
-template to output`,
+template to output
+
+Cloudflare Lists
+----------------
+
+Replace the IP in Cloudflare IP Lists or zone IP Access Rules. Only the
+items marked with the configured comment are replaced
+
+Zone file
+---------
+
+Update A/AAAA records in a BIND zone file, increment the SOA serial and
+optionally reload the name server
+
+Name server
+-----------
+
+Answer DNS queries for a delegated zone with the current IP(s)
+
+DynDNS
+------
+
+Accept IPs pushed by routers via the dyndns2 protocol and update all
+destinations with them`,
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
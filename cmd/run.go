@@ -1,19 +1,25 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/dyndns"
 	"github.com/els0r/dynip-ng/pkg/listener"
 	"github.com/els0r/dynip-ng/pkg/listener/state"
 	"github.com/els0r/dynip-ng/pkg/logging"
+	"github.com/els0r/dynip-ng/pkg/nameserver"
 	"github.com/els0r/dynip-ng/pkg/update"
 	"github.com/spf13/cobra"
 )
 
+var dryRun bool
+
 // runCmd represents the run command
 var runCmd = &cobra.Command{
 	Use:   "run",
@@ -39,25 +45,21 @@ attributes. For example the A record on Cloudflare.`,
 		}
 		logging.Get().Debug("Initialized logger")
 
-		// create updaters
-		var updaters []update.Updater
-		dests := config.Destinations
+		// publish the counters of the destinations
+		stopMetrics, err := startMetrics(config.Metrics)
+		if err != nil {
+			return fmt.Errorf("failed to start metrics server: %s", err)
+		}
+		defer stopMetrics()
 
-		if dests.Cloudflare != nil {
-			cu, err := update.NewCloudFlareUpdate(dests.Cloudflare)
-			if err != nil {
-				return err
-			}
-			updaters = append(updaters, cu)
-			logging.Get().Debug("Initialized cloudflare updates")
+		if dryRun {
+			config.Listen.DryRun = true
 		}
-		if dests.File != nil {
-			fu, err := update.NewFileUpdate(dests.File)
-			if err != nil {
-				return err
-			}
-			updaters = append(updaters, fu)
-			logging.Get().Debug("Initialized file updates")
+
+		// create updaters
+		updaters, err := update.NewUpdaters(config.Destinations)
+		if err != nil {
+			return err
 		}
 
 		// prepare the state
@@ -73,6 +75,46 @@ attributes. For example the A record on Cloudflare.`,
 		if err != nil {
 			return fmt.Errorf("failed to create listener: %s", err)
 		}
+		defer waitForNotifiers(l)
+
+		// serve the monitored IPs via DNS
+		if config.Nameserver != nil {
+			ns, err := nameserver.New(config.Nameserver)
+			if err != nil {
+				return fmt.Errorf("failed to create name server: %s", err)
+			}
+
+			// serve the last known IPs until the listener sees new ones
+			ips, err := state.Get()
+			if err == nil {
+				err = ns.Set(ips)
+				if err != nil {
+					logging.Get().Warnf("not serving the stored IPs: %s", err)
+				}
+			}
+			l.Observe(ns)
+
+			err = ns.Start()
+			if err != nil {
+				return fmt.Errorf("failed to start name server: %s", err)
+			}
+			defer ns.Stop()
+			logging.Get().Debug("Initialized name server")
+		}
+
+		// accept IPs pushed by dyndns clients
+		if config.DynDNS != nil {
+			ds, err := dyndns.New(config.DynDNS, l)
+			if err != nil {
+				return fmt.Errorf("failed to create dyndns server: %s", err)
+			}
+			err = ds.Start()
+			if err != nil {
+				return fmt.Errorf("failed to start dyndns server: %s", err)
+			}
+			defer ds.Stop()
+			logging.Get().Debug("Initialized dyndns server")
+		}
 
 		// and run it
 		logging.Get().Debug("Spawning listener")
@@ -88,4 +130,21 @@ attributes. For example the A record on Cloudflare.`,
 
 func init() {
 	rootCmd.AddCommand(runCmd)
+
+	runCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Report what would be changed at the destinations without changing anything")
+}
+
+// notifyTimeout limits the time spent on exit waiting for notifications which are
+// still being sent
+const notifyTimeout = 10 * time.Second
+
+// waitForNotifiers lets the notifications about the last update go out before exiting
+func waitForNotifiers(l *listener.Listener) {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	err := l.Wait(ctx)
+	if err != nil {
+		logging.Get().Warnf("%s", err)
+	}
 }
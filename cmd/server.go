@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/els0r/dynip-ng/pkg/agent"
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/logging"
+	"github.com/spf13/cobra"
+)
+
+// serverCmd represents the server command
+var serverCmd = &cobra.Command{
+	Use:   "server",
+	Short: "Receive IP reports from dynip-ng agents",
+	Long: `Accepts signed IP reports from dynip-ng agents and updates the
+destinations configured for each of them.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		// we quit on encountering SIGTERM or SIGINT
+		sigExitChan := make(chan os.Signal, 1)
+		signal.Notify(sigExitChan, syscall.SIGTERM, os.Interrupt)
+
+		// parse config
+		config, err := cfg.ParseFile(cfgPath)
+		if err != nil {
+			return err
+		}
+		if config.Server == nil {
+			return fmt.Errorf("no server configuration provided")
+		}
+
+		// initialize logger
+		err = logging.Init(config.Logging)
+		if err != nil {
+			return err
+		}
+		logging.Get().Debug("Initialized logger")
+
+		// publish the counters of the destinations
+		stopMetrics, err := startMetrics(config.Metrics)
+		if err != nil {
+			return fmt.Errorf("failed to start metrics server: %s", err)
+		}
+		defer stopMetrics()
+
+		// create the server and the updaters of all agents
+		s, err := agent.NewServer(config.Server)
+		if err != nil {
+			return fmt.Errorf("failed to create server: %s", err)
+		}
+		err = s.Start()
+		if err != nil {
+			return fmt.Errorf("failed to start server: %s", err)
+		}
+
+		// listen for the exit signal and stop the server
+		<-sigExitChan
+		return s.Stop()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(serverCmd)
+}
@@ -0,0 +1,279 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/listener/state"
+	"github.com/els0r/dynip-ng/pkg/update"
+)
+
+func newTestServer(t *testing.T) (*Server, string) {
+	dir := t.TempDir()
+	template := filepath.Join(dir, "template")
+	output := filepath.Join(dir, "output")
+	err := os.WriteFile(template, []byte("ip={{ . }}"), 0644)
+	if err != nil {
+		t.Fatalf("couldn't write template: %s", err)
+	}
+
+	s, err := NewServer(&cfg.ServerConfig{
+		Listen: "127.0.0.1:0",
+		Agents: map[string]*cfg.AgentDestinations{
+			"branch-zurich": {
+				Secret: "zurich-secret",
+				Destinations: cfg.DestinationsConfig{
+					{Type: "file", Name: "file", Settings: &cfg.FileConfig{Template: template, Output: output}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	return s, output
+}
+
+func TestReport(t *testing.T) {
+	s, output := newTestServer(t)
+	err := s.Start()
+	if err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+	defer s.Stop()
+
+	var tests = []struct {
+		name       string
+		id         string
+		secret     string
+		IP         string
+		shouldPass bool
+	}{
+		{"report accepted", "branch-zurich", "zurich-secret", "203.0.113.7", true},
+		{"unchanged report accepted", "branch-zurich", "zurich-secret", "203.0.113.7", true},
+		{"wrong secret", "branch-zurich", "wrong-secret", "203.0.113.8", false},
+		{"unknown agent", "branch-geneva", "zurich-secret", "203.0.113.8", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := NewReporter(&cfg.AgentConfig{
+				ID:     test.id,
+				Secret: test.secret,
+				Server: "http://" + s.Addr(),
+			})
+			if err != nil {
+				t.Fatalf("failed to create reporter: %s", err)
+			}
+
+			err = r.Update(context.Background(), test.IP)
+			if test.shouldPass {
+				if err != nil {
+					t.Fatalf("report failed: %s", err)
+				}
+			} else {
+				if err == nil {
+					t.Fatalf("report should have failed but didn't")
+				}
+				t.Logf("provoked expected error: %s", err)
+			}
+
+			// the destination only ever sees accepted reports
+			data, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatalf("couldn't read output: %s", err)
+			}
+			if string(data) != "ip=203.0.113.7" {
+				t.Fatalf("unexpected output: %q", data)
+			}
+		})
+	}
+}
+
+func TestReporterApply(t *testing.T) {
+	s, output := newTestServer(t)
+	ra := &recordingApplier{Applier: s.agents["branch-zurich"].applier}
+	s.agents["branch-zurich"].applier = ra
+
+	err := s.Start()
+	if err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+	defer s.Stop()
+
+	r, err := NewReporter(&cfg.AgentConfig{
+		ID:     "branch-zurich",
+		Secret: "zurich-secret",
+		Server: "http://" + s.Addr(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create reporter: %s", err)
+	}
+
+	var tests = []struct {
+		name     string
+		req      *update.Request
+		expected update.Outcome
+	}{
+		{"dry run", &update.Request{IPv4: "203.0.113.7", IPv6: "2001:db8::7", DryRun: true}, update.Changed},
+		{"dual stack", &update.Request{IPv4: "203.0.113.7", IPv6: "2001:db8::7"}, update.Changed},
+		{"unchanged", &update.Request{IPv4: "203.0.113.7", IPv6: "2001:db8::7"}, update.Unchanged},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := r.Apply(context.Background(), test.req)
+			if err != nil {
+				t.Fatalf("report failed: %s", err)
+			}
+			if len(res.Targets) != 1 || res.Targets[0].Outcome != test.expected {
+				t.Fatalf("unexpected result: got %v, want %s", res, test.expected)
+			}
+
+			// nothing is sent in a dry run
+			_, err = os.Stat(output)
+			if test.req.DryRun != os.IsNotExist(err) {
+				t.Fatalf("unexpected output state: %v", err)
+			}
+		})
+	}
+
+	// the server was handed both IPs
+	if ra.ips.IPv4 != "203.0.113.7" || ra.ips.IPv6 != "2001:db8::7" {
+		t.Fatalf("unexpected IPs at the server: %s", ra.ips)
+	}
+}
+
+// takes its time before handing the IPs to the applier it wraps and records whether
+// its context was canceled in the meantime
+type slowApplier struct {
+	Applier
+	delay    time.Duration
+	canceled bool
+	done     chan struct{}
+}
+
+func (s *slowApplier) Apply(ctx context.Context, ips state.MonitoredIPs) (bool, error) {
+	defer close(s.done)
+
+	select {
+	case <-ctx.Done():
+		s.canceled = true
+	case <-time.After(s.delay):
+	}
+	return s.Applier.Apply(ctx, ips)
+}
+
+func TestReportDisconnect(t *testing.T) {
+	s, output := newTestServer(t)
+	sa := &slowApplier{Applier: s.agents["branch-zurich"].applier, delay: 200 * time.Millisecond, done: make(chan struct{})}
+	s.agents["branch-zurich"].applier = sa
+
+	err := s.Start()
+	if err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+	defer s.Stop()
+
+	// the agent gives up before the destinations are updated
+	r, err := NewReporter(&cfg.AgentConfig{
+		ID:      "branch-zurich",
+		Secret:  "zurich-secret",
+		Server:  "http://" + s.Addr(),
+		Timeout: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("failed to create reporter: %s", err)
+	}
+	err = r.Update(context.Background(), "203.0.113.7")
+	if err == nil {
+		t.Fatalf("report should have timed out but didn't")
+	}
+	t.Logf("provoked expected error: %s", err)
+
+	// the server still finishes the update
+	select {
+	case <-sa.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("update didn't finish")
+	}
+	if sa.canceled {
+		t.Fatalf("update was canceled when the agent hung up")
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("couldn't read output: %s", err)
+	}
+	if string(data) != "ip=203.0.113.7" {
+		t.Fatalf("unexpected output: %q", data)
+	}
+}
+
+// records the IPs handed to the applier it wraps
+type recordingApplier struct {
+	Applier
+	ips state.MonitoredIPs
+}
+
+func (r *recordingApplier) Apply(ctx context.Context, ips state.MonitoredIPs) (bool, error) {
+	r.ips = ips
+	return r.Applier.Apply(ctx, ips)
+}
+
+func TestReplay(t *testing.T) {
+	s, _ := newTestServer(t)
+	now := time.Date(2019, 5, 17, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	send := func(report Report, secret string) int {
+		body, _ := json.Marshal(report)
+		req := httptest.NewRequest(http.MethodPost, ReportPath, bytes.NewReader(body))
+		req.Header.Set(SignatureHeader, sign([]byte(secret), body))
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	report := Report{ID: "branch-zurich", IPv4: "203.0.113.7", Timestamp: now.Unix(), Nonce: "a"}
+
+	var tests = []struct {
+		name   string
+		report Report
+		status int
+	}{
+		{"fresh report", report, http.StatusOK},
+		{"replayed report", report, http.StatusUnauthorized},
+		{"new nonce", Report{ID: "branch-zurich", IPv4: "203.0.113.7", Timestamp: now.Unix(), Nonce: "b"}, http.StatusOK},
+		{"no nonce", Report{ID: "branch-zurich", IPv4: "203.0.113.7", Timestamp: now.Unix()}, http.StatusUnauthorized},
+		{"too old", Report{ID: "branch-zurich", IPv4: "203.0.113.7", Timestamp: now.Add(-10 * time.Minute).Unix(), Nonce: "c"}, http.StatusUnauthorized},
+		{"too far in the future", Report{ID: "branch-zurich", IPv4: "203.0.113.7", Timestamp: now.Add(10 * time.Minute).Unix(), Nonce: "d"}, http.StatusUnauthorized},
+		{"invalid IP", Report{ID: "branch-zurich", IPv4: "nope", Timestamp: now.Unix(), Nonce: "e"}, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status := send(test.report, "zurich-secret")
+			if status != test.status {
+				t.Fatalf("unexpected status: got %d, want %d", status, test.status)
+			}
+		})
+	}
+
+	// nonces are forgotten once the replay window has passed, at which point the
+	// timestamp check rejects the report
+	now = now.Add(s.window + time.Second)
+	if status := send(report, "zurich-secret"); status != http.StatusUnauthorized {
+		t.Fatalf("expired report should have been rejected, got status %d", status)
+	}
+	if len(s.nonces) != 0 {
+		t.Fatalf("expired nonces should have been removed, got %d", len(s.nonces))
+	}
+}
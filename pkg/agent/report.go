@@ -0,0 +1,87 @@
+// Package agent lets lightweight agents report their IP to a central dynip-ng server.
+// The server holds the credentials of the destinations and updates them on behalf of
+// the agents.
+//
+// Reports are JSON documents sent via HTTP(S) POST. They are signed with an HMAC-SHA256
+// over the request body using a secret shared between agent and server. Each report
+// carries a timestamp and a random nonce, which allows the server to reject reports
+// that are too old or have been seen before
+package agent
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+const (
+	// ReportPath is the path of the server endpoint receiving reports
+	ReportPath = "/v1/report"
+
+	// SignatureHeader carries the hex-encoded HMAC-SHA256 of the request body
+	SignatureHeader = "X-Dynip-Signature"
+
+	// maximum size of a report body
+	maxReportSize = 64 * 1024
+)
+
+// Report is sent by an agent to inform the server about its current IPs
+type Report struct {
+	// ID of the reporting agent
+	ID string `json:"id"`
+
+	IPv4 string `json:"ipv4,omitempty"`
+	IPv6 string `json:"ipv6,omitempty"`
+
+	// Timestamp is the time the report was created (unix seconds)
+	Timestamp int64 `json:"timestamp"`
+
+	// Nonce is a random value making each report unique
+	Nonce string `json:"nonce"`
+}
+
+// Response is returned by the server for accepted reports
+type Response struct {
+	// Changed is true if the reported IPs differed from the ones known to the server
+	Changed bool `json:"changed"`
+}
+
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func verify(secret, body []byte, signature string) error {
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("malformed signature")
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// fresh checks that the report was created within window around now
+func (r *Report) fresh(now time.Time, window time.Duration) error {
+	age := now.Sub(time.Unix(r.Timestamp, 0))
+	if age > window || age < -window {
+		return fmt.Errorf("report timestamp is outside of the replay window (age: %s)", age)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/listener/state"
+	"github.com/els0r/dynip-ng/pkg/logging"
+	"github.com/els0r/dynip-ng/pkg/update"
+	log "github.com/els0r/log"
+)
+
+// defaultReportTimeout leaves the server time to update several slow destinations
+const defaultReportTimeout = 2 * time.Minute
+
+// Reporter sends the IPs of the agent to the central server. It is used like any other
+// destination
+type Reporter struct {
+	id     string
+	secret []byte
+	url    string
+	client *http.Client
+
+	log log.Logger
+}
+
+// NewReporter creates a reporter for the agent in the config
+func NewReporter(config *cfg.AgentConfig) (*Reporter, error) {
+	if config == nil {
+		return nil, fmt.Errorf("no agent config provided")
+	}
+
+	r := &Reporter{
+		id:     config.ID,
+		secret: []byte(config.Secret),
+		url:    strings.TrimSuffix(config.Server, "/") + ReportPath,
+		client: &http.Client{Timeout: config.Timeout},
+		log:    logging.Get(),
+	}
+	if r.client.Timeout == 0 {
+		r.client.Timeout = defaultReportTimeout
+	}
+
+	// trust a dedicated CA for the server certificate
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no CA certificate found in %s", config.CAFile)
+		}
+		r.client.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}
+	}
+	return r, nil
+}
+
+// Name returns a human-readable identifier for the updater
+func (r *Reporter) Name() string {
+	return "agent reporter"
+}
+
+// Update reports `IP` to the server
+func (r *Reporter) Update(ctx context.Context, IP string) error {
+	req, err := update.NewRequest(IP)
+	if err != nil {
+		return err
+	}
+	_, err = r.Apply(ctx, req)
+	return err
+}
+
+// Apply reports the IPv4 and the IPv6 address of the request to the server. In a dry run,
+// nothing is sent
+func (r *Reporter) Apply(ctx context.Context, req *update.Request) (*update.Result, error) {
+	err := req.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	res := new(update.Result)
+	target := "server " + r.url
+	ips := state.MonitoredIPs{IPv4: req.IPv4, IPv6: req.IPv6}
+	if req.DryRun {
+		res.Add(target, update.Changed, "would report %s", ips)
+		return res, nil
+	}
+
+	changed, err := r.report(ctx, ips)
+	switch {
+	case err != nil:
+		res.Add(target, update.Failed, "%s", err)
+	case changed:
+		res.Add(target, update.Changed, "reported %s", ips)
+	default:
+		res.Add(target, update.Unchanged, "server already knew %s", ips)
+	}
+	return res, res.Err()
+}
+
+// report sends ips to the server. It returns whether they differed from the ones known
+// to the server
+func (r *Reporter) report(ctx context.Context, ips state.MonitoredIPs) (bool, error) {
+	report := Report{
+		ID:        r.id,
+		IPv4:      ips.IPv4,
+		IPv6:      ips.IPv6,
+		Timestamp: time.Now().Unix(),
+	}
+
+	var err error
+	report.Nonce, err = newNonce()
+	if err != nil {
+		return false, err
+	}
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, sign(r.secret, body))
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return false, fmt.Errorf("server rejected report: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var res Response
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return false, fmt.Errorf("failed to decode server response: %w", err)
+	}
+	r.log.Debugf("reported IPs %s to %s (changed=%v)", ips, r.url, res.Changed)
+	return res.Changed, nil
+}
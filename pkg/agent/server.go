@@ -0,0 +1,263 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/listener"
+	"github.com/els0r/dynip-ng/pkg/listener/state"
+	"github.com/els0r/dynip-ng/pkg/logging"
+	"github.com/els0r/dynip-ng/pkg/update"
+	log "github.com/els0r/log"
+)
+
+const (
+	defaultReplayWindow    = 300 * time.Second
+	defaultShutdownTimeout = 5 * time.Second
+)
+
+// Applier runs the destination updates for the IPs reported by an agent
+type Applier interface {
+	Apply(ctx context.Context, ips state.MonitoredIPs) (bool, error)
+}
+
+// waiter is implemented by appliers which notify about updates in the background
+type waiter interface {
+	Wait(ctx context.Context) error
+}
+
+// registered agent
+type agent struct {
+	secret  []byte
+	applier Applier
+}
+
+// Server receives reports from agents and updates the destinations configured for them
+type Server struct {
+	listen   string
+	certFile string
+	keyFile  string
+	window   time.Duration
+
+	agents map[string]*agent
+
+	// nonces seen within the replay window, mapped to the time they expire
+	mu     sync.Mutex
+	nonces map[string]time.Time
+	now    func() time.Time
+
+	srv *http.Server
+	lis net.Listener
+
+	log log.Logger
+}
+
+// NewServer creates the central server. Every agent gets its own set of updaters and
+// its own in-memory state
+func NewServer(config *cfg.ServerConfig) (*Server, error) {
+	if config == nil {
+		return nil, fmt.Errorf("no server config provided")
+	}
+
+	s := &Server{
+		listen:   config.Listen,
+		certFile: config.CertFile,
+		keyFile:  config.KeyFile,
+		window:   time.Duration(config.ReplayWindow) * time.Second,
+		agents:   make(map[string]*agent),
+		nonces:   make(map[string]time.Time),
+		now:      time.Now,
+		log:      logging.Get(),
+	}
+	if s.window == 0 {
+		s.window = defaultReplayWindow
+	}
+
+	for id, a := range config.Agents {
+		updaters, err := update.NewUpdaters(a.Destinations)
+		if err != nil {
+			return nil, fmt.Errorf("agent %q: %w", id, err)
+		}
+
+		// the listener doesn't monitor an interface. It only runs the updates
+		l, err := listener.New(&cfg.ListenConfig{}, state.NewInMemory(), updaters...)
+		if err != nil {
+			return nil, fmt.Errorf("agent %q: %w", id, err)
+		}
+		s.agents[id] = &agent{secret: []byte(a.Secret), applier: l}
+	}
+	return s, nil
+}
+
+// Handler returns the HTTP handler serving the report endpoint
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ReportPath, s.handleReport)
+	return mux
+}
+
+// Start binds the server to its address and serves requests in the background
+func (s *Server) Start() error {
+	var err error
+	s.lis, err = net.Listen("tcp", s.listen)
+	if err != nil {
+		return err
+	}
+	s.srv = &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		var err error
+		if s.certFile != "" {
+			err = s.srv.ServeTLS(s.lis, s.certFile, s.keyFile)
+		} else {
+			err = s.srv.Serve(s.lis)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			s.log.Errorf("server stopped: %s", err)
+		}
+	}()
+	s.log.Infof("accepting agent reports on %s", s.lis.Addr())
+	return nil
+}
+
+// Addr returns the address the server listens on. It is only set after Start was called
+func (s *Server) Addr() string {
+	if s.lis == nil {
+		return ""
+	}
+	return s.lis.Addr().String()
+}
+
+// Stop gracefully shuts down the server and waits for the notifications about the last
+// updates of the agents' destinations
+func (s *Server) Stop() error {
+	if s.srv == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownTimeout)
+	defer cancel()
+
+	err := s.srv.Shutdown(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to stop server: %w", err)
+	}
+	for id, a := range s.agents {
+		w, ok := a.applier.(waiter)
+		if !ok {
+			continue
+		}
+		err = w.Wait(ctx)
+		if err != nil {
+			s.log.Warnf("agent %q: %s", id, err)
+		}
+	}
+	s.log.Info("stopped server")
+	return nil
+}
+
+func (s *Server) handleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxReportSize))
+	if err != nil {
+		http.Error(w, "failed to read report", http.StatusBadRequest)
+		return
+	}
+
+	var report Report
+	err = json.Unmarshal(body, &report)
+	if err != nil {
+		http.Error(w, "malformed report", http.StatusBadRequest)
+		return
+	}
+
+	// authenticate the report before looking at any of its content
+	a, exists := s.agents[report.ID]
+	if !exists {
+		s.log.Warnf("report from unknown agent %q (%s)", report.ID, r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	err = verify(a.secret, body, r.Header.Get(SignatureHeader))
+	if err != nil {
+		s.log.Warnf("rejected report from agent %q (%s): %s", report.ID, r.RemoteAddr, err)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	err = s.checkReplay(&report)
+	if err != nil {
+		s.log.Warnf("rejected report from agent %q (%s): %s", report.ID, r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ips := state.MonitoredIPs{IPv4: report.IPv4, IPv6: report.IPv6}
+	for _, ip := range []string{ips.IPv4, ips.IPv6} {
+		if ip != "" && net.ParseIP(ip) == nil {
+			http.Error(w, fmt.Sprintf("invalid IP address %q", ip), http.StatusBadRequest)
+			return
+		}
+	}
+	s.log.Debugf("agent %q reported IP(s) %s", report.ID, ips)
+
+	// the update is finished even if the agent hangs up, so that its destinations don't
+	// end up partially updated. The applier limits the duration of each destination update
+	ctx := update.WithReason(context.WithoutCancel(r.Context()), update.ReasonReport)
+	changed, err := a.applier.Apply(ctx, ips)
+	if err != nil {
+		s.log.Errorf("updating destinations of agent %q failed: %s", report.ID, err)
+		http.Error(w, "destination updates failed", http.StatusBadGateway)
+		return
+	}
+	if changed {
+		s.log.Infof("updated destinations of agent %q to %s", report.ID, ips)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{Changed: changed})
+}
+
+// checkReplay rejects reports outside of the replay window and reports whose nonce has
+// already been seen
+func (s *Server) checkReplay(report *Report) error {
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// forget nonces which can't be replayed anymore
+	for nonce, expires := range s.nonces {
+		if now.After(expires) {
+			delete(s.nonces, nonce)
+		}
+	}
+
+	err := report.fresh(now, s.window)
+	if err != nil {
+		return err
+	}
+	if report.Nonce == "" {
+		return fmt.Errorf("report has no nonce")
+	}
+
+	key := report.ID + "/" + report.Nonce
+	if _, seen := s.nonces[key]; seen {
+		return fmt.Errorf("report has already been received")
+	}
+	// a report is accepted until window after its timestamp
+	s.nonces[key] = time.Unix(report.Timestamp, 0).Add(s.window)
+	return nil
+}
@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 
 	yaml "gopkg.in/yaml.v3"
 )
@@ -19,7 +22,23 @@ type Config struct {
 	State *StateConfig
 
 	// Destinations stores all places to be updated
-	Destinations *DestinationsConfig
+	Destinations DestinationsConfig
+
+	// Nameserver configures the built-in authoritative DNS server
+	Nameserver *NameserverConfig `yaml:"nameserver,omitempty"`
+
+	// DynDNS configures the dyndns2-compatible HTTP server through which
+	// clients such as routers push their IP
+	DynDNS *DynDNSConfig `yaml:"dyndns,omitempty"`
+
+	// Agent configures reporting the IP to a central dynip-ng server
+	Agent *AgentConfig `yaml:"agent,omitempty"`
+
+	// Server configures the central server agents report their IPs to
+	Server *ServerConfig `yaml:"server,omitempty"`
+
+	// Metrics configures the HTTP listener publishing the counters of the destinations
+	Metrics *MetricsConfig `yaml:"metrics,omitempty"`
 
 	// Logging configuration
 	Logging *LoggingConfig `yaml:"logging"`
@@ -58,49 +77,524 @@ type LoggingConfig struct {
 	Level string `yaml:"level"`
 }
 
-// DestinationsConfig stores all output destinations
-type DestinationsConfig struct {
-	// configures the cloudflare API
-	Cloudflare *CloudflareAPI `yaml:"cloudflare,omitempty"`
-	// configures the file update config
-	File *FileConfig `yaml:"file,omitempty"`
+// FileConfig stores parameters for rendering templates with the IP into output files
+type FileConfig struct {
+	Template string `yaml:"template"`
+	Output   string `yaml:"output"`
+
+	// Files lists further template/output pairs. They are rendered together with
+	// Template and Output, if set
+	Files []*FileTarget `yaml:"files"`
+
+	// Reload is an optional command run after at least one output file was
+	// written, e.g. `systemctl reload caddy`
+	Reload string `yaml:"reload"`
+
+	// HTML escapes the rendered values for use in HTML documents. Templates are
+	// rendered as plain text by default
+	HTML bool `yaml:"html"`
 }
 
-// FileConfig stores parameters for
-type FileConfig struct {
+// FileTarget is a template which is rendered into an output file
+type FileTarget struct {
 	Template string `yaml:"template"`
 	Output   string `yaml:"output"`
 }
 
+// Targets returns all template/output pairs of the config
+func (f *FileConfig) Targets() []*FileTarget {
+	var targets []*FileTarget
+	if f.Template != "" || f.Output != "" {
+		targets = append(targets, &FileTarget{Template: f.Template, Output: f.Output})
+	}
+	return append(targets, f.Files...)
+}
+
 func (f *FileConfig) validate() error {
-	if f.Template == "" {
+	targets := f.Targets()
+	if len(targets) == 0 {
 		return fmt.Errorf("file: no input template provided")
 	}
-	if f.Output == "" {
-		return fmt.Errorf("file: no output file provided")
+
+	outputs := make(map[string]struct{})
+	for _, t := range targets {
+		if t == nil || t.Template == "" {
+			return fmt.Errorf("file: no input template provided")
+		}
+		if t.Output == "" {
+			return fmt.Errorf("file: no output file provided")
+		}
+		if _, exists := outputs[t.Output]; exists {
+			return fmt.Errorf("file: output %s provided more than once", t.Output)
+		}
+		outputs[t.Output] = struct{}{}
 	}
 	return nil
 }
 
-func (d DestinationsConfig) validate() error {
-	var sections []validator
+// ZoneFileConfig stores parameters for updating records in a BIND zone file
+type ZoneFileConfig struct {
+	// Path to the zone file
+	Path string `yaml:"path"`
+
+	// Origin of the zone, e.g. example.com. Relative names in the zone file
+	// and in Records are interpreted relative to it
+	Origin string `yaml:"origin"`
+
+	// Records lists the owner names whose A/AAAA records are updated
+	Records []string `yaml:"records"`
 
-	// check if there is at least one destination configured
-	if d.Cloudflare != nil {
-		sections = append(sections, d.Cloudflare)
+	// Reload is an optional command run after the zone file was written,
+	// e.g. `rndc reload example.com`
+	Reload string `yaml:"reload"`
+}
+
+func (z *ZoneFileConfig) validate() error {
+	if z.Path == "" {
+		return fmt.Errorf("zonefile: no zone file path provided")
 	}
-	if d.File != nil {
-		sections = append(sections, d.File)
+	if z.Origin == "" {
+		return fmt.Errorf("zonefile: no zone origin provided")
 	}
-	if len(sections) == 0 {
-		return fmt.Errorf("no destination for IP provided. Need at least one")
+	if len(z.Records) == 0 {
+		return fmt.Errorf("zonefile: no records to update provided")
+	}
+	for _, r := range z.Records {
+		if r == "" {
+			return fmt.Errorf("zonefile: record with no name provided")
+		}
 	}
+	return nil
+}
 
-	// run all config subsection validators. Order matters here
-	for _, section := range sections {
-		err := section.validate()
+// PatchConfig stores parameters for replacing the IP in parts of an existing file. Only
+// the lines between the markers and the lines matching the pattern are modified
+type PatchConfig struct {
+	// Path to the file
+	Path string `yaml:"path"`
+
+	// Markers enclose the lines in which IPs are replaced
+	Markers *PatchMarkers `yaml:"markers"`
+
+	// Pattern is a regular expression selecting the lines in which IPs are
+	// replaced, e.g. ^ListenAddress. If it has a group named ip, e.g.
+	// ^ListenAddress (?P<ip>\S+), only the addresses in the group are replaced
+	Pattern string `yaml:"pattern"`
+
+	// Reload is an optional command run after the file was written, e.g.
+	// `systemctl reload sshd`
+	Reload string `yaml:"reload"`
+}
+
+// PatchMarkers are the lines enclosing the patched part of a file, typically comments.
+// A line containing Begin starts the part and a line containing End ends it
+type PatchMarkers struct {
+	Begin string `yaml:"begin"`
+	End   string `yaml:"end"`
+}
+
+func (p *PatchConfig) validate() error {
+	if p.Path == "" {
+		return fmt.Errorf("patch: no file path provided")
+	}
+	if p.Markers == nil && p.Pattern == "" {
+		return fmt.Errorf("patch: no markers or pattern provided")
+	}
+	if p.Markers != nil && (p.Markers.Begin == "" || p.Markers.End == "") {
+		return fmt.Errorf("patch: markers need a begin and an end")
+	}
+	if p.Pattern != "" {
+		_, err := regexp.Compile(p.Pattern)
 		if err != nil {
-			return err
+			return fmt.Errorf("patch: invalid pattern: %w", err)
+		}
+	}
+	return nil
+}
+
+// Formats of the entries written by the hosts destination
+const (
+	HostsFormatHosts             = "hosts"
+	HostsFormatDnsmasqAddress    = "dnsmasqAddress"
+	HostsFormatDnsmasqHostRecord = "dnsmasqHostRecord"
+	HostsFormatUnbound           = "unbound"
+)
+
+// HostsConfig stores parameters for pointing names at the IP in a local resolver's file,
+// e.g. /etc/hosts or a dnsmasq or unbound include. The entries are kept in a block
+// fenced by marker comments. The rest of the file is left untouched
+type HostsConfig struct {
+	// Path to the file
+	Path string `yaml:"path"`
+
+	// Format of the entries: hosts (default), dnsmasqAddress, dnsmasqHostRecord
+	// or unbound
+	Format string `yaml:"format"`
+
+	// Names which are pointed at the IP
+	Names []string `yaml:"names"`
+
+	// Marker identifies the block managed by the destination. Defaults to
+	// dynip-ng. Several destinations can share a file if their markers differ
+	Marker string `yaml:"marker"`
+
+	// Reload is an optional command run after the file was written, e.g.
+	// `pkill -HUP dnsmasq` or `unbound-control reload`
+	Reload string `yaml:"reload"`
+}
+
+func (h *HostsConfig) validate() error {
+	if h.Path == "" {
+		return fmt.Errorf("hosts: no file path provided")
+	}
+	switch h.Format {
+	case "", HostsFormatHosts, HostsFormatDnsmasqAddress, HostsFormatDnsmasqHostRecord, HostsFormatUnbound:
+	default:
+		return fmt.Errorf("hosts: unsupported format %q", h.Format)
+	}
+	if len(h.Names) == 0 {
+		return fmt.Errorf("hosts: no names provided")
+	}
+	for _, name := range h.Names {
+		if name == "" || strings.ContainsAny(name, " \t,/\"") {
+			return fmt.Errorf("hosts: invalid name %q", name)
+		}
+	}
+	return nil
+}
+
+// Backends of the firewall destination
+const (
+	FirewallBackendNftables = "nftables"
+	FirewallBackendIPSet    = "ipset"
+)
+
+// FirewallConfig stores parameters for keeping the IP in firewall sets, e.g. to allow
+// traffic from it. Only the previous IP is removed, other elements of the sets are kept
+type FirewallConfig struct {
+	// Backend is nftables (default) or ipset
+	Backend string `yaml:"backend"`
+
+	// Family and Table of the nftables sets. The family defaults to inet
+	Family string `yaml:"family"`
+	Table  string `yaml:"table"`
+
+	// Sets for the IPv4 and the IPv6 address. At least one of them must be set
+	IPv4Set string `yaml:"ipv4Set"`
+	IPv6Set string `yaml:"ipv6Set"`
+}
+
+func (f *FirewallConfig) validate() error {
+	switch f.Backend {
+	case "", FirewallBackendNftables:
+		if f.Table == "" {
+			return fmt.Errorf("firewall: no nftables table provided")
+		}
+	case FirewallBackendIPSet:
+		if f.Family != "" || f.Table != "" {
+			return fmt.Errorf("firewall: family and table are only supported by nftables")
+		}
+	default:
+		return fmt.Errorf("firewall: unsupported backend %q", f.Backend)
+	}
+	if f.IPv4Set == "" && f.IPv6Set == "" {
+		return fmt.Errorf("firewall: no set provided")
+	}
+	return nil
+}
+
+// WireGuardConfig stores parameters for pointing the endpoint of WireGuard peers at the
+// IP, e.g. on spokes connecting to a hub with a dynamic IP
+type WireGuardConfig struct {
+	// Configs lists the wg-quick configuration files, e.g. /etc/wireguard/wg0.conf
+	Configs []string `yaml:"configs"`
+
+	// Peers lists the public keys of the peers whose endpoint is updated
+	Peers []string `yaml:"peers"`
+
+	// Port of the endpoint. Defaults to the port the endpoint has already
+	Port int `yaml:"port"`
+
+	// Live also updates the endpoints of the running interfaces. Each interface
+	// is named after its configuration file, as with wg-quick
+	Live bool `yaml:"live"`
+}
+
+func (w *WireGuardConfig) validate() error {
+	if len(w.Configs) == 0 {
+		return fmt.Errorf("wireguard: no configuration files provided")
+	}
+	if len(w.Peers) == 0 {
+		return fmt.Errorf("wireguard: no peers provided")
+	}
+	for _, peer := range w.Peers {
+		if peer == "" {
+			return fmt.Errorf("wireguard: peer with no public key provided")
+		}
+	}
+	if w.Port < 0 || w.Port > 65535 {
+		return fmt.Errorf("wireguard: invalid port %d", w.Port)
+	}
+	return nil
+}
+
+// GitConfig stores parameters for rendering templates into a git working tree and
+// committing the changes, e.g. for configurations deployed via GitOps
+type GitConfig struct {
+	// Repository is the path of the working tree
+	Repository string `yaml:"repository"`
+
+	// Files lists the templates and the outputs they are rendered into. Outputs are
+	// relative to the repository
+	Files []*FileTarget `yaml:"files"`
+
+	// HTML escapes the rendered values for use in HTML documents
+	HTML bool `yaml:"html"`
+
+	// Message is an optional template of the commit message. It is rendered with
+	// the same data as the files
+	Message string `yaml:"message"`
+
+	// AuthorName and AuthorEmail of the commits. Default to dynip-ng and
+	// dynip-ng@<hostname>
+	AuthorName  string `yaml:"authorName"`
+	AuthorEmail string `yaml:"authorEmail"`
+
+	// Remote is pulled from before rendering and pushed to after committing, e.g.
+	// origin. Nothing is pulled or pushed if empty
+	Remote string `yaml:"remote"`
+
+	// Branch of the remote. Defaults to the branch checked out in the working tree
+	Branch string `yaml:"branch"`
+}
+
+func (g *GitConfig) validate() error {
+	if g.Repository == "" {
+		return fmt.Errorf("git: no repository provided")
+	}
+	if len(g.Files) == 0 {
+		return fmt.Errorf("git: no files provided")
+	}
+
+	outputs := make(map[string]struct{})
+	for _, f := range g.Files {
+		if f == nil || f.Template == "" {
+			return fmt.Errorf("git: no input template provided")
+		}
+		if f.Output == "" {
+			return fmt.Errorf("git: no output file provided")
+		}
+		output := filepath.Clean(f.Output)
+		if filepath.IsAbs(output) || output == ".." || strings.HasPrefix(output, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("git: output %s is outside of the repository", f.Output)
+		}
+		if _, exists := outputs[output]; exists {
+			return fmt.Errorf("git: output %s provided more than once", f.Output)
+		}
+		outputs[output] = struct{}{}
+	}
+	if g.Branch != "" && g.Remote == "" {
+		return fmt.Errorf("git: branch provided without a remote")
+	}
+	return nil
+}
+
+// NameserverConfig configures the built-in authoritative DNS server. It answers
+// queries for a zone delegated to the host running the daemon
+type NameserverConfig struct {
+	// Listen is the address the server binds to for UDP and TCP, e.g. :53
+	Listen string `yaml:"listen"`
+
+	// Zone the server is authoritative for, e.g. dyn.example.org
+	Zone string `yaml:"zone"`
+
+	// Names lists the names which resolve to the current IPs. They are relative
+	// to the zone. Use @ for the apex. If empty, only the apex is served
+	Names []string `yaml:"names"`
+
+	// TTL of the served records (in seconds). Defaults to 60 seconds if
+	// not set
+	TTL uint32 `yaml:"ttl"`
+
+	// NS lists the host names of the zone's name servers
+	NS []string `yaml:"ns"`
+
+	// Mbox is the mailbox of the person responsible for the zone as it
+	// appears in the SOA record, e.g. hostmaster.example.org
+	Mbox string `yaml:"mbox"`
+}
+
+func (n *NameserverConfig) validate() error {
+	if n.Listen == "" {
+		return fmt.Errorf("nameserver: no listen address provided")
+	}
+	if n.Zone == "" {
+		return fmt.Errorf("nameserver: no zone provided")
+	}
+	if len(n.NS) == 0 {
+		return fmt.Errorf("nameserver: no NS host names provided")
+	}
+	for _, name := range n.Names {
+		if name == "" {
+			return fmt.Errorf("nameserver: name with no value provided")
+		}
+	}
+	return nil
+}
+
+// MetricsConfig configures the HTTP listener publishing the counters of the destinations
+// via expvar
+type MetricsConfig struct {
+	// Listen is the address the HTTP server binds to, e.g. 127.0.0.1:9245
+	Listen string `yaml:"listen"`
+}
+
+func (m *MetricsConfig) validate() error {
+	if m.Listen == "" {
+		return fmt.Errorf("metrics: no listen address provided")
+	}
+	return nil
+}
+
+// DynDNSConfig configures the dyndns2-compatible HTTP server. The server updates a single
+// set of IPs, so all host names of all clients are names of the same logical host
+type DynDNSConfig struct {
+	// Listen is the address the HTTP server binds to, e.g. :8245
+	Listen string `yaml:"listen"`
+
+	// CertFile and KeyFile enable HTTPS if both are provided
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+
+	// Clients maps user names to their credentials and the host names they
+	// are allowed to update
+	Clients map[string]*DynDNSClient `yaml:"clients"`
+}
+
+// DynDNSClient stores the credentials and permissions of a dyndns2 client
+type DynDNSClient struct {
+	// Password used in the HTTP basic authentication
+	Password string `yaml:"password"`
+
+	// Hostnames the client is allowed to update. They only authorize the client: every
+	// host name updates the same IPs
+	Hostnames []string `yaml:"hostnames"`
+}
+
+func (d *DynDNSConfig) validate() error {
+	if d.Listen == "" {
+		return fmt.Errorf("dyndns: no listen address provided")
+	}
+	if (d.CertFile == "") != (d.KeyFile == "") {
+		return fmt.Errorf("dyndns: both certificate and key file must be provided for HTTPS")
+	}
+	if len(d.Clients) == 0 {
+		return fmt.Errorf("dyndns: no clients provided")
+	}
+	for user, client := range d.Clients {
+		if user == "" {
+			return fmt.Errorf("dyndns: client with no user name provided")
+		}
+		if client == nil || client.Password == "" {
+			return fmt.Errorf("dyndns: no password provided for client %q", user)
+		}
+		if len(client.Hostnames) == 0 {
+			return fmt.Errorf("dyndns: no host names provided for client %q", user)
+		}
+	}
+	return nil
+}
+
+// AgentConfig configures how an agent reports its IP to the central server
+type AgentConfig struct {
+	// ID identifies the agent at the server
+	ID string `yaml:"id"`
+
+	// Secret is the key shared with the server to sign reports
+	Secret string `yaml:"secret"`
+
+	// Server is the URL of the central server, e.g. https://dynip.example.org:8246
+	Server string `yaml:"server"`
+
+	// CAFile optionally points to a PEM file with the CA certificate(s) used to
+	// verify the server's certificate
+	CAFile string `yaml:"caFile"`
+
+	// Timeout limits a report, including the updates of the destinations at the
+	// server. Defaults to 2m. The report is also limited by the timeout of the
+	// listener, which must be raised along with it
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (a *AgentConfig) validate() error {
+	if a.ID == "" {
+		return fmt.Errorf("agent: no ID provided")
+	}
+	if a.Secret == "" {
+		return fmt.Errorf("agent: no secret provided")
+	}
+	if a.Server == "" {
+		return fmt.Errorf("agent: no server URL provided")
+	}
+	if a.Timeout < 0 {
+		return fmt.Errorf("agent: timeout must not be negative")
+	}
+	return nil
+}
+
+// ServerConfig configures the central server which receives the IPs reported by agents
+// and updates their destinations
+type ServerConfig struct {
+	// Listen is the address the server binds to, e.g. :8246
+	Listen string `yaml:"listen"`
+
+	// CertFile and KeyFile enable HTTPS if both are provided
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+
+	// ReplayWindow is the maximum age of a report (in seconds). Defaults to
+	// 300 seconds if not set
+	ReplayWindow int `yaml:"replayWindow"`
+
+	// Agents maps agent IDs to their secret and destinations
+	Agents map[string]*AgentDestinations `yaml:"agents"`
+}
+
+// AgentDestinations stores the secret of an agent and where its IP is updated
+type AgentDestinations struct {
+	// Secret is the key shared with the agent to sign reports
+	Secret string `yaml:"secret"`
+
+	// Destinations stores all places to be updated with the agent's IP
+	Destinations DestinationsConfig `yaml:"destinations"`
+}
+
+func (s *ServerConfig) validate() error {
+	if s.Listen == "" {
+		return fmt.Errorf("server: no listen address provided")
+	}
+	if (s.CertFile == "") != (s.KeyFile == "") {
+		return fmt.Errorf("server: both certificate and key file must be provided for HTTPS")
+	}
+	if s.ReplayWindow < 0 {
+		return fmt.Errorf("server: replay window must not be negative (seconds)")
+	}
+	if len(s.Agents) == 0 {
+		return fmt.Errorf("server: no agents provided")
+	}
+	for id, agent := range s.Agents {
+		if id == "" {
+			return fmt.Errorf("server: agent with no ID provided")
+		}
+		if agent == nil || agent.Secret == "" {
+			return fmt.Errorf("server: no secret provided for agent %q", id)
+		}
+		if len(agent.Destinations) == 0 {
+			return fmt.Errorf("server: no destinations provided for agent %q", id)
+		}
+		err := agent.Destinations.validate()
+		if err != nil {
+			return fmt.Errorf("server: agent %q: %w", id, err)
 		}
 	}
 	return nil
@@ -108,7 +602,8 @@ func (d DestinationsConfig) validate() error {
 
 // ListenConfig configures the listener
 type ListenConfig struct {
-	// External interface to monitor changes on
+	// External interface to monitor changes on. Must be omitted if IPs
+	// are pushed via dyndns
 	Iface string
 
 	// IsLAN is true if the interface is assigned a private IP address
@@ -116,43 +611,171 @@ type ListenConfig struct {
 
 	// Interval stores the time between periodic checks
 	Interval int
+
+	// Timeout limits the update of each destination, including its retries.
+	// Defaults to 30s
+	Timeout time.Duration `yaml:"timeout"`
+
+	// DryRun only reports what would be changed at the destinations. Nothing
+	// is changed and the state isn't written
+	DryRun bool `yaml:"dryRun"`
 }
 
-// CloudflareAPI configures the accessto cloudflare
-type CloudflareAPI struct {
-	Access struct {
-		// Token is the API token for Cloudflare
-		Token string
+// CloudflareAccess stores the credentials for the Cloudflare API
+type CloudflareAccess struct {
+	// Token is the API token for Cloudflare
+	Token string
 
-		// Key is the API key for Cloudflare
-		Key string
+	// Key is the API key for Cloudflare
+	Key string
 
-		// Email is the email associated with the API key
-		Email string
+	// Email is the email associated with the API key
+	Email string
+}
+
+func (a CloudflareAccess) validate() error {
+	if a.Token == "" {
+		if a.Key == "" {
+			return fmt.Errorf("no API key or token provided")
+		}
+		if a.Email == "" {
+			return fmt.Errorf("no API email provided")
+		}
 	}
+	return nil
+}
+
+// CloudflareAPI configures the accessto cloudflare
+type CloudflareAPI struct {
+	Access CloudflareAccess
 
 	// list of Zones to update
 	Zones map[string]*Zone
+
+	// Ownership marks the records managed by this instance
+	Ownership *Ownership `yaml:"ownership,omitempty"`
+}
+
+// Ownership configures how records are claimed by a dynip-ng instance. Records
+// claimed by another instance or tool are never modified
+type Ownership struct {
+	// Instance identifies this dynip-ng instance. Records are marked with
+	// managed-by=dynip-ng:<instance>
+	Instance string
+
+	// Marker is either "comment" or "tag" and sets where the ownership is
+	// recorded. Defaults to comment
+	Marker string
+
+	// Cleanup deletes records owned by this instance which are no longer
+	// configured in one of the zones
+	Cleanup bool
+}
+
+func (o *Ownership) validate() error {
+	if o.Instance == "" {
+		return fmt.Errorf("cloudflare: no ownership instance provided")
+	}
+	if strings.ContainsAny(o.Instance, " \t\n") {
+		return fmt.Errorf("cloudflare: ownership instance must not contain whitespace")
+	}
+	switch strings.ToLower(o.Marker) {
+	case "", "comment", "tag":
+		break
+	default:
+		return fmt.Errorf("cloudflare: ownership marker %q is not supported. Use comment or tag", o.Marker)
+	}
+	return nil
 }
 
 // Zone stores the DNS objects that should be updated
 type Zone struct {
-	// Record to change
+	// Record to change. Kept for compatibility with configurations that
+	// update a single A record. Use Records instead
 	Record string
+
+	// Records to change
+	Records []*Record
+
+	// Create records if they don't exist yet
+	Create bool
+
+	// TTL (in seconds), proxy status and comment of created records. A TTL
+	// of 1 means automatic, which is also the default
+	TTL     int
+	Proxied bool
+	Comment string
+}
+
+// Record identifies a DNS record in a zone and the settings enforced on it
+type Record struct {
+	// Name of the record relative to the zone. Use @ (or leave it empty) for
+	// the apex and * for wildcards, e.g. *.dev. Names ending in the zone
+	// name are taken as they are
+	Name string
+
+	// Type of the record. Either A or AAAA. Defaults to A
+	Type string
+
+	// TTL (in seconds) and proxy status set on the record. If not set, the
+	// record's current values are kept
+	TTL     *int
+	Proxied *bool
+}
+
+// supported record types
+var recordTypes = map[string]struct{}{
+	"A":    {},
+	"AAAA": {},
+}
+
+func validTTL(ttl int) bool {
+	return ttl == 1 || (ttl >= 60 && ttl <= 86400)
 }
 
 func (z *Zone) validate() error {
+	// an empty zone updates the A record of the apex
+	if z == nil {
+		return nil
+	}
+	if z.TTL != 0 && !validTTL(z.TTL) {
+		return fmt.Errorf("cloudflare: TTL must be 1 (automatic) or between 60 and 86400 seconds")
+	}
+
+	seen := make(map[string]struct{})
+	if len(z.Records) == 0 || z.Record != "" {
+		seen[strings.ToLower(z.Record)+"/A"] = struct{}{}
+	}
+	for _, r := range z.Records {
+		if r == nil {
+			return fmt.Errorf("cloudflare: empty record provided")
+		}
+		t := strings.ToUpper(r.Type)
+		if t == "" {
+			t = "A"
+		}
+		if _, ok := recordTypes[t]; !ok {
+			return fmt.Errorf("cloudflare: record type %q is not (yet) supported", r.Type)
+		}
+		if r.TTL != nil && !validTTL(*r.TTL) {
+			return fmt.Errorf("cloudflare: TTL of record %q must be 1 (automatic) or between 60 and 86400 seconds", r.Name)
+		}
+
+		name := strings.ToLower(r.Name)
+		if name == "@" {
+			name = ""
+		}
+		if _, dup := seen[name+"/"+t]; dup {
+			return fmt.Errorf("cloudflare: %s record %q provided more than once", t, r.Name)
+		}
+		seen[name+"/"+t] = struct{}{}
+	}
 	return nil
 }
 
 func (c *CloudflareAPI) validate() error {
-	if c.Access.Token == "" {
-		if c.Access.Key == "" {
-			return fmt.Errorf("cloudflare: no API key or token provided")
-		}
-		if c.Access.Email == "" {
-			return fmt.Errorf("cloudflare: no API email provided")
-		}
+	if err := c.Access.validate(); err != nil {
+		return fmt.Errorf("cloudflare: %w", err)
 	}
 	if len(c.Zones) == 0 {
 		return fmt.Errorf("cloudflare: no zone to update record in provided")
@@ -166,6 +789,75 @@ func (c *CloudflareAPI) validate() error {
 			return err
 		}
 	}
+	if c.Ownership != nil {
+		return c.Ownership.validate()
+	}
+	return nil
+}
+
+// CloudflareListsConfig configures replacing the IP in Cloudflare IP Lists and zone
+// IP Access Rules. Only the items marked with Comment are replaced. All other items
+// are left untouched
+type CloudflareListsConfig struct {
+	Access CloudflareAccess
+
+	// Lists are account-level IP Lists, e.g. referenced by WAF rules
+	Lists []*CloudflareList
+
+	// AccessRules are IP Access Rules of a zone
+	AccessRules []*CloudflareAccessRule `yaml:"accessRules"`
+
+	// Comment marks the list items and the notes of the access rules managed by
+	// dynip-ng. Defaults to "managed by dynip-ng (<name>)" for named destinations
+	// and "managed by dynip-ng" otherwise
+	Comment string
+}
+
+// CloudflareList identifies an IP List of an account
+type CloudflareList struct {
+	// Account is the ID of the account the list belongs to
+	Account string
+
+	// Name of the list
+	Name string
+}
+
+// CloudflareAccessRule configures an IP Access Rule of a zone
+type CloudflareAccessRule struct {
+	// Zone is the name of the zone, e.g. example.com
+	Zone string
+
+	// Mode is the action of the rule: whitelist, block, challenge,
+	// js_challenge or managed_challenge. Defaults to whitelist
+	Mode string
+}
+
+func (c *CloudflareListsConfig) validate() error {
+	if err := c.Access.validate(); err != nil {
+		return fmt.Errorf("cloudflareLists: %w", err)
+	}
+	if len(c.Lists) == 0 && len(c.AccessRules) == 0 {
+		return fmt.Errorf("cloudflareLists: no list or access rule to update provided")
+	}
+	for _, l := range c.Lists {
+		if l == nil || l.Account == "" {
+			return fmt.Errorf("cloudflareLists: list with no account provided")
+		}
+		if l.Name == "" {
+			return fmt.Errorf("cloudflareLists: list with no name provided")
+		}
+	}
+	for _, r := range c.AccessRules {
+		if r == nil || r.Zone == "" {
+			return fmt.Errorf("cloudflareLists: access rule with no zone provided")
+		}
+		switch strings.ToLower(r.Mode) {
+		case "", "whitelist", "block", "challenge", "js_challenge", "managed_challenge":
+			break
+		default:
+			return fmt.Errorf("cloudflareLists: access rule mode %q is not supported", r.Mode)
+		}
+	}
 	return nil
 }
 
@@ -211,6 +903,9 @@ func (l *ListenConfig) validate() error {
 	if l.Interval <= 0 {
 		return fmt.Errorf("listener: checking period must be greater zero (minutes)")
 	}
+	if l.Timeout < 0 {
+		return fmt.Errorf("listener: timeout must not be negative")
+	}
 	return nil
 }
 
@@ -218,24 +913,50 @@ func (c *Config) validate() error {
 	if c.Listen == nil {
 		return fmt.Errorf("no listener configuration provided")
 	}
-	if c.Destinations == nil {
+	// the built-in name server, reporting to a central server and the central server
+	// itself are destinations in their own right
+	if len(c.Destinations) == 0 && c.Nameserver == nil && c.Agent == nil && c.Server == nil {
 		return fmt.Errorf("no destination configuration provided")
 	}
 	if c.State == nil {
 		return fmt.Errorf("no state configuration provided")
 	}
+	// pushed IPs and the ones read from the interface would overwrite each other
+	if c.DynDNS != nil && c.Listen.Iface != "" {
+		return fmt.Errorf("dyndns: IPs can't be pushed if an interface is monitored")
+	}
 	return nil
 }
 
 // Validate validates the configuration file
 func (c *Config) Validate() error {
 	// run all config subsection validators. Order matters here
-	for _, section := range []validator{
-		c,
-		c.Listen,
-		c.State,
-		c.Destinations,
-	} {
+	sections := []validator{c}
+
+	// IPs pushed via dyndns or reported by agents make monitoring an interface optional
+	if (c.DynDNS == nil && c.Server == nil) || c.Listen == nil || c.Listen.Iface != "" {
+		sections = append(sections, c.Listen)
+	}
+	sections = append(sections, c.State)
+	if len(c.Destinations) > 0 {
+		sections = append(sections, c.Destinations)
+	}
+	if c.Nameserver != nil {
+		sections = append(sections, c.Nameserver)
+	}
+	if c.DynDNS != nil {
+		sections = append(sections, c.DynDNS)
+	}
+	if c.Agent != nil {
+		sections = append(sections, c.Agent)
+	}
+	if c.Server != nil {
+		sections = append(sections, c.Server)
+	}
+	if c.Metrics != nil {
+		sections = append(sections, c.Metrics)
+	}
+	for _, section := range sections {
 		err := section.validate()
 		if err != nil {
 			return err
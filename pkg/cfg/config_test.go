@@ -1,8 +1,14 @@
-package cfg
+package cfg_test
 
 import (
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+
+	// registers the built-in destination types
+	_ "github.com/els0r/dynip-ng/pkg/update"
 )
 
 var validStateConfig = `
@@ -192,6 +198,262 @@ listen:
     interval: 10
     iface: eth0
         `,
+	},
+	{
+		"valid configuration (cloudflare with records)",
+		true,
+		`---` + validStateConfig + `
+destinations:
+    cloudflare:
+        access:
+            token: secret_token
+
+        zones:
+            example.ch:
+                records:
+                    - name: "@"
+                    - name: "*.dev"
+                      type: A
+                      ttl: 300
+                    - name: dynip
+                      type: AAAA
+                      proxied: true
+` + validListenConfig,
+	},
+	{
+		"unsupported record type (cloudflare)",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    cloudflare:
+        access:
+            token: secret_token
+
+        zones:
+            example.ch:
+                records:
+                    - name: dynip
+                      type: CNAME
+` + validListenConfig,
+	},
+	{
+		"duplicate record (cloudflare)",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    cloudflare:
+        access:
+            token: secret_token
+
+        zones:
+            example.ch:
+                record: dynip
+                records:
+                    - name: dynip
+` + validListenConfig,
+	},
+	{
+		"invalid record TTL (cloudflare)",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    cloudflare:
+        access:
+            token: secret_token
+
+        zones:
+            example.ch:
+                records:
+                    - name: dynip
+                      ttl: 30
+` + validListenConfig,
+	},
+	{
+		"valid configuration (cloudflare with ownership)",
+		true,
+		`---` + validStateConfig + `
+destinations:
+    cloudflare:
+        access:
+            token: secret_token
+        ownership:
+            instance: home
+            marker: tag
+            cleanup: true
+        zones:
+            example.ch:
+                record: dynip
+` + validListenConfig,
+	},
+	{
+		"unsupported ownership marker (cloudflare)",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    cloudflare:
+        access:
+            token: secret_token
+        ownership:
+            instance: home
+            marker: label
+        zones:
+            example.ch:
+                record: dynip
+` + validListenConfig,
+	},
+	{
+		"valid configuration (multiple cloudflare accounts)",
+		true,
+		`---` + validStateConfig + `
+destinations:
+    cloudflare:
+        - name: personal
+          access:
+              token: secret_token
+          zones:
+              example.ch:
+                  record: dynip
+        - name: client
+          access:
+              key: secret_key
+              email: ops@example.com
+          zones:
+              example.com:
+                  record: office
+` + validListenConfig,
+	},
+	{
+		"unnamed accounts (cloudflare)",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    cloudflare:
+        - access:
+              token: secret_token
+          zones:
+              example.ch:
+                  record: dynip
+        - access:
+              token: other_token
+          zones:
+              example.com:
+                  record: office
+` + validListenConfig,
+	},
+	{
+		"duplicate account names (cloudflare)",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    cloudflare:
+        - name: personal
+          access:
+              token: secret_token
+          zones:
+              example.ch:
+                  record: dynip
+        - name: personal
+          access:
+              token: other_token
+          zones:
+              example.com:
+                  record: office
+` + validListenConfig,
+	},
+	{
+		"invalid named account (cloudflare)",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    cloudflare:
+        - name: personal
+          access:
+              token: secret_token
+` + validListenConfig,
+	},
+	{
+		"valid configuration (list of destinations)",
+		true,
+		`---` + validStateConfig + `
+destinations:
+    - type: cloudflare
+      name: personal
+      access:
+          token: secret_token
+      zones:
+          example.ch:
+              record: dynip
+    - type: file
+      template: /path/to/template
+      output: /path/to/output
+` + validListenConfig,
+	},
+	{
+		"destination without type",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    - name: caddy
+      template: /path/to/template
+      output: /path/to/output
+` + validListenConfig,
+	},
+	{
+		"unsupported destination type",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    - type: carrierPigeon
+` + validListenConfig,
+	},
+	{
+		"unsupported destination type (mapping)",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    carrierPigeon:
+        loft: roof
+` + validListenConfig,
+	},
+	{
+		"valid configuration (cloudflareLists)",
+		true,
+		`---` + validStateConfig + `
+destinations:
+    cloudflareLists:
+        access:
+            token: secret_token
+        comment: office
+        lists:
+            - account: 023e105f4ecef8ad9ca31a8372d0c353
+              name: office_ips
+        accessRules:
+            - zone: example.ch
+              mode: whitelist
+` + validListenConfig,
+	},
+	{
+		"nothing to update (cloudflareLists)",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    cloudflareLists:
+        access:
+            token: secret_token
+` + validListenConfig,
+	},
+	{
+		"unsupported access rule mode (cloudflareLists)",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    cloudflareLists:
+        access:
+            token: secret_token
+        accessRules:
+            - zone: example.ch
+              mode: allow
+` + validListenConfig,
 	},
 	{
 		"no destinations",
@@ -215,6 +477,170 @@ listen:
     iface: eth0
         `,
 	},
+	{
+		"valid configuration (zonefile)",
+		true,
+		`---` + validStateConfig + `
+destinations:
+    zonefile:
+        path: /etc/bind/db.example.org
+        origin: example.org
+        records:
+            - "@"
+            - dynip
+        reload: rndc reload example.org
+listen:
+    interval: 10
+    iface: eth0
+        `,
+	},
+	{
+		"no records (zonefile)",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    zonefile:
+        path: /etc/bind/db.example.org
+        origin: example.org
+listen:
+    interval: 10
+    iface: eth0
+        `,
+	},
+	{
+		"valid configuration (nameserver only)",
+		true,
+		`---` + validStateConfig + `
+nameserver:
+    listen: ":53"
+    zone: dyn.example.org
+    names:
+        - home
+    ttl: 60
+    ns:
+        - ns1.example.org
+listen:
+    interval: 10
+    iface: eth0
+        `,
+	},
+	{
+		"no zone (nameserver)",
+		false,
+		`---` + validStateConfig + `
+nameserver:
+    listen: ":53"
+    ns:
+        - ns1.example.org
+listen:
+    interval: 10
+    iface: eth0
+        `,
+	},
+	{
+		"valid configuration (dyndns without interface)",
+		true,
+		`---` + validStateConfig + `
+destinations:
+    file:
+        template: /path/to/template
+        output: /path/to/output
+dyndns:
+    listen: ":8245"
+    clients:
+        fritzbox:
+            password: secret
+            hostnames:
+                - home.example.org
+        `,
+	},
+	{
+		"dyndns with interface",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    file:
+        template: /path/to/template
+        output: /path/to/output
+dyndns:
+    listen: ":8245"
+    clients:
+        fritzbox:
+            password: secret
+            hostnames:
+                - home.example.org
+` + validListenConfig,
+	},
+	{
+		"no password (dyndns)",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    file:
+        template: /path/to/template
+        output: /path/to/output
+dyndns:
+    listen: ":8245"
+    clients:
+        fritzbox:
+            hostnames:
+                - home.example.org
+        `,
+	},
+	{
+		"valid configuration (agent)",
+		true,
+		`---` + validStateConfig + `
+agent:
+    id: branch-zurich
+    secret: secret
+    server: https://dynip.example.org:8246
+` + validListenConfig,
+	},
+	{
+		"no server URL (agent)",
+		false,
+		`---` + validStateConfig + `
+agent:
+    id: branch-zurich
+    secret: secret
+` + validListenConfig,
+	},
+	{
+		"valid configuration (server)",
+		true,
+		`---` + validStateConfig + `
+server:
+    listen: ":8246"
+    replayWindow: 60
+    agents:
+        branch-zurich:
+            secret: secret
+            destinations:
+                cloudflare:
+                    access:
+                        token: secret_token
+                    zones:
+                        example.ch:
+                            record: zurich
+        `,
+	},
+	{
+		"invalid agent destinations (server)",
+		false,
+		`---` + validStateConfig + `
+server:
+    listen: ":8246"
+    agents:
+        branch-zurich:
+            secret: secret
+            destinations:
+                cloudflare:
+                    zones:
+                        example.ch:
+                            record: zurich
+        `,
+	},
 	{
 		"wrong interval value",
 		false,
@@ -267,6 +693,308 @@ listen:
     iface: eth0
         `,
 	},
+	{
+		"destination middleware",
+		true,
+		`---` + validStateConfig + `
+destinations:
+    - type: file
+      template: /path/to/template
+      output: /path/to/output
+      timeout: 10s
+      rateLimit: 1m
+      retry:
+          attempts: 3
+          backoff: 2s
+` + validListenConfig,
+	},
+	{
+		"destination retry without attempts",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    - type: file
+      template: /path/to/template
+      output: /path/to/output
+      retry:
+          backoff: 2s
+` + validListenConfig,
+	},
+	{
+		"negative destination timeout",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    file:
+        template: /path/to/template
+        output: /path/to/output
+        timeout: -10s
+` + validListenConfig,
+	},
+	{
+		"negative listen timeout",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    file:
+        template: /path/to/template
+        output: /path/to/output
+
+listen:
+    iface: eth0
+    interval: 10
+    timeout: -10s
+`,
+	},
+	{
+		"metrics",
+		true,
+		`---` + validStateConfig + `
+destinations:
+    file:
+        template: /path/to/template
+        output: /path/to/output
+
+metrics:
+    listen: 127.0.0.1:9245
+` + validListenConfig,
+	},
+	{
+		"metrics without listen address",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    file:
+        template: /path/to/template
+        output: /path/to/output
+
+metrics:
+    listen: ""
+` + validListenConfig,
+	},
+	{
+		"several files with reload",
+		true,
+		`---` + validStateConfig + `
+destinations:
+    file:
+        reload: systemctl reload caddy
+        files:
+            - template: /path/to/Caddyfile.gotmpl
+              output: /path/to/Caddyfile
+            - template: /path/to/hosts.gotmpl
+              output: /path/to/hosts
+` + validListenConfig,
+	},
+	{
+		"file output provided twice",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    file:
+        template: /path/to/template
+        output: /path/to/output
+        files:
+            - template: /path/to/other
+              output: /path/to/output
+` + validListenConfig,
+	},
+	{
+		"file without output",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    file:
+        files:
+            - template: /path/to/template
+` + validListenConfig,
+	},
+	{
+		"patch with markers and pattern",
+		true,
+		`---` + validStateConfig + `
+destinations:
+    patch:
+        path: /etc/ssh/sshd_config
+        markers:
+            begin: "# BEGIN dynip-ng"
+            end: "# END dynip-ng"
+        pattern: ^ListenAddress
+        reload: systemctl reload sshd
+` + validListenConfig,
+	},
+	{
+		"patch without markers or pattern",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    patch:
+        path: /etc/ssh/sshd_config
+` + validListenConfig,
+	},
+	{
+		"patch with invalid pattern",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    patch:
+        path: /etc/ssh/sshd_config
+        pattern: ^Listen(Address
+` + validListenConfig,
+	},
+	{
+		"hosts for dnsmasq",
+		true,
+		`---` + validStateConfig + `
+destinations:
+    hosts:
+        path: /etc/dnsmasq.d/dynip.conf
+        format: dnsmasqAddress
+        names:
+            - dynip.example.org
+        reload: systemctl restart dnsmasq
+` + validListenConfig,
+	},
+	{
+		"hosts with unknown format",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    hosts:
+        path: /etc/hosts
+        format: bind
+        names:
+            - dynip.example.org
+` + validListenConfig,
+	},
+	{
+		"hosts without names",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    hosts:
+        path: /etc/hosts
+` + validListenConfig,
+	},
+	{
+		"firewall nftables sets",
+		true,
+		`---` + validStateConfig + `
+destinations:
+    firewall:
+        table: filter
+        ipv4Set: dynip4
+        ipv6Set: dynip6
+` + validListenConfig,
+	},
+	{
+		"firewall ipset with table",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    firewall:
+        backend: ipset
+        table: filter
+        ipv4Set: dynip4
+` + validListenConfig,
+	},
+	{
+		"firewall without sets",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    firewall:
+        table: filter
+` + validListenConfig,
+	},
+	{
+		"wireguard peers",
+		true,
+		`---` + validStateConfig + `
+destinations:
+    wireguard:
+        configs:
+            - /etc/wireguard/wg0.conf
+        peers:
+            - xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+        port: 51820
+        live: true
+` + validListenConfig,
+	},
+	{
+		"wireguard without peers",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    wireguard:
+        configs:
+            - /etc/wireguard/wg0.conf
+` + validListenConfig,
+	},
+	{
+		"git files",
+		true,
+		`---` + validStateConfig + `
+destinations:
+    git:
+        repository: /srv/gitops/dns
+        files:
+            - template: /etc/dynip-ng/records.yaml.tmpl
+              output: zones/example.org/records.yaml
+        remote: origin
+        branch: main
+` + validListenConfig,
+	},
+	{
+		"git output outside of the repository",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    git:
+        repository: /srv/gitops/dns
+        files:
+            - template: /etc/dynip-ng/records.yaml.tmpl
+              output: ../records.yaml
+` + validListenConfig,
+	},
+	{
+		"git branch without remote",
+		false,
+		`---` + validStateConfig + `
+destinations:
+    git:
+        repository: /srv/gitops/dns
+        files:
+            - template: /etc/dynip-ng/records.yaml.tmpl
+              output: records.yaml
+        branch: main
+` + validListenConfig,
+	},
+}
+
+func TestDestinationMiddleware(t *testing.T) {
+	c, err := cfg.Parse(strings.NewReader(`---` + validStateConfig + `
+destinations:
+    - type: file
+      template: /path/to/template
+      output: /path/to/output
+      timeout: 10s
+      retry:
+          attempts: 3
+          backoff: 2s
+` + validListenConfig))
+	if err != nil {
+		t.Fatalf("couldn't parse config: %s", err)
+	}
+
+	m := c.Destinations[0].Middleware
+	if m.Timeout != 10*time.Second || m.RateLimit != 0 || m.Retry == nil ||
+		m.Retry.Attempts != 3 || m.Retry.Backoff != 2*time.Second {
+		t.Fatalf("unexpected middleware config: %+v", m)
+	}
+	if c.Destinations[0].Settings.(*cfg.FileConfig).Output != "/path/to/output" {
+		t.Fatalf("unexpected settings: %+v", c.Destinations[0].Settings)
+	}
 }
 
 func TestValidate(t *testing.T) {
@@ -279,16 +1007,16 @@ func TestValidate(t *testing.T) {
 			r := strings.NewReader(test.cfg)
 
 			// parse config
-			cfg, err := Parse(r)
+			c, err := cfg.Parse(r)
 			if test.shouldPass {
 				if err != nil {
-					t.Logf("config: %s", cfg)
+					t.Logf("config: %s", c)
 					t.Fatalf("[%d] couldn't parse config: %s", i, err)
 				}
-				t.Log(cfg)
+				t.Log(c)
 			} else {
 				if err == nil {
-					t.Log(cfg)
+					t.Log(c)
 					t.Fatalf("[%d] config parsing should have failed but didn't", i)
 				}
 				t.Logf("[%d] provoked expected error: %s", i, err)
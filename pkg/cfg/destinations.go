@@ -0,0 +1,267 @@
+package cfg
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// DestinationType describes how the settings of a destination type are decoded and
+// validated
+type DestinationType struct {
+	// New returns a pointer to the settings a destination's configuration is
+	// decoded into
+	New func() interface{}
+
+	// Validate checks the decoded settings. If not set, settings which have a
+	// validate method are checked with it
+	Validate func(settings interface{}) error
+}
+
+var (
+	destinationTypesMu sync.RWMutex
+	destinationTypes   = make(map[string]DestinationType)
+)
+
+// RegisterDestinationType makes a destination type available in the configuration. The
+// built-in types are registered by package update, see update.Register. It panics if the type is registered twice or if it can't be decoded
+func RegisterDestinationType(name string, t DestinationType) {
+	destinationTypesMu.Lock()
+	defer destinationTypesMu.Unlock()
+
+	if name == "" {
+		panic("cfg: destination type has no name")
+	}
+	if t.New == nil {
+		panic("cfg: destination type " + name + " has no settings constructor")
+	}
+	if _, exists := destinationTypes[name]; exists {
+		panic("cfg: destination type " + name + " registered twice")
+	}
+	destinationTypes[name] = t
+}
+
+// DestinationTypes returns the names of all registered destination types
+func DestinationTypes() []string {
+	destinationTypesMu.RLock()
+	defer destinationTypesMu.RUnlock()
+
+	var names []string
+	for name := range destinationTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func destinationType(name string) (DestinationType, error) {
+	destinationTypesMu.RLock()
+	defer destinationTypesMu.RUnlock()
+
+	t, ok := destinationTypes[name]
+	if !ok {
+		return DestinationType{}, fmt.Errorf("destination type %q is not supported", name)
+	}
+	return t, nil
+}
+
+// Destination is a place the IP is written to
+type Destination struct {
+	// Type selects the updater, e.g. cloudflare or file
+	Type string
+
+	// Name identifies the destination. Defaults to the type
+	Name string
+
+	// Middleware configures how updates of the destination are run
+	Middleware MiddlewareConfig
+
+	// Settings holds the type-specific configuration. It is the value returned
+	// by the New function of the destination type
+	Settings interface{}
+}
+
+// UnmarshalYAML decodes a destination of the form {type: ..., name: ..., <settings>}
+func (d *Destination) UnmarshalYAML(value *yaml.Node) error {
+	var header struct {
+		Type string `yaml:"type"`
+	}
+	err := value.Decode(&header)
+	if err != nil {
+		return err
+	}
+	if header.Type == "" {
+		return fmt.Errorf("line %d: destination has no type", value.Line)
+	}
+	dest, err := decodeDestination(header.Type, value)
+	if err != nil {
+		return err
+	}
+	*d = *dest
+	return nil
+}
+
+// decodeDestination decodes the name and the settings of a destination of type typ
+func decodeDestination(typ string, value *yaml.Node) (*Destination, error) {
+	t, err := destinationType(typ)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %w", value.Line, err)
+	}
+
+	var header struct {
+		Name             string `yaml:"name"`
+		MiddlewareConfig `yaml:",inline"`
+	}
+	err = value.Decode(&header)
+	if err != nil {
+		return nil, err
+	}
+
+	// the settings are decoded from the entire entry. Keys which belong to the
+	// destination itself are ignored by the settings
+	settings := t.New()
+	err = value.Decode(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Destination{
+		Type:       typ,
+		Name:       header.Name,
+		Middleware: header.MiddlewareConfig,
+		Settings:   settings,
+	}
+	if d.Name == "" {
+		d.Name = typ
+	}
+	return d, nil
+}
+
+func (d *Destination) validate() error {
+	t, err := destinationType(d.Type)
+	if err != nil {
+		return err
+	}
+	if d.Settings == nil {
+		return fmt.Errorf("%s: no settings provided", d.Type)
+	}
+	err = d.Middleware.validate()
+	if err != nil {
+		return err
+	}
+	if t.Validate != nil {
+		return t.Validate(d.Settings)
+	}
+	if v, ok := d.Settings.(validator); ok {
+		return v.validate()
+	}
+	return nil
+}
+
+// MiddlewareConfig configures the behavior shared by all destination types. It is
+// set next to the settings of a destination
+type MiddlewareConfig struct {
+	// Timeout limits the duration of a single update attempt
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Retry repeats failed updates
+	Retry *RetryConfig `yaml:"retry"`
+
+	// RateLimit is the minimum time between two updates of the destination
+	RateLimit time.Duration `yaml:"rateLimit"`
+}
+
+// RetryConfig configures how failed updates are repeated
+type RetryConfig struct {
+	// Attempts is the maximum number of attempts, including the first one
+	Attempts int `yaml:"attempts"`
+
+	// Backoff is the wait before the first retry. It doubles with each retry
+	Backoff time.Duration `yaml:"backoff"`
+}
+
+func (m MiddlewareConfig) validate() error {
+	if m.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if m.RateLimit < 0 {
+		return fmt.Errorf("rate limit must not be negative")
+	}
+	if m.Retry != nil {
+		if m.Retry.Attempts < 1 {
+			return fmt.Errorf("retry: need at least one attempt")
+		}
+		if m.Retry.Backoff < 0 {
+			return fmt.Errorf("retry: backoff must not be negative")
+		}
+	}
+	return nil
+}
+
+// DestinationsConfig stores all output destinations. It is configured as a list of
+// destinations, or as a mapping from destination types to their settings. In the
+// latter form, a list of settings configures several destinations of the same type
+type DestinationsConfig []*Destination
+
+// UnmarshalYAML accepts both the list and the mapping form of the destinations
+func (d *DestinationsConfig) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.SequenceNode:
+		var dests []*Destination
+		err := value.Decode(&dests)
+		if err != nil {
+			return err
+		}
+		*d = dests
+	case yaml.MappingNode:
+		var dests DestinationsConfig
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			typ, settings := value.Content[i].Value, value.Content[i+1]
+
+			entries := []*yaml.Node{settings}
+			if settings.Kind == yaml.SequenceNode {
+				entries = settings.Content
+			}
+			for _, entry := range entries {
+				dest, err := decodeDestination(typ, entry)
+				if err != nil {
+					return err
+				}
+				dests = append(dests, dest)
+			}
+		}
+		*d = dests
+	default:
+		return fmt.Errorf("line %d: destinations must be a list or a mapping", value.Line)
+	}
+	return nil
+}
+
+func (d DestinationsConfig) validate() error {
+	if len(d) == 0 {
+		return fmt.Errorf("no destination for IP provided. Need at least one")
+	}
+
+	names := make(map[string]struct{})
+	for _, dest := range d {
+		if dest == nil {
+			return fmt.Errorf("empty destination provided")
+		}
+		if _, exists := names[dest.Name]; exists {
+			return fmt.Errorf("destination %q configured more than once. Names must be unique", dest.Name)
+		}
+		names[dest.Name] = struct{}{}
+
+		err := dest.validate()
+		if err != nil {
+			if dest.Name != dest.Type {
+				return fmt.Errorf("%w (destination %s)", err, dest.Name)
+			}
+			return err
+		}
+	}
+	return nil
+}
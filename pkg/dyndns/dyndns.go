@@ -0,0 +1,270 @@
+// Package dyndns implements a dyndns2-compatible HTTP server. Clients such as routers
+// push their IP to it, which is then handed to all configured destinations.
+//
+// An instance tracks a single set of IPs, i.e. a single logical host. The host names of
+// a request only authorize the update. Whichever host name is pushed, the same IPs and
+// destinations are updated
+package dyndns
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/listener/state"
+	"github.com/els0r/dynip-ng/pkg/logging"
+	"github.com/els0r/dynip-ng/pkg/update"
+	log "github.com/els0r/log"
+)
+
+// UpdatePath is the path of the dyndns2 update endpoint
+const UpdatePath = "/nic/update"
+
+const defaultShutdownTimeout = 5 * time.Second
+
+// dyndns2 return codes
+const (
+	codeGood     = "good"
+	codeNoChange = "nochg"
+	codeBadAuth  = "badauth"
+	codeNoHost   = "nohost"
+	codeNotFQDN  = "notfqdn"
+	codeServer   = "911"
+)
+
+// Applier runs the destination updates for IPs pushed by a client. An address family
+// missing from ips is kept as it is. The listener implements it
+type Applier interface {
+	Push(ctx context.Context, ips state.MonitoredIPs) (bool, error)
+}
+
+// Server handles dyndns2 update requests
+type Server struct {
+	listen   string
+	certFile string
+	keyFile  string
+
+	// maps user names to their credentials
+	clients map[string]*cfg.DynDNSClient
+
+	applier Applier
+
+	srv *http.Server
+	lis net.Listener
+
+	log log.Logger
+}
+
+// New creates a dyndns2 server which hands pushed IPs to `applier`
+func New(config *cfg.DynDNSConfig, applier Applier) (*Server, error) {
+	if config == nil {
+		return nil, fmt.Errorf("no dyndns config provided")
+	}
+	if applier == nil {
+		return nil, fmt.Errorf("dyndns server needs an applier for pushed IPs")
+	}
+	return &Server{
+		listen:   config.Listen,
+		certFile: config.CertFile,
+		keyFile:  config.KeyFile,
+		clients:  config.Clients,
+		applier:  applier,
+		log:      logging.Get(),
+	}, nil
+}
+
+// Handler returns the HTTP handler serving the update endpoint
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(UpdatePath, s.handleUpdate)
+	return mux
+}
+
+// Start binds the HTTP server to its address and serves requests in the background
+func (s *Server) Start() error {
+	var err error
+	s.lis, err = net.Listen("tcp", s.listen)
+	if err != nil {
+		return err
+	}
+	s.srv = &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		var err error
+		if s.certFile != "" {
+			err = s.srv.ServeTLS(s.lis, s.certFile, s.keyFile)
+		} else {
+			err = s.srv.Serve(s.lis)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			s.log.Errorf("dyndns server stopped: %s", err)
+		}
+	}()
+	s.log.Infof("accepting dyndns updates on %s", s.lis.Addr())
+	return nil
+}
+
+// Addr returns the address the server listens on. It is only set after Start was called
+func (s *Server) Addr() string {
+	if s.lis == nil {
+		return ""
+	}
+	return s.lis.Addr().String()
+}
+
+// Stop gracefully shuts down the server
+func (s *Server) Stop() error {
+	if s.srv == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownTimeout)
+	defer cancel()
+
+	err := s.srv.Shutdown(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to stop dyndns server: %w", err)
+	}
+	s.log.Info("stopped dyndns server")
+	return nil
+}
+
+func (s *Server) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	client, user, ok := s.authenticate(r)
+	if !ok {
+		s.log.Warnf("dyndns: failed authentication from %s (user=%q)", r.RemoteAddr, user)
+		w.Header().Set("WWW-Authenticate", `Basic realm="dynip-ng"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintln(w, codeBadAuth)
+		return
+	}
+
+	// check that the client may update all requested host names
+	hostnames := splitList(r.URL.Query().Get("hostname"))
+	if len(hostnames) == 0 {
+		reply(w, codeNotFQDN)
+		return
+	}
+	for _, hostname := range hostnames {
+		if !authorized(client, hostname) {
+			s.log.Warnf("dyndns: %q is not allowed to update %q", user, hostname)
+			reply(w, codeNoHost)
+			return
+		}
+	}
+
+	ips, err := pushedIPs(r)
+	if err != nil {
+		s.log.Warnf("dyndns: invalid update from %q: %s", user, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.log.Debugf("dyndns: %q pushed IP(s) %s for %s", user, ips, strings.Join(hostnames, ","))
+
+	// the update is finished even if the client hangs up, so that the destinations don't
+	// end up partially updated. The applier limits the duration of each destination update
+	ctx := update.WithReason(context.WithoutCancel(r.Context()), update.ReasonPush)
+	changed, err := s.applier.Push(ctx, ips)
+	if err != nil {
+		s.log.Errorf("dyndns: update pushed by %q failed: %s", user, err)
+		reply(w, codeServer)
+		return
+	}
+
+	code := codeNoChange
+	if changed {
+		code = codeGood
+	}
+	ip := ips.IPv4
+	if ip == "" {
+		ip = ips.IPv6
+	}
+
+	// one status line per host name
+	lines := make([]string, len(hostnames))
+	for i := range hostnames {
+		lines[i] = code + " " + ip
+	}
+	reply(w, lines...)
+}
+
+func (s *Server) authenticate(r *http.Request) (*cfg.DynDNSClient, string, bool) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, "", false
+	}
+	client, exists := s.clients[user]
+	if !exists || client == nil {
+		return nil, user, false
+	}
+	if subtle.ConstantTimeCompare([]byte(password), []byte(client.Password)) != 1 {
+		return nil, user, false
+	}
+	return client, user, true
+}
+
+func authorized(client *cfg.DynDNSClient, hostname string) bool {
+	for _, h := range client.Hostnames {
+		if strings.EqualFold(strings.TrimSuffix(h, "."), strings.TrimSuffix(hostname, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// pushedIPs extracts the IPs from the `myip` and `myipv6` parameters. If neither is set,
+// the address the request originates from is used. A family which wasn't pushed is left
+// empty
+func pushedIPs(r *http.Request) (state.MonitoredIPs, error) {
+	var ips state.MonitoredIPs
+
+	params := append(splitList(r.URL.Query().Get("myip")), splitList(r.URL.Query().Get("myipv6"))...)
+	if len(params) == 0 {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return ips, fmt.Errorf("no IP provided")
+		}
+		params = []string{host}
+	}
+
+	for _, p := range params {
+		ip := net.ParseIP(p)
+		if ip == nil {
+			return ips, fmt.Errorf("invalid IP address %q", p)
+		}
+		if ip.To4() != nil {
+			ips.IPv4 = ip.String()
+		} else {
+			ips.IPv6 = ip.String()
+		}
+	}
+	return ips, nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func reply(w http.ResponseWriter, lines ...string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, strings.Join(lines, "\n"))
+}
@@ -0,0 +1,224 @@
+package dyndns
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/listener/state"
+)
+
+// mock applier recording the pushed IPs. If delay is set, it takes its time and records
+// whether its context was canceled in the meantime
+type mockApplier struct {
+	stored   state.MonitoredIPs
+	fail     bool
+	delay    time.Duration
+	canceled bool
+	done     chan struct{}
+}
+
+func (m *mockApplier) Push(ctx context.Context, ips state.MonitoredIPs) (bool, error) {
+	if m.done != nil {
+		defer close(m.done)
+	}
+	if m.delay > 0 {
+		select {
+		case <-ctx.Done():
+			m.canceled = true
+		case <-time.After(m.delay):
+		}
+	}
+	if m.fail {
+		return false, fmt.Errorf("destination update failed")
+	}
+	if state.Equal(m.stored, ips) {
+		return false, nil
+	}
+	m.stored = ips
+	return true, nil
+}
+
+func TestUpdate(t *testing.T) {
+	config := &cfg.DynDNSConfig{
+		Listen: "127.0.0.1:0",
+		Clients: map[string]*cfg.DynDNSClient{
+			"fritzbox": {Password: "secret", Hostnames: []string{"home.example.org", "vpn.example.org"}},
+		},
+	}
+
+	var tests = []struct {
+		name     string
+		user     string
+		password string
+		query    string
+		fail     bool
+		status   int
+		body     string
+		ips      state.MonitoredIPs
+	}{
+		{"good", "fritzbox", "secret", "hostname=home.example.org&myip=203.0.113.7", false,
+			http.StatusOK, "good 203.0.113.7", state.MonitoredIPs{IPv4: "203.0.113.7"}},
+		{"multiple hosts", "fritzbox", "secret", "hostname=home.example.org,vpn.example.org&myip=203.0.113.7", false,
+			http.StatusOK, "good 203.0.113.7\ngood 203.0.113.7", state.MonitoredIPs{IPv4: "203.0.113.7"}},
+		{"dual stack", "fritzbox", "secret", "hostname=home.example.org&myip=203.0.113.7&myipv6=2001:db8::7", false,
+			http.StatusOK, "good 203.0.113.7", state.MonitoredIPs{IPv4: "203.0.113.7", IPv6: "2001:db8::7"}},
+		{"remote address", "fritzbox", "secret", "hostname=home.example.org", false,
+			http.StatusOK, "good 192.0.2.1", state.MonitoredIPs{IPv4: "192.0.2.1"}},
+		{"wrong password", "fritzbox", "wrong", "hostname=home.example.org&myip=203.0.113.7", false,
+			http.StatusUnauthorized, "badauth", state.MonitoredIPs{}},
+		{"unknown user", "openwrt", "secret", "hostname=home.example.org&myip=203.0.113.7", false,
+			http.StatusUnauthorized, "badauth", state.MonitoredIPs{}},
+		{"unauthorized host", "fritzbox", "secret", "hostname=home.example.org,other.example.org&myip=203.0.113.7", false,
+			http.StatusOK, "nohost", state.MonitoredIPs{}},
+		{"no host", "fritzbox", "secret", "myip=203.0.113.7", false,
+			http.StatusOK, "notfqdn", state.MonitoredIPs{}},
+		{"invalid IP", "fritzbox", "secret", "hostname=home.example.org&myip=nope", false,
+			http.StatusBadRequest, "invalid IP address", state.MonitoredIPs{}},
+		{"failed update", "fritzbox", "secret", "hostname=home.example.org&myip=203.0.113.7", true,
+			http.StatusOK, "911", state.MonitoredIPs{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			applier := &mockApplier{fail: test.fail}
+			s, err := New(config, applier)
+			if err != nil {
+				t.Fatalf("failed to create dyndns server: %s", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, UpdatePath+"?"+test.query, nil)
+			req.SetBasicAuth(test.user, test.password)
+			rec := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rec, req)
+
+			body, _ := io.ReadAll(rec.Body)
+			if rec.Code != test.status {
+				t.Fatalf("unexpected status: got %d, want %d (%s)", rec.Code, test.status, body)
+			}
+			if !strings.HasPrefix(string(body), test.body) {
+				t.Fatalf("unexpected response: got %q, want %q", body, test.body)
+			}
+			if !state.Equal(applier.stored, test.ips) {
+				t.Fatalf("unexpected IPs applied: got %s, want %s", applier.stored, test.ips)
+			}
+		})
+	}
+}
+
+func TestServer(t *testing.T) {
+	applier := &mockApplier{}
+	s, err := New(&cfg.DynDNSConfig{
+		Listen: "127.0.0.1:0",
+		Clients: map[string]*cfg.DynDNSClient{
+			"openwrt": {Password: "secret", Hostnames: []string{"home.example.org"}},
+		},
+	}, applier)
+	if err != nil {
+		t.Fatalf("failed to create dyndns server: %s", err)
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatalf("failed to start dyndns server: %s", err)
+	}
+	defer s.Stop()
+
+	// pushing the same IP twice results in no change on the second attempt
+	for _, expected := range []string{"good 203.0.113.7", "nochg 203.0.113.7"} {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+s.Addr()+UpdatePath+"?hostname=home.example.org&myip=203.0.113.7", nil)
+		req.SetBasicAuth("openwrt", "secret")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if strings.TrimSpace(string(body)) != expected {
+			t.Fatalf("unexpected response: got %q, want %q", body, expected)
+		}
+	}
+}
+
+func TestSingleHost(t *testing.T) {
+	applier := &mockApplier{}
+	s, err := New(&cfg.DynDNSConfig{
+		Listen: "127.0.0.1:0",
+		Clients: map[string]*cfg.DynDNSClient{
+			"fritzbox": {Password: "secret", Hostnames: []string{"home.example.org"}},
+			"openwrt":  {Password: "secret", Hostnames: []string{"vpn.example.org"}},
+		},
+	}, applier)
+	if err != nil {
+		t.Fatalf("failed to create dyndns server: %s", err)
+	}
+
+	// the host names only authorize the clients. Both update the same IPs
+	for _, push := range []struct{ user, query string }{
+		{"fritzbox", "hostname=home.example.org&myip=203.0.113.7"},
+		{"openwrt", "hostname=vpn.example.org&myip=198.51.100.7"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, UpdatePath+"?"+push.query, nil)
+		req.SetBasicAuth(push.user, "secret")
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+
+		body, _ := io.ReadAll(rec.Body)
+		if !strings.HasPrefix(string(body), "good") {
+			t.Fatalf("unexpected response to %s: %q", push.user, body)
+		}
+	}
+	expected := state.MonitoredIPs{IPv4: "198.51.100.7"}
+	if !state.Equal(applier.stored, expected) {
+		t.Fatalf("unexpected IPs applied: got %s, want %s", applier.stored, expected)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	applier := &mockApplier{delay: 200 * time.Millisecond, done: make(chan struct{})}
+	s, err := New(&cfg.DynDNSConfig{
+		Listen: "127.0.0.1:0",
+		Clients: map[string]*cfg.DynDNSClient{
+			"fritzbox": {Password: "secret", Hostnames: []string{"home.example.org"}},
+		},
+	}, applier)
+	if err != nil {
+		t.Fatalf("failed to create dyndns server: %s", err)
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatalf("failed to start dyndns server: %s", err)
+	}
+	defer s.Stop()
+
+	// the router gives up before the destinations are updated
+	req, _ := http.NewRequest(http.MethodGet, "http://"+s.Addr()+UpdatePath+"?hostname=home.example.org&myip=203.0.113.7", nil)
+	req.SetBasicAuth("fritzbox", "secret")
+	client := &http.Client{Timeout: 20 * time.Millisecond}
+	_, err = client.Do(req)
+	if err == nil {
+		t.Fatalf("request should have timed out but didn't")
+	}
+	t.Logf("provoked expected error: %s", err)
+
+	// the server still finishes the update
+	select {
+	case <-applier.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("update didn't finish")
+	}
+	if applier.canceled {
+		t.Fatalf("update was canceled when the client hung up")
+	}
+	expected := state.MonitoredIPs{IPv4: "203.0.113.7"}
+	if !state.Equal(applier.stored, expected) {
+		t.Fatalf("unexpected IPs applied: got %s, want %s", applier.stored, expected)
+	}
+}
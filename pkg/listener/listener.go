@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/els0r/dynip-ng/pkg/cfg"
@@ -15,15 +16,19 @@ import (
 	"github.com/miekg/dns"
 )
 
-const defaultUpdateTimeout = 30 * time.Second
+const (
+	defaultLookupTimeout      = 30 * time.Second
+	defaultDestinationTimeout = 30 * time.Second
+	defaultNotifyTimeout      = 30 * time.Second
+)
 
 func (l *Listener) update() {
 	var (
 		err error
-		ip  net.IP
+		ips []net.IP
 	)
 
-	ctx, cancel := context.WithTimeout(context.Background(), defaultUpdateTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultLookupTimeout)
 	defer cancel()
 
 	// reset state in case the error is non-nil upon function return
@@ -40,24 +45,68 @@ func (l *Listener) update() {
 
 	// get current ip addresses
 	if !l.cfg.IsLAN {
-		ip, err = getLocalAddress(l.cfg.Iface)
+		ips, err = getLocalAddresses(l.cfg.Iface)
 		if err != nil {
-			l.log.Errorf("failed to get IP address on %q: %s", l.cfg.Iface, err)
+			l.log.Errorf("failed to get IP addresses on %q: %s", l.cfg.Iface, err)
 			return
 		}
 	} else {
 		l.log.Infof("getting external IP address on %q (lan=%v)", l.cfg.Iface, l.cfg.IsLAN)
 		// get the IP address via a call to dyn
-		ip, err = getExternalIPAddress(ctx)
+		ip, err := getExternalIPAddress(ctx)
 		if err != nil {
 			l.log.Errorf("failed to get external IP address on %q: %s", l.cfg.Iface, err)
 			return
 		}
+		ips = []net.IP{ip}
+	}
+	current := state.NewMonitoredIPs(ips...)
+	l.log.Debugf("current interface IPs are %s", current)
+
+	// assign read out IPs to state and run the updates. Each destination has its own
+	// timeout, so the one of the lookup doesn't apply
+	l.Apply(context.Background(), current)
+}
+
+// Apply runs all destination updates with ips if they differ from the stored state. It
+// returns whether the IPs changed and an error if any of the destinations failed to update.
+// Apply is safe for concurrent use, so that IPs can also be pushed from sources other than
+// the monitored interface. The reason for the update is taken from ctx (see update.WithReason)
+func (l *Listener) Apply(ctx context.Context, ips state.MonitoredIPs) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.apply(ctx, ips)
+}
+
+// Push works like Apply, but takes an address family missing from ips from the stored
+// state. Clients pushing their IPs typically send only one family per request, which
+// mustn't remove the other one from the destinations
+func (l *Listener) Push(ctx context.Context, ips state.MonitoredIPs) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	storedIPs, err := l.state.Get()
+	if err != nil {
+		l.log.Warnf("failed to get state: %s", err)
+	}
+	if ips.IPv4 == "" {
+		ips.IPv4 = storedIPs.IPv4
+	}
+	if ips.IPv6 == "" {
+		ips.IPv6 = storedIPs.IPv6
 	}
-	l.log.Debugf("current interface IP is %q", ip)
+	return l.apply(ctx, ips)
+}
 
-	// assign read out IPs to state
-	var ips = state.NewMonitoredIPs(ip)
+func (l *Listener) apply(ctx context.Context, ips state.MonitoredIPs) (bool, error) {
+	// observers see the live IPs, even if the destinations can't be updated with them
+	for _, o := range l.observers {
+		err := o.Set(ips)
+		if err != nil {
+			l.log.Warnf("failed to hand IPs to observer: %s", err)
+		}
+	}
 
 	// get stored state
 	storedIPs, err := l.state.Get()
@@ -66,40 +115,171 @@ func (l *Listener) update() {
 	}
 
 	// check update trigger condition
-	if !state.Equal(storedIPs, ips) {
-		l.log.Infof("IP(s) changed (%s): running destination updates", ips)
+	if state.Equal(storedIPs, ips) {
+		l.log.Debug("IPs are equal. Nothing to do")
+		return false, nil
+	}
+	reason := update.ReasonFrom(ctx)
+	l.log.Infof("IP(s) changed (%s, reason=%s): running destination updates", ips, reason)
+	if l.cfg.DryRun {
+		l.log.Info("dry run: destinations won't be changed")
+	}
 
-		tstart := time.Now()
-		var numErrors int
-		for _, u := range l.updaters {
+	tstart := time.Now()
+	var (
+		numErrors int
+		updated   = make(map[string]state.DestinationIPs)
+		results   []update.DestinationResult
+	)
+	for _, d := range l.destinations {
+		name := d.Name()
+
+		// destinations which were updated before a previous run failed are skipped
+		if storedIPs.UpToDate(name, ips) {
+			l.log.Debugf("%s is up to date", name)
+			updated[name] = storedIPs.Destinations[name]
+			continue
+		}
 
-			l.log.Debugf("running %s", u.Name())
+		// update the IPs at the destination
+		req := &update.Request{
+			IPv4:         ips.IPv4,
+			IPv6:         ips.IPv6,
+			PreviousIPv4: storedIPs.IPv4,
+			PreviousIPv6: storedIPs.IPv6,
+			Reason:       reason,
+			DryRun:       l.cfg.DryRun,
+		}
+		if reason == update.ReasonInterface {
+			req.Interface = l.cfg.Iface
+		}
+		if previous, ok := storedIPs.Destinations[name]; ok {
+			req.PreviousIPv4, req.PreviousIPv6 = previous.IPv4, previous.IPv6
+		}
+		res, err := l.applyDestination(ctx, d, req)
+		results = append(results, update.DestinationResult{Name: name, Result: res, Err: err})
+		if err != nil {
+			numErrors++
+			continue
+		}
+		updated[name] = state.DestinationIPs{IPv4: ips.IPv4, IPv6: ips.IPv6}
+	}
+	if l.outcomeChanged(ips, results) {
+		n := update.NewNotification(&update.Request{
+			IPv4:         ips.IPv4,
+			IPv6:         ips.IPv6,
+			PreviousIPv4: storedIPs.IPv4,
+			PreviousIPv6: storedIPs.IPv6,
+			Reason:       reason,
+		})
+		n.Results = results
+		l.notify(n)
+	}
+	if l.cfg.DryRun {
+		l.log.Infof("dry run of all destinations finished in %s", time.Now().Sub(tstart))
+		if numErrors > 0 {
+			return true, fmt.Errorf("%d of %d destinations encountered update errors", numErrors, len(l.destinations))
+		}
+		return true, nil
+	}
 
-			// update the IPs at the destination
-			err = u.Update(ctx, ips.IPv4)
+	// the IPs are only stored once all destinations were updated. Until then, the
+	// destinations which were updated are tracked individually
+	newState := state.MonitoredIPs{
+		IPv4:         ips.IPv4,
+		IPv6:         ips.IPv6,
+		Destinations: updated,
+	}
+	if numErrors > 0 {
+		newState.IPv4, newState.IPv6 = storedIPs.IPv4, storedIPs.IPv6
+	}
+	err = l.state.Set(newState)
+	if err != nil {
+		l.log.Warnf("failed to set new state: %s", err)
+	}
 
-			// log errors
-			if err != nil {
-				l.log.Errorf("%s: %s", u.Name(), err)
-				numErrors++
-			}
+	if numErrors == 0 {
+		l.log.Infof("all destinations updated in %s", time.Now().Sub(tstart))
+		return true, nil
+	} else if numErrors == len(l.destinations) {
+		l.log.Errorf("all destinations encountered update errors. Time elapsed: %s", time.Now().Sub(tstart))
+	} else {
+		l.log.Warnf("some destinations encountered update errors. Time elapsed: %s", time.Now().Sub(tstart))
+	}
+	return true, fmt.Errorf("%d of %d destinations encountered update errors", numErrors, len(l.destinations))
+}
+
+// applyDestination updates a single destination. Each destination gets its own timeout,
+// so that a slow one, e.g. one retrying its update, doesn't leave the others without time
+func (l *Listener) applyDestination(ctx context.Context, d update.Destination, req *update.Request) (*update.Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+
+	return d.Apply(ctx, req)
+}
+
+// outcomeChanged records the outcome of each destination and reports whether any of
+// them differs from the last one the notifiers were told about. A destination failing
+// the same way on every check thus only leads to a single notification
+func (l *Listener) outcomeChanged(ips state.MonitoredIPs, results []update.DestinationResult) bool {
+	var changed bool
+	for _, r := range results {
+		outcome := ips.String()
+		if r.Result != nil {
+			outcome += ": " + r.Result.String()
+		}
+		if r.Err != nil {
+			outcome += ": " + r.Err.Error()
+		}
+		if l.notified[r.Name] != outcome {
+			l.notified[r.Name] = outcome
+			changed = true
 		}
-		if numErrors == 0 {
-			l.log.Infof("all destinations updated in %s", time.Now().Sub(tstart))
+	}
+	return changed
+}
 
-			// write state only if all updates were successful
-			err = l.state.Set(ips)
-			if err != nil {
-				l.log.Warnf("failed to set new state: %s", err)
-			}
-		} else if numErrors == len(l.updaters) {
-			l.log.Errorf("all destinations encountered update errors. Time elapsed: %s", time.Now().Sub(tstart))
-		} else {
-			l.log.Warnf("some destinations encountered update errors. Time elapsed: %s", time.Now().Sub(tstart))
+// notify runs the notifiers in the background, so that slow or failing notifiers don't
+// hold up destination updates. Their errors are logged, but don't affect the state
+func (l *Listener) notify(n *update.Notification) {
+	for _, d := range l.notifiers {
+		req := &update.Request{
+			IPv4:         n.IPv4,
+			IPv6:         n.IPv6,
+			PreviousIPv4: n.PreviousIPv4,
+			PreviousIPv6: n.PreviousIPv6,
+			Reason:       n.Reason,
+			DryRun:       l.cfg.DryRun,
+			Notification: n,
 		}
-		return
+
+		l.notifying.Add(1)
+		go func(d update.Destination) {
+			defer l.notifying.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), defaultNotifyTimeout)
+			defer cancel()
+
+			d.Apply(ctx, req)
+		}(d)
+	}
+}
+
+// Wait waits for the notifiers still running in the background, e.g. before the program
+// exits. It returns an error if they don't finish before ctx is done
+func (l *Listener) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		l.notifying.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("notifiers didn't finish: %w", ctx.Err())
 	}
-	l.log.Debug("IPs are equal. Nothing to do")
 }
 
 // Listener listens for IP changes on an interface and updates all its configured destinations
@@ -107,8 +287,27 @@ type Listener struct {
 	state state.State
 	cfg   *cfg.ListenConfig
 
+	// time between checks of the interface
+	interval time.Duration
+
+	// maximum duration of the update of a single destination
+	timeout time.Duration
+
+	// serializes destination updates
+	mu sync.Mutex
+
 	// units that will receive an update
-	updaters []update.Updater
+	destinations []update.Destination
+
+	// units that are told about the outcome of an update
+	notifiers []update.Destination
+	notifying sync.WaitGroup
+
+	// last outcome of each destination the notifiers were told about
+	notified map[string]string
+
+	// units that are handed every IP the listener sees
+	observers []state.Setter
 
 	// logger for injection
 	log log.Logger
@@ -125,6 +324,12 @@ func New(cfg *cfg.ListenConfig, state state.State, upds ...update.Updater) (*Lis
 		return nil, fmt.Errorf("cannot run without listener config")
 	}
 	l.cfg = cfg
+	l.notified = make(map[string]string)
+	l.interval = time.Duration(cfg.Interval) * time.Minute
+	l.timeout = cfg.Timeout
+	if l.timeout <= 0 {
+		l.timeout = defaultDestinationTimeout
+	}
 
 	// create initial state
 	l.state = state
@@ -136,26 +341,59 @@ func New(cfg *cfg.ListenConfig, state state.State, upds ...update.Updater) (*Lis
 		l.state.Reset()
 	}
 
-	// assign updaters
-	l.updaters = upds
+	// assign updaters. Their names identify them in the state
+	names := make(map[string]struct{})
+	for _, u := range upds {
+		if _, exists := names[u.Name()]; exists {
+			return nil, fmt.Errorf("destination %q configured more than once", u.Name())
+		}
+		names[u.Name()] = struct{}{}
+		d := update.Chain(update.AsDestination(u),
+			update.Logging(l.log),
+			update.Metrics(),
+		)
+		if update.IsNotifier(d) {
+			l.notifiers = append(l.notifiers, d)
+			continue
+		}
+		l.destinations = append(l.destinations, d)
+	}
 
 	return l, nil
 }
 
-// Run starts the IP change listener
+// Observe registers o to be handed the IPs of every Apply, regardless of whether they
+// changed or the destinations were updated successfully. It must be called before Run
+func (l *Listener) Observe(o state.Setter) {
+	l.mu.Lock()
+	l.observers = append(l.observers, o)
+	l.mu.Unlock()
+}
+
+// Run starts the IP change listener. If no interface is configured, the listener doesn't
+// monitor anything and only applies IPs handed to it via Apply
 func (l *Listener) Run() chan struct{} {
 
 	l.log.Debugf("running with config: %s", l.cfg)
 
+	stopChan := make(chan struct{})
+	if l.cfg.Iface == "" {
+		l.log.Info("no interface configured. Waiting for pushed IP updates")
+		go func(stop chan struct{}) {
+			<-stop
+			l.log.Info("stopped listening for IP updates")
+		}(stopChan)
+		return stopChan
+	}
+
 	// setup time interval for periodic checks
-	ticker := time.NewTicker(time.Duration(l.cfg.Interval) * time.Minute)
+	ticker := time.NewTicker(l.interval)
 
 	// check and update if necessary
 	l.log.Debug("running initial IP update check")
 	l.update()
 
 	// go into monitoring mode
-	stopChan := make(chan struct{})
 	go func(stop chan struct{}) {
 		for {
 			select {
@@ -174,7 +412,9 @@ func (l *Listener) Run() chan struct{} {
 	return stopChan
 }
 
-func getLocalAddress(iface string) (net.IP, error) {
+// getLocalAddresses returns the first IPv4 and the first IPv6 address of an interface.
+// IPv6 link-local addresses are skipped, since they can't be reached from elsewhere
+func getLocalAddresses(iface string) ([]net.IP, error) {
 
 	// get the interface
 	ifi, err := net.InterfaceByName(iface)
@@ -189,16 +429,37 @@ func getLocalAddress(iface string) (net.IP, error) {
 		return nil, err
 	}
 
-	// get IP address for interface
+	// get IP addresses for interface
+	var v4, v6 net.IP
 	for _, a := range addrs {
+		var ip net.IP
 		switch v := a.(type) {
 		case *net.IPAddr:
-			return v.IP, nil
+			ip = v.IP
 		case *net.IPNet:
-			return v.IP, nil
+			ip = v.IP
+		default:
+			continue
+		}
+		if ip.To4() != nil {
+			if v4 == nil {
+				v4 = ip
+			}
+		} else if v6 == nil && !ip.IsLinkLocalUnicast() {
+			v6 = ip
 		}
 	}
-	return nil, fmt.Errorf("no IP address found for interface %q", iface)
+
+	var ips []net.IP
+	for _, ip := range []net.IP{v4, v6} {
+		if ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no IP address found for interface %q", iface)
+	}
+	return ips, nil
 }
 
 const (
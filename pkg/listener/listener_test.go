@@ -2,6 +2,9 @@ package listener
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -15,46 +18,471 @@ type mockUpdater struct{}
 func (m *mockUpdater) Update(_ context.Context, ip string) error { return nil }
 func (m *mockUpdater) Name() string                              { return "mock updater" }
 
-func TestListener(t *testing.T) {
+// counts the updates it receives and fails if told so
+type countingUpdater struct {
+	name    string
+	updates int
+	fail    bool
+}
+
+func (c *countingUpdater) Update(_ context.Context, ip string) error {
+	c.updates++
+	if c.fail {
+		return fmt.Errorf("update to %s failed", ip)
+	}
+	return nil
+}
+func (c *countingUpdater) Name() string {
+	if c.name != "" {
+		return c.name
+	}
+	return "counting updater"
+}
+
+func TestApply(t *testing.T) {
+	ips := state.MonitoredIPs{IPv4: "203.0.113.7"}
+
 	var tests = []struct {
-		name   string
-		config *cfg.ListenConfig
+		name      string
+		fail      bool
+		changed   []bool
+		updates   int
+		wantState state.MonitoredIPs
 	}{
-		{
-			"test run and stop (long)",
-			&cfg.ListenConfig{
-				Interval: 1,
-			},
-		},
+		{"change applied once", false, []bool{true, false}, 1, ips},
+		{"failed change is retried", true, []bool{true, true}, 2, state.MonitoredIPs{}},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
+			st := state.NewInMemory()
+			cu := &countingUpdater{fail: test.fail}
 
-			config := test.config
-
-			state := state.NewInMemory()
-			mu := &mockUpdater{}
-
-			// create listener
-			l, err := New(config, state, []update.Updater{
-				// line up all different updaters
-				mu,
-			}...)
+			l, err := New(&cfg.ListenConfig{Interval: 1}, st, cu)
 			if err != nil {
 				t.Fatalf("failed to create listener: %s", err)
 			}
 
-			// and run it
-			stop := l.Run()
+			for i, expected := range test.changed {
+				changed, err := l.Apply(context.Background(), ips)
+				if changed != expected {
+					t.Fatalf("[%d] unexpected change indication: got %v, want %v", i, changed, expected)
+				}
+				if test.fail != (err != nil) {
+					t.Fatalf("[%d] unexpected error: %v", i, err)
+				}
+			}
+			if cu.updates != test.updates {
+				t.Fatalf("unexpected number of updates: got %d, want %d", cu.updates, test.updates)
+			}
+			stored, _ := st.Get()
+			if !state.Equal(stored, test.wantState) {
+				t.Fatalf("unexpected state: got %s, want %s", stored, test.wantState)
+			}
+		})
+	}
+}
 
-			// wait for at least one ticker cycle to complete
-			// TODO: this slows down the test significatly, since the minimum
-			// duration is at 1 minute at the moment. Change config to accept seconds
-			time.Sleep(time.Duration(config.Interval)*time.Minute + 5*time.Second)
+func TestApplyPartialFailure(t *testing.T) {
+	ips := state.MonitoredIPs{IPv4: "203.0.113.7"}
 
-			// check if the listener can be stopped
-			stop <- struct{}{}
-		})
+	st := state.NewInMemory()
+	caddy := &countingUpdater{name: "file updater (caddy)"}
+	nginx := &countingUpdater{name: "file updater (nginx)", fail: true}
+
+	l, err := New(&cfg.ListenConfig{Interval: 1}, st, caddy, nginx)
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+
+	_, err = l.Apply(context.Background(), ips)
+	if err == nil {
+		t.Fatalf("apply should have failed but didn't")
+	}
+	stored, _ := st.Get()
+	if !stored.UpToDate(caddy.Name(), ips) || stored.UpToDate(nginx.Name(), ips) {
+		t.Fatalf("unexpected destination state: %v", stored.Destinations)
+	}
+
+	// only the failed destination is retried
+	nginx.fail = false
+	_, err = l.Apply(context.Background(), ips)
+	if err != nil {
+		t.Fatalf("apply failed: %s", err)
+	}
+	if caddy.updates != 1 || nginx.updates != 2 {
+		t.Fatalf("unexpected number of updates: caddy=%d, nginx=%d", caddy.updates, nginx.updates)
+	}
+	stored, _ = st.Get()
+	if !state.Equal(stored, ips) {
+		t.Fatalf("unexpected state: got %s, want %s", stored, ips)
+	}
+}
+
+// blocks until the context of its update is done
+type blockingUpdater struct{}
+
+func (b *blockingUpdater) Update(ctx context.Context, _ string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+func (b *blockingUpdater) Name() string { return "blocking updater" }
+
+func TestApplyTimeout(t *testing.T) {
+	ips := state.MonitoredIPs{IPv4: "203.0.113.7"}
+
+	st := state.NewInMemory()
+	cu := &countingUpdater{}
+
+	l, err := New(&cfg.ListenConfig{Interval: 1}, st, &blockingUpdater{}, cu)
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+	l.timeout = 50 * time.Millisecond
+
+	// the blocking destination uses up its own timeout, not the one of the next
+	_, err = l.Apply(context.Background(), ips)
+	if err == nil {
+		t.Fatalf("apply should have failed but didn't")
+	}
+	if cu.updates != 1 {
+		t.Fatalf("unexpected number of updates: got %d, want 1", cu.updates)
+	}
+	stored, _ := st.Get()
+	if !stored.UpToDate(cu.Name(), ips) {
+		t.Fatalf("unexpected destination state: %v", stored.Destinations)
+	}
+}
+
+func TestApplyObserve(t *testing.T) {
+	ips := state.MonitoredIPs{IPv4: "203.0.113.7"}
+
+	st := state.NewInMemory()
+	l, err := New(&cfg.ListenConfig{Interval: 1}, st, &countingUpdater{fail: true})
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+	observed := state.NewInMemory()
+	l.Observe(observed)
+
+	// the observer sees the IPs even though the destination update failed
+	_, err = l.Apply(context.Background(), ips)
+	if err == nil {
+		t.Fatalf("apply should have failed but didn't")
+	}
+	got, _ := observed.Get()
+	if !state.Equal(got, ips) {
+		t.Fatalf("unexpected observed IPs: got %s, want %s", got, ips)
+	}
+	stored, _ := st.Get()
+	if state.Equal(stored, ips) {
+		t.Fatalf("state shouldn't have been committed: %s", stored)
+	}
+}
+
+// records the requests it receives
+type recordingDestination struct {
+	countingUpdater
+	requests []*update.Request
+}
+
+func (r *recordingDestination) Apply(ctx context.Context, req *update.Request) (*update.Result, error) {
+	r.requests = append(r.requests, req)
+	res := new(update.Result)
+	res.Add("record", update.Changed, "updated to %s", req.IP())
+	return res, nil
+}
+
+func TestApplyRequest(t *testing.T) {
+	ips := state.MonitoredIPs{IPv4: "203.0.113.7", IPv6: "2001:db8::7"}
+
+	st := state.NewInMemory()
+	err := st.Set(state.MonitoredIPs{IPv4: "203.0.113.1"})
+	if err != nil {
+		t.Fatalf("failed to set state: %s", err)
+	}
+	rd := &recordingDestination{}
+
+	l, err := New(&cfg.ListenConfig{Interval: 1}, st, rd)
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+	_, err = l.Apply(update.WithReason(context.Background(), update.ReasonPush), ips)
+	if err != nil {
+		t.Fatalf("apply failed: %s", err)
+	}
+
+	want := update.Request{
+		IPv4:         ips.IPv4,
+		IPv6:         ips.IPv6,
+		PreviousIPv4: "203.0.113.1",
+		Reason:       update.ReasonPush,
+	}
+	if len(rd.requests) != 1 || *rd.requests[0] != want {
+		t.Fatalf("unexpected requests: got %v, want %v", rd.requests, want)
+	}
+}
+
+func TestApplyDryRun(t *testing.T) {
+	ips := state.MonitoredIPs{IPv4: "203.0.113.7"}
+
+	st := state.NewInMemory()
+	cu := &countingUpdater{}
+	rd := &recordingDestination{countingUpdater: countingUpdater{name: "recording"}}
+
+	l, err := New(&cfg.ListenConfig{Interval: 1, DryRun: true}, st, cu, rd)
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		changed, err := l.Apply(context.Background(), ips)
+		if err != nil || !changed {
+			t.Fatalf("[%d] unexpected dry run result: changed=%v, err=%v", i, changed, err)
+		}
+	}
+
+	// plain updaters aren't called and the state isn't written
+	if cu.updates != 0 {
+		t.Fatalf("updater called %d times during dry run", cu.updates)
+	}
+	if len(rd.requests) != 2 || !rd.requests[0].DryRun {
+		t.Fatalf("unexpected requests: %v", rd.requests)
+	}
+	stored, _ := st.Get()
+	if !state.Equal(stored, state.MonitoredIPs{}) || len(stored.Destinations) != 0 {
+		t.Fatalf("state written during dry run: %s", stored)
+	}
+}
+
+// records the notifications it receives and fails if told so. If block is set, it
+// waits for block to be closed before recording a notification
+type recordingNotifier struct {
+	recordingDestination
+	notes []*update.Notification
+	fail  bool
+	block chan struct{}
+}
+
+func (r *recordingNotifier) Apply(ctx context.Context, req *update.Request) (*update.Result, error) {
+	if r.block != nil {
+		<-r.block
+	}
+	r.notes = append(r.notes, req.Notification)
+	if r.fail {
+		return nil, fmt.Errorf("sending notification failed")
+	}
+	return new(update.Result), nil
+}
+
+func (r *recordingNotifier) Notify(ctx context.Context, n *update.Notification) error {
+	_, err := r.Apply(ctx, &update.Request{Notification: n})
+	return err
+}
+
+func TestApplyNotify(t *testing.T) {
+	ips := state.MonitoredIPs{IPv4: "203.0.113.7"}
+
+	st := state.NewInMemory()
+	err := st.Set(state.MonitoredIPs{IPv4: "203.0.113.1"})
+	if err != nil {
+		t.Fatalf("failed to set state: %s", err)
+	}
+	cu := &countingUpdater{fail: true}
+	rn := &recordingNotifier{fail: true}
+	rn.name = "notifier"
+
+	l, err := New(&cfg.ListenConfig{Interval: 1}, st, cu, rn)
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+	_, err = l.Apply(context.Background(), ips)
+	if err == nil {
+		t.Fatalf("apply should have failed but didn't")
+	}
+	l.notifying.Wait()
+
+	if len(rn.notes) != 1 {
+		t.Fatalf("unexpected notifications: %v", rn.notes)
+	}
+	n := rn.notes[0]
+	if n.IPv4 != ips.IPv4 || n.PreviousIPv4 != "203.0.113.1" || len(n.Results) != 1 || n.Failed() != 1 {
+		t.Fatalf("unexpected notification: %+v", n)
+	}
+
+	// the same failure isn't reported again
+	_, err = l.Apply(context.Background(), ips)
+	if err == nil {
+		t.Fatalf("apply should have failed but didn't")
+	}
+	l.notifying.Wait()
+	if cu.updates != 2 || len(rn.notes) != 1 {
+		t.Fatalf("unexpected notifications after %d updates: %v", cu.updates, rn.notes)
+	}
+
+	// the failed notifier doesn't count as an error and isn't retried
+	cu.fail = false
+	_, err = l.Apply(context.Background(), ips)
+	if err != nil {
+		t.Fatalf("apply failed: %s", err)
+	}
+	l.notifying.Wait()
+	if len(rn.notes) != 2 || rn.notes[1].Failed() != 0 {
+		t.Fatalf("unexpected notifications: %v", rn.notes)
+	}
+
+	// nothing to tell if all destinations are up to date
+	_, err = l.Apply(context.Background(), ips)
+	if err != nil {
+		t.Fatalf("apply failed: %s", err)
+	}
+	l.notifying.Wait()
+	if len(rn.notes) != 2 {
+		t.Fatalf("unexpected notifications: %v", rn.notes)
+	}
+}
+
+func TestWait(t *testing.T) {
+	rn := &recordingNotifier{block: make(chan struct{})}
+	rn.name = "notifier"
+
+	l, err := New(&cfg.ListenConfig{Interval: 1}, state.NewInMemory(), &countingUpdater{}, rn)
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+	_, err = l.Apply(context.Background(), state.MonitoredIPs{IPv4: "203.0.113.7"})
+	if err != nil {
+		t.Fatalf("apply failed: %s", err)
+	}
+
+	// the notifier is still sending
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = l.Wait(ctx)
+	if err == nil {
+		t.Fatalf("wait should have timed out but didn't")
+	}
+	t.Logf("provoked expected error: %s", err)
+
+	close(rn.block)
+	err = l.Wait(context.Background())
+	if err != nil {
+		t.Fatalf("wait failed: %s", err)
+	}
+	if len(rn.notes) != 1 {
+		t.Fatalf("unexpected notifications: %v", rn.notes)
+	}
+}
+
+func TestDuplicateNames(t *testing.T) {
+	_, err := New(&cfg.ListenConfig{Interval: 1}, state.NewInMemory(), &countingUpdater{}, &countingUpdater{})
+	if err == nil {
+		t.Fatalf("listener with duplicate destination names should have been rejected")
+	}
+}
+
+func TestPush(t *testing.T) {
+	st := state.NewInMemory()
+	st.Set(state.MonitoredIPs{IPv4: "203.0.113.7", IPv6: "2001:db8::7"})
+
+	rd := &recordingDestination{}
+	l, err := New(&cfg.ListenConfig{Interval: 1}, st, rd)
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+
+	// pushing one family keeps the other one
+	_, err = l.Push(context.Background(), state.MonitoredIPs{IPv4: "198.51.100.1"})
+	if err != nil {
+		t.Fatalf("push failed: %s", err)
+	}
+	_, err = l.Push(context.Background(), state.MonitoredIPs{IPv6: "2001:db8::1"})
+	if err != nil {
+		t.Fatalf("push failed: %s", err)
+	}
+
+	want := []state.MonitoredIPs{
+		{IPv4: "198.51.100.1", IPv6: "2001:db8::7"},
+		{IPv4: "198.51.100.1", IPv6: "2001:db8::1"},
+	}
+	if len(rd.requests) != len(want) {
+		t.Fatalf("unexpected number of requests: got %d, want %d", len(rd.requests), len(want))
+	}
+	for i, req := range rd.requests {
+		if req.IPv4 != want[i].IPv4 || req.IPv6 != want[i].IPv6 {
+			t.Fatalf("[%d] unexpected request: got v4=%s, v6=%s, want %s", i, req.IPv4, req.IPv6, want[i])
+		}
+	}
+}
+
+// counts the IPs handed to it by the listener
+type countingObserver struct {
+	mu  sync.Mutex
+	ips []state.MonitoredIPs
+}
+
+func (c *countingObserver) Set(ips state.MonitoredIPs) error {
+	c.mu.Lock()
+	c.ips = append(c.ips, ips)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *countingObserver) observed() []state.MonitoredIPs {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]state.MonitoredIPs(nil), c.ips...)
+}
+
+// loopback returns the name of the loopback interface, which always has an IP assigned
+func loopback(t *testing.T) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("failed to list interfaces: %s", err)
+	}
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagLoopback != 0 && ifi.Flags&net.FlagUp != 0 {
+			return ifi.Name
+		}
+	}
+	t.Skip("no loopback interface found")
+	return ""
+}
+
+func TestListener(t *testing.T) {
+	st := state.NewInMemory()
+	cu := &countingUpdater{}
+
+	l, err := New(&cfg.ListenConfig{Iface: loopback(t), Interval: 1}, st, cu)
+	if err != nil {
+		t.Fatalf("failed to create listener: %s", err)
+	}
+	l.interval = 10 * time.Millisecond
+
+	co := &countingObserver{}
+	l.Observe(co)
+
+	// the interface is polled initially and then periodically
+	stop := l.Run()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(co.observed()) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("interface wasn't polled periodically: %d polls", len(co.observed()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop <- struct{}{}
+
+	ips := co.observed()[0]
+	if ips.IPv4 == "" && ips.IPv6 == "" {
+		t.Fatalf("no IP was read from the interface")
+	}
+	stored, _ := st.Get()
+	if !state.Equal(stored, ips) {
+		t.Fatalf("unexpected state: got %s, want %s", stored, ips)
+	}
+
+	// the IPs didn't change after the first poll
+	if cu.updates != 1 {
+		t.Fatalf("unexpected number of updates: got %d, want 1", cu.updates)
 	}
 }
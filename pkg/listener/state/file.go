@@ -3,12 +3,14 @@ package state
 import (
 	"fmt"
 	"os"
+	"sync"
 
 	yaml "gopkg.in/yaml.v3"
 )
 
 // File supplies methods to handle the state via a file
 type File struct {
+	mu   sync.Mutex
 	fd   *os.File
 	path string
 }
@@ -20,6 +22,8 @@ func NewFile(path string) *File {
 
 // Set writes a the state to disk in YAML representation
 func (f *File) Set(ips MonitoredIPs) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if f.open(os.O_WRONLY|os.O_CREATE|os.O_TRUNC) != nil {
 		return fmt.Errorf("unable to open state file")
 	}
@@ -29,6 +33,8 @@ func (f *File) Set(ips MonitoredIPs) error {
 
 // Get reads the state from a YAML file from disk
 func (f *File) Get() (MonitoredIPs, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	stored := MonitoredIPs{}
 	if f.open(os.O_RDONLY) != nil {
 		return stored, fmt.Errorf("unable to open state file")
@@ -44,6 +50,8 @@ func (f *File) Get() (MonitoredIPs, error) {
 
 // Reset deletes the state file
 func (f *File) Reset() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	// close file in case it hasn't been closed
 	f.close()
 	return os.Remove(f.path)
@@ -1,8 +1,11 @@
 package state
 
+import "sync"
+
 // InMemory stores the state in memory. It is hence volatile and only persistent as long
 // as the program is running.
 type InMemory struct {
+	mu     sync.RWMutex
 	stored *MonitoredIPs
 }
 
@@ -15,17 +18,23 @@ func NewInMemory() *InMemory {
 
 // Set sets the state to ips
 func (m *InMemory) Set(ips MonitoredIPs) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.stored = &ips
 	return nil
 }
 
 // Get returns the currently stored state
 func (m *InMemory) Get() (MonitoredIPs, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	return *m.stored, nil
 }
 
 // Reset returns the state to its default value
 func (m *InMemory) Reset() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.stored = &MonitoredIPs{}
 	return nil
 }
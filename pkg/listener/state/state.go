@@ -29,16 +29,30 @@ type Getter interface {
 type MonitoredIPs struct {
 	IPv4 string
 	IPv6 string
+
+	// Destinations stores the IPs each destination was last updated with, keyed by
+	// the destination's name
+	Destinations map[string]DestinationIPs `yaml:"destinations,omitempty"`
 }
 
-// NewMonitoredIPs creates a new container for the changed IP based on the
-// interface reading
-func NewMonitoredIPs(ip net.IP) MonitoredIPs {
+// DestinationIPs stores the IPs a destination was updated with
+type DestinationIPs struct {
+	IPv4 string
+	IPv6 string
+}
+
+// NewMonitoredIPs creates a new container for the changed IPs based on the
+// interface reading. The first address of each family is used
+func NewMonitoredIPs(addrs ...net.IP) MonitoredIPs {
 	var ips = MonitoredIPs{}
-	if ip.To4() != nil {
-		ips.IPv4 = ip.String()
-	} else {
-		ips.IPv6 = ip.String()
+	for _, ip := range addrs {
+		if ip.To4() != nil {
+			if ips.IPv4 == "" {
+				ips.IPv4 = ip.String()
+			}
+		} else if ips.IPv6 == "" {
+			ips.IPv6 = ip.String()
+		}
 	}
 	return ips
 }
@@ -56,7 +70,14 @@ func (m MonitoredIPs) String() string {
 	return fmt.Sprintf("v4=%s, v6=%s", v4, v6)
 }
 
-// Equal checks if IPs a are identical to ips b
+// UpToDate checks if the destination `name` was last updated with ips
+func (m MonitoredIPs) UpToDate(name string, ips MonitoredIPs) bool {
+	d, ok := m.Destinations[name]
+	return ok && d.IPv4 == ips.IPv4 && d.IPv6 == ips.IPv6
+}
+
+// Equal checks if IPs a are identical to ips b. The IPs of the individual
+// destinations aren't compared
 func Equal(a, b MonitoredIPs) bool {
 	return a.IPv4 == b.IPv4 && a.IPv6 == b.IPv6
 }
@@ -2,6 +2,7 @@ package state
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
 	"testing"
@@ -122,3 +123,29 @@ func TestState(t *testing.T) {
 		})
 	}
 }
+
+func TestNewMonitoredIPs(t *testing.T) {
+	var tests = []struct {
+		name     string
+		addrs    []string
+		expected MonitoredIPs
+	}{
+		{"IPv4 only", []string{"192.0.2.1"}, MonitoredIPs{IPv4: "192.0.2.1"}},
+		{"IPv6 only", []string{"2001:db8::1"}, MonitoredIPs{IPv6: "2001:db8::1"}},
+		{"dual stack", []string{"2001:db8::1", "192.0.2.1"}, MonitoredIPs{IPv4: "192.0.2.1", IPv6: "2001:db8::1"}},
+		{"first of each family", []string{"192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2"}, MonitoredIPs{IPv4: "192.0.2.1", IPv6: "2001:db8::1"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var addrs []net.IP
+			for _, a := range test.addrs {
+				addrs = append(addrs, net.ParseIP(a))
+			}
+			got := NewMonitoredIPs(addrs...)
+			if !Equal(got, test.expected) {
+				t.Fatalf("unexpected IPs: got %s, want %s", got, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package mqtt
+
+import (
+	"github.com/els0r/dynip-ng/pkg/update"
+	"github.com/els0r/dynip-ng/pkg/version"
+)
+
+// sensor is the discovery message of a Home Assistant entity
+type sensor struct {
+	topic  string
+	config *discoveryConfig
+}
+
+// discoveryConfig is the payload of a discovery message. See
+// https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery
+type discoveryConfig struct {
+	Name                string  `json:"name"`
+	UniqueID            string  `json:"unique_id"`
+	ObjectID            string  `json:"object_id,omitempty"`
+	StateTopic          string  `json:"state_topic"`
+	ValueTemplate       string  `json:"value_template,omitempty"`
+	JSONAttributesTopic string  `json:"json_attributes_topic,omitempty"`
+	DeviceClass         string  `json:"device_class,omitempty"`
+	PayloadOn           string  `json:"payload_on,omitempty"`
+	PayloadOff          string  `json:"payload_off,omitempty"`
+	Icon                string  `json:"icon,omitempty"`
+	Device              *device `json:"device"`
+}
+
+// device groups the entities of a host
+type device struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+}
+
+// sensors returns the entities for the IPs, the time of the last change and the health
+// of each destination in note
+func (p *Publisher) sensors(note *update.Notification) []sensor {
+	dev := &device{
+		Identifiers:  []string{p.node},
+		Name:         "dynip-ng " + p.hostname,
+		Manufacturer: "dynip-ng",
+		Model:        "Dynamic IP updater",
+		SWVersion:    version.GitSHA,
+	}
+
+	newSensor := func(component, object string, c *discoveryConfig) sensor {
+		c.UniqueID = p.node + "_" + object
+		c.ObjectID = c.UniqueID
+		c.Device = dev
+		return sensor{
+			topic:  p.discovery + "/" + component + "/" + p.node + "/" + object + "/config",
+			config: c,
+		}
+	}
+
+	sensors := []sensor{
+		newSensor("sensor", "ipv4", &discoveryConfig{
+			Name:       "IPv4 address",
+			StateTopic: p.topic + "/ipv4",
+			Icon:       "mdi:ip-network",
+		}),
+		newSensor("sensor", "ipv6", &discoveryConfig{
+			Name:       "IPv6 address",
+			StateTopic: p.topic + "/ipv6",
+			Icon:       "mdi:ip-network",
+		}),
+		newSensor("sensor", "last_change", &discoveryConfig{
+			Name:        "Last IP change",
+			StateTopic:  p.topic + "/last_change",
+			DeviceClass: "timestamp",
+		}),
+	}
+	for _, r := range note.Results {
+		topic := p.destinationTopic(r.Name)
+		sensors = append(sensors, newSensor("binary_sensor", slug(r.Name), &discoveryConfig{
+			Name:                r.Name,
+			StateTopic:          topic,
+			ValueTemplate:       "{{ value_json.status }}",
+			JSONAttributesTopic: topic,
+			DeviceClass:         "problem",
+			PayloadOn:           "failed",
+			PayloadOff:          "ok",
+		}))
+	}
+	return sensors
+}
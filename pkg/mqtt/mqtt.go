@@ -0,0 +1,389 @@
+// Package mqtt provides a destination which publishes the IPs and the health of the
+// other destinations to an MQTT broker, including discovery messages for Home Assistant
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/logging"
+	"github.com/els0r/dynip-ng/pkg/update"
+	log "github.com/els0r/log"
+)
+
+const (
+	defaultTopicPrefix     = "dynip-ng"
+	defaultDiscoveryPrefix = "homeassistant"
+	defaultQoS             = 1
+	defaultConnectTimeout  = 10 * time.Second
+)
+
+// Config stores the parameters for publishing to an MQTT broker
+type Config struct {
+	// Broker is the URL of the broker, e.g. tcp://mqtt.example.org:1883. Use ssl:// for
+	// TLS and ws:// or wss:// for websockets
+	Broker string `yaml:"broker"`
+
+	// ClientID identifies the connection at the broker. Defaults to dynip-ng-<hostname>
+	ClientID string `yaml:"clientID"`
+
+	// Username and Password for authentication
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// CAFile optionally points to a PEM file with the CA certificate(s) used to verify
+	// the broker's certificate
+	CAFile string `yaml:"caFile"`
+
+	// CertFile and KeyFile enable authentication with a client certificate if both are
+	// provided
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+
+	// Topic is the prefix of all state topics. Defaults to dynip-ng/<hostname>
+	Topic string `yaml:"topic"`
+
+	// QoS of the published messages. Defaults to 1
+	QoS *byte `yaml:"qos"`
+
+	// Discovery publishes Home Assistant discovery messages, so that the sensors show up
+	// automatically
+	Discovery bool `yaml:"discovery"`
+
+	// DiscoveryPrefix is the discovery topic prefix configured in Home Assistant.
+	// Defaults to homeassistant
+	DiscoveryPrefix string `yaml:"discoveryPrefix"`
+}
+
+func (c *Config) validate() error {
+	if c.Broker == "" {
+		return fmt.Errorf("no broker provided")
+	}
+	u, err := url.Parse(c.Broker)
+	if err != nil {
+		return fmt.Errorf("invalid broker URL: %w", err)
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts", "ws", "wss":
+	default:
+		return fmt.Errorf("unsupported broker scheme %q", u.Scheme)
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("both certificate and key file must be provided for client authentication")
+	}
+	if c.QoS != nil && *c.QoS > 2 {
+		return fmt.Errorf("QoS must be 0, 1 or 2")
+	}
+	if strings.ContainsAny(c.Topic, "+#") || strings.ContainsAny(c.DiscoveryPrefix, "+#") {
+		return fmt.Errorf("topics must not contain wildcards")
+	}
+	return nil
+}
+
+func init() {
+	update.Register("mqtt", update.Registration{
+		New: func() interface{} { return new(Config) },
+		Validate: func(settings interface{}) error {
+			err := settings.(*Config).validate()
+			if err != nil {
+				return fmt.Errorf("mqtt: %w", err)
+			}
+			return nil
+		},
+		Create: func(dest *cfg.Destination) (update.Updater, error) {
+			return New(dest.Settings.(*Config))
+		},
+	})
+}
+
+// Publisher publishes the IPs, the time they last changed and the outcome of the other
+// destinations as retained messages. It is a notifier, so it runs after all other
+// destinations
+type Publisher struct {
+	update.Instance
+
+	opts      *paho.ClientOptions
+	topic     string
+	qos       byte
+	discovery string
+	node      string
+	hostname  string
+
+	log log.Logger
+}
+
+// New creates a publisher
+func New(c *Config) (*Publisher, error) {
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "localhost"
+	}
+
+	p := &Publisher{
+		topic:    c.Topic,
+		qos:      defaultQoS,
+		hostname: hostname,
+		log:      logging.Get(),
+	}
+	if p.topic == "" {
+		p.topic = defaultTopicPrefix + "/" + slug(hostname)
+	}
+	p.topic = strings.TrimSuffix(p.topic, "/")
+	if c.QoS != nil {
+		p.qos = *c.QoS
+	}
+
+	clientID := c.ClientID
+	if clientID == "" {
+		clientID = "dynip-ng-" + slug(hostname)
+	}
+	p.node = slug(clientID)
+	if c.Discovery {
+		p.discovery = c.DiscoveryPrefix
+		if p.discovery == "" {
+			p.discovery = defaultDiscoveryPrefix
+		}
+		p.discovery = strings.TrimSuffix(p.discovery, "/")
+	}
+
+	p.opts = paho.NewClientOptions().
+		AddBroker(c.Broker).
+		SetClientID(clientID).
+		SetUsername(c.Username).
+		SetPassword(c.Password).
+		SetCleanSession(true).
+		SetAutoReconnect(false).
+		SetConnectRetry(false).
+		SetConnectTimeout(defaultConnectTimeout)
+
+	tlsConfig, err := newTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		p.opts.SetTLSConfig(tlsConfig)
+	}
+	return p, nil
+}
+
+// newTLSConfig returns the TLS settings for a dedicated CA or a client certificate. It
+// returns nil if neither is configured
+func newTLSConfig(c *Config) (*tls.Config, error) {
+	if c.CAFile == "" && c.CertFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := new(tls.Config)
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no CA certificate found in %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Name returns a human-readable identifier for the publisher
+func (p *Publisher) Name() string {
+	return p.Label("mqtt publisher")
+}
+
+// Update publishes IP
+func (p *Publisher) Update(ctx context.Context, IP string) error {
+	req, err := update.NewRequest(IP)
+	if err != nil {
+		return err
+	}
+	_, err = p.Apply(ctx, req)
+	return err
+}
+
+// Notify publishes the update described by n
+func (p *Publisher) Notify(ctx context.Context, n *update.Notification) error {
+	_, err := p.Apply(ctx, &update.Request{
+		IPv4:         n.IPv4,
+		IPv6:         n.IPv6,
+		PreviousIPv4: n.PreviousIPv4,
+		PreviousIPv6: n.PreviousIPv6,
+		Reason:       n.Reason,
+		Notification: n,
+	})
+	return err
+}
+
+// message is a retained message to be published
+type message struct {
+	topic   string
+	payload []byte
+}
+
+// destinationState is published for each destination
+type destinationState struct {
+	Name      string    `json:"name"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Changed   int       `json:"changed"`
+	Unchanged int       `json:"unchanged"`
+	Failed    int       `json:"failed"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Apply publishes the IPs of the request and the results of its notification. Without
+// a notification, only the IPs are published
+func (p *Publisher) Apply(ctx context.Context, req *update.Request) (*update.Result, error) {
+	note := req.Notification
+	if note == nil {
+		note = update.NewNotification(req)
+	}
+	msgs, err := p.messages(note)
+	if err != nil {
+		return nil, err
+	}
+
+	res := new(update.Result)
+	if req.DryRun {
+		for _, msg := range msgs {
+			res.Add(msg.topic, update.Skipped, "dry run. Would publish %s", msg.payload)
+		}
+		return res, nil
+	}
+
+	client := paho.NewClient(p.opts)
+	err = wait(ctx, client.Connect())
+	if err != nil {
+		res.Add(p.opts.Servers[0].Redacted(), update.Failed, "couldn't connect: %s", err)
+		return res, res.Err()
+	}
+	defer client.Disconnect(250)
+
+	for _, msg := range msgs {
+		err = wait(ctx, client.Publish(msg.topic, p.qos, true, msg.payload))
+		if err != nil {
+			res.Add(msg.topic, update.Failed, "%s", err)
+			continue
+		}
+		res.Add(msg.topic, update.Changed, "published %s", msg.payload)
+	}
+	return res, res.Err()
+}
+
+// messages returns the state messages for note, preceded by the discovery messages of
+// the sensors if enabled
+func (p *Publisher) messages(note *update.Notification) ([]message, error) {
+	var msgs []message
+	add := func(topic string, payload interface{}) error {
+		var data []byte
+		switch v := payload.(type) {
+		case string:
+			data = []byte(v)
+		default:
+			var err error
+			data, err = json.Marshal(v)
+			if err != nil {
+				return err
+			}
+		}
+		msgs = append(msgs, message{topic, data})
+		return nil
+	}
+
+	if p.discovery != "" {
+		for _, s := range p.sensors(note) {
+			err := add(s.topic, s.config)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// an empty retained message would delete the last known IP of a family the update
+	// doesn't carry
+	for _, ip := range []struct{ family, ip string }{{"ipv4", note.IPv4}, {"ipv6", note.IPv6}} {
+		if ip.ip == "" {
+			continue
+		}
+		err := add(p.topic+"/"+ip.family, ip.ip)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if note.IPv4 != note.PreviousIPv4 || note.IPv6 != note.PreviousIPv6 {
+		err := add(p.topic+"/last_change", note.Timestamp.UTC().Format(time.RFC3339))
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, r := range note.Results {
+		state := destinationState{
+			Name:      r.Name,
+			Status:    "ok",
+			Timestamp: note.Timestamp.UTC(),
+		}
+		if r.Err != nil {
+			state.Status = "failed"
+			state.Error = r.Err.Error()
+		}
+		if r.Result != nil {
+			state.Changed = r.Result.Count(update.Changed)
+			state.Unchanged = r.Result.Count(update.Unchanged)
+			state.Failed = r.Result.Count(update.Failed)
+		}
+		err := add(p.destinationTopic(r.Name), state)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
+
+func (p *Publisher) destinationTopic(name string) string {
+	return p.topic + "/destinations/" + slug(name)
+}
+
+// wait waits for the token to complete or ctx to be done
+func wait(ctx context.Context, t paho.Token) error {
+	select {
+	case <-t.Done():
+		return t.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// slug turns s into an identifier usable in topics and Home Assistant IDs
+func slug(s string) string {
+	var b strings.Builder
+	underscore := false
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			underscore = false
+			continue
+		}
+		if !underscore && b.Len() > 0 {
+			b.WriteByte('_')
+			underscore = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "_")
+}
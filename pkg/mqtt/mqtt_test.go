@@ -0,0 +1,374 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/update"
+)
+
+// broker is an embedded MQTT broker which stores retained messages
+type broker struct {
+	lis      net.Listener
+	username string
+	password string
+
+	sync.Mutex
+	retained map[string]string
+}
+
+func newBroker(t *testing.T, tlsConfig *tls.Config, username, password string) *broker {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	if tlsConfig != nil {
+		lis = tls.NewListener(lis, tlsConfig)
+	}
+	t.Cleanup(func() { lis.Close() })
+
+	b := &broker{lis: lis, username: username, password: password, retained: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *broker) url(scheme string) string {
+	return scheme + "://" + b.lis.Addr().String()
+}
+
+func (b *broker) get(topic string) (string, bool) {
+	b.Lock()
+	defer b.Unlock()
+	payload, ok := b.retained[topic]
+	return payload, ok
+}
+
+func (b *broker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+
+		var reply packets.ControlPacket
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			if p.Username != b.username || string(p.Password) != b.password {
+				ack.ReturnCode = packets.ErrRefusedNotAuthorised
+			}
+			reply = ack
+		case *packets.PublishPacket:
+			if p.Retain {
+				b.Lock()
+				if len(p.Payload) == 0 {
+					delete(b.retained, p.TopicName)
+				} else {
+					b.retained[p.TopicName] = string(p.Payload)
+				}
+				b.Unlock()
+			}
+			switch p.Qos {
+			case 1:
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				reply = ack
+			case 2:
+				rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				rec.MessageID = p.MessageID
+				reply = rec
+			}
+		case *packets.PubrelPacket:
+			comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			comp.MessageID = p.MessageID
+			reply = comp
+		case *packets.PingreqPacket:
+			reply = packets.NewControlPacket(packets.Pingresp)
+		case *packets.DisconnectPacket:
+			return
+		}
+		if reply != nil {
+			err = reply.Write(conn)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// testCertificate returns a certificate valid for 127.0.0.1 and writes its CA to a file
+func testCertificate(t *testing.T) (tls.Certificate, string) {
+	srv := httptest.NewTLSServer(nil)
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+	if err != nil {
+		t.Fatalf("couldn't write CA file: %s", err)
+	}
+	return srv.TLS.Certificates[0], path
+}
+
+func TestPublish(t *testing.T) {
+	cert, caFile := testCertificate(t)
+	qos2 := byte(2)
+
+	note := &update.Notification{
+		IPv4:         "203.0.113.7",
+		IPv6:         "2001:db8::7",
+		PreviousIPv4: "203.0.113.1",
+		Timestamp:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Results: []update.DestinationResult{
+			{Name: "cloudflare updater (personal)", Err: fmt.Errorf("invalid token")},
+			{Name: "file updater", Result: &update.Result{Targets: []update.TargetResult{
+				{Target: "/etc/caddy/Caddyfile", Outcome: update.Changed},
+			}}},
+		},
+	}
+
+	var tests = []struct {
+		name       string
+		tls        bool
+		password   string
+		qos        *byte
+		discovery  bool
+		dryRun     bool
+		shouldPass bool
+	}{
+		{"plain with discovery", false, "secret", nil, true, false, true},
+		{"TLS with QoS 2", true, "secret", &qos2, false, false, true},
+		{"dry run", false, "secret", nil, true, true, true},
+		{"wrong password", false, "wrong", nil, false, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				tlsConfig *tls.Config
+				scheme    = "tcp"
+				c         = &Config{Username: "dynip", Password: test.password, Topic: "home/gateway", QoS: test.qos, Discovery: test.discovery}
+			)
+			if test.tls {
+				tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+				scheme = "ssl"
+				c.CAFile = caFile
+			}
+			b := newBroker(t, tlsConfig, "dynip", "secret")
+			c.Broker = b.url(scheme)
+
+			err := c.validate()
+			if err != nil {
+				t.Fatalf("invalid config: %s", err)
+			}
+			p, err := New(c)
+			if err != nil {
+				t.Fatalf("couldn't create publisher: %s", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			res, err := p.Apply(ctx, &update.Request{IPv4: note.IPv4, IPv6: note.IPv6, DryRun: test.dryRun, Notification: note})
+			if !test.shouldPass {
+				if err == nil {
+					t.Fatalf("publishing should have failed but didn't")
+				}
+				t.Logf("provoked expected error: %s", err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("publishing failed: %s", err)
+			}
+			t.Log(res)
+
+			if test.dryRun {
+				if res.Count(update.Skipped) != len(res.Targets) {
+					t.Fatalf("unexpected dry run result: %v", res.Targets)
+				}
+				if _, ok := b.get("home/gateway/ipv4"); ok {
+					t.Fatalf("message published during dry run")
+				}
+				return
+			}
+
+			for topic, expected := range map[string]string{
+				"home/gateway/ipv4":        "203.0.113.7",
+				"home/gateway/ipv6":        "2001:db8::7",
+				"home/gateway/last_change": "2024-05-01T12:00:00Z",
+			} {
+				payload, _ := b.get(topic)
+				if payload != expected {
+					t.Fatalf("unexpected payload of %s: got %q, want %q", topic, payload, expected)
+				}
+			}
+
+			for topic, status := range map[string]string{
+				"home/gateway/destinations/cloudflare_updater_personal": "failed",
+				"home/gateway/destinations/file_updater":                "ok",
+			} {
+				payload, _ := b.get(topic)
+				var state destinationState
+				err = json.Unmarshal([]byte(payload), &state)
+				if err != nil {
+					t.Fatalf("invalid payload of %s: %q: %s", topic, payload, err)
+				}
+				if state.Status != status {
+					t.Fatalf("unexpected status of %s: got %q, want %q", topic, state.Status, status)
+				}
+			}
+
+			discovery, ok := b.get("homeassistant/binary_sensor/dynip_ng_" + slug(p.hostname) + "/file_updater/config")
+			if ok != test.discovery {
+				t.Fatalf("unexpected discovery message: %q", discovery)
+			}
+			if !test.discovery {
+				return
+			}
+			var config discoveryConfig
+			err = json.Unmarshal([]byte(discovery), &config)
+			if err != nil {
+				t.Fatalf("invalid discovery message %q: %s", discovery, err)
+			}
+			if config.StateTopic != "home/gateway/destinations/file_updater" || config.DeviceClass != "problem" || config.Device == nil {
+				t.Fatalf("unexpected discovery message: %s", discovery)
+			}
+		})
+	}
+}
+
+func TestMessages(t *testing.T) {
+	p, err := New(&Config{Broker: "tcp://localhost:1883", Topic: "home/gateway"})
+	if err != nil {
+		t.Fatalf("couldn't create publisher: %s", err)
+	}
+
+	var tests = []struct {
+		name     string
+		note     *update.Notification
+		expected []string
+	}{
+		{"both families", &update.Notification{IPv4: "203.0.113.7", IPv6: "2001:db8::7", PreviousIPv4: "203.0.113.7", PreviousIPv6: "2001:db8::7"},
+			[]string{"home/gateway/ipv4=203.0.113.7", "home/gateway/ipv6=2001:db8::7"}},
+		{"no IPv6", &update.Notification{IPv4: "203.0.113.7", PreviousIPv4: "203.0.113.1"},
+			[]string{"home/gateway/ipv4=203.0.113.7", "home/gateway/last_change=0001-01-01T00:00:00Z"}},
+		{"no IPv4", &update.Notification{IPv6: "2001:db8::7", PreviousIPv6: "2001:db8::7"},
+			[]string{"home/gateway/ipv6=2001:db8::7"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msgs, err := p.messages(test.note)
+			if err != nil {
+				t.Fatalf("couldn't create messages: %s", err)
+			}
+			var got []string
+			for _, msg := range msgs {
+				got = append(got, msg.topic+"="+string(msg.payload))
+			}
+			if strings.Join(got, " ") != strings.Join(test.expected, " ") {
+				t.Fatalf("unexpected messages: got %v, want %v", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestConfig(t *testing.T) {
+	var tests = []struct {
+		name       string
+		config     string
+		shouldPass bool
+	}{
+		{"valid", `
+destinations:
+    - type: mqtt
+      name: homeassistant
+      broker: ssl://mqtt.example.org:8883
+      username: dynip
+      password: secret
+      qos: 0
+      discovery: true
+`, true},
+		{"no broker", `
+destinations:
+    - type: mqtt
+      topic: home/gateway
+`, false},
+		{"unsupported scheme", `
+destinations:
+    - type: mqtt
+      broker: http://mqtt.example.org
+`, false},
+		{"invalid QoS", `
+destinations:
+    - type: mqtt
+      broker: tcp://mqtt.example.org:1883
+      qos: 3
+`, false},
+		{"wildcard topic", `
+destinations:
+    - type: mqtt
+      broker: tcp://mqtt.example.org:1883
+      topic: home/#
+`, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := cfg.Parse(strings.NewReader("---\nlisten:\n    iface: eth0\n" + test.config))
+			if !test.shouldPass {
+				if err == nil {
+					t.Fatalf("config should have been rejected but wasn't")
+				}
+				t.Logf("provoked expected error: %s", err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("couldn't parse config: %s", err)
+			}
+
+			updaters, err := update.NewUpdaters(c.Destinations)
+			if err != nil {
+				t.Fatalf("couldn't create publisher: %s", err)
+			}
+			if len(updaters) != 1 || updaters[0].Name() != "mqtt publisher (homeassistant)" {
+				t.Fatalf("unexpected updaters: %v", updaters)
+			}
+			if !update.IsNotifier(update.AsDestination(updaters[0])) {
+				t.Fatalf("publisher isn't a notifier")
+			}
+		})
+	}
+}
+
+func TestSlug(t *testing.T) {
+	for in, expected := range map[string]string{
+		"cloudflare updater (personal)": "cloudflare_updater_personal",
+		"gw-01.example.org":             "gw_01_example_org",
+		"--x--":                         "x",
+	} {
+		if slug(in) != expected {
+			t.Fatalf("unexpected slug of %q: got %q, want %q", in, slug(in), expected)
+		}
+	}
+}
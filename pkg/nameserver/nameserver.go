@@ -0,0 +1,256 @@
+// Package nameserver answers DNS queries for the monitored IPs. It makes the daemon an
+// authoritative name server for a (delegated) zone
+package nameserver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/listener/state"
+	"github.com/els0r/dynip-ng/pkg/logging"
+	log "github.com/els0r/log"
+	"github.com/miekg/dns"
+)
+
+const defaultTTL = 60
+
+// Server is an authoritative DNS server serving A, AAAA, SOA and NS records for a
+// single zone. The A and AAAA records are the IPs last handed to Set, independent of
+// whether the destinations could be updated with them
+type Server struct {
+	listen string
+	zone   string
+	names  map[string]struct{}
+	ns     []string
+	mbox   string
+	ttl    uint32
+
+	// the serial is derived from the time the served IPs changed last
+	mu     sync.Mutex
+	ips    state.MonitoredIPs
+	serial uint32
+
+	udp *dns.Server
+	tcp *dns.Server
+
+	log log.Logger
+}
+
+// New creates a name server. It doesn't serve any A or AAAA records until Set is called
+func New(config *cfg.NameserverConfig) (*Server, error) {
+	if config == nil {
+		return nil, fmt.Errorf("no name server config provided")
+	}
+
+	s := &Server{
+		listen: config.Listen,
+		zone:   dns.CanonicalName(config.Zone),
+		names:  make(map[string]struct{}),
+		ttl:    config.TTL,
+		serial: uint32(time.Now().Unix()),
+		log:    logging.Get(),
+	}
+	if s.ttl == 0 {
+		s.ttl = defaultTTL
+	}
+
+	names := config.Names
+	if len(names) == 0 {
+		names = []string{"@"}
+	}
+	for _, name := range names {
+		s.names[s.qualify(name)] = struct{}{}
+	}
+	for _, ns := range config.NS {
+		s.ns = append(s.ns, dns.CanonicalName(ns))
+	}
+
+	s.mbox = "hostmaster." + s.zone
+	if config.Mbox != "" {
+		s.mbox = dns.CanonicalName(strings.Replace(config.Mbox, "@", ".", 1))
+	}
+	return s, nil
+}
+
+// Set changes the IPs the server answers with. The SOA serial is incremented if they
+// differ from the ones served before. IPs which aren't addresses of their family, e.g.
+// from a corrupted state file, are rejected and the previous IPs are kept
+func (s *Server) Set(ips state.MonitoredIPs) error {
+	if ip := net.ParseIP(ips.IPv4); ips.IPv4 != "" && (ip == nil || ip.To4() == nil) {
+		return fmt.Errorf("invalid IPv4 address %q", ips.IPv4)
+	}
+	if ip := net.ParseIP(ips.IPv6); ips.IPv6 != "" && (ip == nil || ip.To4() != nil) {
+		return fmt.Errorf("invalid IPv6 address %q", ips.IPv6)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if state.Equal(s.ips, ips) {
+		return nil
+	}
+	s.ips = state.MonitoredIPs{IPv4: ips.IPv4, IPv6: ips.IPv6}
+
+	serial := uint32(time.Now().Unix())
+	if serial <= s.serial {
+		serial = s.serial + 1
+	}
+	s.serial = serial
+	return nil
+}
+
+// qualify turns a name relative to the zone into a canonical FQDN
+func (s *Server) qualify(name string) string {
+	if name == "@" {
+		return s.zone
+	}
+	if dns.IsFqdn(name) {
+		return dns.CanonicalName(name)
+	}
+	return dns.CanonicalName(name + "." + s.zone)
+}
+
+// Start binds the server to its UDP and TCP sockets and serves queries in the background
+func (s *Server) Start() error {
+	pc, err := net.ListenPacket("udp", s.listen)
+	if err != nil {
+		return err
+	}
+
+	// bind TCP to the same port in case an ephemeral one was requested
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	s.udp = &dns.Server{PacketConn: pc, Handler: s}
+	s.tcp = &dns.Server{Listener: l, Handler: s}
+
+	for _, srv := range []*dns.Server{s.udp, s.tcp} {
+		go func(srv *dns.Server) {
+			err := srv.ActivateAndServe()
+			if err != nil {
+				s.log.Errorf("name server stopped: %s", err)
+			}
+		}(srv)
+	}
+	s.log.Infof("serving zone %s on %s", s.zone, pc.LocalAddr())
+	return nil
+}
+
+// Addr returns the address the server listens on. It is only set after Start was called
+func (s *Server) Addr() string {
+	if s.udp == nil {
+		return ""
+	}
+	return s.udp.PacketConn.LocalAddr().String()
+}
+
+// Stop shuts down the server
+func (s *Server) Stop() error {
+	var errs []string
+	for _, srv := range []*dns.Server{s.udp, s.tcp} {
+		if srv == nil {
+			continue
+		}
+		err := srv.Shutdown()
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to stop name server: %s", strings.Join(errs, "; "))
+	}
+	s.log.Info("stopped name server")
+	return nil
+}
+
+// ServeDNS answers a single query
+func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+
+	if req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+		m.SetRcode(req, dns.RcodeNotImplemented)
+		w.WriteMsg(m)
+		return
+	}
+
+	q := req.Question[0]
+	name := dns.CanonicalName(q.Name)
+
+	// refuse to answer for anything outside of the zone
+	if !dns.IsSubDomain(s.zone, name) {
+		m.SetRcode(req, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+	m.Authoritative = true
+
+	s.mu.Lock()
+	ips, serial := s.ips, s.serial
+	s.mu.Unlock()
+	soa := s.soa(serial)
+
+	_, served := s.names[name]
+	if !served && name != s.zone {
+		m.SetRcode(req, dns.RcodeNameError)
+		m.Ns = append(m.Ns, soa)
+		w.WriteMsg(m)
+		return
+	}
+
+	var (
+		all = q.Qtype == dns.TypeANY
+		hdr = func(rrtype uint16) dns.RR_Header {
+			return dns.RR_Header{Name: q.Name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: s.ttl}
+		}
+	)
+	if name == s.zone {
+		if q.Qtype == dns.TypeSOA || all {
+			m.Answer = append(m.Answer, soa)
+		}
+		if q.Qtype == dns.TypeNS || all {
+			for _, ns := range s.ns {
+				m.Answer = append(m.Answer, &dns.NS{Hdr: hdr(dns.TypeNS), Ns: ns})
+			}
+		}
+	}
+	if served {
+		if ip := net.ParseIP(ips.IPv4); ip != nil && (q.Qtype == dns.TypeA || all) {
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr(dns.TypeA), A: ip.To4()})
+		}
+		if ip := net.ParseIP(ips.IPv6); ip != nil && (q.Qtype == dns.TypeAAAA || all) {
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: ip})
+		}
+	}
+
+	// the name exists, but there's no data for the requested type
+	if len(m.Answer) == 0 {
+		m.Ns = append(m.Ns, soa)
+	}
+	w.WriteMsg(m)
+}
+
+// soa returns the zone's SOA record with `serial`
+func (s *Server) soa(serial uint32) *dns.SOA {
+	var primary string
+	if len(s.ns) > 0 {
+		primary = s.ns[0]
+	}
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: s.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: s.ttl},
+		Ns:      primary,
+		Mbox:    s.mbox,
+		Serial:  serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  s.ttl,
+	}
+}
@@ -0,0 +1,155 @@
+package nameserver
+
+import (
+	"testing"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/listener/state"
+	"github.com/miekg/dns"
+)
+
+func TestServer(t *testing.T) {
+	s, err := New(&cfg.NameserverConfig{
+		Listen: "127.0.0.1:0",
+		Zone:   "dyn.example.org",
+		Names:  []string{"@", "home"},
+		TTL:    30,
+		NS:     []string{"ns1.example.org"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create name server: %s", err)
+	}
+	err = s.Set(state.MonitoredIPs{IPv4: "203.0.113.7", IPv6: "2001:db8::7"})
+	if err != nil {
+		t.Fatalf("failed to set IPs: %s", err)
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatalf("failed to start name server: %s", err)
+	}
+	defer s.Stop()
+
+	var tests = []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		rcode   int
+		answers int
+		ns      int
+	}{
+		{"apex A", "dyn.example.org.", dns.TypeA, dns.RcodeSuccess, 1, 0},
+		{"name A", "home.dyn.example.org.", dns.TypeA, dns.RcodeSuccess, 1, 0},
+		{"name AAAA", "HOME.dyn.example.org.", dns.TypeAAAA, dns.RcodeSuccess, 1, 0},
+		{"apex SOA", "dyn.example.org.", dns.TypeSOA, dns.RcodeSuccess, 1, 0},
+		{"apex NS", "dyn.example.org.", dns.TypeNS, dns.RcodeSuccess, 1, 0},
+		{"no data", "home.dyn.example.org.", dns.TypeMX, dns.RcodeSuccess, 0, 1},
+		{"unknown name", "other.dyn.example.org.", dns.TypeA, dns.RcodeNameError, 0, 1},
+		{"outside of zone", "example.com.", dns.TypeA, dns.RcodeRefused, 0, 0},
+	}
+
+	for _, proto := range []string{"udp", "tcp"} {
+		c := &dns.Client{Net: proto}
+		for _, test := range tests {
+			t.Run(proto+" "+test.name, func(t *testing.T) {
+				msg := new(dns.Msg)
+				msg.SetQuestion(test.qname, test.qtype)
+
+				reply, _, err := c.Exchange(msg, s.Addr())
+				if err != nil {
+					t.Fatalf("query failed: %s", err)
+				}
+				if reply.Rcode != test.rcode {
+					t.Fatalf("unexpected rcode: got %s, want %s", dns.RcodeToString[reply.Rcode], dns.RcodeToString[test.rcode])
+				}
+				if len(reply.Answer) != test.answers {
+					t.Fatalf("unexpected number of answers: got %d, want %d", len(reply.Answer), test.answers)
+				}
+				if len(reply.Ns) != test.ns {
+					t.Fatalf("unexpected number of authority records: got %d, want %d", len(reply.Ns), test.ns)
+				}
+				for _, rr := range reply.Answer {
+					if rr.Header().Ttl != 30 {
+						t.Fatalf("unexpected TTL %d", rr.Header().Ttl)
+					}
+				}
+			})
+		}
+	}
+
+	// the served IP and the serial follow the IPs that were set
+	soa := func() uint32 {
+		msg := new(dns.Msg)
+		msg.SetQuestion("dyn.example.org.", dns.TypeSOA)
+		reply, err := dns.Exchange(msg, s.Addr())
+		if err != nil {
+			t.Fatalf("query failed: %s", err)
+		}
+		return reply.Answer[0].(*dns.SOA).Serial
+	}
+	before := soa()
+	err = s.Set(state.MonitoredIPs{IPv4: "198.51.100.1"})
+	if err != nil {
+		t.Fatalf("failed to set IPs: %s", err)
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("home.dyn.example.org.", dns.TypeA)
+	reply, err := dns.Exchange(msg, s.Addr())
+	if err != nil {
+		t.Fatalf("query failed: %s", err)
+	}
+	if len(reply.Answer) != 1 || reply.Answer[0].(*dns.A).A.String() != "198.51.100.1" {
+		t.Fatalf("name server didn't serve the new IP: %v", reply.Answer)
+	}
+	if after := soa(); after <= before {
+		t.Fatalf("serial should have increased: before %d, after %d", before, after)
+	}
+}
+
+func TestSet(t *testing.T) {
+	valid := state.MonitoredIPs{IPv4: "203.0.113.7", IPv6: "2001:db8::7"}
+
+	var tests = []struct {
+		name       string
+		ips        state.MonitoredIPs
+		shouldPass bool
+	}{
+		{"both families", valid, true},
+		{"IPv4 only", state.MonitoredIPs{IPv4: "203.0.113.8"}, true},
+		{"invalid IPv4", state.MonitoredIPs{IPv4: "203.0.113"}, false},
+		{"IPv6 as IPv4", state.MonitoredIPs{IPv4: "2001:db8::8"}, false},
+		{"IPv4 as IPv6", state.MonitoredIPs{IPv6: "203.0.113.8"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := New(&cfg.NameserverConfig{Listen: "127.0.0.1:0", Zone: "dyn.example.org"})
+			if err != nil {
+				t.Fatalf("failed to create name server: %s", err)
+			}
+			err = s.Set(valid)
+			if err != nil {
+				t.Fatalf("failed to set IPs: %s", err)
+			}
+
+			err = s.Set(test.ips)
+			expected := test.ips
+			if test.shouldPass {
+				if err != nil {
+					t.Fatalf("failed to set IPs: %s", err)
+				}
+			} else {
+				if err == nil {
+					t.Fatalf("IPs should have been rejected but weren't")
+				}
+				t.Logf("provoked expected error: %s", err)
+				expected = valid
+			}
+
+			// rejected IPs leave the served ones as they were
+			if !state.Equal(s.ips, expected) {
+				t.Fatalf("unexpected IPs: got %s, want %s", s.ips, expected)
+			}
+		})
+	}
+}
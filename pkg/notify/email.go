@@ -0,0 +1,181 @@
+package notify
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Security modes of the connection to the SMTP server
+const (
+	SecurityStartTLS = "starttls"
+	SecurityTLS      = "tls"
+	SecurityNone     = "none"
+)
+
+const defaultSMTPPort = 587
+
+// EmailConfig stores the parameters for sending mails via SMTP
+type EmailConfig struct {
+	Config `yaml:",inline"`
+
+	// Host is the SMTP server
+	Host string `yaml:"host"`
+
+	// Port of the SMTP server. Defaults to 587
+	Port int `yaml:"port"`
+
+	// Security is one of "starttls" (default), "tls" or "none"
+	Security string `yaml:"security"`
+
+	// Username and Password for authentication. No authentication is done if empty
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// From is the sender address
+	From string `yaml:"from"`
+
+	// To are the recipient addresses
+	To []string `yaml:"to"`
+}
+
+func (c *EmailConfig) validate() error {
+	if c.Host == "" {
+		return fmt.Errorf("no host provided")
+	}
+	switch c.Security {
+	case "", SecurityStartTLS, SecurityTLS, SecurityNone:
+	default:
+		return fmt.Errorf("unsupported security %q", c.Security)
+	}
+	if c.From == "" {
+		return fmt.Errorf("no sender provided")
+	}
+	if len(c.To) == 0 {
+		return fmt.Errorf("no recipients provided")
+	}
+	return nil
+}
+
+type email struct {
+	*EmailConfig
+
+	// tlsConfig is used for TLS and STARTTLS connections
+	tlsConfig *tls.Config
+}
+
+func newEmail(s settings) (sender, error) {
+	c := s.(*EmailConfig)
+	if c.Port == 0 {
+		c.Port = defaultSMTPPort
+	}
+	if c.Security == "" {
+		c.Security = SecurityStartTLS
+	}
+	return &email{EmailConfig: c, tlsConfig: &tls.Config{ServerName: c.Host}}, nil
+}
+
+func (e *email) send(ctx context.Context, title, message string) error {
+	addr := net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if e.Security == SecurityTLS {
+		conn, err = (&tls.Dialer{Config: e.tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = new(net.Dialer).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// abort the conversation if the context is done
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	c, err := smtp.NewClient(conn, e.Host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if e.Security == SecurityStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s doesn't support STARTTLS", addr)
+		}
+		err = c.StartTLS(e.tlsConfig)
+		if err != nil {
+			return fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	}
+	if e.Username != "" {
+		// smtp.PlainAuth refuses to send credentials over unencrypted connections to
+		// remote hosts, which protects setups with security "none"
+		err = c.Auth(smtp.PlainAuth("", e.Username, e.Password, e.Host))
+		if err != nil {
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+
+	err = c.Mail(e.From)
+	if err != nil {
+		return err
+	}
+	for _, to := range e.To {
+		err = c.Rcpt(to)
+		if err != nil {
+			return fmt.Errorf("recipient %s: %w", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(e.mail(title, message))
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// subject turns title into a single line and encodes it if it isn't plain ASCII, so that
+// neither line breaks nor other characters of a template or host name end up in the headers
+func subject(title string) string {
+	title = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(title)
+	return mime.QEncoding.Encode("utf-8", title)
+}
+
+// mail returns the message including its headers
+func (e *email) mail(title, message string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", e.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject(title))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	for _, line := range strings.Split(message, "\n") {
+		b.WriteString(strings.TrimSuffix(line, "\r"))
+		b.WriteString("\r\n")
+	}
+	return []byte(b.String())
+}
@@ -0,0 +1,183 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeSMTP is a minimal SMTP server accepting a single mail on a plain connection
+type fakeSMTP struct {
+	lis       net.Listener
+	auth      string
+	from      string
+	to        []string
+	data      string
+	extension string
+}
+
+func newFakeSMTP(t *testing.T, extension string) *fakeSMTP {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	t.Cleanup(func() { lis.Close() })
+
+	f := &fakeSMTP{lis: lis, extension: extension}
+	go f.serve()
+	return f
+}
+
+func (f *fakeSMTP) port() int {
+	return f.lis.Addr().(*net.TCPAddr).Port
+}
+
+func (f *fakeSMTP) serve() {
+	conn, err := f.lis.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch cmd {
+		case "EHLO":
+			reply("250-localhost")
+			reply("250 " + f.extension)
+		case "AUTH":
+			f.auth = line
+			reply("235 2.7.0 Authentication successful")
+		case "MAIL":
+			f.from = line
+			reply("250 OK")
+		case "RCPT":
+			f.to = append(f.to, line)
+			reply("250 OK")
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			f.data = data.String()
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func TestEmail(t *testing.T) {
+	var tests = []struct {
+		name       string
+		security   string
+		username   string
+		extension  string
+		shouldPass bool
+	}{
+		{"plain with authentication", SecurityNone, "dynip", "AUTH PLAIN", true},
+		{"plain without authentication", SecurityNone, "", "SIZE 10240000", true},
+		{"STARTTLS not supported", SecurityStartTLS, "dynip", "AUTH PLAIN", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := newFakeSMTP(t, test.extension)
+
+			s, err := newEmail(&EmailConfig{
+				Host:     "127.0.0.1",
+				Port:     srv.port(),
+				Security: test.security,
+				Username: test.username,
+				Password: "secret",
+				From:     "dynip@example.com",
+				To:       []string{"ops@example.com", "admin@example.com"},
+			})
+			if err != nil {
+				t.Fatalf("couldn't create email sender: %s", err)
+			}
+
+			err = s.send(context.Background(), "IP of gateway changed", "IPv4: 203.0.113.7\nIPv6: 2001:db8::7")
+			if !test.shouldPass {
+				if err == nil {
+					t.Fatalf("sending should have failed but didn't")
+				}
+				t.Logf("provoked expected error: %s", err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("sending failed: %s", err)
+			}
+
+			if test.username != "" {
+				creds := base64.StdEncoding.EncodeToString([]byte("\x00dynip\x00secret"))
+				if srv.auth != "AUTH PLAIN "+creds {
+					t.Fatalf("unexpected authentication: %q", srv.auth)
+				}
+			} else if srv.auth != "" {
+				t.Fatalf("unexpected authentication: %q", srv.auth)
+			}
+			if srv.from != "MAIL FROM:<dynip@example.com>" || len(srv.to) != 2 {
+				t.Fatalf("unexpected envelope: %q %q", srv.from, srv.to)
+			}
+			for _, expected := range []string{
+				"From: dynip@example.com\r\n",
+				"To: ops@example.com, admin@example.com\r\n",
+				"Subject: IP of gateway changed\r\n",
+				"\r\n\r\nIPv4: 203.0.113.7\r\nIPv6: 2001:db8::7\r\n",
+			} {
+				if !strings.Contains(srv.data, expected) {
+					t.Fatalf("mail doesn't contain %q:\n%s", expected, srv.data)
+				}
+			}
+		})
+	}
+}
+
+func TestSubject(t *testing.T) {
+	var tests = []struct {
+		name     string
+		title    string
+		expected string
+	}{
+		{"plain", "IP of gateway changed", "IP of gateway changed"},
+		{"line breaks", "IP of gw\r\nBcc: x@example.com\rX-Injected: 1\n", "IP of gw Bcc: x@example.com X-Injected: 1 "},
+		{"non-ASCII", "IP von Büro geändert", "=?utf-8?q?IP_von_B=C3=BCro_ge=C3=A4ndert?="},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := subject(test.title)
+			if got != test.expected {
+				t.Fatalf("unexpected subject: got %q, want %q", got, test.expected)
+			}
+			if strings.ContainsAny(got, "\r\n") {
+				t.Fatalf("subject contains a line break: %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// GotifyConfig stores the parameters for pushing messages to a Gotify server
+type GotifyConfig struct {
+	Config `yaml:",inline"`
+
+	// Server is the base URL of the Gotify server
+	Server string `yaml:"server"`
+
+	// Token of the application the message is sent as
+	Token string `yaml:"token"`
+
+	// Priority of the message
+	Priority int `yaml:"priority"`
+}
+
+func (c *GotifyConfig) validate() error {
+	if c.Server == "" {
+		return fmt.Errorf("no server provided")
+	}
+	if c.Token == "" {
+		return fmt.Errorf("no application token provided")
+	}
+	return nil
+}
+
+type gotify struct {
+	*GotifyConfig
+}
+
+func newGotify(s settings) (sender, error) {
+	return &gotify{s.(*GotifyConfig)}, nil
+}
+
+func (g *gotify) send(ctx context.Context, title, message string) error {
+	header := make(http.Header)
+	header.Set("X-Gotify-Key", g.Token)
+
+	return do(ctx, http.MethodPost, strings.TrimSuffix(g.Server, "/")+"/message", map[string]interface{}{
+		"title":    title,
+		"message":  message,
+		"priority": g.Priority,
+	}, header)
+}
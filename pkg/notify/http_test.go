@@ -0,0 +1,126 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// request stores what the test server received
+type request struct {
+	method string
+	path   string
+	header http.Header
+	body   string
+}
+
+func TestHTTPTransports(t *testing.T) {
+	var tests = []struct {
+		name       string
+		sender     func(url string) sender
+		method     string
+		path       string
+		header     map[string]string
+		body       map[string]interface{}
+		text       string
+		status     int
+		shouldPass bool
+	}{
+		{"ntfy",
+			func(url string) sender {
+				s, _ := newNtfy(&NtfyConfig{Server: url, Topic: "dynip", Token: "secret", Priority: 4, Tags: []string{"globe_with_meridians", "dynip"}})
+				return s
+			},
+			http.MethodPost, "/dynip",
+			map[string]string{"Title": "title", "Priority": "4", "Tags": "globe_with_meridians,dynip", "Authorization": "Bearer secret"},
+			nil, "message", http.StatusOK, true},
+		{"gotify",
+			func(url string) sender {
+				s, _ := newGotify(&GotifyConfig{Server: url + "/", Token: "secret", Priority: 5})
+				return s
+			},
+			http.MethodPost, "/message",
+			map[string]string{"X-Gotify-Key": "secret", "Content-Type": "application/json"},
+			map[string]interface{}{"title": "title", "message": "message", "priority": float64(5)}, "", http.StatusOK, true},
+		{"matrix",
+			func(url string) sender {
+				s, _ := newMatrix(&MatrixConfig{Homeserver: url, AccessToken: "secret", Room: "!abcdef:example.com"})
+				return s
+			},
+			http.MethodPut, "/_matrix/client/v3/rooms/%21abcdef:example.com/send/m.room.message/",
+			map[string]string{"Authorization": "Bearer secret"},
+			map[string]interface{}{"msgtype": "m.text", "body": "title\n\nmessage"}, "", http.StatusOK, true},
+		{"webhook",
+			func(url string) sender {
+				s, _ := newWebhook(&WebhookConfig{URL: url + "/services/T0/B0/X"})
+				return s
+			},
+			http.MethodPost, "/services/T0/B0/X",
+			nil,
+			map[string]interface{}{"text": "*title*\nmessage"}, "", http.StatusOK, true},
+		{"error status",
+			func(url string) sender {
+				s, _ := newWebhook(&WebhookConfig{URL: url + "/services/T0/B0/X?token=secret"})
+				return s
+			},
+			http.MethodPost, "/services/T0/B0/X",
+			nil, nil, "", http.StatusForbidden, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []request
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				got = append(got, request{r.Method, r.URL.EscapedPath(), r.Header, string(body)})
+				w.WriteHeader(test.status)
+				io.WriteString(w, "invalid_token")
+			}))
+			defer srv.Close()
+
+			err := test.sender(srv.URL).send(context.Background(), "title", "message")
+			if !test.shouldPass {
+				if err == nil {
+					t.Fatalf("sending should have failed but didn't")
+				}
+				t.Logf("provoked expected error: %s", err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("sending failed: %s", err)
+			}
+
+			if len(got) != 1 {
+				t.Fatalf("unexpected number of requests: %d", len(got))
+			}
+			req := got[0]
+			if req.method != test.method || req.path[:len(test.path)] != test.path {
+				t.Fatalf("unexpected request: %s %s", req.method, req.path)
+			}
+			for key, value := range test.header {
+				if req.header.Get(key) != value {
+					t.Fatalf("unexpected header %s: got %q, want %q", key, req.header.Get(key), value)
+				}
+			}
+			if test.body == nil {
+				if req.body != test.text {
+					t.Fatalf("unexpected body: got %q, want %q", req.body, test.text)
+				}
+				return
+			}
+			var body map[string]interface{}
+			err = json.Unmarshal([]byte(req.body), &body)
+			if err != nil {
+				t.Fatalf("invalid body %q: %s", req.body, err)
+			}
+			for key, value := range test.body {
+				if body[key] != value {
+					t.Fatalf("unexpected %s: got %v, want %v", key, body[key], value)
+				}
+			}
+		})
+	}
+}
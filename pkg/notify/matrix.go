@@ -0,0 +1,62 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// MatrixConfig stores the parameters for sending messages to a Matrix room via the
+// client-server API
+type MatrixConfig struct {
+	Config `yaml:",inline"`
+
+	// Homeserver is the base URL of the homeserver, e.g. https://matrix.org
+	Homeserver string `yaml:"homeserver"`
+
+	// AccessToken of the user sending the message
+	AccessToken string `yaml:"accessToken"`
+
+	// Room is the ID of the room, e.g. !abcdef:matrix.org. The user must have
+	// joined it
+	Room string `yaml:"room"`
+}
+
+func (c *MatrixConfig) validate() error {
+	if c.Homeserver == "" {
+		return fmt.Errorf("no homeserver provided")
+	}
+	if c.AccessToken == "" {
+		return fmt.Errorf("no access token provided")
+	}
+	if c.Room == "" {
+		return fmt.Errorf("no room provided")
+	}
+	return nil
+}
+
+type matrix struct {
+	*MatrixConfig
+}
+
+func newMatrix(s settings) (sender, error) {
+	return &matrix{s.(*MatrixConfig)}, nil
+}
+
+func (m *matrix) send(ctx context.Context, title, message string) error {
+	header := make(http.Header)
+	header.Set("Authorization", "Bearer "+m.AccessToken)
+
+	// the transaction ID makes retries of the same request idempotent
+	txn := fmt.Sprintf("dynip-ng-%d", time.Now().UnixNano())
+	endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+		strings.TrimSuffix(m.Homeserver, "/"), url.PathEscape(m.Room), txn)
+
+	return do(ctx, http.MethodPut, endpoint, map[string]string{
+		"msgtype": "m.text",
+		"body":    title + "\n\n" + message,
+	}, header)
+}
@@ -0,0 +1,220 @@
+// Package notify provides destinations which send a message about each update, e.g. by
+// email or to a chat. They register with package update and are configured like any
+// other destination
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/logging"
+	"github.com/els0r/dynip-ng/pkg/update"
+	log "github.com/els0r/log"
+)
+
+const (
+	defaultTitle = `{{ if .Failed }}{{ .Failed }} destination(s) of {{ .Hostname }} failed{{ else }}IP of {{ .Hostname }} changed{{ end }}`
+
+	defaultMessage = `IP of {{ .Hostname }} changed ({{ .Reason }})
+{{- if .IPv4 }}
+IPv4: {{ with .PreviousIPv4 }}{{ . }} -> {{ end }}{{ .IPv4 }}{{ end }}
+{{- if .IPv6 }}
+IPv6: {{ with .PreviousIPv6 }}{{ . }} -> {{ end }}{{ .IPv6 }}{{ end }}
+{{ range .Results }}
+{{ .Name }}: {{ if .Err }}failed: {{ .Err }}{{ else }}{{ .Result }}{{ end }}{{ end }}
+`
+)
+
+// Config holds the settings shared by all notifiers. It is part of the settings of each
+// notifier
+type Config struct {
+	// Title is the template of the subject of the message
+	Title string `yaml:"title"`
+
+	// Template is the template of the message. The templates receive an
+	// update.Notification
+	Template string `yaml:"template"`
+
+	// OnlyFailures sends messages only if a destination failed to update
+	OnlyFailures bool `yaml:"onlyFailures"`
+}
+
+func (c *Config) templates() (title, message *template.Template, err error) {
+	text := c.Title
+	if text == "" {
+		text = defaultTitle
+	}
+	title, err = template.New("title").Parse(text)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid title: %w", err)
+	}
+
+	text = c.Template
+	if text == "" {
+		text = defaultMessage
+	}
+	message, err = template.New("message").Parse(text)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid template: %w", err)
+	}
+	return title, message, nil
+}
+
+// settings are implemented by the configuration of each notifier
+type settings interface {
+	common() *Config
+	validate() error
+}
+
+func (c *Config) common() *Config {
+	return c
+}
+
+// sender delivers a message
+type sender interface {
+	send(ctx context.Context, title, message string) error
+}
+
+// register adds a notifier type to the destinations. newSender creates the transport
+// from the settings
+func register(typ string, newSettings func() settings, newSender func(s settings) (sender, error)) {
+	update.Register(typ, update.Registration{
+		New: func() interface{} { return newSettings() },
+		Validate: func(s interface{}) error {
+			err := s.(settings).validate()
+			if err != nil {
+				return fmt.Errorf("%s: %w", typ, err)
+			}
+			_, _, err = s.(settings).common().templates()
+			if err != nil {
+				return fmt.Errorf("%s: %w", typ, err)
+			}
+			return nil
+		},
+		Create: func(dest *cfg.Destination) (update.Updater, error) {
+			s := dest.Settings.(settings)
+			snd, err := newSender(s)
+			if err != nil {
+				return nil, err
+			}
+			return newNotifier(typ, s.common(), snd)
+		},
+	})
+}
+
+func init() {
+	register("email", func() settings { return new(EmailConfig) }, newEmail)
+	register("ntfy", func() settings { return new(NtfyConfig) }, newNtfy)
+	register("gotify", func() settings { return new(GotifyConfig) }, newGotify)
+	register("matrix", func() settings { return new(MatrixConfig) }, newMatrix)
+	register("webhook", func() settings { return new(WebhookConfig) }, newWebhook)
+}
+
+// Notifier sends a message rendered from the notification of an update
+type Notifier struct {
+	update.Instance
+
+	kind         string
+	title        *template.Template
+	message      *template.Template
+	onlyFailures bool
+	sender       sender
+
+	log log.Logger
+}
+
+func newNotifier(typ string, c *Config, snd sender) (*Notifier, error) {
+	title, message, err := c.templates()
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Notifier{
+		kind:         typ + " notifier",
+		title:        title,
+		message:      message,
+		onlyFailures: c.OnlyFailures,
+		sender:       snd,
+		log:          logging.Get(),
+	}
+	return n, nil
+}
+
+// Name returns a human-readable identifier for the notifier
+func (n *Notifier) Name() string {
+	return n.Label(n.kind)
+}
+
+// Update sends a message about IP
+func (n *Notifier) Update(ctx context.Context, IP string) error {
+	req, err := update.NewRequest(IP)
+	if err != nil {
+		return err
+	}
+	_, err = n.Apply(ctx, req)
+	return err
+}
+
+// Notify sends a message about the update described by note
+func (n *Notifier) Notify(ctx context.Context, note *update.Notification) error {
+	_, err := n.Apply(ctx, &update.Request{
+		IPv4:         note.IPv4,
+		IPv6:         note.IPv6,
+		PreviousIPv4: note.PreviousIPv4,
+		PreviousIPv6: note.PreviousIPv6,
+		Reason:       note.Reason,
+		Notification: note,
+	})
+	return err
+}
+
+// Apply sends a message about the notification of the request. Without one, the message
+// only covers the IPs of the request
+func (n *Notifier) Apply(ctx context.Context, req *update.Request) (*update.Result, error) {
+	res := new(update.Result)
+
+	note := req.Notification
+	if note == nil {
+		note = update.NewNotification(req)
+	}
+	if n.onlyFailures && note.Failed() == 0 {
+		res.Add("message", update.Skipped, "no destination failed")
+		return res, nil
+	}
+
+	title, err := render(n.title, note)
+	if err != nil {
+		res.Add("message", update.Failed, "%s", err)
+		return res, res.Err()
+	}
+	message, err := render(n.message, note)
+	if err != nil {
+		res.Add("message", update.Failed, "%s", err)
+		return res, res.Err()
+	}
+	if req.DryRun {
+		res.Add("message", update.Skipped, "dry run. Would send %q", title)
+		return res, nil
+	}
+
+	err = n.sender.send(ctx, title, message)
+	if err != nil {
+		res.Add("message", update.Failed, "%s", err)
+		return res, res.Err()
+	}
+	res.Add("message", update.Changed, "sent %q", title)
+	return res, nil
+}
+
+func render(t *template.Template, note *update.Notification) (string, error) {
+	var buf bytes.Buffer
+	err := t.Execute(&buf, note)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
@@ -0,0 +1,218 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/update"
+)
+
+func TestConfig(t *testing.T) {
+	var tests = []struct {
+		name       string
+		config     string
+		notifiers  []string
+		shouldPass bool
+	}{
+		{
+			"all notifiers",
+			`
+destinations:
+    - type: email
+      host: smtp.example.com
+      from: dynip@example.com
+      to: [ops@example.com]
+    - type: ntfy
+      name: phone
+      topic: dynip
+    - type: gotify
+      server: https://gotify.example.com
+      token: secret
+    - type: matrix
+      homeserver: https://matrix.example.com
+      accessToken: secret
+      room: "!abcdef:example.com"
+    - type: webhook
+      url: https://hooks.slack.com/services/T0/B0/X
+      onlyFailures: true
+`,
+			[]string{"email notifier", "ntfy notifier (phone)", "gotify notifier", "matrix notifier", "webhook notifier"},
+			true,
+		},
+		{
+			"email without recipients",
+			`
+destinations:
+    - type: email
+      host: smtp.example.com
+      from: dynip@example.com
+`,
+			nil,
+			false,
+		},
+		{
+			"unsupported security",
+			`
+destinations:
+    - type: email
+      host: smtp.example.com
+      security: ssl
+      from: dynip@example.com
+      to: [ops@example.com]
+`,
+			nil,
+			false,
+		},
+		{
+			"ntfy without topic",
+			`
+destinations:
+    - type: ntfy
+      server: https://ntfy.example.com
+`,
+			nil,
+			false,
+		},
+		{
+			"invalid template",
+			`
+destinations:
+    - type: webhook
+      url: https://hooks.slack.com/services/T0/B0/X
+      template: "{{ .IPv4 "
+`,
+			nil,
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := cfg.Parse(strings.NewReader("---\nlisten:\n    iface: eth0\n" + test.config))
+			if !test.shouldPass {
+				if err == nil {
+					t.Fatalf("config should have been rejected but wasn't")
+				}
+				t.Logf("provoked expected error: %s", err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("couldn't parse config: %s", err)
+			}
+
+			updaters, err := update.NewUpdaters(c.Destinations)
+			if err != nil {
+				t.Fatalf("couldn't create notifiers: %s", err)
+			}
+			var names []string
+			for _, u := range updaters {
+				names = append(names, u.Name())
+				if !update.IsNotifier(update.AsDestination(u)) {
+					t.Fatalf("%s isn't a notifier", u.Name())
+				}
+			}
+			if fmt.Sprint(names) != fmt.Sprint(test.notifiers) {
+				t.Fatalf("unexpected notifiers: got %v, want %v", names, test.notifiers)
+			}
+		})
+	}
+}
+
+// recordingSender stores the messages it sends
+type recordingSender struct {
+	titles   []string
+	messages []string
+	fail     bool
+}
+
+func (r *recordingSender) send(_ context.Context, title, message string) error {
+	if r.fail {
+		return fmt.Errorf("connection refused")
+	}
+	r.titles = append(r.titles, title)
+	r.messages = append(r.messages, message)
+	return nil
+}
+
+func TestNotifier(t *testing.T) {
+	failed := &update.Notification{
+		IPv4:         "203.0.113.7",
+		PreviousIPv4: "203.0.113.1",
+		Reason:       update.ReasonInterface,
+		Hostname:     "gateway",
+		Results: []update.DestinationResult{
+			{Name: "cloudflare updater", Err: fmt.Errorf("invalid token")},
+		},
+	}
+	succeeded := &update.Notification{
+		IPv4:     "203.0.113.7",
+		IPv6:     "2001:db8::7",
+		Reason:   update.ReasonPush,
+		Hostname: "gateway",
+		Results: []update.DestinationResult{
+			{Name: "file updater", Result: &update.Result{Targets: []update.TargetResult{
+				{Target: "/etc/caddy/Caddyfile", Outcome: update.Changed},
+			}}},
+		},
+	}
+
+	var tests = []struct {
+		name    string
+		config  Config
+		note    *update.Notification
+		dryRun  bool
+		fail    bool
+		outcome update.Outcome
+		title   string
+		message string
+	}{
+		{"default templates", Config{}, failed, false, false, update.Changed,
+			"1 destination(s) of gateway failed",
+			"IP of gateway changed (interface)\nIPv4: 203.0.113.1 -> 203.0.113.7\n\ncloudflare updater: failed: invalid token"},
+		{"dual-stack", Config{}, succeeded, false, false, update.Changed,
+			"IP of gateway changed",
+			"IP of gateway changed (push)\nIPv4: 203.0.113.7\nIPv6: 2001:db8::7\n\nfile updater: changed=1, unchanged=0, failed=0, removed=0, skipped=0"},
+		{"custom templates", Config{Title: "{{ .Hostname }}", Template: "{{ .IPv4 }}"}, succeeded, false, false, update.Changed,
+			"gateway", "203.0.113.7"},
+		{"only failures", Config{OnlyFailures: true}, succeeded, false, false, update.Skipped, "", ""},
+		{"dry run", Config{}, failed, true, false, update.Skipped, "", ""},
+		{"send fails", Config{}, failed, false, true, update.Failed, "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			snd := &recordingSender{fail: test.fail}
+			n, err := newNotifier("test", &test.config, snd)
+			if err != nil {
+				t.Fatalf("couldn't create notifier: %s", err)
+			}
+
+			res, err := n.Apply(context.Background(), &update.Request{
+				IPv4:         test.note.IPv4,
+				IPv6:         test.note.IPv6,
+				DryRun:       test.dryRun,
+				Notification: test.note,
+			})
+			if (test.outcome == update.Failed) != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(res.Targets) != 1 || res.Targets[0].Outcome != test.outcome {
+				t.Fatalf("unexpected result: %v", res)
+			}
+			t.Log(res)
+
+			if test.outcome != update.Changed {
+				if len(snd.titles) != 0 {
+					t.Fatalf("unexpected message: %q", snd.titles)
+				}
+				return
+			}
+			if len(snd.titles) != 1 || snd.titles[0] != test.title || snd.messages[0] != test.message {
+				t.Fatalf("unexpected message: %q: %q\nwant: %q: %q", snd.titles, snd.messages, test.title, test.message)
+			}
+		})
+	}
+}
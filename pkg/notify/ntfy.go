@@ -0,0 +1,68 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const defaultNtfyServer = "https://ntfy.sh"
+
+// NtfyConfig stores the parameters for publishing to an ntfy topic
+type NtfyConfig struct {
+	Config `yaml:",inline"`
+
+	// Server is the base URL of the ntfy server. Defaults to https://ntfy.sh
+	Server string `yaml:"server"`
+
+	// Topic the message is published to
+	Topic string `yaml:"topic"`
+
+	// Token is an optional access token
+	Token string `yaml:"token"`
+
+	// Priority of the message, from 1 (min) to 5 (max)
+	Priority int `yaml:"priority"`
+
+	// Tags of the message, e.g. emojis
+	Tags []string `yaml:"tags"`
+}
+
+func (c *NtfyConfig) validate() error {
+	if c.Topic == "" {
+		return fmt.Errorf("no topic provided")
+	}
+	if c.Priority < 0 || c.Priority > 5 {
+		return fmt.Errorf("priority must be between 1 and 5")
+	}
+	return nil
+}
+
+type ntfy struct {
+	*NtfyConfig
+}
+
+func newNtfy(s settings) (sender, error) {
+	c := s.(*NtfyConfig)
+	if c.Server == "" {
+		c.Server = defaultNtfyServer
+	}
+	return &ntfy{c}, nil
+}
+
+func (n *ntfy) send(ctx context.Context, title, message string) error {
+	header := make(http.Header)
+	header.Set("Title", title)
+	if n.Priority > 0 {
+		header.Set("Priority", strconv.Itoa(n.Priority))
+	}
+	if len(n.Tags) > 0 {
+		header.Set("Tags", strings.Join(n.Tags, ","))
+	}
+	if n.Token != "" {
+		header.Set("Authorization", "Bearer "+n.Token)
+	}
+	return do(ctx, http.MethodPost, strings.TrimSuffix(n.Server, "/")+"/"+n.Topic, message, header)
+}
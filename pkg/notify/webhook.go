@@ -0,0 +1,38 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// WebhookConfig stores the parameters for posting to a Slack-style incoming webhook. Such
+// webhooks are also offered by Mattermost, Rocket.Chat and Discord (with /slack appended
+// to the URL)
+type WebhookConfig struct {
+	Config `yaml:",inline"`
+
+	// URL of the webhook
+	URL string `yaml:"url"`
+}
+
+func (c *WebhookConfig) validate() error {
+	if c.URL == "" {
+		return fmt.Errorf("no URL provided")
+	}
+	return nil
+}
+
+type webhook struct {
+	*WebhookConfig
+}
+
+func newWebhook(s settings) (sender, error) {
+	return &webhook{s.(*WebhookConfig)}, nil
+}
+
+func (w *webhook) send(ctx context.Context, title, message string) error {
+	return do(ctx, http.MethodPost, w.URL, map[string]string{
+		"text": "*" + title + "*\n" + message,
+	}, nil)
+}
@@ -0,0 +1,75 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/els0r/dynip-ng/pkg/update"
+)
+
+// Conformance checks that the plugin configured by c speaks the protocol. It describes
+// the plugin, validates the configuration and, if the plugin supports dry runs, runs an
+// update in dry run mode. It returns the first violation found. Plugin authors can call
+// it from their tests
+func Conformance(ctx context.Context, c *Config) error {
+	p, err := newPlugin(c)
+	if err != nil {
+		return err
+	}
+
+	return p.session(ctx, func(s *session) error {
+		err := p.describe(s)
+		if err != nil {
+			return err
+		}
+
+		// notifications must not be answered. Otherwise the response would be taken
+		// for the one of the next request
+		err = s.enc.Encode(&rpcRequest{JSONRPC: "2.0", Method: MethodDescribe})
+		if err != nil {
+			return err
+		}
+		var d Description
+		err = s.call(MethodDescribe, struct{}{}, &d)
+		if err != nil {
+			return fmt.Errorf("describe after notification: %w", err)
+		}
+
+		var rpcErr *Error
+		err = s.call("dynip-ng.conformance", struct{}{}, nil)
+		if !errors.As(err, &rpcErr) || rpcErr.Code != CodeMethodNotFound {
+			return fmt.Errorf("unknown method: expected error code %d, got %v", CodeMethodNotFound, err)
+		}
+
+		// the configuration is always an object
+		err = s.call(MethodValidate, &ValidateParams{Config: []byte(`"not an object"`)}, nil)
+		if !errors.As(err, &rpcErr) {
+			return fmt.Errorf("invalid config: expected an error, got %v", err)
+		}
+
+		if !p.description.DryRun {
+			return nil
+		}
+		var result UpdateResult
+		err = s.call(MethodUpdate, &UpdateParams{
+			Config: p.config,
+			Request: newRequest(&update.Request{
+				IPv4:         "203.0.113.7",
+				IPv6:         "2001:db8::7",
+				PreviousIPv4: "192.0.2.1",
+				Reason:       update.ReasonInterface,
+				DryRun:       true,
+			}),
+		}, &result)
+		if err != nil {
+			return fmt.Errorf("dry run: %w", err)
+		}
+		for _, t := range result.Targets {
+			if t.Target == "" {
+				return fmt.Errorf("dry run: target without a name")
+			}
+		}
+		return nil
+	})
+}
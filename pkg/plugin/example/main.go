@@ -0,0 +1,96 @@
+// Command example is the reference plugin for dynip-ng. It stores the IPs in a JSON file
+// and shows how plugins are written with package plugin. Configure it with
+//
+//	destinations:
+//	    - type: plugin
+//	      command: /usr/local/bin/dynip-ng-example
+//	      config:
+//	          path: /var/lib/dynip-ng/example.json
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/els0r/dynip-ng/pkg/plugin"
+	"github.com/els0r/dynip-ng/pkg/update"
+)
+
+// config is the configuration of the plugin
+type config struct {
+	Path string `json:"path"`
+}
+
+func parseConfig(data json.RawMessage) (*config, error) {
+	c := new(config)
+	err := json.Unmarshal(data, c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Path == "" {
+		return nil, fmt.Errorf("no path provided")
+	}
+	return c, nil
+}
+
+// ips is the content of the file
+type ips struct {
+	IPv4 string `json:"ipv4,omitempty"`
+	IPv6 string `json:"ipv6,omitempty"`
+}
+
+type handler struct{}
+
+func (handler) Describe() plugin.Description {
+	return plugin.Description{
+		Name:        "example",
+		Version:     "1.0.0",
+		Description: "stores the IPs in a JSON file",
+		DryRun:      true,
+	}
+}
+
+func (handler) Validate(data json.RawMessage) error {
+	_, err := parseConfig(data)
+	return err
+}
+
+func (handler) Update(_ context.Context, data json.RawMessage, req *plugin.Request) (*plugin.UpdateResult, error) {
+	c, err := parseConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	content, err := json.Marshal(&ips{IPv4: req.IPv4, IPv6: req.IPv6})
+	if err != nil {
+		return nil, err
+	}
+
+	target := plugin.Target{Target: c.Path}
+	current, err := os.ReadFile(c.Path)
+	switch {
+	case err == nil && bytes.Equal(bytes.TrimSpace(current), content):
+		target.Outcome, target.Message = update.Unchanged, "IPs are stored already"
+	case req.DryRun:
+		target.Outcome, target.Message = update.Changed, "dry run. Would store "+string(content)
+	default:
+		err = os.WriteFile(c.Path, append(content, '\n'), 0644)
+		if err != nil {
+			target.Outcome, target.Message = update.Failed, err.Error()
+			break
+		}
+		target.Outcome, target.Message = update.Changed, "stored "+string(content)
+	}
+	return &plugin.UpdateResult{Targets: []plugin.Target{target}}, nil
+}
+
+func main() {
+	err := plugin.Serve(handler{})
+	if err != nil {
+		// stdout belongs to the protocol
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,292 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/logging"
+	"github.com/els0r/dynip-ng/pkg/update"
+	log "github.com/els0r/log"
+)
+
+// defaultStartTimeout limits describing and validating a plugin when it is created
+const defaultStartTimeout = 10 * time.Second
+
+// maxStderr is the amount of a plugin's stderr kept for error messages
+const maxStderr = 4096
+
+// Config stores the parameters for running a plugin
+type Config struct {
+	// Command is the path of the executable and its arguments, separated by whitespace
+	Command string `yaml:"command"`
+
+	// Env are additional environment variables of the plugin
+	Env map[string]string `yaml:"env"`
+
+	// Config is handed to the plugin as JSON
+	Config map[string]interface{} `yaml:"config"`
+}
+
+func (c *Config) validate() error {
+	if len(strings.Fields(c.Command)) == 0 {
+		return fmt.Errorf("no command provided")
+	}
+	_, err := json.Marshal(c.Config)
+	if err != nil {
+		return fmt.Errorf("config can't be encoded as JSON: %w", err)
+	}
+	return nil
+}
+
+func init() {
+	update.Register("plugin", update.Registration{
+		New: func() interface{} { return new(Config) },
+		Validate: func(settings interface{}) error {
+			err := settings.(*Config).validate()
+			if err != nil {
+				return fmt.Errorf("plugin: %w", err)
+			}
+			return nil
+		},
+		Create: func(dest *cfg.Destination) (update.Updater, error) {
+			return New(dest.Settings.(*Config))
+		},
+	})
+}
+
+// Plugin is an updater implemented by an external executable. The executable is started
+// for each update
+type Plugin struct {
+	update.Instance
+
+	args        []string
+	env         []string
+	config      json.RawMessage
+	description Description
+
+	log log.Logger
+}
+
+// New creates a plugin. It starts the executable to describe the plugin and to validate
+// its configuration
+func New(c *Config) (*Plugin, error) {
+	p, err := newPlugin(c)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStartTimeout)
+	defer cancel()
+
+	err = p.session(ctx, p.describe)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", p.args[0], err)
+	}
+	return p, nil
+}
+
+// describe asks the plugin for its description and has it validate its configuration
+func (p *Plugin) describe(s *session) error {
+	err := s.call(MethodDescribe, struct{}{}, &p.description)
+	if err != nil {
+		return fmt.Errorf("describe: %w", err)
+	}
+	if p.description.ProtocolVersion != ProtocolVersion {
+		return fmt.Errorf("unsupported protocol version %d", p.description.ProtocolVersion)
+	}
+	if p.description.Name == "" {
+		return fmt.Errorf("plugin has no name")
+	}
+	err = s.call(MethodValidate, &ValidateParams{Config: p.config}, nil)
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	return nil
+}
+
+// newPlugin sets up a plugin which hasn't been described yet
+func newPlugin(c *Config) (*Plugin, error) {
+	args := strings.Fields(c.Command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("plugin must have a command")
+	}
+	config, err := json.Marshal(c.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Plugin{
+		args:   args,
+		config: config,
+		log:    logging.Get(),
+	}
+	for key, value := range c.Env {
+		p.env = append(p.env, key+"="+value)
+	}
+	return p, nil
+}
+
+// Name returns a human-readable identifier for the plugin
+func (p *Plugin) Name() string {
+	return p.Label(p.description.Name + " plugin")
+}
+
+// Description returns what the plugin reported about itself
+func (p *Plugin) Description() Description {
+	return p.description
+}
+
+// Update sets the IP at the plugin
+func (p *Plugin) Update(ctx context.Context, IP string) error {
+	req, err := update.NewRequest(IP)
+	if err != nil {
+		return err
+	}
+	_, err = p.Apply(ctx, req)
+	return err
+}
+
+// Apply hands the request to the plugin and returns the outcomes it reported. Plugins
+// which don't support dry runs are skipped during dry runs
+func (p *Plugin) Apply(ctx context.Context, req *update.Request) (*update.Result, error) {
+	err := req.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	res := new(update.Result)
+	if req.DryRun && !p.description.DryRun {
+		res.Add(p.Name(), update.Skipped, "dry run not supported")
+		return res, nil
+	}
+
+	var result UpdateResult
+	err = p.session(ctx, func(s *session) error {
+		return s.call(MethodUpdate, &UpdateParams{Config: p.config, Request: newRequest(req)}, &result)
+	})
+	if err != nil {
+		res.Add(p.Name(), update.Failed, "%s", err)
+		return res, res.Err()
+	}
+	for _, t := range result.Targets {
+		res.Add(t.Target, t.Outcome, "%s", t.Message)
+	}
+	return res, res.Err()
+}
+
+// session runs the plugin for the duration of f
+func (p *Plugin) session(ctx context.Context, f func(s *session) error) error {
+	cmd := exec.CommandContext(ctx, p.args[0], p.args[1:]...)
+	cmd.Env = append(os.Environ(), p.env...)
+	cmd.WaitDelay = time.Second
+
+	stderr := &limitedBuffer{max: maxStderr}
+	cmd.Stderr = stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	s := &session{enc: json.NewEncoder(stdin), dec: json.NewDecoder(stdout)}
+	err = f(s)
+
+	// the plugin exits once its input is closed
+	stdin.Close()
+	waitErr := cmd.Wait()
+
+	msg := strings.TrimSpace(stderr.String())
+	if msg != "" {
+		p.log.Debugf("%s: %s", p.args[0], msg)
+		msg = ": " + msg
+	}
+	switch {
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case err != nil:
+		// a plugin which crashed usually explains why on stderr
+		if waitErr != nil {
+			return fmt.Errorf("%w%s", err, msg)
+		}
+		return err
+	case waitErr != nil:
+		return fmt.Errorf("plugin exited: %w%s", waitErr, msg)
+	}
+	return nil
+}
+
+// session is a connection to a running plugin
+type session struct {
+	enc *json.Encoder
+	dec *json.Decoder
+	id  int
+}
+
+// call sends a request and decodes the result into result, unless it is nil
+func (s *session) call(method string, params, result interface{}) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	s.id++
+	id := s.id
+	err = s.enc.Encode(&rpcRequest{JSONRPC: "2.0", ID: &id, Method: method, Params: data})
+	if err != nil {
+		return fmt.Errorf("couldn't send request: %w", err)
+	}
+
+	var resp rpcResponse
+	err = s.dec.Decode(&resp)
+	if err == io.EOF {
+		return fmt.Errorf("plugin closed the connection")
+	}
+	if err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	if resp.JSONRPC != "2.0" || resp.ID == nil || *resp.ID != id {
+		return fmt.Errorf("invalid response to request %d", id)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if result == nil {
+		return nil
+	}
+	err = json.Unmarshal(resp.Result, result)
+	if err != nil {
+		return fmt.Errorf("invalid result: %w", err)
+	}
+	return nil
+}
+
+// limitedBuffer keeps the first max bytes written to it
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
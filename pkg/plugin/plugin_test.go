@@ -0,0 +1,247 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/update"
+)
+
+// testModeEnv makes the test binary act as a plugin
+const testModeEnv = "DYNIP_NG_TEST_PLUGIN"
+
+// testHandler behaves according to its mode
+type testHandler struct {
+	mode string
+}
+
+func (h testHandler) Describe() Description {
+	return Description{Name: "test", DryRun: h.mode != "no dry run"}
+}
+
+func (h testHandler) Validate(data json.RawMessage) error {
+	var c struct {
+		Zone string `json:"zone"`
+	}
+	err := json.Unmarshal(data, &c)
+	if err != nil {
+		return err
+	}
+	if c.Zone == "" {
+		return fmt.Errorf("no zone provided")
+	}
+	return nil
+}
+
+func (h testHandler) Update(ctx context.Context, _ json.RawMessage, req *Request) (*UpdateResult, error) {
+	switch h.mode {
+	case "crash":
+		fmt.Fprintln(os.Stderr, "panic: provider API changed")
+		os.Exit(3)
+	case "hang":
+		time.Sleep(time.Minute)
+	case "error":
+		return nil, fmt.Errorf("provider unreachable")
+	}
+	return &UpdateResult{Targets: []Target{
+		{Target: "A dynip.example.com", Outcome: update.Changed, Message: "points to " + req.IPv4},
+		{Target: "AAAA dynip.example.com", Outcome: update.Failed, Message: "no IPv6 support"},
+	}}, nil
+}
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(testModeEnv); mode != "" {
+		if mode == "garbage" {
+			fmt.Println("hello, I'm not JSON")
+			os.Exit(0)
+		}
+		err := Serve(testHandler{mode: mode})
+		if err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestPlugin(t *testing.T) {
+	var tests = []struct {
+		name     string
+		mode     string
+		config   map[string]interface{}
+		dryRun   bool
+		created  bool
+		outcomes []update.Outcome
+		errMsg   string
+	}{
+		{"outcomes", "ok", map[string]interface{}{"zone": "example.com"}, false, true, []update.Outcome{update.Changed, update.Failed}, "no IPv6 support"},
+		{"invalid config", "ok", map[string]interface{}{"region": "eu"}, false, false, nil, "no zone provided"},
+		{"not a plugin", "garbage", map[string]interface{}{"zone": "example.com"}, false, false, nil, "invalid response"},
+		{"crash", "crash", map[string]interface{}{"zone": "example.com"}, false, true, []update.Outcome{update.Failed}, "provider API changed"},
+		{"error", "error", map[string]interface{}{"zone": "example.com"}, false, true, []update.Outcome{update.Failed}, "provider unreachable"},
+		{"dry run not supported", "no dry run", map[string]interface{}{"zone": "example.com"}, true, true, []update.Outcome{update.Skipped}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := New(&Config{
+				Command: os.Args[0],
+				Env:     map[string]string{testModeEnv: test.mode},
+				Config:  test.config,
+			})
+			if !test.created {
+				if err == nil || !strings.Contains(err.Error(), test.errMsg) {
+					t.Fatalf("unexpected error: got %v, want %q", err, test.errMsg)
+				}
+				t.Logf("provoked expected error: %s", err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("couldn't create plugin: %s", err)
+			}
+			if p.Name() != "test plugin" {
+				t.Fatalf("unexpected name: %s", p.Name())
+			}
+
+			res, err := p.Apply(context.Background(), &update.Request{IPv4: "203.0.113.7", DryRun: test.dryRun})
+			if test.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), test.errMsg) {
+					t.Fatalf("unexpected error: got %v, want %q", err, test.errMsg)
+				}
+				t.Logf("provoked expected error: %s", err)
+			} else if err != nil {
+				t.Fatalf("update failed: %s", err)
+			}
+			if len(res.Targets) != len(test.outcomes) {
+				t.Fatalf("unexpected result: %v", res.Targets)
+			}
+			for i, o := range test.outcomes {
+				if res.Targets[i].Outcome != o {
+					t.Fatalf("unexpected outcome of %s: got %s, want %s", res.Targets[i].Target, res.Targets[i].Outcome, o)
+				}
+			}
+		})
+	}
+}
+
+func TestPluginTimeout(t *testing.T) {
+	p, err := New(&Config{
+		Command: os.Args[0],
+		Env:     map[string]string{testModeEnv: "hang"},
+		Config:  map[string]interface{}{"zone": "example.com"},
+	})
+	if err != nil {
+		t.Fatalf("couldn't create plugin: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	tstart := time.Now()
+	_, err = p.Apply(ctx, &update.Request{IPv4: "203.0.113.7"})
+	if err == nil {
+		t.Fatalf("update should have timed out but didn't")
+	}
+	if time.Since(tstart) > 5*time.Second {
+		t.Fatalf("plugin wasn't stopped in time: %s", time.Since(tstart))
+	}
+	t.Logf("provoked expected error: %s", err)
+}
+
+// buildExample compiles the reference plugin
+func buildExample(t *testing.T) string {
+	goTool := filepath.Join(runtime.GOROOT(), "bin", "go")
+	if _, err := os.Stat(goTool); err != nil {
+		t.Skipf("go tool not available: %s", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "dynip-ng-example")
+	out, err := exec.Command(goTool, "build", "-o", path, "./example").CombinedOutput()
+	if err != nil {
+		t.Fatalf("couldn't build reference plugin: %s: %s", err, out)
+	}
+	return path
+}
+
+func TestConformance(t *testing.T) {
+	example := buildExample(t)
+	state := filepath.Join(t.TempDir(), "example.json")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, c := range []*Config{
+		{Command: example, Config: map[string]interface{}{"path": state}},
+		{Command: os.Args[0], Env: map[string]string{testModeEnv: "ok"}, Config: map[string]interface{}{"zone": "example.com"}},
+	} {
+		err := Conformance(ctx, c)
+		if err != nil {
+			t.Fatalf("%s doesn't conform: %s", c.Command, err)
+		}
+	}
+	if _, err := os.Stat(state); err == nil {
+		t.Fatalf("conformance check wrote to %s", state)
+	}
+
+	err := Conformance(ctx, &Config{Command: os.Args[0], Env: map[string]string{testModeEnv: "garbage"}})
+	if err == nil {
+		t.Fatalf("conformance check should have failed but didn't")
+	}
+	t.Logf("provoked expected error: %s", err)
+}
+
+func TestExample(t *testing.T) {
+	example := buildExample(t)
+	state := filepath.Join(t.TempDir(), "example.json")
+
+	c, err := cfg.Parse(strings.NewReader(`---
+listen:
+    iface: eth0
+destinations:
+    - type: plugin
+      name: state
+      command: ` + example + `
+      config:
+          path: ` + state + `
+`))
+	if err != nil {
+		t.Fatalf("couldn't parse config: %s", err)
+	}
+	updaters, err := update.NewUpdaters(c.Destinations)
+	if err != nil {
+		t.Fatalf("couldn't create plugin: %s", err)
+	}
+	if len(updaters) != 1 || updaters[0].Name() != "example plugin (state)" {
+		t.Fatalf("unexpected updaters: %v", updaters)
+	}
+	d := update.AsDestination(updaters[0])
+
+	req := &update.Request{IPv4: "203.0.113.7", IPv6: "2001:db8::7"}
+	for _, expected := range []update.Outcome{update.Changed, update.Unchanged} {
+		res, err := d.Apply(context.Background(), req)
+		if err != nil {
+			t.Fatalf("update failed: %s", err)
+		}
+		if len(res.Targets) != 1 || res.Targets[0].Outcome != expected {
+			t.Fatalf("unexpected result: got %v, want %s", res.Targets, expected)
+		}
+	}
+
+	data, err := os.ReadFile(state)
+	if err != nil {
+		t.Fatalf("couldn't read state: %s", err)
+	}
+	expected := `{"ipv4":"203.0.113.7","ipv6":"2001:db8::7"}` + "\n"
+	if string(data) != expected {
+		t.Fatalf("unexpected state: got %q, want %q", data, expected)
+	}
+}
@@ -0,0 +1,134 @@
+// Package plugin runs updaters implemented by external executables. The host starts the
+// executable and exchanges JSON-RPC 2.0 messages with it over stdin and stdout, one
+// message per line. The executable exits once its stdin is closed.
+//
+// Plugins implement three methods:
+//
+//   - describe returns a Description
+//   - validate checks the plugin's configuration (ValidateParams)
+//   - update applies a Request (UpdateParams) and returns an UpdateResult
+//
+// Plugins written in Go implement Handler and call Serve. Conformance checks a plugin
+// against the protocol
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/els0r/dynip-ng/pkg/update"
+)
+
+// ProtocolVersion is the version of the protocol spoken by the host
+const ProtocolVersion = 1
+
+// Methods of the protocol
+const (
+	MethodDescribe = "describe"
+	MethodValidate = "validate"
+	MethodUpdate   = "update"
+)
+
+// Description identifies a plugin
+type Description struct {
+	// Name of the plugin, e.g. the provider it updates
+	Name string `json:"name"`
+
+	// Version of the plugin
+	Version string `json:"version,omitempty"`
+
+	// Description is a short summary of what the plugin does
+	Description string `json:"description,omitempty"`
+
+	// ProtocolVersion is the version of the protocol the plugin speaks
+	ProtocolVersion int `json:"protocolVersion"`
+
+	// DryRun states whether the plugin supports dry runs. Updates of plugins which
+	// don't are skipped during dry runs
+	DryRun bool `json:"dryRun"`
+}
+
+// ValidateParams are the parameters of the validate method
+type ValidateParams struct {
+	// Config is the plugin's configuration as given in the config file
+	Config json.RawMessage `json:"config"`
+}
+
+// UpdateParams are the parameters of the update method
+type UpdateParams struct {
+	// Config is the plugin's configuration as given in the config file
+	Config json.RawMessage `json:"config"`
+
+	// Request is the update to apply
+	Request Request `json:"request"`
+}
+
+// Request describes an update. It corresponds to update.Request
+type Request struct {
+	IPv4         string `json:"ipv4,omitempty"`
+	IPv6         string `json:"ipv6,omitempty"`
+	PreviousIPv4 string `json:"previousIPv4,omitempty"`
+	PreviousIPv6 string `json:"previousIPv6,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+	Interface    string `json:"interface,omitempty"`
+	DryRun       bool   `json:"dryRun,omitempty"`
+}
+
+func newRequest(req *update.Request) Request {
+	return Request{
+		IPv4:         req.IPv4,
+		IPv6:         req.IPv6,
+		PreviousIPv4: req.PreviousIPv4,
+		PreviousIPv6: req.PreviousIPv6,
+		Reason:       string(req.Reason),
+		Interface:    req.Interface,
+		DryRun:       req.DryRun,
+	}
+}
+
+// UpdateResult is the result of the update method. It corresponds to update.Result
+type UpdateResult struct {
+	Targets []Target `json:"targets"`
+}
+
+// Target is the outcome of updating a single target
+type Target struct {
+	Target  string         `json:"target"`
+	Outcome update.Outcome `json:"outcome"`
+	Message string         `json:"message,omitempty"`
+}
+
+// Error codes defined by JSON-RPC 2.0
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+)
+
+// Error is a JSON-RPC error returned by a plugin
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// rpcRequest is a JSON-RPC 2.0 request
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *int            `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// rpcResponse is a JSON-RPC 2.0 response
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *int            `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
@@ -0,0 +1,111 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+)
+
+// Handler implements a plugin
+type Handler interface {
+	// Describe returns the description of the plugin. ProtocolVersion is set by Serve
+	Describe() Description
+
+	// Validate checks the configuration of the plugin
+	Validate(config json.RawMessage) error
+
+	// Update applies req. Failed targets are reported in the result. An error means
+	// that the update couldn't be attempted at all
+	Update(ctx context.Context, config json.RawMessage, req *Request) (*UpdateResult, error)
+}
+
+// Serve answers requests on stdin until it is closed
+func Serve(h Handler) error {
+	return serve(context.Background(), os.Stdin, os.Stdout, h)
+}
+
+func serve(ctx context.Context, r io.Reader, w io.Writer, h Handler) error {
+	dec := json.NewDecoder(r)
+	enc := json.NewEncoder(w)
+	for {
+		var req rpcRequest
+		err := dec.Decode(&req)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			// the stream can't be resynchronized
+			enc.Encode(&rpcResponse{JSONRPC: "2.0", Error: &Error{Code: CodeParseError, Message: err.Error()}})
+			return err
+		}
+
+		resp := &rpcResponse{JSONRPC: "2.0", ID: req.ID}
+		result, err := handle(ctx, h, &req)
+		if err != nil {
+			var rpcErr *Error
+			if !errors.As(err, &rpcErr) {
+				rpcErr = &Error{Code: CodeInternalError, Message: err.Error()}
+			}
+			resp.Error = rpcErr
+		} else {
+			resp.Result, err = json.Marshal(result)
+			if err != nil {
+				resp.Error = &Error{Code: CodeInternalError, Message: err.Error()}
+			}
+		}
+
+		// notifications aren't answered
+		if req.ID == nil {
+			continue
+		}
+		err = enc.Encode(resp)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func handle(ctx context.Context, h Handler, req *rpcRequest) (interface{}, error) {
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return nil, &Error{Code: CodeInvalidRequest, Message: "invalid JSON-RPC 2.0 request"}
+	}
+
+	switch req.Method {
+	case MethodDescribe:
+		d := h.Describe()
+		d.ProtocolVersion = ProtocolVersion
+		return &d, nil
+	case MethodValidate:
+		var params ValidateParams
+		err := unmarshalParams(req.Params, &params)
+		if err != nil {
+			return nil, err
+		}
+		err = h.Validate(params.Config)
+		if err != nil {
+			return nil, &Error{Code: CodeInvalidParams, Message: err.Error()}
+		}
+		return struct{}{}, nil
+	case MethodUpdate:
+		var params UpdateParams
+		err := unmarshalParams(req.Params, &params)
+		if err != nil {
+			return nil, err
+		}
+		return h.Update(ctx, params.Config, &params.Request)
+	}
+	return nil, &Error{Code: CodeMethodNotFound, Message: "method " + req.Method + " not found"}
+}
+
+func unmarshalParams(data json.RawMessage, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	err := json.Unmarshal(data, v)
+	if err != nil {
+		return &Error{Code: CodeInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
@@ -3,6 +3,10 @@ package update
 import (
 	"context"
 	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
 
 	cloudflare "github.com/cloudflare/cloudflare-go"
 	"github.com/els0r/dynip-ng/pkg/cfg"
@@ -13,9 +17,21 @@ import (
 
 // CloudFlareUpdate communicates with the cloudflare API to change records
 type CloudFlareUpdate struct {
+	Instance
+
 	api CloudflareAPI
 	cfg *cfg.CloudflareAPI
 	log log.Logger
+
+	// claims the managed records. Nil if ownership isn't tracked
+	owner *ownerMarker
+
+	// zone and record IDs known from previous runs
+	cache *cfCache
+
+	// paging and rate limit handling
+	pageSize   int
+	retryDelay time.Duration
 }
 
 // CloudflareAPI allows us to decouple the third-party CloudFlare API implementation.
@@ -24,6 +40,9 @@ type CloudflareAPI interface {
 	ZoneIDByName(string) (string, error)
 	ListDNSRecords(context.Context, *cloudflare.ResourceContainer, cloudflare.ListDNSRecordsParams) ([]cloudflare.DNSRecord, *cloudflare.ResultInfo, error)
 	UpdateDNSRecord(context.Context, *cloudflare.ResourceContainer, cloudflare.UpdateDNSRecordParams) (cloudflare.DNSRecord, error)
+	CreateDNSRecord(context.Context, *cloudflare.ResourceContainer, cloudflare.CreateDNSRecordParams) (cloudflare.DNSRecord, error)
+	GetDNSRecord(context.Context, *cloudflare.ResourceContainer, string) (cloudflare.DNSRecord, error)
+	DeleteDNSRecord(context.Context, *cloudflare.ResourceContainer, string) error
 }
 
 // CFOption allows to modify the cloudflare updater
@@ -42,17 +61,17 @@ func NewCloudFlareUpdate(cfg *cfg.CloudflareAPI, opts ...CFOption) (*CloudFlareU
 
 	// store zone and record update config
 	c.cfg = cfg
+	c.owner = newOwnerMarker(cfg.Ownership)
+	c.cache = newCFCache()
+	c.pageSize = cfPageSize
+	c.retryDelay = cfRateLimitDelay
 
 	// initialize the logger
 	c.log = logging.Get()
 
 	// Construct a new API object
 	var err error
-	if cfg.Access.Token != "" {
-		c.api, err = cloudflare.NewWithAPIToken(cfg.Access.Token)
-	} else {
-		c.api, err = cloudflare.New(cfg.Access.Key, cfg.Access.Email)
-	}
+	c.api, err = newCloudflareAPI(cfg.Access)
 	if err != nil {
 		return nil, err
 	}
@@ -65,77 +84,372 @@ func NewCloudFlareUpdate(cfg *cfg.CloudflareAPI, opts ...CFOption) (*CloudFlareU
 	return c, nil
 }
 
+// newCloudflareAPI creates a Cloudflare API client. API tokens take precedence over
+// the API key and email. The client's own retries are disabled, since rate limits are
+// handled by backoff, which honors the Retry-After header
+func newCloudflareAPI(access cfg.CloudflareAccess, opts ...cloudflare.Option) (*cloudflare.API, error) {
+	opts = append([]cloudflare.Option{
+		cloudflare.UsingRetryPolicy(0, 0, 0),
+		cloudflare.HTTPClient(&http.Client{Transport: &cfRateLimitTransport{next: http.DefaultTransport}}),
+	}, opts...)
+	if access.Token != "" {
+		return cloudflare.NewWithAPIToken(access.Token, opts...)
+	}
+	return cloudflare.New(access.Key, access.Email, opts...)
+}
+
 // Name returns a human-readable identifier for the updater
 func (c *CloudFlareUpdate) Name() string {
-	return "cloudflare updater"
+	return c.Label("cloudflare updater")
 }
 
-// Update changes the record from the config in Cloudflare to `ip`
+// Update changes the records from the config in Cloudflare to `IP`. Only records of
+// the type matching the IP's address family are touched
 func (c *CloudFlareUpdate) Update(ctx context.Context, IP string) error {
+	req, err := NewRequest(IP)
+	if err != nil {
+		return err
+	}
+	_, err = c.Apply(ctx, req)
+	return err
+}
 
-	// update counters
-	recordsUpdated := 0
-	currentUpdateCount := 0
+// Apply points the A records from the config to the IPv4 address and the AAAA records to
+// the IPv6 address of the request. Records which already point to the IP and have the
+// configured settings aren't written
+func (c *CloudFlareUpdate) Apply(ctx context.Context, req *Request) (*Result, error) {
+	err := req.Validate()
+	if err != nil {
+		return nil, err
+	}
 
+	res := new(Result)
 	for name, zoneCfg := range c.cfg.Zones {
+		if zoneCfg == nil {
+			zoneCfg = &cfg.Zone{}
+		}
+
+		var records []cfRecord
+		if req.IPv4 != "" {
+			records = append(records, zoneRecords(name, zoneCfg, "A")...)
+		}
+		if req.IPv6 != "" {
+			records = append(records, zoneRecords(name, zoneCfg, "AAAA")...)
+		}
+		if len(records) == 0 {
+			c.log.Debugf("no records for %s configured in Cloudflare zone: %s", strings.Join(req.IPs(), ", "), name)
+			continue
+		}
 		c.log.Debugf("updating Cloudflare zone: %s", name)
 
-		// Fetch the zone ID
-		zoneID, err := c.api.ZoneIDByName(name)
+		c.updateZone(ctx, name, zoneCfg, records, req, res)
+	}
+	return res, res.Err()
+}
+
+// updateZone updates all `records` in a zone and records the outcome in `res`
+func (c *CloudFlareUpdate) updateZone(ctx context.Context, name string, zoneCfg *cfg.Zone, records []cfRecord, req *Request, res *Result) {
+
+	// Fetch the zone ID
+	zoneID, err := c.zoneID(ctx, name)
+	if err != nil {
+		for _, record := range records {
+			res.Add(record.target(), Failed, "%s", err)
+		}
+		return
+	}
+
+	for _, record := range records {
+		IP := req.IPv4
+		if record.rtype == "AAAA" {
+			IP = req.IPv6
+		}
+
+		recs, err := c.lookup(ctx, name, zoneID, record)
+		if isNotFound(err) {
+			// the zone may have been re-created. Look up its ID once more
+			c.log.Debugf("zone %s not found with cached ID. Refreshing", name)
+			c.cache.invalidateZone(name)
+			zoneID, err = c.zoneID(ctx, name)
+			if err == nil {
+				recs, err = c.lookup(ctx, name, zoneID, record)
+			}
+		}
 		if err != nil {
-			return err
+			res.Add(record.target(), Failed, "%s", err)
+			continue
+		}
+
+		for _, r := range recs {
+			target := record.rtype + " " + r.Name
+
+			// never touch records claimed by someone else
+			if c.owner != nil {
+				if owner := recordOwner(r); owner != "" && !c.owner.owns(r) {
+					res.Add(target, Failed, "record is managed by %q", owner)
+					continue
+				}
+			}
+
+			changed, err := c.updateRecord(ctx, zoneID, record, r, IP, req.DryRun)
+			switch {
+			case err != nil:
+				res.Add(target, Failed, "%s", err)
+			case changed && req.DryRun:
+				res.Add(target, Changed, "would point to %s", IP)
+			case changed:
+				res.Add(target, Changed, "points to %s", IP)
+			default:
+				res.Add(target, Unchanged, "already points to %s", IP)
+			}
+		}
+		if len(recs) > 0 {
+			continue
 		}
 
-		// Fetch all records for a zone
-		recs, _, err := c.api.ListDNSRecords(ctx, cloudflare.ZoneIdentifier(zoneID), cloudflare.ListDNSRecordsParams{})
+		// create the record if it doesn't exist and the config allows it
+		if !zoneCfg.Create {
+			res.Add(record.target(), Failed, "record was not found")
+			continue
+		}
+		if req.DryRun {
+			res.Add(record.target(), Changed, "would be created pointing to %s", IP)
+			continue
+		}
+		err = c.create(ctx, zoneID, name, record, IP, zoneCfg)
 		if err != nil {
-			return err
+			res.Add(record.target(), Failed, "%s", err)
+			continue
 		}
+		res.Add(record.target(), Changed, "created pointing to %s", IP)
+	}
+
+	// remove owned records which are no longer configured
+	if c.owner != nil && c.owner.cleanup {
+		c.cleanup(ctx, zoneID, name, zoneCfg, req.DryRun, res)
+	}
+}
 
-		recordToUpdate := name
-		if zoneCfg.Record != "" {
-			recordToUpdate = zoneCfg.Record + "." + name
+// cleanup deletes all A and AAAA records owned by this instance which aren't configured
+// for the zone anymore
+func (c *CloudFlareUpdate) cleanup(ctx context.Context, zoneID, name string, zoneCfg *cfg.Zone, dryRun bool, res *Result) {
+	configured := make(map[string]struct{})
+	for _, rtype := range []string{"A", "AAAA"} {
+		for _, record := range zoneRecords(name, zoneCfg, rtype) {
+			configured[recordKey(name, rtype, record.name)] = struct{}{}
+		}
+	}
+
+	for _, rtype := range []string{"A", "AAAA"} {
+		// tags can be searched for. Comments are matched locally since the marker
+		// may be part of a longer comment
+		params := cloudflare.ListDNSRecordsParams{Type: rtype}
+		if c.owner.useTag {
+			params.Tags = []string{c.owner.tag()}
+		}
+		recs, err := c.list(ctx, zoneID, params)
+		if err != nil {
+			res.Add(rtype+" records of "+name, Failed, "failed to list records for clean up: %s", err)
+			continue
 		}
 
 		for _, r := range recs {
-			// only take the A record
-			if r.Type == "A" {
-
-				// update if it is the IP address record
-				if r.Name == recordToUpdate {
-
-					tags := r.Tags
-					if tags == nil {
-						tags = []string{}
-					}
-
-					// set to new IP address
-					params := cloudflare.UpdateDNSRecordParams{
-						ID:      r.ID,
-						Type:    "A",
-						Name:    r.Name,
-						Content: IP,
-						TTL:     r.TTL,
-						Proxied: r.Proxied,
-						Tags:    tags,
-					}
-
-					_, err = c.api.UpdateDNSRecord(ctx, cloudflare.ZoneIdentifier(zoneID), params)
-					if err != nil {
-						return err
-					}
-					c.log.Debugf("updated A record '%s' with IP address '%s'", recordToUpdate, IP)
-					recordsUpdated++
-				}
+			if r.Type != rtype || !c.owner.owns(r) {
+				continue
 			}
+			key := recordKey(name, rtype, r.Name)
+			if _, ok := configured[key]; ok {
+				continue
+			}
+			target := r.Type + " " + r.Name
+			if dryRun {
+				res.Add(target, Removed, "would be removed since it is no longer configured")
+				continue
+			}
+			err := c.backoff(ctx, func() error {
+				return c.api.DeleteDNSRecord(ctx, cloudflare.ZoneIdentifier(zoneID), r.ID)
+			})
+			if err != nil {
+				res.Add(target, Failed, "failed to remove record: %s", err)
+				continue
+			}
+			c.log.Debugf("removed %s record '%s' which is no longer configured", r.Type, r.Name)
+			delete(c.cache.records, key)
+			res.Add(target, Removed, "removed since it is no longer configured")
 		}
+	}
+}
+
+// updateRecord points the existing record `r` to `IP` and enforces the configured settings.
+// The record is only written if it differs, in which case it is read back to verify the
+// change. It returns whether the record was changed. In a dry run, it returns whether the
+// record would be changed without writing it
+func (c *CloudFlareUpdate) updateRecord(ctx context.Context, zoneID string, record cfRecord, r cloudflare.DNSRecord, IP string, dryRun bool) (bool, error) {
+	tags := r.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+
+	// set to new IP address and enforce the configured settings
+	params := cloudflare.UpdateDNSRecordParams{
+		ID:      r.ID,
+		Type:    record.rtype,
+		Name:    r.Name,
+		Content: IP,
+		TTL:     r.TTL,
+		Proxied: r.Proxied,
+		Tags:    tags,
+	}
+	if record.ttl != nil {
+		params.TTL = *record.ttl
+	}
+	if record.proxied != nil {
+		params.Proxied = record.proxied
+	}
+
+	// claim records that aren't owned by anyone yet
+	claimed := c.owner == nil || c.owner.owns(r)
+	if !claimed {
+		c.owner.claim(&params, r)
+	}
 
-		// check if the records update was completed
-		if recordsUpdated == currentUpdateCount {
-			return fmt.Errorf("record %q was not found", recordToUpdate)
+	if claimed && upToDate(r, params) {
+		c.log.Debugf("%s record '%s' already points to '%s'", record.rtype, r.Name, IP)
+		return false, nil
+	}
+	if dryRun {
+		return true, nil
+	}
+
+	err := c.backoff(ctx, func() error {
+		_, err := c.api.UpdateDNSRecord(ctx, cloudflare.ZoneIdentifier(zoneID), params)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// make sure the change was applied
+	var written cloudflare.DNSRecord
+	err = c.backoff(ctx, func() (err error) {
+		written, err = c.api.GetDNSRecord(ctx, cloudflare.ZoneIdentifier(zoneID), r.ID)
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to read back record: %w", err)
+	}
+	if !upToDate(written, params) {
+		return false, fmt.Errorf("read back record has content %q (ttl=%d), expected %q (ttl=%d)", written.Content, written.TTL, params.Content, params.TTL)
+	}
+	if c.owner != nil && !c.owner.owns(written) {
+		return false, fmt.Errorf("read back record isn't marked as managed by %q", c.owner.value)
+	}
+	c.log.Debugf("updated %s record '%s' with IP address '%s'", record.rtype, r.Name, IP)
+	return true, nil
+}
+
+// upToDate checks if record r has the content and settings of params
+func upToDate(r cloudflare.DNSRecord, params cloudflare.UpdateDNSRecordParams) bool {
+	current := net.ParseIP(r.Content)
+	if current == nil || !current.Equal(net.ParseIP(params.Content)) {
+		return false
+	}
+	if r.TTL != params.TTL {
+		return false
+	}
+	if params.Proxied != nil && (r.Proxied == nil || *r.Proxied != *params.Proxied) {
+		return false
+	}
+	return true
+}
+
+// cfRecord is a record from the config with its fully qualified name
+type cfRecord struct {
+	name    string
+	rtype   string
+	ttl     *int
+	proxied *bool
+}
+
+// target identifies the record in results
+func (r cfRecord) target() string {
+	return r.rtype + " " + r.name
+}
+
+// zoneRecords returns all records of type `rtype` configured for the zone
+func zoneRecords(zone string, zoneCfg *cfg.Zone, rtype string) []cfRecord {
+	records := zoneCfg.Records
+
+	// the single record is an A record
+	if zoneCfg.Record != "" || len(records) == 0 {
+		records = append([]*cfg.Record{{Name: zoneCfg.Record, Type: "A"}}, records...)
+	}
+
+	var filtered []cfRecord
+	for _, r := range records {
+		t := strings.ToUpper(r.Type)
+		if t == "" {
+			t = "A"
+		}
+		if t != rtype {
+			continue
 		}
-		currentUpdateCount = recordsUpdated
+		filtered = append(filtered, cfRecord{
+			name:    recordName(r.Name, zone),
+			rtype:   t,
+			ttl:     r.TTL,
+			proxied: r.Proxied,
+		})
+	}
+	return filtered
+}
+
+// recordName returns the fully qualified name of a record in zone
+func recordName(name, zone string) string {
+	lname, lzone := strings.ToLower(name), strings.ToLower(zone)
+	switch {
+	case name == "" || name == "@":
+		return zone
+	case lname == lzone || strings.HasSuffix(lname, "."+lzone):
+		return name
+	}
+	return name + "." + zone
+}
+
+// create adds a record pointing to `IP` to the zone
+func (c *CloudFlareUpdate) create(ctx context.Context, zoneID, zone string, record cfRecord, IP string, zoneCfg *cfg.Zone) error {
+	ttl := zoneCfg.TTL
+	if record.ttl != nil {
+		ttl = *record.ttl
+	}
+	if ttl == 0 {
+		ttl = 1 // automatic
+	}
+	proxied := zoneCfg.Proxied
+	if record.proxied != nil {
+		proxied = *record.proxied
+	}
+
+	params := cloudflare.CreateDNSRecordParams{
+		Type:    record.rtype,
+		Name:    record.name,
+		Content: IP,
+		TTL:     ttl,
+		Proxied: &proxied,
+		Comment: zoneCfg.Comment,
+	}
+	if c.owner != nil {
+		c.owner.claimNew(&params)
+	}
+	var created cloudflare.DNSRecord
+	err := c.backoff(ctx, func() (err error) {
+		created, err = c.api.CreateDNSRecord(ctx, cloudflare.ZoneIdentifier(zoneID), params)
+		return err
+	})
+	if err != nil {
+		return err
 	}
-	c.log.Debugf("updated %d records", recordsUpdated)
+	c.cache.records[recordKey(zone, record.rtype, record.name)] = []string{created.ID}
+	c.log.Debugf("created %s record '%s' with IP address '%s'", record.rtype, record.name, IP)
 	return nil
 }
@@ -0,0 +1,280 @@
+package update
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	cloudflare "github.com/cloudflare/cloudflare-go"
+	log "github.com/els0r/log"
+)
+
+const (
+	// number of records requested per page when listing a zone
+	cfPageSize = 100
+
+	// retries and initial delay when Cloudflare responds with a rate limit error.
+	// The delay doubles with every attempt
+	cfRateLimitRetries = 3
+	cfRateLimitDelay   = 2 * time.Second
+	cfRateLimitMaxWait = 30 * time.Second
+)
+
+// cfCache stores zone, record and list IDs across updates, so that they don't have to be
+// looked up on every run
+type cfCache struct {
+	// maps zone names to their IDs
+	zones map[string]string
+
+	// maps zone/type/name to the IDs of the records with that name and type
+	records map[string][]string
+
+	// maps account/name to the IDs of IP lists
+	lists map[string]string
+}
+
+func newCFCache() *cfCache {
+	return &cfCache{
+		zones:   make(map[string]string),
+		records: make(map[string][]string),
+		lists:   make(map[string]string),
+	}
+}
+
+func recordKey(zone, rtype, name string) string {
+	return strings.ToLower(zone) + "/" + rtype + "/" + strings.ToLower(name)
+}
+
+// invalidateZone drops the zone ID and all record IDs of the zone
+func (cc *cfCache) invalidateZone(zone string) {
+	delete(cc.zones, zone)
+	prefix := strings.ToLower(zone) + "/"
+	for key := range cc.records {
+		if strings.HasPrefix(key, prefix) {
+			delete(cc.records, key)
+		}
+	}
+}
+
+func listKey(account, name string) string {
+	return account + "/" + name
+}
+
+// zoneID returns the ID of a zone. It is only looked up via `api` if it isn't cached yet
+func (cc *cfCache) zoneID(ctx context.Context, api CloudflareAPI, backoff func(context.Context, func() error) error, zone string) (string, error) {
+	if id, ok := cc.zones[zone]; ok {
+		return id, nil
+	}
+
+	var id string
+	err := backoff(ctx, func() (err error) {
+		id, err = api.ZoneIDByName(zone)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	cc.zones[zone] = id
+	return id, nil
+}
+
+// zoneID returns the ID of a zone. It is only looked up if it isn't cached yet
+func (c *CloudFlareUpdate) zoneID(ctx context.Context, zone string) (string, error) {
+	return c.cache.zoneID(ctx, c.api, c.backoff, zone)
+}
+
+// lookup returns all records matching the name and type of `record`. If their IDs are
+// known, the records are fetched directly. Otherwise, the zone is searched for them
+func (c *CloudFlareUpdate) lookup(ctx context.Context, zone, zoneID string, record cfRecord) ([]cloudflare.DNSRecord, error) {
+	key := recordKey(zone, record.rtype, record.name)
+
+	if ids, ok := c.cache.records[key]; ok {
+		recs, err := c.fetch(ctx, zoneID, ids)
+		if err == nil {
+			return recs, nil
+		}
+		if !isNotFound(err) {
+			return nil, err
+		}
+		// one of the records is gone. Search for the current ones
+		c.log.Debugf("cached %s record '%s' no longer exists", record.rtype, record.name)
+		delete(c.cache.records, key)
+	}
+
+	recs, err := c.list(ctx, zoneID, cloudflare.ListDNSRecordsParams{
+		Name: record.name,
+		Type: record.rtype,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the API matches names exactly. Filter anyway to be on the safe side
+	var matching []cloudflare.DNSRecord
+	var ids []string
+	for _, r := range recs {
+		if r.Type != record.rtype || !strings.EqualFold(r.Name, record.name) {
+			continue
+		}
+		matching = append(matching, r)
+		ids = append(ids, r.ID)
+	}
+	if len(ids) > 0 {
+		c.cache.records[key] = ids
+	}
+	return matching, nil
+}
+
+// fetch gets the records with the provided IDs
+func (c *CloudFlareUpdate) fetch(ctx context.Context, zoneID string, ids []string) ([]cloudflare.DNSRecord, error) {
+	var recs []cloudflare.DNSRecord
+	for _, id := range ids {
+		var r cloudflare.DNSRecord
+		err := c.backoff(ctx, func() (err error) {
+			r, err = c.api.GetDNSRecord(ctx, cloudflare.ZoneIdentifier(zoneID), id)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, r)
+	}
+	return recs, nil
+}
+
+// list returns all records of a zone matching params. It walks through all pages of
+// the result
+func (c *CloudFlareUpdate) list(ctx context.Context, zoneID string, params cloudflare.ListDNSRecordsParams) ([]cloudflare.DNSRecord, error) {
+	params.PerPage = c.pageSize
+	params.Page = 1
+
+	var recs []cloudflare.DNSRecord
+	for {
+		var (
+			page []cloudflare.DNSRecord
+			info *cloudflare.ResultInfo
+		)
+		err := c.backoff(ctx, func() (err error) {
+			page, info, err = c.api.ListDNSRecords(ctx, cloudflare.ZoneIdentifier(zoneID), params)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, page...)
+
+		if info == nil || !info.HasMorePages() || len(page) == 0 {
+			return recs, nil
+		}
+		params.Page++
+	}
+}
+
+// backoff runs call and retries it with an increasing delay as long as Cloudflare
+// responds with rate limit errors
+func (c *CloudFlareUpdate) backoff(ctx context.Context, call func() error) error {
+	return cfBackoff(ctx, c.log, c.retryDelay, call)
+}
+
+// cfBackoff retries call, starting with `delay` between attempts, as long as it fails
+// with a rate limit error. If Cloudflare says how long to wait, that delay is used instead
+func cfBackoff(ctx context.Context, logger log.Logger, delay time.Duration, call func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := call()
+		if err == nil || !isRateLimited(err) || attempt >= cfRateLimitRetries {
+			return err
+		}
+		wait := delay
+		var rl *cfRateLimitError
+		if errors.As(err, &rl) && rl.retryAfter > 0 {
+			if rl.retryAfter > cfRateLimitMaxWait {
+				return fmt.Errorf("%w: retry after %s exceeds maximum wait of %s", err, rl.retryAfter, cfRateLimitMaxWait)
+			}
+			wait = rl.retryAfter
+		}
+		logger.Warnf("rate limited by Cloudflare. Retrying in %s", wait)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+		if delay > cfRateLimitMaxWait {
+			delay = cfRateLimitMaxWait
+		}
+	}
+}
+
+// cfRateLimitError is returned for requests Cloudflare answered with 429 Too Many Requests
+type cfRateLimitError struct {
+	// retryAfter is the delay requested via the Retry-After header. It is zero if the
+	// header is missing
+	retryAfter time.Duration
+}
+
+func (e *cfRateLimitError) Error() string {
+	return "rate limited by Cloudflare (HTTP 429)"
+}
+
+// cfRateLimitTransport turns 429 responses into a cfRateLimitError. The Cloudflare client
+// discards the response headers of rate limited requests, so that Retry-After would be lost
+type cfRateLimitTransport struct {
+	next http.RoundTripper
+}
+
+func (t *cfRateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		return resp, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	resp.Body.Close()
+
+	return nil, &cfRateLimitError{retryAfter: retryAfter(resp.Header.Get("Retry-After"), time.Now())}
+}
+
+// retryAfter parses the value of a Retry-After header, which is either a number of seconds
+// or an HTTP date
+func retryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+func isRateLimited(err error) bool {
+	var cfRL *cfRateLimitError
+	if errors.As(err, &cfRL) {
+		return true
+	}
+	var rl cloudflare.RatelimitError
+	if errors.As(err, &rl) {
+		return true
+	}
+	var cfErr *cloudflare.Error
+	return errors.As(err, &cfErr) && (cfErr.ClientRateLimited() || cfErr.StatusCode == http.StatusTooManyRequests)
+}
+
+func isNotFound(err error) bool {
+	var nf cloudflare.NotFoundError
+	if errors.As(err, &nf) {
+		return true
+	}
+	var cfErr *cloudflare.Error
+	return errors.As(err, &cfErr) && cfErr.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,439 @@
+package update
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	cloudflare "github.com/cloudflare/cloudflare-go"
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/logging"
+
+	log "github.com/els0r/log"
+)
+
+const (
+	// marks the list items and access rules managed by dynip-ng if no comment is configured.
+	// The destination's name is appended, so that several instances can share a list
+	cfDefaultListComment = "managed by dynip-ng"
+
+	// action of an access rule if no mode is configured
+	cfDefaultAccessRuleMode = "whitelist"
+)
+
+// CloudFlareListUpdate replaces the IP in Cloudflare IP Lists and zone IP Access Rules.
+// The items it manages are recognized by their comment (see marker). All other items are kept
+type CloudFlareListUpdate struct {
+	Instance
+
+	api     CloudflareListsAPI
+	cfg     *cfg.CloudflareListsConfig
+	comment string
+	log     log.Logger
+
+	// list and zone IDs known from previous runs
+	cache *cfCache
+
+	// initial delay when rate limited
+	retryDelay time.Duration
+}
+
+// CloudflareListsAPI extends the CloudflareAPI with the calls needed to manage IP Lists
+// and zone IP Access Rules
+type CloudflareListsAPI interface {
+	CloudflareAPI
+
+	ListLists(context.Context, *cloudflare.ResourceContainer, cloudflare.ListListsParams) ([]cloudflare.List, error)
+	ListListItems(context.Context, *cloudflare.ResourceContainer, cloudflare.ListListItemsParams) ([]cloudflare.ListItem, error)
+	CreateListItems(context.Context, *cloudflare.ResourceContainer, cloudflare.ListCreateItemsParams) ([]cloudflare.ListItem, error)
+	DeleteListItems(context.Context, *cloudflare.ResourceContainer, cloudflare.ListDeleteItemsParams) ([]cloudflare.ListItem, error)
+
+	ListZoneAccessRules(ctx context.Context, zoneID string, rule cloudflare.AccessRule, page int) (*cloudflare.AccessRuleListResponse, error)
+	CreateZoneAccessRule(ctx context.Context, zoneID string, rule cloudflare.AccessRule) (*cloudflare.AccessRuleResponse, error)
+	DeleteZoneAccessRule(ctx context.Context, zoneID, ruleID string) (*cloudflare.AccessRuleResponse, error)
+}
+
+// CFListOption allows to modify the cloudflare lists updater
+type CFListOption func(c *CloudFlareListUpdate)
+
+// WithCFListsAPI allows to pass another API than the default one
+func WithCFListsAPI(api CloudflareListsAPI) CFListOption {
+	return func(c *CloudFlareListUpdate) {
+		c.api = api
+	}
+}
+
+// NewCloudFlareListUpdate returns a new updater for Cloudflare IP Lists and zone IP
+// Access Rules
+func NewCloudFlareListUpdate(cfg *cfg.CloudflareListsConfig, opts ...CFListOption) (*CloudFlareListUpdate, error) {
+	c := &CloudFlareListUpdate{
+		cfg:        cfg,
+		comment:    cfg.Comment,
+		log:        logging.Get(),
+		cache:      newCFCache(),
+		retryDelay: cfRateLimitDelay,
+	}
+
+	var err error
+	c.api, err = newCloudflareAPI(cfg.Access)
+	if err != nil {
+		return nil, err
+	}
+
+	// apply functional options
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// Name returns a human-readable identifier for the updater
+func (c *CloudFlareListUpdate) Name() string {
+	return c.Label("cloudflare lists updater")
+}
+
+// marker returns the comment of the list items and the notes of the access rules managed
+// by this instance
+func (c *CloudFlareListUpdate) marker() string {
+	if c.comment != "" {
+		return c.comment
+	}
+	if c.name != "" {
+		return fmt.Sprintf("%s (%s)", cfDefaultListComment, c.name)
+	}
+	return cfDefaultListComment
+}
+
+// Update adds `IP` to all configured lists and access rules and removes the managed
+// items of the same address family which point to another IP
+func (c *CloudFlareListUpdate) Update(ctx context.Context, IP string) error {
+	req, err := NewRequest(IP)
+	if err != nil {
+		return err
+	}
+	_, err = c.Apply(ctx, req)
+	return err
+}
+
+// Apply adds the IPs of the request to all configured lists and access rules and removes
+// the managed items which point to the previous IP of the same address family. If the
+// previous IP isn't known, all managed items of the address family are replaced
+func (c *CloudFlareListUpdate) Apply(ctx context.Context, req *Request) (*Result, error) {
+	err := req.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	res := new(Result)
+	for _, ips := range [][2]string{{req.IPv4, req.PreviousIPv4}, {req.IPv6, req.PreviousIPv6}} {
+		if ips[0] == "" {
+			continue
+		}
+		ip, previous := net.ParseIP(ips[0]), net.ParseIP(ips[1])
+		for _, l := range c.cfg.Lists {
+			target := fmt.Sprintf("list %s (%s)", l.Name, listEntry(ip))
+			changed, err := c.updateList(ctx, l, ip, previous, req.DryRun)
+			addOutcome(res, target, changed, req.DryRun, err)
+		}
+		for _, r := range c.cfg.AccessRules {
+			target := fmt.Sprintf("access rule in zone %s (%s)", r.Zone, ip)
+			changed, err := c.updateAccessRule(ctx, r, ip, previous, req.DryRun)
+			addOutcome(res, target, changed, req.DryRun, err)
+		}
+	}
+	return res, res.Err()
+}
+
+// addOutcome records the outcome of a list or access rule update
+func addOutcome(res *Result, target string, changed, dryRun bool, err error) {
+	switch {
+	case err != nil:
+		res.Add(target, Failed, "%s", err)
+	case changed && dryRun:
+		res.Add(target, Changed, "would be replaced")
+	case changed:
+		res.Add(target, Changed, "replaced")
+	default:
+		res.Add(target, Unchanged, "already present")
+	}
+}
+
+// listEntry returns the list item for ip. IPv6 addresses can only be added to lists as
+// prefixes of at most /64, so the /64 containing ip is used
+func listEntry(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
+
+// parseEntry parses an IP or CIDR range as found in lists and access rules. It
+// returns the normalized entry and whether it is an IPv4 entry
+func parseEntry(entry string) (string, bool, error) {
+	if strings.Contains(entry, "/") {
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return "", false, err
+		}
+		return ipnet.String(), ipnet.IP.To4() != nil, nil
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return "", false, fmt.Errorf("invalid IP address %q", entry)
+	}
+	return ip.String(), ip.To4() != nil, nil
+}
+
+// updateList makes sure the list contains ip and removes the managed item of `previous`.
+// If previous is nil, all managed items of the same address family which point elsewhere
+// are removed. It returns whether the list was changed
+func (c *CloudFlareListUpdate) updateList(ctx context.Context, l *cfg.CloudflareList, ip, previous net.IP, dryRun bool) (bool, error) {
+	rc := cloudflare.AccountIdentifier(l.Account)
+
+	listID, err := c.listID(ctx, l)
+	if err != nil {
+		return false, err
+	}
+
+	var items []cloudflare.ListItem
+	listItems := func() error {
+		return c.backoff(ctx, func() (err error) {
+			items, err = c.api.ListListItems(ctx, rc, cloudflare.ListListItemsParams{ID: listID})
+			return err
+		})
+	}
+	err = listItems()
+	if isNotFound(err) {
+		// the list may have been re-created. Look up its ID once more
+		c.log.Debugf("list %s not found with cached ID. Refreshing", l.Name)
+		delete(c.cache.lists, listKey(l.Account, l.Name))
+		listID, err = c.listID(ctx, l)
+		if err == nil {
+			err = listItems()
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+
+	entry := listEntry(ip)
+	isV4 := ip.To4() != nil
+
+	var (
+		present bool
+		stale   []cloudflare.ListItemDeleteItemRequest
+	)
+	for _, item := range items {
+		if item.IP == nil {
+			continue
+		}
+		normalized, v4, err := parseEntry(*item.IP)
+		if err != nil {
+			c.log.Debugf("skipping list item %q: %s", *item.IP, err)
+			continue
+		}
+		if normalized == entry {
+			present = true
+			continue
+		}
+		if item.Comment != c.marker() || v4 != isV4 {
+			continue
+		}
+		if previous == nil || normalized == listEntry(previous) {
+			stale = append(stale, cloudflare.ListItemDeleteItemRequest{ID: item.ID})
+		}
+	}
+
+	if present && len(stale) == 0 {
+		return false, nil
+	}
+	if dryRun {
+		return true, nil
+	}
+
+	// add the new IP before removing the old one, so that the list is never without
+	// the current IP
+	if !present {
+		err = c.backoff(ctx, func() error {
+			_, err := c.api.CreateListItems(ctx, rc, cloudflare.ListCreateItemsParams{
+				ID: listID,
+				Items: []cloudflare.ListItemCreateRequest{
+					{IP: &entry, Comment: c.marker()},
+				},
+			})
+			return err
+		})
+		if err != nil {
+			return false, err
+		}
+		c.log.Debugf("added '%s' to list %s", entry, l.Name)
+	}
+	if len(stale) > 0 {
+		err = c.backoff(ctx, func() error {
+			_, err := c.api.DeleteListItems(ctx, rc, cloudflare.ListDeleteItemsParams{
+				ID:    listID,
+				Items: cloudflare.ListItemDeleteRequest{Items: stale},
+			})
+			return err
+		})
+		if err != nil {
+			return false, err
+		}
+		c.log.Debugf("removed %d outdated items from list %s", len(stale), l.Name)
+	}
+	return true, nil
+}
+
+// listID returns the ID of a list. It is only looked up if it isn't cached yet
+func (c *CloudFlareListUpdate) listID(ctx context.Context, l *cfg.CloudflareList) (string, error) {
+	key := listKey(l.Account, l.Name)
+	if id, ok := c.cache.lists[key]; ok {
+		return id, nil
+	}
+
+	var lists []cloudflare.List
+	err := c.backoff(ctx, func() (err error) {
+		lists, err = c.api.ListLists(ctx, cloudflare.AccountIdentifier(l.Account), cloudflare.ListListsParams{})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, list := range lists {
+		if list.Name != l.Name {
+			continue
+		}
+		if list.Kind != "" && list.Kind != "ip" {
+			return "", fmt.Errorf("list is of kind %q, not ip", list.Kind)
+		}
+		c.cache.lists[key] = list.ID
+		return list.ID, nil
+	}
+	return "", fmt.Errorf("list not found in account %s", l.Account)
+}
+
+// updateAccessRule makes sure the zone has an access rule for ip and removes the
+// managed rule of `previous`. If previous is nil, all managed rules of the same address
+// family which point elsewhere are removed. It returns whether the rules were changed
+func (c *CloudFlareListUpdate) updateAccessRule(ctx context.Context, r *cfg.CloudflareAccessRule, ip, previous net.IP, dryRun bool) (bool, error) {
+	zoneID, err := c.zoneID(ctx, r.Zone)
+	if err != nil {
+		return false, err
+	}
+
+	target := "ip"
+	if ip.To4() == nil {
+		target = "ip6"
+	}
+	mode := strings.ToLower(r.Mode)
+	if mode == "" {
+		mode = cfDefaultAccessRuleMode
+	}
+
+	rules, err := c.accessRules(ctx, zoneID, target)
+	if isNotFound(err) {
+		// the zone may have been re-created. Look up its ID once more
+		c.log.Debugf("zone %s not found with cached ID. Refreshing", r.Zone)
+		c.cache.invalidateZone(r.Zone)
+		zoneID, err = c.zoneID(ctx, r.Zone)
+		if err == nil {
+			rules, err = c.accessRules(ctx, zoneID, target)
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var (
+		present bool
+		stale   []string
+	)
+	for _, rule := range rules {
+		value := net.ParseIP(rule.Configuration.Value)
+		if value != nil && value.Equal(ip) {
+			present = true
+			if rule.Mode != mode {
+				c.log.Warnf("access rule for '%s' in zone %s has mode %s instead of %s", ip, r.Zone, rule.Mode, mode)
+			}
+			continue
+		}
+		if rule.Notes != c.marker() {
+			continue
+		}
+		if previous == nil || (value != nil && value.Equal(previous)) {
+			stale = append(stale, rule.ID)
+		}
+	}
+
+	if present && len(stale) == 0 {
+		return false, nil
+	}
+	if dryRun {
+		return true, nil
+	}
+
+	if !present {
+		err = c.backoff(ctx, func() error {
+			_, err := c.api.CreateZoneAccessRule(ctx, zoneID, cloudflare.AccessRule{
+				Mode:  mode,
+				Notes: c.marker(),
+				Configuration: cloudflare.AccessRuleConfiguration{
+					Target: target,
+					Value:  ip.String(),
+				},
+			})
+			return err
+		})
+		if err != nil {
+			return false, err
+		}
+		c.log.Debugf("created %s access rule for '%s' in zone %s", mode, ip, r.Zone)
+	}
+	for _, id := range stale {
+		err = c.backoff(ctx, func() error {
+			_, err := c.api.DeleteZoneAccessRule(ctx, zoneID, id)
+			return err
+		})
+		if err != nil {
+			return false, err
+		}
+		c.log.Debugf("removed outdated access rule %s in zone %s", id, r.Zone)
+	}
+	return true, nil
+}
+
+// accessRules returns all access rules of a zone for the target type. It walks through
+// all pages of the result
+func (c *CloudFlareListUpdate) accessRules(ctx context.Context, zoneID, target string) ([]cloudflare.AccessRule, error) {
+	filter := cloudflare.AccessRule{
+		Configuration: cloudflare.AccessRuleConfiguration{Target: target},
+	}
+
+	var rules []cloudflare.AccessRule
+	for page := 1; ; page++ {
+		var resp *cloudflare.AccessRuleListResponse
+		err := c.backoff(ctx, func() (err error) {
+			resp, err = c.api.ListZoneAccessRules(ctx, zoneID, filter, page)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, resp.Result...)
+
+		if !resp.ResultInfo.HasMorePages() || len(resp.Result) == 0 {
+			return rules, nil
+		}
+	}
+}
+
+// zoneID returns the ID of a zone. It is only looked up if it isn't cached yet
+func (c *CloudFlareListUpdate) zoneID(ctx context.Context, zone string) (string, error) {
+	return c.cache.zoneID(ctx, c.api, c.backoff, zone)
+}
+
+func (c *CloudFlareListUpdate) backoff(ctx context.Context, call func() error) error {
+	return cfBackoff(ctx, c.log, c.retryDelay, call)
+}
@@ -0,0 +1,414 @@
+package update
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+
+	cloudflare "github.com/cloudflare/cloudflare-go"
+	"github.com/els0r/dynip-ng/pkg/cfg"
+)
+
+// mock API for cloudflare lists and access rules
+type mockListsAPI struct {
+	*mockAPI
+
+	accountID string
+	lists     []cloudflare.List
+	items     map[string][]cloudflare.ListItem
+	rules     []cloudflare.AccessRule
+
+	// number of modifications of lists and rules
+	writes int
+
+	// rules returned per page
+	rulesPerPage int
+}
+
+func (m *mockListsAPI) ListLists(_ context.Context, rc *cloudflare.ResourceContainer, _ cloudflare.ListListsParams) ([]cloudflare.List, error) {
+	if rc.Identifier != m.accountID {
+		return nil, notFound("account %s not found", rc.Identifier)
+	}
+	return m.lists, nil
+}
+
+func (m *mockListsAPI) ListListItems(_ context.Context, rc *cloudflare.ResourceContainer, params cloudflare.ListListItemsParams) ([]cloudflare.ListItem, error) {
+	if rc.Identifier != m.accountID {
+		return nil, notFound("account %s not found", rc.Identifier)
+	}
+	items, ok := m.items[params.ID]
+	if !ok {
+		return nil, notFound("list %s not found", params.ID)
+	}
+	return items, nil
+}
+
+func (m *mockListsAPI) CreateListItems(_ context.Context, rc *cloudflare.ResourceContainer, params cloudflare.ListCreateItemsParams) ([]cloudflare.ListItem, error) {
+	if rc.Identifier != m.accountID {
+		return nil, notFound("account %s not found", rc.Identifier)
+	}
+	m.writes++
+	for _, item := range params.Items {
+		m.items[params.ID] = append(m.items[params.ID], cloudflare.ListItem{
+			ID:      fmt.Sprintf("createdItemID%d", len(m.items[params.ID])),
+			IP:      item.IP,
+			Comment: item.Comment,
+		})
+	}
+	return m.items[params.ID], nil
+}
+
+func (m *mockListsAPI) DeleteListItems(_ context.Context, rc *cloudflare.ResourceContainer, params cloudflare.ListDeleteItemsParams) ([]cloudflare.ListItem, error) {
+	if rc.Identifier != m.accountID {
+		return nil, notFound("account %s not found", rc.Identifier)
+	}
+	m.writes++
+	for _, del := range params.Items.Items {
+		items := m.items[params.ID]
+		for i, item := range items {
+			if item.ID == del.ID {
+				m.items[params.ID] = append(items[:i], items[i+1:]...)
+				break
+			}
+		}
+	}
+	return m.items[params.ID], nil
+}
+
+func (m *mockListsAPI) ListZoneAccessRules(_ context.Context, zoneID string, filter cloudflare.AccessRule, page int) (*cloudflare.AccessRuleListResponse, error) {
+	if zoneID != m.zoneID {
+		return nil, notFound("zone ID %s not found", zoneID)
+	}
+	var matching []cloudflare.AccessRule
+	for _, r := range m.rules {
+		if filter.Configuration.Target != "" && r.Configuration.Target != filter.Configuration.Target {
+			continue
+		}
+		matching = append(matching, r)
+	}
+
+	perPage := m.rulesPerPage
+	if perPage == 0 {
+		perPage = 100
+	}
+	resp := &cloudflare.AccessRuleListResponse{
+		ResultInfo: cloudflare.ResultInfo{
+			Page:       page,
+			PerPage:    perPage,
+			Total:      len(matching),
+			TotalPages: (len(matching) + perPage - 1) / perPage,
+		},
+	}
+	start := (page - 1) * perPage
+	if start >= len(matching) {
+		return resp, nil
+	}
+	end := start + perPage
+	if end > len(matching) {
+		end = len(matching)
+	}
+	resp.Result = matching[start:end]
+	return resp, nil
+}
+
+func (m *mockListsAPI) CreateZoneAccessRule(_ context.Context, zoneID string, rule cloudflare.AccessRule) (*cloudflare.AccessRuleResponse, error) {
+	if zoneID != m.zoneID {
+		return nil, notFound("zone ID %s not found", zoneID)
+	}
+	for _, r := range m.rules {
+		if r.Configuration == rule.Configuration {
+			return nil, fmt.Errorf("duplicate of an existing rule")
+		}
+	}
+	m.writes++
+	rule.ID = fmt.Sprintf("createdRuleID%d", len(m.rules))
+	m.rules = append(m.rules, rule)
+	return &cloudflare.AccessRuleResponse{Result: rule}, nil
+}
+
+func (m *mockListsAPI) DeleteZoneAccessRule(_ context.Context, zoneID, ruleID string) (*cloudflare.AccessRuleResponse, error) {
+	if zoneID != m.zoneID {
+		return nil, notFound("zone ID %s not found", zoneID)
+	}
+	for i, r := range m.rules {
+		if r.ID == ruleID {
+			m.writes++
+			m.rules = append(m.rules[:i], m.rules[i+1:]...)
+			return &cloudflare.AccessRuleResponse{Result: r}, nil
+		}
+	}
+	return nil, notFound("rule %s not found", ruleID)
+}
+
+func strPtr(s string) *string { return &s }
+
+func newMockListsAPI() *mockListsAPI {
+	return &mockListsAPI{
+		mockAPI: &mockAPI{
+			zoneName: "example.com",
+			zoneID:   "zoneID",
+		},
+		accountID: "accountID",
+		lists: []cloudflare.List{
+			{ID: "listID", Name: "office", Kind: "ip"},
+			{ID: "hostsID", Name: "hosts", Kind: "hostname"},
+		},
+		items: map[string][]cloudflare.ListItem{
+			"listID": {
+				{ID: "item1", IP: strPtr("192.0.2.1"), Comment: cfDefaultListComment},
+				{ID: "item2", IP: strPtr("198.51.100.0/24"), Comment: "branch office"},
+				{ID: "item3", IP: strPtr("2001:db8:1::/64"), Comment: cfDefaultListComment},
+				{ID: "item4", IP: strPtr("192.0.2.99"), Comment: "vpn"},
+			},
+			"hostsID": {},
+		},
+		rules: []cloudflare.AccessRule{
+			{ID: "rule1", Mode: "whitelist", Notes: cfDefaultListComment, Configuration: cloudflare.AccessRuleConfiguration{Target: "ip", Value: "192.0.2.1"}},
+			{ID: "rule2", Mode: "block", Notes: "abuse", Configuration: cloudflare.AccessRuleConfiguration{Target: "ip", Value: "203.0.113.66"}},
+			{ID: "rule3", Mode: "whitelist", Notes: cfDefaultListComment, Configuration: cloudflare.AccessRuleConfiguration{Target: "ip6", Value: "2001:db8:1::1"}},
+		},
+	}
+}
+
+func listIPs(items []cloudflare.ListItem) []string {
+	var ips []string
+	for _, item := range items {
+		ips = append(ips, *item.IP)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+func ruleValues(rules []cloudflare.AccessRule) []string {
+	var values []string
+	for _, r := range rules {
+		values = append(values, r.Configuration.Value)
+	}
+	sort.Strings(values)
+	return values
+}
+
+func TestCloudFlareListUpdate(t *testing.T) {
+	var tests = []struct {
+		name       string
+		IP         string
+		list       string
+		zone       string
+		items      []string
+		rules      []string
+		writes     int
+		shouldPass bool
+	}{
+		{"replace IPv4", "203.0.113.7", "office", "example.com",
+			[]string{"192.0.2.99", "198.51.100.0/24", "2001:db8:1::/64", "203.0.113.7"},
+			[]string{"2001:db8:1::1", "203.0.113.66", "203.0.113.7"},
+			4, true,
+		},
+		{"replace IPv6", "2001:db8:2::1", "office", "example.com",
+			[]string{"192.0.2.1", "192.0.2.99", "198.51.100.0/24", "2001:db8:2::/64"},
+			[]string{"192.0.2.1", "2001:db8:2::1", "203.0.113.66"},
+			4, true,
+		},
+		{"unchanged", "192.0.2.1", "office", "example.com",
+			[]string{"192.0.2.1", "192.0.2.99", "198.51.100.0/24", "2001:db8:1::/64"},
+			[]string{"192.0.2.1", "2001:db8:1::1", "203.0.113.66"},
+			0, true,
+		},
+		{"IP already listed by someone else", "192.0.2.99", "office", "",
+			[]string{"192.0.2.99", "198.51.100.0/24", "2001:db8:1::/64"},
+			nil,
+			1, true,
+		},
+		{"list not found", "203.0.113.7", "notAvailable", "",
+			[]string{"192.0.2.1", "192.0.2.99", "198.51.100.0/24", "2001:db8:1::/64"},
+			nil,
+			0, false,
+		},
+		{"not an IP list", "203.0.113.7", "hosts", "",
+			[]string{"192.0.2.1", "192.0.2.99", "198.51.100.0/24", "2001:db8:1::/64"},
+			nil,
+			0, false,
+		},
+		{"zone not found", "203.0.113.7", "", "example.org",
+			[]string{"192.0.2.1", "192.0.2.99", "198.51.100.0/24", "2001:db8:1::/64"},
+			[]string{"192.0.2.1", "2001:db8:1::1", "203.0.113.66"},
+			0, false,
+		},
+		{"invalid IP", "not-an-ip", "office", "example.com",
+			[]string{"192.0.2.1", "192.0.2.99", "198.51.100.0/24", "2001:db8:1::/64"},
+			[]string{"192.0.2.1", "2001:db8:1::1", "203.0.113.66"},
+			0, false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newMockListsAPI()
+			api.rulesPerPage = 1
+
+			lcfg := &cfg.CloudflareListsConfig{
+				Access: cfg.CloudflareAccess{Token: "token"},
+			}
+			if test.list != "" {
+				lcfg.Lists = []*cfg.CloudflareList{{Account: "accountID", Name: test.list}}
+			}
+			if test.zone != "" {
+				lcfg.AccessRules = []*cfg.CloudflareAccessRule{{Zone: test.zone}}
+			}
+
+			lu, err := NewCloudFlareListUpdate(lcfg, WithCFListsAPI(api))
+			if err != nil {
+				t.Fatalf("couldn't create cloudflare lists updater: %s", err)
+			}
+
+			err = lu.Update(context.Background(), test.IP)
+			if test.shouldPass {
+				if err != nil {
+					t.Fatalf("cloudflare lists update failed: %s", err)
+				}
+			} else {
+				if err == nil {
+					t.Fatalf("cloudflare lists update should have failed but didn't")
+				}
+				t.Logf("provoked expected error: %s", err)
+			}
+
+			items := listIPs(api.items["listID"])
+			if fmt.Sprint(items) != fmt.Sprint(test.items) {
+				t.Fatalf("unexpected list items: got %v, want %v", items, test.items)
+			}
+			if test.rules != nil {
+				rules := ruleValues(api.rules)
+				if fmt.Sprint(rules) != fmt.Sprint(test.rules) {
+					t.Fatalf("unexpected access rules: got %v, want %v", rules, test.rules)
+				}
+			}
+			if api.writes != test.writes {
+				t.Fatalf("unexpected number of writes: got %d, want %d", api.writes, test.writes)
+			}
+		})
+	}
+}
+
+func TestCloudFlareListCache(t *testing.T) {
+	api := newMockListsAPI()
+	lu, err := NewCloudFlareListUpdate(&cfg.CloudflareListsConfig{
+		Access:      cfg.CloudflareAccess{Token: "token"},
+		Lists:       []*cfg.CloudflareList{{Account: "accountID", Name: "office"}},
+		AccessRules: []*cfg.CloudflareAccessRule{{Zone: "example.com"}},
+	}, WithCFListsAPI(api))
+	if err != nil {
+		t.Fatalf("couldn't create cloudflare lists updater: %s", err)
+	}
+
+	var steps = []struct {
+		name   string
+		IP     string
+		modify func()
+	}{
+		{"initial lookup", "203.0.113.7", func() {}},
+		{"list and zone re-created", "203.0.113.8", func() {
+			api.lists[0].ID = "newListID"
+			api.items["newListID"] = api.items["listID"]
+			delete(api.items, "listID")
+			api.zoneID = "newZoneID"
+		}},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			step.modify()
+
+			err = lu.Update(context.Background(), step.IP)
+			if err != nil {
+				t.Fatalf("cloudflare lists update failed: %s", err)
+			}
+			if items := listIPs(api.items[api.lists[0].ID]); items[len(items)-1] != step.IP {
+				t.Fatalf("IP wasn't added to the list: %v", items)
+			}
+			if rules := ruleValues(api.rules); rules[len(rules)-1] != step.IP {
+				t.Fatalf("IP wasn't added to the access rules: %v", rules)
+			}
+		})
+	}
+}
+
+func TestListEntry(t *testing.T) {
+	var tests = []struct {
+		IP       string
+		expected string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+	}
+
+	for _, test := range tests {
+		got := listEntry(net.ParseIP(test.IP))
+		if got != test.expected {
+			t.Fatalf("unexpected list entry for %s: got %s, want %s", test.IP, got, test.expected)
+		}
+	}
+}
+
+func TestCloudFlareListUpdateShared(t *testing.T) {
+	api := newMockListsAPI()
+
+	newInstance := func(name string) *CloudFlareListUpdate {
+		lu, err := NewCloudFlareListUpdate(&cfg.CloudflareListsConfig{
+			Access:      cfg.CloudflareAccess{Token: "token"},
+			Lists:       []*cfg.CloudflareList{{Account: "accountID", Name: "office"}},
+			AccessRules: []*cfg.CloudflareAccessRule{{Zone: "example.com"}},
+		}, WithCFListsAPI(api))
+		if err != nil {
+			t.Fatalf("couldn't create cloudflare lists updater: %s", err)
+		}
+		lu.SetName(name)
+		return lu
+	}
+	home, branch := newInstance("home"), newInstance("branch")
+
+	var steps = []struct {
+		lu    *CloudFlareListUpdate
+		req   *Request
+		items []string
+		rules []string
+	}{
+		// the first run of an instance doesn't touch the items of the other one
+		{home, &Request{IPv4: "203.0.113.7"},
+			[]string{"192.0.2.1", "192.0.2.99", "198.51.100.0/24", "2001:db8:1::/64", "203.0.113.7"},
+			[]string{"192.0.2.1", "2001:db8:1::1", "203.0.113.66", "203.0.113.7"},
+		},
+		{branch, &Request{IPv4: "203.0.113.8"},
+			[]string{"192.0.2.1", "192.0.2.99", "198.51.100.0/24", "2001:db8:1::/64", "203.0.113.7", "203.0.113.8"},
+			[]string{"192.0.2.1", "2001:db8:1::1", "203.0.113.66", "203.0.113.7", "203.0.113.8"},
+		},
+		// only the previous IP of the instance is replaced
+		{home, &Request{IPv4: "203.0.113.9", PreviousIPv4: "203.0.113.7"},
+			[]string{"192.0.2.1", "192.0.2.99", "198.51.100.0/24", "2001:db8:1::/64", "203.0.113.8", "203.0.113.9"},
+			[]string{"192.0.2.1", "2001:db8:1::1", "203.0.113.66", "203.0.113.8", "203.0.113.9"},
+		},
+		// the previous IP isn't removed if it was marked by the other instance
+		{branch, &Request{IPv4: "203.0.113.10", PreviousIPv4: "203.0.113.9"},
+			[]string{"192.0.2.1", "192.0.2.99", "198.51.100.0/24", "2001:db8:1::/64", "203.0.113.10", "203.0.113.8", "203.0.113.9"},
+			[]string{"192.0.2.1", "2001:db8:1::1", "203.0.113.10", "203.0.113.66", "203.0.113.8", "203.0.113.9"},
+		},
+	}
+
+	for i, step := range steps {
+		_, err := step.lu.Apply(context.Background(), step.req)
+		if err != nil {
+			t.Fatalf("[%d] cloudflare lists update failed: %s", i, err)
+		}
+
+		items := listIPs(api.items["listID"])
+		if fmt.Sprint(items) != fmt.Sprint(step.items) {
+			t.Fatalf("[%d] unexpected list items: got %v, want %v", i, items, step.items)
+		}
+		rules := ruleValues(api.rules)
+		if fmt.Sprint(rules) != fmt.Sprint(step.rules) {
+			t.Fatalf("[%d] unexpected access rules: got %v, want %v", i, rules, step.rules)
+		}
+	}
+}
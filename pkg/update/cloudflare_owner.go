@@ -0,0 +1,80 @@
+package update
+
+import (
+	"regexp"
+	"strings"
+
+	cloudflare "github.com/cloudflare/cloudflare-go"
+	"github.com/els0r/dynip-ng/pkg/cfg"
+)
+
+// ownerKey is the key of the ownership marker in comments and tags
+const ownerKey = "managed-by"
+
+// matches managed-by=<owner> in record comments
+var ownerCommentRegex = regexp.MustCompile(ownerKey + `=(\S+)`)
+
+// ownerMarker claims records for a dynip-ng instance. In comments, the marker is
+// written as managed-by=dynip-ng:<instance>. As a tag, it is managed-by:dynip-ng:<instance>
+type ownerMarker struct {
+	value   string
+	useTag  bool
+	cleanup bool
+}
+
+func newOwnerMarker(o *cfg.Ownership) *ownerMarker {
+	if o == nil {
+		return nil
+	}
+	return &ownerMarker{
+		value:   "dynip-ng:" + o.Instance,
+		useTag:  strings.ToLower(o.Marker) == "tag",
+		cleanup: o.Cleanup,
+	}
+}
+
+// recordOwner returns the owner recorded in the comment or the tags of r. It returns an
+// empty string if the record isn't claimed by anyone
+func recordOwner(r cloudflare.DNSRecord) string {
+	if m := ownerCommentRegex.FindStringSubmatch(r.Comment); m != nil {
+		return m[1]
+	}
+	for _, tag := range r.Tags {
+		if strings.HasPrefix(tag, ownerKey+":") {
+			return strings.TrimPrefix(tag, ownerKey+":")
+		}
+	}
+	return ""
+}
+
+// owns checks if r is claimed by this instance
+func (o *ownerMarker) owns(r cloudflare.DNSRecord) bool {
+	return recordOwner(r) == o.value
+}
+
+// claim adds the marker to the comment or the tags of a record update
+func (o *ownerMarker) claim(params *cloudflare.UpdateDNSRecordParams, r cloudflare.DNSRecord) {
+	if o.useTag {
+		params.Tags = append(params.Tags, o.tag())
+		return
+	}
+	comment := strings.TrimSpace(r.Comment + " " + o.comment())
+	params.Comment = &comment
+}
+
+// claimNew adds the marker to the comment or the tags of a record that is created
+func (o *ownerMarker) claimNew(params *cloudflare.CreateDNSRecordParams) {
+	if o.useTag {
+		params.Tags = append(params.Tags, o.tag())
+		return
+	}
+	params.Comment = strings.TrimSpace(params.Comment + " " + o.comment())
+}
+
+func (o *ownerMarker) comment() string {
+	return ownerKey + "=" + o.value
+}
+
+func (o *ownerMarker) tag() string {
+	return ownerKey + ":" + o.value
+}
@@ -2,11 +2,16 @@ package update
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	cloudflare "github.com/cloudflare/cloudflare-go"
 	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/logging"
 )
 
 // mock API for cloudflare to test program flow
@@ -14,9 +19,45 @@ type mockAPI struct {
 	zoneName string
 	zoneID   string
 	records  []cloudflare.DNSRecord
+
+	// number of record updates
+	writes int
+
+	// accept updates without applying them
+	dropWrites bool
+
+	// number of calls to the API's lookup functions
+	zoneLookups int
+	listCalls   int
+	getCalls    int
+
+	// number of calls answered with a rate limit error before succeeding
+	rateLimited int
+}
+
+func notFound(format string, args ...interface{}) error {
+	return cloudflare.NewNotFoundError(&cloudflare.Error{
+		StatusCode:    404,
+		ErrorMessages: []string{fmt.Sprintf(format, args...)},
+	})
+}
+
+func (m *mockAPI) limit() error {
+	if m.rateLimited > 0 {
+		m.rateLimited--
+		return cloudflare.NewRatelimitError(&cloudflare.Error{
+			StatusCode: 429,
+			Type:       cloudflare.ErrorTypeRateLimit,
+		})
+	}
+	return nil
 }
 
 func (m *mockAPI) ZoneIDByName(name string) (string, error) {
+	m.zoneLookups++
+	if err := m.limit(); err != nil {
+		return "", err
+	}
 	if name != m.zoneName {
 		return "", fmt.Errorf("no zone ID found for name: %s", name)
 	}
@@ -24,10 +65,64 @@ func (m *mockAPI) ZoneIDByName(name string) (string, error) {
 }
 
 func (m *mockAPI) ListDNSRecords(_ context.Context, rc *cloudflare.ResourceContainer, params cloudflare.ListDNSRecordsParams) ([]cloudflare.DNSRecord, *cloudflare.ResultInfo, error) {
+	m.listCalls++
+	if err := m.limit(); err != nil {
+		return nil, nil, err
+	}
 	if rc.Identifier != m.zoneID {
-		return nil, nil, fmt.Errorf("no records found for zone ID: %s", rc.Identifier)
+		return nil, nil, notFound("no records found for zone ID: %s", rc.Identifier)
+	}
+
+	// filter like the API does
+	var matching []cloudflare.DNSRecord
+	for _, r := range m.records {
+		if params.Name != "" && r.Name != params.Name {
+			continue
+		}
+		if params.Type != "" && r.Type != params.Type {
+			continue
+		}
+		if len(params.Tags) > 0 && !hasTags(r, params.Tags) {
+			continue
+		}
+		matching = append(matching, r)
+	}
+
+	// return the requested page
+	if params.PerPage == 0 {
+		return matching, &cloudflare.ResultInfo{}, nil
 	}
-	return m.records, &cloudflare.ResultInfo{}, nil
+	info := &cloudflare.ResultInfo{
+		Page:       params.Page,
+		PerPage:    params.PerPage,
+		Total:      len(matching),
+		TotalPages: (len(matching) + params.PerPage - 1) / params.PerPage,
+	}
+	start := (params.Page - 1) * params.PerPage
+	if start >= len(matching) {
+		return nil, info, nil
+	}
+	end := start + params.PerPage
+	if end > len(matching) {
+		end = len(matching)
+	}
+	info.Count = end - start
+	return matching[start:end], info, nil
+}
+
+func hasTags(r cloudflare.DNSRecord, tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, t := range r.Tags {
+			if t == tag {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
 }
 
 func (m *mockAPI) UpdateDNSRecord(_ context.Context, rc *cloudflare.ResourceContainer, params cloudflare.UpdateDNSRecordParams) (cloudflare.DNSRecord, error) {
@@ -36,13 +131,75 @@ func (m *mockAPI) UpdateDNSRecord(_ context.Context, rc *cloudflare.ResourceCont
 	}
 	for i, record := range m.records {
 		if record.ID == params.ID {
+			m.writes++
+			if m.dropWrites {
+				return m.records[i], nil
+			}
 			m.records[i].Content = params.Content
+			m.records[i].TTL = params.TTL
+			m.records[i].Proxied = params.Proxied
+			m.records[i].Tags = params.Tags
+			if params.Comment != nil {
+				m.records[i].Comment = *params.Comment
+			}
 			return m.records[i], nil
 		}
 	}
 	return cloudflare.DNSRecord{}, fmt.Errorf("record %q could not be found in zone", params.ID)
 }
 
+func (m *mockAPI) GetDNSRecord(_ context.Context, rc *cloudflare.ResourceContainer, recordID string) (cloudflare.DNSRecord, error) {
+	m.getCalls++
+	if err := m.limit(); err != nil {
+		return cloudflare.DNSRecord{}, err
+	}
+	if rc.Identifier != m.zoneID {
+		return cloudflare.DNSRecord{}, notFound("zone ID %s not found", rc.Identifier)
+	}
+	for _, record := range m.records {
+		if record.ID == recordID {
+			return record, nil
+		}
+	}
+	return cloudflare.DNSRecord{}, notFound("record %q could not be found in zone", recordID)
+}
+
+func (m *mockAPI) DeleteDNSRecord(_ context.Context, rc *cloudflare.ResourceContainer, recordID string) error {
+	if rc.Identifier != m.zoneID {
+		return fmt.Errorf("zone ID %s not found", rc.Identifier)
+	}
+	for i, record := range m.records {
+		if record.ID == recordID {
+			m.records = append(m.records[:i], m.records[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("record %q could not be found in zone", recordID)
+}
+
+func (m *mockAPI) CreateDNSRecord(_ context.Context, rc *cloudflare.ResourceContainer, params cloudflare.CreateDNSRecordParams) (cloudflare.DNSRecord, error) {
+	if rc.Identifier != m.zoneID {
+		return cloudflare.DNSRecord{}, fmt.Errorf("zone ID %s not found", rc.Identifier)
+	}
+	for _, record := range m.records {
+		if record.Name == params.Name && record.Type == params.Type {
+			return cloudflare.DNSRecord{}, fmt.Errorf("record %q already exists", params.Name)
+		}
+	}
+	record := cloudflare.DNSRecord{
+		ID:      fmt.Sprintf("createdRecordID%d", len(m.records)),
+		Type:    params.Type,
+		Name:    params.Name,
+		Content: params.Content,
+		TTL:     params.TTL,
+		Proxied: params.Proxied,
+		Comment: params.Comment,
+		Tags:    params.Tags,
+	}
+	m.records = append(m.records, record)
+	return record, nil
+}
+
 func TestNewCloudFlare(t *testing.T) {
 
 	var tests = []struct {
@@ -153,6 +310,12 @@ func TestCloudFlareUpdate(t *testing.T) {
 			},
 			Access: struct{ Token, Key, Email string }{"", "key", "e@mail.com"},
 		}, false},
+		{"record created", IP, &cfg.CloudflareAPI{
+			Zones: map[string]*cfg.Zone{
+				zoneName: &cfg.Zone{Record: "notAvailable", Create: true},
+			},
+			Access: struct{ Token, Key, Email string }{"", "key", "e@mail.com"},
+		}, true},
 	}
 
 	for _, test := range tests {
@@ -192,3 +355,540 @@ func TestCloudFlareUpdate(t *testing.T) {
 		})
 	}
 }
+
+func TestCloudFlareCreate(t *testing.T) {
+	var zoneName, zoneID = "testZone", "testZoneID"
+
+	api := &mockAPI{
+		zoneName: zoneName,
+		zoneID:   zoneID,
+		records: []cloudflare.DNSRecord{
+			{Type: "A", ID: "otherRecordID", Content: "192.168.1.1", Name: "other." + zoneName},
+		},
+	}
+	c, err := NewCloudFlareUpdate(&cfg.CloudflareAPI{
+		Zones: map[string]*cfg.Zone{
+			zoneName: {Record: "new", Create: true, TTL: 120, Proxied: true, Comment: "dynip-ng"},
+		},
+		Access: struct{ Token, Key, Email string }{"token", "", ""},
+	}, WithCFAPI(api))
+	if err != nil {
+		t.Fatalf("couldn't create cloudflare updater: %s", err)
+	}
+
+	// the first update creates the record, the second one updates it
+	for _, IP := range []string{"192.168.1.2", "192.168.1.3"} {
+		err = c.Update(context.Background(), IP)
+		if err != nil {
+			t.Fatalf("cloudflare update failed: %s", err)
+		}
+		if len(api.records) != 2 {
+			t.Fatalf("expected exactly one record to be created, have %d records", len(api.records))
+		}
+
+		r := api.records[1]
+		if r.Name != "new."+zoneName || r.Type != "A" || r.Content != IP {
+			t.Fatalf("unexpected record: %+v", r)
+		}
+		if r.TTL != 120 || r.Proxied == nil || !*r.Proxied || r.Comment != "dynip-ng" {
+			t.Fatalf("record settings weren't applied: %+v", r)
+		}
+	}
+}
+
+func TestCloudFlareRecords(t *testing.T) {
+	var (
+		zoneName, zoneID = "example.com", "testZoneID"
+		ttl              = 300
+		proxied          = true
+		notProxied       = false
+	)
+
+	api := &mockAPI{
+		zoneName: zoneName,
+		zoneID:   zoneID,
+		records: []cloudflare.DNSRecord{
+			{Type: "A", ID: "apex", Content: "192.168.1.1", Name: "example.com", TTL: 1, Proxied: &proxied},
+			{Type: "A", ID: "wildcard", Content: "192.168.1.1", Name: "*.example.com", TTL: 120, Proxied: &notProxied},
+			{Type: "A", ID: "www", Content: "192.168.1.1", Name: "www.example.com", TTL: 120, Proxied: &notProxied},
+			{Type: "AAAA", ID: "www6", Content: "2001:db8::1", Name: "www.example.com", TTL: 120, Proxied: &notProxied},
+			{Type: "A", ID: "other", Content: "192.168.1.1", Name: "other.example.com", TTL: 120},
+		},
+	}
+	c, err := NewCloudFlareUpdate(&cfg.CloudflareAPI{
+		Zones: map[string]*cfg.Zone{
+			zoneName: {Records: []*cfg.Record{
+				{Name: "@"},
+				{Name: "*"},
+				{Name: "www.example.com", Type: "A", TTL: &ttl, Proxied: &proxied},
+				{Name: "www", Type: "aaaa", TTL: &ttl},
+			}},
+		},
+		Access: struct{ Token, Key, Email string }{"token", "", ""},
+	}, WithCFAPI(api))
+	if err != nil {
+		t.Fatalf("couldn't create cloudflare updater: %s", err)
+	}
+
+	for _, IP := range []string{"192.168.1.2", "2001:db8::2"} {
+		err = c.Update(context.Background(), IP)
+		if err != nil {
+			t.Fatalf("cloudflare update to %s failed: %s", IP, err)
+		}
+	}
+
+	var expected = map[string]struct {
+		content string
+		ttl     int
+		proxied bool
+	}{
+		"apex":     {"192.168.1.2", 1, true},
+		"wildcard": {"192.168.1.2", 120, false},
+		"www":      {"192.168.1.2", 300, true},
+		"www6":     {"2001:db8::2", 300, false},
+		"other":    {"192.168.1.1", 120, false},
+	}
+	for _, r := range api.records {
+		e := expected[r.ID]
+		isProxied := r.Proxied != nil && *r.Proxied
+		if r.Content != e.content || r.TTL != e.ttl || isProxied != e.proxied {
+			t.Fatalf("unexpected state of record %s: content=%s ttl=%d proxied=%v", r.ID, r.Content, r.TTL, isProxied)
+		}
+	}
+}
+
+func TestCloudFlareNoOp(t *testing.T) {
+	var zoneName, zoneID = "example.com", "testZoneID"
+
+	var tests = []struct {
+		name       string
+		IP         string
+		dropWrites bool
+		writes     int
+		result     map[Outcome]int
+		shouldPass bool
+	}{
+		{"unchanged", "192.168.1.1", false, 0, map[Outcome]int{Unchanged: 2}, true},
+		{"changed", "192.168.1.2", false, 2, map[Outcome]int{Changed: 2}, true},
+		{"read back mismatch", "192.168.1.2", true, 2, map[Outcome]int{Failed: 2}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := &mockAPI{
+				zoneName:   zoneName,
+				zoneID:     zoneID,
+				dropWrites: test.dropWrites,
+				records: []cloudflare.DNSRecord{
+					{Type: "A", ID: "apex", Content: "192.168.1.1", Name: "example.com", TTL: 1},
+					{Type: "A", ID: "www", Content: "192.168.1.1", Name: "www.example.com", TTL: 1},
+				},
+			}
+			c, err := NewCloudFlareUpdate(&cfg.CloudflareAPI{
+				Zones: map[string]*cfg.Zone{
+					zoneName: {Records: []*cfg.Record{{Name: "@"}, {Name: "www"}}},
+				},
+				Access: struct{ Token, Key, Email string }{"token", "", ""},
+			}, WithCFAPI(api))
+			if err != nil {
+				t.Fatalf("couldn't create cloudflare updater: %s", err)
+			}
+
+			res, err := c.Apply(context.Background(), &Request{IPv4: test.IP})
+			if test.shouldPass {
+				if err != nil {
+					t.Fatalf("cloudflare update failed: %s", err)
+				}
+			} else {
+				if err == nil {
+					t.Fatalf("cloudflare update should have failed but didn't")
+				}
+				t.Logf("provoked expected error: %s", err)
+			}
+			if api.writes != test.writes {
+				t.Fatalf("unexpected number of writes: got %d, want %d", api.writes, test.writes)
+			}
+			checkOutcomes(t, res, test.result)
+		})
+	}
+}
+
+func TestCloudFlareOwnership(t *testing.T) {
+	var zoneName, zoneID = "example.com", "testZoneID"
+
+	var tests = []struct {
+		name       string
+		ownership  *cfg.Ownership
+		records    []cloudflare.DNSRecord
+		expected   map[string]string
+		result     map[Outcome]int
+		shouldPass bool
+	}{
+		{
+			"claim unowned record via comment",
+			&cfg.Ownership{Instance: "home"},
+			[]cloudflare.DNSRecord{
+				{Type: "A", ID: "www", Content: "192.168.1.2", Name: "www.example.com", TTL: 1, Comment: "web server"},
+			},
+			map[string]string{"www": "192.168.1.2"},
+			map[Outcome]int{Changed: 1},
+			true,
+		},
+		{
+			"claim unowned record via tag",
+			&cfg.Ownership{Instance: "home", Marker: "tag"},
+			[]cloudflare.DNSRecord{
+				{Type: "A", ID: "www", Content: "192.168.1.1", Name: "www.example.com", TTL: 1},
+			},
+			map[string]string{"www": "192.168.1.2"},
+			map[Outcome]int{Changed: 1},
+			true,
+		},
+		{
+			"owned record is unchanged",
+			&cfg.Ownership{Instance: "home"},
+			[]cloudflare.DNSRecord{
+				{Type: "A", ID: "www", Content: "192.168.1.2", Name: "www.example.com", TTL: 1, Comment: "managed-by=dynip-ng:home"},
+			},
+			map[string]string{"www": "192.168.1.2"},
+			map[Outcome]int{Unchanged: 1},
+			true,
+		},
+		{
+			"foreign record is left alone",
+			&cfg.Ownership{Instance: "home"},
+			[]cloudflare.DNSRecord{
+				{Type: "A", ID: "www", Content: "192.168.1.1", Name: "www.example.com", TTL: 1, Tags: []string{"managed-by:external-dns"}},
+			},
+			map[string]string{"www": "192.168.1.1"},
+			map[Outcome]int{Failed: 1},
+			false,
+		},
+		{
+			"foreign record is updated without ownership",
+			nil,
+			[]cloudflare.DNSRecord{
+				{Type: "A", ID: "www", Content: "192.168.1.1", Name: "www.example.com", TTL: 1, Tags: []string{"managed-by:external-dns"}},
+			},
+			map[string]string{"www": "192.168.1.2"},
+			map[Outcome]int{Changed: 1},
+			true,
+		},
+		{
+			"owned records no longer configured are removed",
+			&cfg.Ownership{Instance: "home", Cleanup: true},
+			[]cloudflare.DNSRecord{
+				{Type: "A", ID: "www", Content: "192.168.1.2", Name: "www.example.com", TTL: 1, Comment: "managed-by=dynip-ng:home"},
+				{Type: "A", ID: "old", Content: "192.168.1.1", Name: "old.example.com", TTL: 1, Comment: "managed-by=dynip-ng:home"},
+				{Type: "AAAA", ID: "www6", Content: "2001:db8::1", Name: "www.example.com", TTL: 1, Comment: "managed-by=dynip-ng:home"},
+				{Type: "A", ID: "office", Content: "192.168.1.1", Name: "office.example.com", TTL: 1, Comment: "managed-by=dynip-ng:office"},
+				{Type: "A", ID: "mail", Content: "192.168.1.1", Name: "mail.example.com", TTL: 1},
+			},
+			map[string]string{"www": "192.168.1.2", "www6": "2001:db8::1", "office": "192.168.1.1", "mail": "192.168.1.1"},
+			map[Outcome]int{Unchanged: 1, Removed: 1},
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := &mockAPI{
+				zoneName: zoneName,
+				zoneID:   zoneID,
+				records:  test.records,
+			}
+			c, err := NewCloudFlareUpdate(&cfg.CloudflareAPI{
+				Zones: map[string]*cfg.Zone{
+					zoneName: {Records: []*cfg.Record{{Name: "www"}, {Name: "www", Type: "AAAA"}}},
+				},
+				Ownership: test.ownership,
+				Access:    struct{ Token, Key, Email string }{"token", "", ""},
+			}, WithCFAPI(api))
+			if err != nil {
+				t.Fatalf("couldn't create cloudflare updater: %s", err)
+			}
+
+			res, err := c.Apply(context.Background(), &Request{IPv4: "192.168.1.2"})
+			if test.shouldPass {
+				if err != nil {
+					t.Fatalf("cloudflare update failed: %s", err)
+				}
+			} else {
+				if err == nil {
+					t.Fatalf("cloudflare update should have failed but didn't")
+				}
+				t.Logf("provoked expected error: %s", err)
+			}
+			checkOutcomes(t, res, test.result)
+
+			if len(api.records) != len(test.expected) {
+				t.Fatalf("unexpected number of records: got %d, want %d", len(api.records), len(test.expected))
+			}
+			for _, r := range api.records {
+				if r.Content != test.expected[r.ID] {
+					t.Fatalf("unexpected content of record %s: got %s, want %s", r.ID, r.Content, test.expected[r.ID])
+				}
+				if test.shouldPass && test.ownership != nil && r.ID == "www" && recordOwner(r) != "dynip-ng:home" {
+					t.Fatalf("record wasn't claimed: comment=%q tags=%v", r.Comment, r.Tags)
+				}
+			}
+		})
+	}
+}
+
+func TestCloudFlareCache(t *testing.T) {
+	var zoneName = "example.com"
+
+	api := &mockAPI{
+		zoneName: zoneName,
+		zoneID:   "testZoneID",
+		records: []cloudflare.DNSRecord{
+			{Type: "A", ID: "apex", Content: "192.168.1.1", Name: "example.com", TTL: 1},
+			{Type: "A", ID: "www", Content: "192.168.1.1", Name: "www.example.com", TTL: 1},
+		},
+	}
+	c, err := NewCloudFlareUpdate(&cfg.CloudflareAPI{
+		Zones: map[string]*cfg.Zone{
+			zoneName: {Records: []*cfg.Record{{Name: "@"}, {Name: "www"}}},
+		},
+		Access: struct{ Token, Key, Email string }{"token", "", ""},
+	}, WithCFAPI(api))
+	if err != nil {
+		t.Fatalf("couldn't create cloudflare updater: %s", err)
+	}
+
+	type calls struct{ zoneLookups, listCalls int }
+	var steps = []struct {
+		name     string
+		IP       string
+		modify   func()
+		expected calls
+	}{
+		{"initial lookup", "192.168.1.2", func() {}, calls{1, 2}},
+		{"cached IDs", "192.168.1.3", func() {}, calls{0, 0}},
+		{"record re-created", "192.168.1.4", func() {
+			api.records[1].ID = "www2"
+		}, calls{0, 1}},
+		{"zone re-created", "192.168.1.5", func() {
+			api.zoneID = "newZoneID"
+		}, calls{1, 3}},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			step.modify()
+			api.zoneLookups, api.listCalls = 0, 0
+
+			err = c.Update(context.Background(), step.IP)
+			if err != nil {
+				t.Fatalf("cloudflare update failed: %s", err)
+			}
+			got := calls{api.zoneLookups, api.listCalls}
+			if got != step.expected {
+				t.Fatalf("unexpected API calls: got %+v, want %+v", got, step.expected)
+			}
+			for _, r := range api.records {
+				if r.Content != step.IP {
+					t.Fatalf("record %s wasn't updated: %s", r.ID, r.Content)
+				}
+			}
+		})
+	}
+}
+
+func TestCloudFlarePagination(t *testing.T) {
+	var zoneName = "example.com"
+
+	// a round robin record spread across several pages
+	api := &mockAPI{zoneName: zoneName, zoneID: "testZoneID"}
+	for i := 0; i < 5; i++ {
+		api.records = append(api.records,
+			cloudflare.DNSRecord{Type: "A", ID: fmt.Sprintf("www%d", i), Content: "192.168.1.1", Name: "www.example.com", TTL: 1},
+			cloudflare.DNSRecord{Type: "A", ID: fmt.Sprintf("other%d", i), Content: "192.168.1.1", Name: "other.example.com", TTL: 1},
+		)
+	}
+	c, err := NewCloudFlareUpdate(&cfg.CloudflareAPI{
+		Zones: map[string]*cfg.Zone{
+			zoneName: {Records: []*cfg.Record{{Name: "www"}}},
+		},
+		Access: struct{ Token, Key, Email string }{"token", "", ""},
+	}, WithCFAPI(api))
+	if err != nil {
+		t.Fatalf("couldn't create cloudflare updater: %s", err)
+	}
+	c.pageSize = 2
+
+	res, err := c.Apply(context.Background(), &Request{IPv4: "192.168.1.2"})
+	if err != nil {
+		t.Fatalf("cloudflare update failed: %s", err)
+	}
+	if api.listCalls != 3 {
+		t.Fatalf("expected 3 pages to be fetched, got %d", api.listCalls)
+	}
+	if res.Count(Changed) != 5 {
+		t.Fatalf("expected 5 records to be changed, got %s", res)
+	}
+	for _, r := range api.records {
+		expected := "192.168.1.1"
+		if r.Name == "www.example.com" {
+			expected = "192.168.1.2"
+		}
+		if r.Content != expected {
+			t.Fatalf("unexpected content of record %s: %s", r.ID, r.Content)
+		}
+	}
+}
+
+func TestCloudFlareRateLimit(t *testing.T) {
+	var zoneName = "example.com"
+
+	var tests = []struct {
+		name        string
+		rateLimited int
+		shouldPass  bool
+	}{
+		{"recovers from rate limiting", cfRateLimitRetries, true},
+		{"gives up eventually", cfRateLimitRetries + 1, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := &mockAPI{
+				zoneName:    zoneName,
+				zoneID:      "testZoneID",
+				rateLimited: test.rateLimited,
+				records: []cloudflare.DNSRecord{
+					{Type: "A", ID: "www", Content: "192.168.1.1", Name: "www.example.com", TTL: 1},
+				},
+			}
+			c, err := NewCloudFlareUpdate(&cfg.CloudflareAPI{
+				Zones: map[string]*cfg.Zone{
+					zoneName: {Records: []*cfg.Record{{Name: "www"}}},
+				},
+				Access: struct{ Token, Key, Email string }{"token", "", ""},
+			}, WithCFAPI(api))
+			if err != nil {
+				t.Fatalf("couldn't create cloudflare updater: %s", err)
+			}
+			c.retryDelay = time.Millisecond
+
+			err = c.Update(context.Background(), "192.168.1.2")
+			if test.shouldPass {
+				if err != nil {
+					t.Fatalf("cloudflare update failed: %s", err)
+				}
+			} else {
+				if err == nil {
+					t.Fatalf("cloudflare update should have failed but didn't")
+				}
+				t.Logf("provoked expected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestCFRateLimitTransport(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	api, err := newCloudflareAPI(cfg.CloudflareAccess{Token: "token"}, cloudflare.BaseURL(srv.URL))
+	if err != nil {
+		t.Fatalf("couldn't create cloudflare API: %s", err)
+	}
+	_, err = api.ZoneIDByName("example.com")
+
+	var rl *cfRateLimitError
+	if !errors.As(err, &rl) {
+		t.Fatalf("unexpected error: got %v, want rate limit error", err)
+	}
+	if rl.retryAfter != 7*time.Second {
+		t.Fatalf("unexpected retry delay: got %s, want %s", rl.retryAfter, 7*time.Second)
+	}
+	// the client doesn't retry on its own
+	if requests != 1 {
+		t.Fatalf("unexpected number of requests: got %d, want 1", requests)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2019, 5, 17, 12, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"3", 3 * time.Second},
+		{"-1", 0},
+		{"Fri, 17 May 2019 12:00:30 GMT", 30 * time.Second},
+		{"Fri, 17 May 2019 11:00:00 GMT", 0},
+		{"soon", 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			got := retryAfter(test.value, now)
+			if got != test.expected {
+				t.Fatalf("unexpected delay: got %s, want %s", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestCFBackoffRetryAfter(t *testing.T) {
+	var tests = []struct {
+		name       string
+		retryAfter time.Duration
+		shouldPass bool
+	}{
+		{"waits as requested", 10 * time.Millisecond, true},
+		{"refuses to wait too long", cfRateLimitMaxWait + time.Second, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int
+			call := func() error {
+				calls++
+				if calls == 1 {
+					return fmt.Errorf("HTTP request failed: %w", &cfRateLimitError{retryAfter: test.retryAfter})
+				}
+				return nil
+			}
+
+			// the default delay would exceed the deadline, so only Retry-After lets the call succeed
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			err := cfBackoff(ctx, logging.Get(), time.Hour, call)
+			if test.shouldPass {
+				if err != nil {
+					t.Fatalf("call failed: %s", err)
+				}
+				if calls != 2 {
+					t.Fatalf("unexpected number of calls: got %d, want 2", calls)
+				}
+			} else {
+				if err == nil {
+					t.Fatalf("call should have failed but didn't")
+				}
+				t.Logf("provoked expected error: %s", err)
+			}
+		})
+	}
+}
+
+// checkOutcomes compares the number of targets per outcome in res to expected
+func checkOutcomes(t *testing.T, res *Result, expected map[Outcome]int) {
+	t.Helper()
+	for _, o := range []Outcome{Changed, Unchanged, Failed, Removed, Skipped} {
+		if res.Count(o) != expected[o] {
+			t.Fatalf("unexpected number of %s targets: got %d, want %d (%s)", o, res.Count(o), expected[o], res)
+		}
+	}
+}
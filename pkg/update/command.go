@@ -0,0 +1,60 @@
+package update
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// executor runs a program with input on stdin and returns its stdout. It allows tests
+// to replace the execution of system tools
+type executor interface {
+	Run(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error)
+}
+
+// execExecutor runs programs on the host
+type execExecutor struct{}
+
+func (execExecutor) Run(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg != "" {
+			return nil, fmt.Errorf("%s failed: %w: %s", name, err, msg)
+		}
+		return nil, fmt.Errorf("%s failed: %w", name, err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// runCommand executes a command line such as `rndc reload example.com`. The command is
+// split on whitespace and run directly, without involving a shell
+func runCommand(ctx context.Context, cmdline string) error {
+	args := strings.Fields(cmdline)
+	if len(args) == 0 {
+		return nil
+	}
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	err := cmd.Run()
+	if err != nil {
+		msg := strings.TrimSpace(out.String())
+		if msg != "" {
+			return fmt.Errorf("%q failed: %w: %s", cmdline, err, msg)
+		}
+		return fmt.Errorf("%q failed: %w", cmdline, err)
+	}
+	return nil
+}
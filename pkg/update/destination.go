@@ -0,0 +1,286 @@
+package update
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Reason describes what triggered an update
+type Reason string
+
+// Reasons for updates
+const (
+	// ReasonInterface means that the IP of the monitored interface changed
+	ReasonInterface Reason = "interface"
+
+	// ReasonPush means that a dyndns client pushed its IP
+	ReasonPush Reason = "push"
+
+	// ReasonReport means that an agent reported its IP to the server
+	ReasonReport Reason = "report"
+)
+
+type reasonKey struct{}
+
+// WithReason attaches the reason for an update to ctx
+func WithReason(ctx context.Context, reason Reason) context.Context {
+	return context.WithValue(ctx, reasonKey{}, reason)
+}
+
+// ReasonFrom returns the reason attached to ctx. Without one, the update is assumed to
+// be triggered by the monitored interface
+func ReasonFrom(ctx context.Context) Reason {
+	if reason, ok := ctx.Value(reasonKey{}).(Reason); ok {
+		return reason
+	}
+	return ReasonInterface
+}
+
+// Request describes the IPs a destination is updated with
+type Request struct {
+	// IPs the destination is updated with. Either of them may be empty
+	IPv4 string
+	IPv6 string
+
+	// IPs the destination was last updated with. Empty if unknown
+	PreviousIPv4 string
+	PreviousIPv6 string
+
+	// Reason states what triggered the update
+	Reason Reason
+
+	// Interface is the monitored network interface. Empty if the IPs weren't
+	// read from an interface
+	Interface string
+
+	// DryRun asks the destination to report what it would change without
+	// changing anything
+	DryRun bool
+
+	// Notification holds the outcome of the other destinations. It is only set
+	// for notifiers
+	Notification *Notification
+}
+
+// NewRequest creates a request for a single IP, which is assigned to the field of its
+// address family
+func NewRequest(IP string) (*Request, error) {
+	ip := net.ParseIP(IP)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", IP)
+	}
+	if ip.To4() != nil {
+		return &Request{IPv4: IP}, nil
+	}
+	return &Request{IPv6: IP}, nil
+}
+
+// Validate checks that the IPs of the request are addresses of their family and that
+// there is at least one of them
+func (r *Request) Validate() error {
+	if r.IPv4 == "" && r.IPv6 == "" {
+		return fmt.Errorf("no IP to update with")
+	}
+	if r.IPv4 != "" {
+		ip := net.ParseIP(r.IPv4)
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid IPv4 address %q", r.IPv4)
+		}
+	}
+	if r.IPv6 != "" {
+		ip := net.ParseIP(r.IPv6)
+		if ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid IPv6 address %q", r.IPv6)
+		}
+	}
+	return nil
+}
+
+// IP returns the preferred address of the request: the IPv4 address if there is one,
+// the IPv6 address otherwise
+func (r *Request) IP() string {
+	if r.IPv4 != "" {
+		return r.IPv4
+	}
+	return r.IPv6
+}
+
+// IPs returns all addresses of the request, the IPv4 address first
+func (r *Request) IPs() []string {
+	var ips []string
+	for _, ip := range []string{r.IPv4, r.IPv6} {
+		if ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// Outcome states what happened to a single target of a destination
+type Outcome int
+
+// Outcomes of updating a target
+const (
+	// Unchanged targets already pointed to the IP
+	Unchanged Outcome = iota
+
+	// Changed targets were (or, in a dry run, would have been) updated
+	Changed
+
+	// Failed targets couldn't be updated
+	Failed
+
+	// Removed targets were deleted since they are no longer configured
+	Removed
+
+	// Skipped targets weren't looked at, e.g. since there was no IP for them
+	Skipped
+)
+
+var outcomeNames = map[Outcome]string{
+	Unchanged: "unchanged",
+	Changed:   "changed",
+	Failed:    "failed",
+	Removed:   "removed",
+	Skipped:   "skipped",
+}
+
+// String returns the name of the outcome
+func (o Outcome) String() string {
+	if name, ok := outcomeNames[o]; ok {
+		return name
+	}
+	return fmt.Sprintf("outcome(%d)", int(o))
+}
+
+// MarshalText encodes the outcome as its name
+func (o Outcome) MarshalText() ([]byte, error) {
+	name, ok := outcomeNames[o]
+	if !ok {
+		return nil, fmt.Errorf("unknown outcome %d", int(o))
+	}
+	return []byte(name), nil
+}
+
+// UnmarshalText decodes the name of an outcome
+func (o *Outcome) UnmarshalText(text []byte) error {
+	for outcome, name := range outcomeNames {
+		if name == string(text) {
+			*o = outcome
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown outcome %q", text)
+}
+
+// TargetResult is the outcome of updating a single target of a destination, such as a
+// DNS record or a file
+type TargetResult struct {
+	Target  string
+	Outcome Outcome
+	Message string
+}
+
+// Result collects the outcomes of all targets of a destination
+type Result struct {
+	Targets []TargetResult
+}
+
+// Add records the outcome of a target
+func (r *Result) Add(target string, outcome Outcome, format string, args ...interface{}) {
+	r.Targets = append(r.Targets, TargetResult{
+		Target:  target,
+		Outcome: outcome,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Merge adds all targets of other to the result
+func (r *Result) Merge(other *Result) {
+	if other == nil {
+		return
+	}
+	r.Targets = append(r.Targets, other.Targets...)
+}
+
+// Count returns the number of targets with outcome o
+func (r *Result) Count(o Outcome) int {
+	var n int
+	for _, t := range r.Targets {
+		if t.Outcome == o {
+			n++
+		}
+	}
+	return n
+}
+
+// Err summarizes the failed targets in an error. It is nil if no target failed
+func (r *Result) Err() error {
+	var msgs []string
+	for _, t := range r.Targets {
+		if t.Outcome == Failed {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", t.Target, t.Message))
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d targets failed: %s", len(msgs), len(r.Targets), strings.Join(msgs, "; "))
+}
+
+// String outputs the number of targets per outcome
+func (r *Result) String() string {
+	return fmt.Sprintf("changed=%d, unchanged=%d, failed=%d, removed=%d, skipped=%d",
+		r.Count(Changed), r.Count(Unchanged), r.Count(Failed), r.Count(Removed), r.Count(Skipped))
+}
+
+// Destination is updated with both address families at once and reports the outcome
+// for each of its targets. The built-in updaters implement it. Updaters which don't can
+// be turned into a Destination with AsDestination
+type Destination interface {
+	// Apply updates the destination. The returned error is non-nil if any of the
+	// targets failed, or if the destination couldn't be updated at all
+	Apply(ctx context.Context, req *Request) (*Result, error)
+	Name() string
+}
+
+// AsDestination returns u itself if it implements Destination. Otherwise, u is wrapped
+// so that it is called with the preferred IP of each request
+func AsDestination(u Updater) Destination {
+	if d, ok := u.(Destination); ok {
+		return d
+	}
+	return &updaterAdapter{u}
+}
+
+// updaterAdapter runs an Updater as a Destination. The whole updater counts as a single
+// target
+type updaterAdapter struct {
+	Updater
+}
+
+// Apply calls the updater with the preferred IP of req. Dry runs aren't supported by
+// plain updaters, so they are skipped
+func (a *updaterAdapter) Apply(ctx context.Context, req *Request) (*Result, error) {
+	res := new(Result)
+
+	ip := req.IP()
+	switch {
+	case ip == "":
+		res.Add(a.Name(), Skipped, "no IP to update with")
+		return res, nil
+	case req.DryRun:
+		res.Add(a.Name(), Skipped, "dry run not supported. Would update to %s", ip)
+		return res, nil
+	}
+
+	err := a.Update(ctx, ip)
+	if err != nil {
+		res.Add(a.Name(), Failed, "%s", err)
+		return res, err
+	}
+	res.Add(a.Name(), Changed, "updated to %s", ip)
+	return res, nil
+}
@@ -0,0 +1,118 @@
+package update
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+type failingUpdater struct {
+	calls int
+	fail  bool
+}
+
+func (f *failingUpdater) Update(_ context.Context, ip string) error {
+	f.calls++
+	if f.fail {
+		return fmt.Errorf("couldn't update to %s", ip)
+	}
+	return nil
+}
+func (f *failingUpdater) Name() string { return "failing updater" }
+
+func TestRequestValidate(t *testing.T) {
+	var tests = []struct {
+		name       string
+		req        *Request
+		shouldPass bool
+	}{
+		{"IPv4", &Request{IPv4: "203.0.113.7"}, true},
+		{"IPv6", &Request{IPv6: "2001:db8::7"}, true},
+		{"dual-stack", &Request{IPv4: "203.0.113.7", IPv6: "2001:db8::7"}, true},
+		{"no IP", &Request{}, false},
+		{"IPv6 as IPv4", &Request{IPv4: "2001:db8::7"}, false},
+		{"IPv4 as IPv6", &Request{IPv6: "203.0.113.7"}, false},
+		{"invalid IP", &Request{IPv4: "not-an-ip"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.req.Validate()
+			if test.shouldPass && err != nil {
+				t.Fatalf("validation failed: %s", err)
+			}
+			if !test.shouldPass && err == nil {
+				t.Fatalf("validation should have failed but didn't")
+			}
+		})
+	}
+}
+
+func TestAsDestination(t *testing.T) {
+	var tests = []struct {
+		name    string
+		req     *Request
+		fail    bool
+		calls   int
+		outcome Outcome
+	}{
+		{"IPv4 preferred", &Request{IPv4: "203.0.113.7", IPv6: "2001:db8::7"}, false, 1, Changed},
+		{"IPv6 only", &Request{IPv6: "2001:db8::7"}, false, 1, Changed},
+		{"failure", &Request{IPv4: "203.0.113.7"}, true, 1, Failed},
+		{"dry run", &Request{IPv4: "203.0.113.7", DryRun: true}, false, 0, Skipped},
+		{"no IP", &Request{}, false, 0, Skipped},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u := &failingUpdater{fail: test.fail}
+			d := AsDestination(u)
+
+			res, err := d.Apply(context.Background(), test.req)
+			if test.fail != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if u.calls != test.calls {
+				t.Fatalf("unexpected number of calls: got %d, want %d", u.calls, test.calls)
+			}
+			if len(res.Targets) != 1 || res.Targets[0].Outcome != test.outcome {
+				t.Fatalf("unexpected result: %v", res.Targets)
+			}
+		})
+	}
+}
+
+func TestResultErr(t *testing.T) {
+	res := new(Result)
+	res.Add("A dynip.example.com", Changed, "points to %s", "203.0.113.7")
+	if res.Err() != nil {
+		t.Fatalf("unexpected error: %s", res.Err())
+	}
+
+	res.Add("AAAA dynip.example.com", Failed, "rate limited")
+	expected := "1 of 2 targets failed: AAAA dynip.example.com: rate limited"
+	if res.Err() == nil || res.Err().Error() != expected {
+		t.Fatalf("unexpected error: got %v, want %s", res.Err(), expected)
+	}
+}
+
+func TestOutcomeText(t *testing.T) {
+	for o := range outcomeNames {
+		text, err := o.MarshalText()
+		if err != nil {
+			t.Fatalf("couldn't marshal %s: %s", o, err)
+		}
+		var decoded Outcome
+		err = decoded.UnmarshalText(text)
+		if err != nil || decoded != o {
+			t.Fatalf("unexpected outcome decoded from %q: %s (%v)", text, decoded, err)
+		}
+	}
+
+	var o Outcome
+	err := o.UnmarshalText([]byte("exploded"))
+	if err == nil {
+		t.Fatalf("unknown outcome should have been rejected but wasn't")
+	}
+	t.Logf("provoked expected error: %s", err)
+}
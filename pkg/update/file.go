@@ -1,29 +1,39 @@
 package update
 
 import (
+	"bytes"
 	"context"
 	"fmt"
-	"html/template"
 	"io"
 	"os"
+	"time"
 
 	"github.com/els0r/dynip-ng/pkg/cfg"
 	"github.com/els0r/dynip-ng/pkg/logging"
 	log "github.com/els0r/log"
 )
 
-// FileUpdate supplies methods to update the IP in a template and write it to an output file
+// FileUpdate supplies methods to update the IP in templates and write them to output files
 type FileUpdate struct {
-	templatePath      string
-	outputPath        string
+	Instance
+
+	targets           []*cfg.FileTarget
+	reload            string
+	html              bool
 	outputWriteCloser io.WriteCloser
-	log               log.Logger
+
+	// now returns the timestamp passed to the templates
+	now func() time.Time
+
+	log log.Logger
 }
 
 // FOption can be used to configure optional parameters for the file updater
 type FOption func(*FileUpdate)
 
-// WithOutputWriteCloser allows for a more generic way of writing the output
+// WithOutputWriteCloser allows for a more generic way of writing the output. It receives
+// the rendered template of each target without an output file. The writer is shared by
+// all targets and updates, so it is left to the caller to close it
 func WithOutputWriteCloser(wc io.WriteCloser) FOption {
 	return func(f *FileUpdate) {
 		f.outputWriteCloser = wc
@@ -33,9 +43,11 @@ func WithOutputWriteCloser(wc io.WriteCloser) FOption {
 // NewFileUpdate creates a file updater
 func NewFileUpdate(cfg *cfg.FileConfig, opts ...FOption) (*FileUpdate, error) {
 	f := &FileUpdate{
-		templatePath: cfg.Template,
-		outputPath:   cfg.Output,
-		log:          logging.Get(),
+		targets: cfg.Targets(),
+		reload:  cfg.Reload,
+		html:    cfg.HTML,
+		now:     time.Now,
+		log:     logging.Get(),
 	}
 
 	// apply options
@@ -43,41 +55,117 @@ func NewFileUpdate(cfg *cfg.FileConfig, opts ...FOption) (*FileUpdate, error) {
 		opt(f)
 	}
 
-	if f.outputPath == "" && f.outputWriteCloser == nil {
+	if len(f.targets) == 0 {
 		return nil, fmt.Errorf("file update must have an output")
 	}
+	for _, t := range f.targets {
+		if t.Output == "" && f.outputWriteCloser == nil {
+			return nil, fmt.Errorf("file update must have an output")
+		}
+	}
 
 	return f, nil
 }
 
 // Name returns a human-readable identifier for the updater
 func (f *FileUpdate) Name() string {
-	return "file updater"
+	return f.Label("file updater")
 }
 
-// Update takes the IP and writes it to the specified output file using the provided
-// input template
-func (f *FileUpdate) Update(_ context.Context, ip string) error {
-	f.log.Debugf("updating file: %s", f.outputPath)
+// Update takes the IP and writes it to the specified output files using the provided
+// input templates
+func (f *FileUpdate) Update(ctx context.Context, ip string) error {
+	req, err := NewRequest(ip)
+	if err != nil {
+		return err
+	}
+	_, err = f.Apply(ctx, req)
+	return err
+}
+
+// Apply renders the templates with the data of the request (see TemplateData) and writes
+// them to their outputs. Output files which already have the rendered content aren't
+// rewritten. The reload command is run if at least one of them was written
+func (f *FileUpdate) Apply(ctx context.Context, req *Request) (*Result, error) {
+	err := req.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	res := new(Result)
+	data := newTemplateData(req, f.now())
+
+	var changed bool
+	for _, t := range f.targets {
+		if f.render(t, req, data, res) {
+			changed = true
+		}
+	}
+	if !changed || req.DryRun || f.reload == "" {
+		return res, res.Err()
+	}
+
+	err = runCommand(ctx, f.reload)
+	if err != nil {
+		res.Add("reload", Failed, "%s", err)
+		return res, res.Err()
+	}
+	f.log.Debugf("ran reload command %q", f.reload)
+	return res, res.Err()
+}
+
+// render renders the template of t and writes it to the output. The outcome is added to
+// res. It returns whether the output was written
+func (f *FileUpdate) render(t *cfg.FileTarget, req *Request, data *TemplateData, res *Result) bool {
+	target := t.Output
+	if target == "" {
+		target = "output"
+	}
+	ip := req.IP()
+	f.log.Debugf("updating file: %s", target)
 
 	// parse template file
-	templ, err := template.ParseFiles(f.templatePath)
+	templ, err := parseTemplate(t.Template, f.html)
 	if err != nil {
-		return err
+		res.Add(target, Failed, "%s", err)
+		return false
+	}
+
+	// execute the template
+	var buf bytes.Buffer
+	err = templ.Execute(&buf, data)
+	if err != nil {
+		res.Add(target, Failed, "%s", err)
+		return false
 	}
 
-	// check if the output is a file
-	if f.outputPath != "" {
-		fd, err := os.OpenFile(f.outputPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
-		if err != nil {
-			return err
+	if t.Output != "" {
+		current, err := os.ReadFile(t.Output)
+		if err == nil && bytes.Equal(current, buf.Bytes()) {
+			res.Add(target, Unchanged, "already rendered with %s", ip)
+			return false
 		}
-		f.outputWriteCloser = fd
 	}
-	defer func(wc io.WriteCloser) {
-		wc.Close()
-	}(f.outputWriteCloser)
+	if req.DryRun {
+		res.Add(target, Changed, "would be rendered with %s", ip)
+		return true
+	}
+
+	err = f.write(t.Output, buf.Bytes())
+	if err != nil {
+		res.Add(target, Failed, "%s", err)
+		return false
+	}
+	res.Add(target, Changed, "rendered with %s", ip)
+	return true
+}
 
-	// execute the template and store result in output
-	return templ.Execute(f.outputWriteCloser, ip)
+// write stores data in the output file. Without an output file, data is written to the
+// configured writer
+func (f *FileUpdate) write(output string, data []byte) error {
+	if output != "" {
+		return writeFileAtomic(output, data)
+	}
+	_, err := f.outputWriteCloser.Write(data)
+	return err
 }
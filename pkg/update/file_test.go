@@ -0,0 +1,202 @@
+package update
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+)
+
+func TestFileUpdate(t *testing.T) {
+	dir := t.TempDir()
+
+	caddyTemplate := filepath.Join(dir, "Caddyfile.gotmpl")
+	nginxTemplate := filepath.Join(dir, "nginx.conf.gotmpl")
+	for path, content := range map[string]string{
+		caddyTemplate: "bind {{ . }}\n",
+		nginxTemplate: "listen {{ . }}:80;\n",
+	} {
+		err := os.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("couldn't write template: %s", err)
+		}
+	}
+
+	// the nginx config exists already and has restricted permissions
+	caddyOutput := filepath.Join(dir, "Caddyfile")
+	nginxOutput := filepath.Join(dir, "nginx.conf")
+	err := os.WriteFile(nginxOutput, []byte("listen 192.0.2.1:80;\n"), 0600)
+	if err != nil {
+		t.Fatalf("couldn't write output: %s", err)
+	}
+
+	// the reload command leaves a marker
+	marker := filepath.Join(dir, "reloaded")
+	f, err := NewFileUpdate(&cfg.FileConfig{
+		Template: caddyTemplate,
+		Output:   caddyOutput,
+		Files: []*cfg.FileTarget{
+			{Template: nginxTemplate, Output: nginxOutput},
+		},
+		Reload: "touch " + marker,
+	})
+	if err != nil {
+		t.Fatalf("couldn't create file updater: %s", err)
+	}
+
+	var tests = []struct {
+		name     string
+		IP       string
+		changed  int
+		reloaded bool
+	}{
+		{"initial render", "203.0.113.7", 2, true},
+		{"unchanged", "203.0.113.7", 0, false},
+		{"changed", "203.0.113.8", 2, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Remove(marker)
+
+			res, err := f.Apply(context.Background(), &Request{IPv4: test.IP})
+			if err != nil {
+				t.Fatalf("file update failed: %s", err)
+			}
+			if res.Count(Changed) != test.changed || len(res.Targets) != 2 {
+				t.Fatalf("unexpected result: %s", res)
+			}
+			_, err = os.Stat(marker)
+			if test.reloaded != (err == nil) {
+				t.Fatalf("unexpected reload: got %v, want %v", err == nil, test.reloaded)
+			}
+
+			expected := map[string]string{
+				caddyOutput: "bind " + test.IP + "\n",
+				nginxOutput: "listen " + test.IP + ":80;\n",
+			}
+			for path, content := range expected {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatalf("couldn't read output: %s", err)
+				}
+				if string(data) != content {
+					t.Fatalf("unexpected content of %s: got %q, want %q", path, data, content)
+				}
+			}
+
+			fi, err := os.Stat(nginxOutput)
+			if err != nil {
+				t.Fatalf("couldn't stat output: %s", err)
+			}
+			if fi.Mode().Perm() != 0600 {
+				t.Fatalf("file mode wasn't preserved: %s", fi.Mode())
+			}
+		})
+	}
+}
+
+// fails to write once it is closed
+type closingBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *closingBuffer) Write(p []byte) (int, error) {
+	if c.closed {
+		return 0, fmt.Errorf("write to closed buffer")
+	}
+	return c.Buffer.Write(p)
+}
+
+func (c *closingBuffer) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestFileUpdateWriter(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"a": "a {{ .IPv4 }}\n", "b": "b {{ .IPv4 }}\n"} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("couldn't write template: %s", err)
+		}
+	}
+
+	out := new(closingBuffer)
+	f, err := NewFileUpdate(&cfg.FileConfig{
+		Files: []*cfg.FileTarget{
+			{Template: filepath.Join(dir, "a")},
+			{Template: filepath.Join(dir, "b")},
+		},
+	}, WithOutputWriteCloser(out))
+	if err != nil {
+		t.Fatalf("couldn't create file updater: %s", err)
+	}
+
+	// the writer is shared by all targets and updates
+	for _, ip := range []string{"203.0.113.7", "203.0.113.8"} {
+		_, err = f.Apply(context.Background(), &Request{IPv4: ip})
+		if err != nil {
+			t.Fatalf("file update failed: %s", err)
+		}
+	}
+
+	expected := "a 203.0.113.7\nb 203.0.113.7\na 203.0.113.8\nb 203.0.113.8\n"
+	if out.String() != expected {
+		t.Fatalf("unexpected output: got %q, want %q", out.String(), expected)
+	}
+	if out.closed {
+		t.Fatalf("writer was closed by the updater")
+	}
+}
+
+func TestFileUpdateFailures(t *testing.T) {
+	dir := t.TempDir()
+	template := filepath.Join(dir, "template")
+	err := os.WriteFile(template, []byte("{{ . }}"), 0644)
+	if err != nil {
+		t.Fatalf("couldn't write template: %s", err)
+	}
+
+	var tests = []struct {
+		name   string
+		cfg    *cfg.FileConfig
+		failed int
+	}{
+		{"missing template", &cfg.FileConfig{
+			Template: filepath.Join(dir, "missing"),
+			Output:   filepath.Join(dir, "missing.out"),
+			Files: []*cfg.FileTarget{
+				{Template: template, Output: filepath.Join(dir, "out")},
+			},
+		}, 1},
+		{"failing reload", &cfg.FileConfig{
+			Template: template,
+			Output:   filepath.Join(dir, "reload.out"),
+			Reload:   "false",
+		}, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := NewFileUpdate(test.cfg)
+			if err != nil {
+				t.Fatalf("couldn't create file updater: %s", err)
+			}
+			res, err := f.Apply(context.Background(), &Request{IPv4: "203.0.113.7"})
+			if err == nil {
+				t.Fatalf("file update should have failed but didn't")
+			}
+			t.Logf("provoked expected error: %s", err)
+
+			if res.Count(Failed) != test.failed {
+				t.Fatalf("unexpected result: %s", res)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package update
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/logging"
+	log "github.com/els0r/log"
+)
+
+// FirewallUpdate keeps the IP in nftables sets or ipsets. The previous IP is swapped for
+// the new one in a single transaction, so there is no moment in which neither of them is
+// part of the set. Other elements of the sets are left alone
+type FirewallUpdate struct {
+	Instance
+
+	backend firewallBackend
+	ipv4Set string
+	ipv6Set string
+
+	exec executor
+	log  log.Logger
+}
+
+// firewallBackend reads and modifies the sets of a firewall
+type firewallBackend interface {
+	// describe returns a human-readable identifier of a set
+	describe(set string) string
+
+	// elements returns the addresses contained in a set
+	elements(ctx context.Context, exec executor, set string) ([]string, error)
+
+	// swap adds add to a set and removes remove from it in a single transaction.
+	// remove is empty if there is nothing to remove
+	swap(ctx context.Context, exec executor, set, remove, add string) error
+}
+
+// NewFirewallUpdate creates a firewall updater
+func NewFirewallUpdate(cfg *cfg.FirewallConfig) (*FirewallUpdate, error) {
+	if cfg.IPv4Set == "" && cfg.IPv6Set == "" {
+		return nil, fmt.Errorf("firewall update must have a set")
+	}
+
+	f := &FirewallUpdate{
+		ipv4Set: cfg.IPv4Set,
+		ipv6Set: cfg.IPv6Set,
+		exec:    execExecutor{},
+		log:     logging.Get(),
+	}
+	switch cfg.Backend {
+	case "", "nftables":
+		if cfg.Table == "" {
+			return nil, fmt.Errorf("nftables sets need a table")
+		}
+		family := cfg.Family
+		if family == "" {
+			family = "inet"
+		}
+		f.backend = &nftBackend{family: family, table: cfg.Table}
+	case "ipset":
+		f.backend = ipsetBackend{}
+	default:
+		return nil, fmt.Errorf("unsupported firewall backend %q", cfg.Backend)
+	}
+	return f, nil
+}
+
+// Name returns a human-readable identifier for the updater
+func (f *FirewallUpdate) Name() string {
+	return f.Label("firewall updater")
+}
+
+// Update adds IP to the set of its address family
+func (f *FirewallUpdate) Update(ctx context.Context, IP string) error {
+	req, err := NewRequest(IP)
+	if err != nil {
+		return err
+	}
+	_, err = f.Apply(ctx, req)
+	return err
+}
+
+// Apply adds the IPs of the request to the sets of their address family and removes the
+// previous IPs from them
+func (f *FirewallUpdate) Apply(ctx context.Context, req *Request) (*Result, error) {
+	err := req.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	res := new(Result)
+	for _, s := range []struct{ set, IP, previous, family string }{
+		{f.ipv4Set, req.IPv4, req.PreviousIPv4, "IPv4"},
+		{f.ipv6Set, req.IPv6, req.PreviousIPv6, "IPv6"},
+	} {
+		if s.set == "" {
+			continue
+		}
+		target := f.backend.describe(s.set)
+		if s.IP == "" {
+			res.Add(target, Skipped, "no %s address to add", s.family)
+			continue
+		}
+		f.swap(ctx, target, s.set, s.previous, s.IP, req.DryRun, res)
+	}
+	return res, res.Err()
+}
+
+// swap replaces previous with IP in set and adds the outcome to res
+func (f *FirewallUpdate) swap(ctx context.Context, target, set, previous, IP string, dryRun bool, res *Result) {
+	f.log.Debugf("updating %s", target)
+
+	elements, err := f.backend.elements(ctx, f.exec, set)
+	if err != nil {
+		res.Add(target, Failed, "%s", err)
+		return
+	}
+
+	var hasIP, hasPrevious bool
+	for _, e := range elements {
+		switch {
+		case sameIP(e, IP):
+			hasIP = true
+		case previous != "" && sameIP(e, previous):
+			hasPrevious = true
+		}
+	}
+	if !hasPrevious {
+		previous = ""
+	}
+
+	action := fmt.Sprintf("add %s", IP)
+	if previous != "" {
+		action = fmt.Sprintf("replace %s with %s", previous, IP)
+	}
+	switch {
+	case hasIP && previous == "":
+		res.Add(target, Unchanged, "already contains %s", IP)
+		return
+	case dryRun:
+		res.Add(target, Changed, "would %s", action)
+		return
+	}
+
+	err = f.backend.swap(ctx, f.exec, set, previous, IP)
+	if err != nil {
+		res.Add(target, Failed, "couldn't %s: %s", action, err)
+		return
+	}
+	if previous != "" {
+		res.Add(target, Changed, "replaced %s with %s", previous, IP)
+		return
+	}
+	res.Add(target, Changed, "added %s", IP)
+}
+
+func sameIP(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	return ipA != nil && ipA.Equal(ipB)
+}
+
+// nftBackend manages the sets of an nftables table through the JSON interface of nft
+type nftBackend struct {
+	family string
+	table  string
+}
+
+func (n *nftBackend) describe(set string) string {
+	return fmt.Sprintf("nftables set %s %s %s", n.family, n.table, set)
+}
+
+func (n *nftBackend) elements(ctx context.Context, exec executor, set string) ([]string, error) {
+	out, err := exec.Run(ctx, nil, "nft", "-j", "list", "set", n.family, n.table, set)
+	if err != nil {
+		return nil, err
+	}
+
+	var listing struct {
+		Nftables []struct {
+			Set *struct {
+				Elem []json.RawMessage `json:"elem"`
+			} `json:"set"`
+		} `json:"nftables"`
+	}
+	err = json.Unmarshal(out, &listing)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse nft output: %w", err)
+	}
+
+	var elements []string
+	for _, obj := range listing.Nftables {
+		if obj.Set == nil {
+			continue
+		}
+		for _, raw := range obj.Set.Elem {
+			// elements are plain values or objects carrying options such as a
+			// timeout. Prefixes and ranges are ignored
+			var value string
+			if json.Unmarshal(raw, &value) == nil {
+				elements = append(elements, value)
+				continue
+			}
+			var withOptions struct {
+				Elem struct {
+					Val json.RawMessage `json:"val"`
+				} `json:"elem"`
+			}
+			if json.Unmarshal(raw, &withOptions) == nil && json.Unmarshal(withOptions.Elem.Val, &value) == nil {
+				elements = append(elements, value)
+			}
+		}
+	}
+	return elements, nil
+}
+
+// swap runs the addition and the removal as a single nft batch, which is applied as one
+// transaction
+func (n *nftBackend) swap(ctx context.Context, exec executor, set, remove, add string) error {
+	element := func(ip string) map[string]interface{} {
+		return map[string]interface{}{
+			"element": map[string]interface{}{
+				"family": n.family,
+				"table":  n.table,
+				"name":   set,
+				"elem":   []string{ip},
+			},
+		}
+	}
+	commands := []interface{}{
+		map[string]interface{}{"add": element(add)},
+	}
+	if remove != "" {
+		commands = append(commands, map[string]interface{}{"delete": element(remove)})
+	}
+
+	batch, err := json.Marshal(map[string]interface{}{"nftables": commands})
+	if err != nil {
+		return err
+	}
+	_, err = exec.Run(ctx, batch, "nft", "-j", "-f", "-")
+	return err
+}
+
+// ipsetBackend manages ipsets. Since ipset has no transactions, the new content is built
+// up in a temporary set which is then swapped with the original one
+type ipsetBackend struct{}
+
+func (ipsetBackend) describe(set string) string {
+	return "ipset " + set
+}
+
+// save returns the create line and the add lines of a set as printed by `ipset save`
+func (ipsetBackend) save(ctx context.Context, exec executor, set string) (string, []string, error) {
+	out, err := exec.Run(ctx, nil, "ipset", "save", set)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var (
+		create string
+		adds   []string
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != set {
+			continue
+		}
+		switch fields[0] {
+		case "create":
+			create = scanner.Text()
+		case "add":
+			adds = append(adds, scanner.Text())
+		}
+	}
+	if create == "" {
+		return "", nil, fmt.Errorf("set %s not found in ipset output", set)
+	}
+	return create, adds, scanner.Err()
+}
+
+func (b ipsetBackend) elements(ctx context.Context, exec executor, set string) ([]string, error) {
+	_, adds, err := b.save(ctx, exec, set)
+	if err != nil {
+		return nil, err
+	}
+	var elements []string
+	for _, line := range adds {
+		elements = append(elements, strings.Fields(line)[2])
+	}
+	return elements, nil
+}
+
+func (b ipsetBackend) swap(ctx context.Context, exec executor, set, remove, add string) error {
+	create, adds, err := b.save(ctx, exec, set)
+	if err != nil {
+		return err
+	}
+
+	// set names are limited to 31 characters
+	tmp := fmt.Sprintf("%.27s-tmp", set)
+
+	var script strings.Builder
+	fmt.Fprintf(&script, "create %s %s\n", tmp, strings.Join(strings.Fields(create)[2:], " "))
+	fmt.Fprintf(&script, "flush %s\n", tmp)
+	for _, line := range adds {
+		fields := strings.Fields(line)
+		if remove != "" && sameIP(fields[2], remove) {
+			continue
+		}
+		fields[1] = tmp
+		fmt.Fprintln(&script, strings.Join(fields, " "))
+	}
+	fmt.Fprintf(&script, "add %s %s\n", tmp, add)
+	fmt.Fprintf(&script, "swap %s %s\n", tmp, set)
+	fmt.Fprintf(&script, "destroy %s\n", tmp)
+
+	_, err = exec.Run(ctx, []byte(script.String()), "ipset", "-exist", "restore")
+	return err
+}
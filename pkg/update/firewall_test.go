@@ -0,0 +1,173 @@
+package update
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+)
+
+// fakeExecutor emulates nft and ipset on a set of elements per set name
+type fakeExecutor struct {
+	sets     map[string][]string
+	commands []string
+	inputs   []string
+	fail     bool
+}
+
+func (f *fakeExecutor) Run(_ context.Context, stdin []byte, name string, args ...string) ([]byte, error) {
+	cmdline := strings.Join(append([]string{name}, args...), " ")
+	f.commands = append(f.commands, cmdline)
+	if len(stdin) > 0 {
+		f.inputs = append(f.inputs, string(stdin))
+	}
+
+	switch {
+	case cmdline == "nft -j -f -" || cmdline == "ipset -exist restore":
+		if f.fail {
+			return nil, fmt.Errorf("%s failed: exit status 1", name)
+		}
+		return nil, nil
+	case strings.HasPrefix(cmdline, "nft -j list set"):
+		set := args[len(args)-1]
+		elems, ok := f.sets[set]
+		if !ok {
+			return nil, fmt.Errorf("nft failed: exit status 1: No such file or directory")
+		}
+		var raw []interface{}
+		for i, e := range elems {
+			// alternate between plain elements and elements with options
+			if i%2 == 0 {
+				raw = append(raw, e)
+			} else {
+				raw = append(raw, map[string]interface{}{"elem": map[string]interface{}{"val": e, "timeout": 3600}})
+			}
+		}
+		return json.Marshal(map[string]interface{}{"nftables": []interface{}{
+			map[string]interface{}{"metainfo": map[string]interface{}{"json_schema_version": 1}},
+			map[string]interface{}{"set": map[string]interface{}{"family": "inet", "name": set, "table": "filter", "elem": raw}},
+		}})
+	case strings.HasPrefix(cmdline, "ipset save"):
+		set := args[len(args)-1]
+		elems, ok := f.sets[set]
+		if !ok {
+			return nil, fmt.Errorf("ipset failed: exit status 1: The set with the given name does not exist")
+		}
+		out := fmt.Sprintf("create %s hash:ip family inet hashsize 1024 maxelem 65536\n", set)
+		for _, e := range elems {
+			out += fmt.Sprintf("add %s %s\n", set, e)
+		}
+		return []byte(out), nil
+	}
+	return nil, fmt.Errorf("unexpected command %q", cmdline)
+}
+
+func TestFirewallUpdate(t *testing.T) {
+	var tests = []struct {
+		name     string
+		cfg      *cfg.FirewallConfig
+		sets     map[string][]string
+		req      *Request
+		outcomes []Outcome
+		input    string
+		fail     bool
+	}{
+		{"nftables swap",
+			&cfg.FirewallConfig{Table: "filter", IPv4Set: "dynip4"},
+			map[string][]string{"dynip4": {"198.51.100.1", "192.0.2.1"}},
+			&Request{IPv4: "203.0.113.7", PreviousIPv4: "192.0.2.1"},
+			[]Outcome{Changed},
+			`{"nftables":[{"add":{"element":{"elem":["203.0.113.7"],"family":"inet","name":"dynip4","table":"filter"}}},` +
+				`{"delete":{"element":{"elem":["192.0.2.1"],"family":"inet","name":"dynip4","table":"filter"}}}]}`,
+			false},
+		{"nftables add without previous IP",
+			&cfg.FirewallConfig{Family: "ip6", Table: "filter", IPv6Set: "dynip6"},
+			map[string][]string{"dynip6": {}},
+			&Request{IPv4: "203.0.113.7", IPv6: "2001:db8::7", PreviousIPv6: "2001:db8::1"},
+			[]Outcome{Changed},
+			`{"nftables":[{"add":{"element":{"elem":["2001:db8::7"],"family":"ip6","name":"dynip6","table":"filter"}}}]}`,
+			false},
+		{"nftables unchanged",
+			&cfg.FirewallConfig{Table: "filter", IPv4Set: "dynip4", IPv6Set: "dynip6"},
+			map[string][]string{"dynip4": {"198.51.100.1", "203.0.113.7"}},
+			&Request{IPv4: "203.0.113.7", PreviousIPv4: "192.0.2.1"},
+			[]Outcome{Unchanged, Skipped},
+			"",
+			false},
+		{"nftables dry run",
+			&cfg.FirewallConfig{Table: "filter", IPv4Set: "dynip4"},
+			map[string][]string{"dynip4": {"192.0.2.1"}},
+			&Request{IPv4: "203.0.113.7", PreviousIPv4: "192.0.2.1", DryRun: true},
+			[]Outcome{Changed},
+			"",
+			false},
+		{"nftables missing set",
+			&cfg.FirewallConfig{Table: "filter", IPv4Set: "dynip4"},
+			map[string][]string{},
+			&Request{IPv4: "203.0.113.7"},
+			[]Outcome{Failed},
+			"",
+			false},
+		{"ipset swap",
+			&cfg.FirewallConfig{Backend: "ipset", IPv4Set: "dynip4"},
+			map[string][]string{"dynip4": {"198.51.100.1", "192.0.2.1"}},
+			&Request{IPv4: "203.0.113.7", PreviousIPv4: "192.0.2.1"},
+			[]Outcome{Changed},
+			`create dynip4-tmp hash:ip family inet hashsize 1024 maxelem 65536
+flush dynip4-tmp
+add dynip4-tmp 198.51.100.1
+add dynip4-tmp 203.0.113.7
+swap dynip4-tmp dynip4
+destroy dynip4-tmp
+`,
+			false},
+		{"ipset restore fails",
+			&cfg.FirewallConfig{Backend: "ipset", IPv4Set: "dynip4"},
+			map[string][]string{"dynip4": {"192.0.2.1"}},
+			&Request{IPv4: "203.0.113.7", PreviousIPv4: "192.0.2.1"},
+			[]Outcome{Failed},
+			"",
+			true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := NewFirewallUpdate(test.cfg)
+			if err != nil {
+				t.Fatalf("couldn't create firewall updater: %s", err)
+			}
+			fake := &fakeExecutor{sets: test.sets, fail: test.fail}
+			f.exec = fake
+
+			res, err := f.Apply(context.Background(), test.req)
+			t.Logf("commands: %v", fake.commands)
+
+			var failed bool
+			for _, o := range test.outcomes {
+				failed = failed || o == Failed
+			}
+			if failed != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(res.Targets) != len(test.outcomes) {
+				t.Fatalf("unexpected result: %v", res.Targets)
+			}
+			for i, o := range test.outcomes {
+				if res.Targets[i].Outcome != o {
+					t.Fatalf("unexpected outcome of %s: got %s, want %s", res.Targets[i].Target, res.Targets[i].Outcome, o)
+				}
+			}
+
+			var input string
+			if len(fake.inputs) > 0 && !test.fail {
+				input = fake.inputs[0]
+			}
+			if input != test.input {
+				t.Fatalf("unexpected input:\n%s\nwant:\n%s", input, test.input)
+			}
+		})
+	}
+}
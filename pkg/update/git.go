@@ -0,0 +1,318 @@
+package update
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/logging"
+	log "github.com/els0r/log"
+)
+
+// GitUpdate renders templates into a git working tree and commits the changes. With a
+// remote, the commits are pushed, so that they go through the same review and
+// deployment pipeline as manual changes
+type GitUpdate struct {
+	Instance
+
+	repository  string
+	outputs     []string
+	files       *FileUpdate
+	message     *template.Template
+	authorName  string
+	authorEmail string
+	remote      string
+	branch      string
+
+	exec executor
+	log  log.Logger
+}
+
+// NewGitUpdate creates a git updater
+func NewGitUpdate(config *cfg.GitConfig) (*GitUpdate, error) {
+	if config.Repository == "" {
+		return nil, fmt.Errorf("git update must have a repository")
+	}
+	if len(config.Files) == 0 {
+		return nil, fmt.Errorf("git update must have files")
+	}
+
+	hostname, _ := os.Hostname()
+	g := &GitUpdate{
+		repository:  config.Repository,
+		authorName:  config.AuthorName,
+		authorEmail: config.AuthorEmail,
+		remote:      config.Remote,
+		branch:      config.Branch,
+		files: &FileUpdate{
+			html: config.HTML,
+			now:  time.Now,
+			log:  logging.Get(),
+		},
+		exec: execExecutor{},
+		log:  logging.Get(),
+	}
+	if g.authorName == "" {
+		g.authorName = "dynip-ng"
+	}
+	if g.authorEmail == "" {
+		g.authorEmail = "dynip-ng@" + hostname
+	}
+	for _, f := range config.Files {
+		output := filepath.Clean(f.Output)
+		g.outputs = append(g.outputs, output)
+		g.files.targets = append(g.files.targets, &cfg.FileTarget{
+			Template: f.Template,
+			Output:   filepath.Join(config.Repository, output),
+		})
+	}
+	if config.Message != "" {
+		var err error
+		g.message, err = template.New("message").Funcs(template.FuncMap(templateFuncs)).Parse(config.Message)
+		if err != nil {
+			return nil, fmt.Errorf("invalid commit message: %w", err)
+		}
+	}
+	return g, nil
+}
+
+// Name returns a human-readable identifier for the updater
+func (g *GitUpdate) Name() string {
+	return g.Label("git updater")
+}
+
+// Update renders the files with IP and commits them
+func (g *GitUpdate) Update(ctx context.Context, IP string) error {
+	req, err := NewRequest(IP)
+	if err != nil {
+		return err
+	}
+	_, err = g.Apply(ctx, req)
+	return err
+}
+
+// Apply rebases the working tree onto the remote, renders the templates with the data
+// of the request (see TemplateData) and commits the outputs which changed. Commits which
+// aren't on the remote yet are pushed, including those of earlier updates whose push
+// failed
+func (g *GitUpdate) Apply(ctx context.Context, req *Request) (*Result, error) {
+	err := req.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	res := new(Result)
+	branch, err := g.remoteBranch(ctx)
+	if err != nil {
+		res.Add(g.repository, Failed, "%s", err)
+		return res, res.Err()
+	}
+	var onRemote bool
+	if branch != "" && !req.DryRun {
+		onRemote, err = g.pull(ctx, branch)
+		if err != nil {
+			res.Add("pull "+g.remote+"/"+branch, Failed, "%s", err)
+			return res, res.Err()
+		}
+	}
+
+	data := newTemplateData(req, g.files.now())
+	var changed bool
+	for _, t := range g.files.targets {
+		if !req.DryRun {
+			// outputs may be in directories which don't exist yet
+			err = os.MkdirAll(filepath.Dir(t.Output), 0755)
+			if err != nil {
+				res.Add(t.Output, Failed, "%s", err)
+				continue
+			}
+		}
+		if g.files.render(t, req, data, res) {
+			changed = true
+		}
+	}
+	if req.DryRun {
+		if changed {
+			msg, err := g.commitMessage(req, data)
+			if err != nil {
+				res.Add("commit", Failed, "%s", err)
+				return res, res.Err()
+			}
+			subject, _, _ := strings.Cut(msg, "\n")
+			res.Add("commit", Changed, "would commit %s", subject)
+		}
+		return res, res.Err()
+	}
+
+	// outputs may also have been written by an earlier update which failed before
+	// committing, so the working tree decides what is committed
+	status, err := g.git(ctx, append([]string{"status", "--porcelain", "--"}, g.outputs...)...)
+	if err != nil {
+		res.Add("commit", Failed, "%s", err)
+		return res, res.Err()
+	}
+	if len(bytes.TrimSpace(status)) > 0 {
+		err = g.commit(ctx, req, data, res)
+		if err != nil {
+			res.Add("commit", Failed, "%s", err)
+			return res, res.Err()
+		}
+	}
+
+	if branch != "" {
+		g.push(ctx, branch, onRemote, res)
+	}
+	return res, res.Err()
+}
+
+// git runs a git command in the working tree and returns its output
+func (g *GitUpdate) git(ctx context.Context, args ...string) ([]byte, error) {
+	return g.exec.Run(ctx, nil, "git", append([]string{"-C", g.repository}, args...)...)
+}
+
+// remoteBranch returns the branch of the remote. It is empty without a remote
+func (g *GitUpdate) remoteBranch(ctx context.Context) (string, error) {
+	if g.remote == "" || g.branch != "" {
+		return g.branch, nil
+	}
+	out, err := g.git(ctx, "symbolic-ref", "--short", "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("couldn't determine the current branch: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// pull fetches the branch from the remote and rebases the local commits onto it. It
+// returns whether the branch exists on the remote. If it doesn't, e.g. before the first
+// push to a new branch, there is nothing to rebase onto
+func (g *GitUpdate) pull(ctx context.Context, branch string) (bool, error) {
+	out, err := g.git(ctx, "ls-remote", "--heads", g.remote, "refs/heads/"+branch)
+	if err != nil {
+		return false, err
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return false, nil
+	}
+
+	_, err = g.git(ctx, "fetch", "--quiet", g.remote, branch)
+	if err != nil {
+		return true, err
+	}
+	_, err = g.git(ctx, "rebase", "--quiet", "--autostash", "FETCH_HEAD")
+	if err != nil {
+		// leave the working tree as it was
+		g.git(ctx, "rebase", "--abort")
+		return true, err
+	}
+	return true, nil
+}
+
+// commit commits the outputs
+func (g *GitUpdate) commit(ctx context.Context, req *Request, data *TemplateData, res *Result) error {
+	msg, err := g.commitMessage(req, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = g.git(ctx, append([]string{"add", "--"}, g.outputs...)...)
+	if err != nil {
+		return err
+	}
+	_, err = g.git(ctx, append([]string{
+		"-c", "user.name=" + g.authorName,
+		"-c", "user.email=" + g.authorEmail,
+		"-c", "commit.gpgSign=false",
+		"commit", "--quiet", "--message", msg, "--",
+	}, g.outputs...)...)
+	if err != nil {
+		return err
+	}
+
+	hash, err := g.git(ctx, "rev-parse", "--short", "HEAD")
+	if err != nil {
+		return err
+	}
+	subject, _, _ := strings.Cut(msg, "\n")
+	res.Add("commit", Changed, "committed %s: %s", bytes.TrimSpace(hash), subject)
+	return nil
+}
+
+// push pushes the commits which aren't on the remote yet. A branch which isn't on the
+// remote yet is created with all local commits and set as the upstream of the current one
+func (g *GitUpdate) push(ctx context.Context, branch string, onRemote bool, res *Result) {
+	target := "push " + g.remote + "/" + branch
+
+	// FETCH_HEAD is the state of the remote branch as of the pull
+	commits, args := "FETCH_HEAD..HEAD", []string{"push", "--quiet"}
+	if !onRemote {
+		commits, args = "HEAD", append(args, "--set-upstream")
+	}
+	out, err := g.git(ctx, "rev-list", "--count", commits)
+	if err != nil {
+		res.Add(target, Failed, "%s", err)
+		return
+	}
+	ahead, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		res.Add(target, Failed, "unexpected output of git rev-list: %q", out)
+		return
+	}
+	if ahead == 0 {
+		return
+	}
+
+	_, err = g.git(ctx, append(args, g.remote, "HEAD:refs/heads/"+branch)...)
+	if err != nil {
+		res.Add(target, Failed, "%s", err)
+		return
+	}
+	res.Add(target, Changed, "pushed %d commit(s)", ahead)
+}
+
+// commitMessage renders the configured message. The default message states the
+// previous and the new IPs
+func (g *GitUpdate) commitMessage(req *Request, data *TemplateData) (string, error) {
+	if g.message != nil {
+		var buf bytes.Buffer
+		err := g.message.Execute(&buf, data)
+		if err != nil {
+			return "", fmt.Errorf("couldn't render commit message: %w", err)
+		}
+		return buf.String(), nil
+	}
+
+	var b strings.Builder
+	b.WriteString(g.subject(req, data))
+	b.WriteString("\n\n")
+	fmt.Fprintf(&b, "Reason: %s\n", req.Reason)
+	b.WriteString("Files:\n")
+	for _, output := range g.outputs {
+		fmt.Fprintf(&b, "  %s\n", output)
+	}
+	return b.String(), nil
+}
+
+// subject is the first line of the default commit message, e.g.
+// "Update IP of gateway: 192.0.2.1 → 203.0.113.7"
+func (g *GitUpdate) subject(req *Request, data *TemplateData) string {
+	var changes []string
+	for _, ips := range [][2]string{{req.PreviousIPv4, req.IPv4}, {req.PreviousIPv6, req.IPv6}} {
+		previous, current := ips[0], ips[1]
+		switch {
+		case current == "":
+			continue
+		case previous == "" || previous == current:
+			changes = append(changes, current)
+		default:
+			changes = append(changes, previous+" → "+current)
+		}
+	}
+	return fmt.Sprintf("Update IP of %s: %s", data.Hostname, strings.Join(changes, ", "))
+}
@@ -0,0 +1,253 @@
+package update
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+)
+
+// runGit runs git in dir and returns its trimmed output
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	args = append([]string{"-C", dir, "-c", "user.name=Test", "-c", "user.email=test@example.com", "-c", "commit.gpgSign=false"}, args...)
+	out, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %s: %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// gitRemote creates a bare repository with an initial commit on main and returns its
+// path and a clone of it
+func gitRemote(t *testing.T) (string, string) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skipf("git not available: %s", err)
+	}
+	dir := t.TempDir()
+	remote, work := filepath.Join(dir, "remote.git"), filepath.Join(dir, "work")
+
+	runGit(t, dir, "init", "--quiet", "--bare", "--initial-branch=main", remote)
+	runGit(t, dir, "clone", "--quiet", remote, work)
+	err := os.WriteFile(filepath.Join(work, "README"), []byte("managed by GitOps\n"), 0644)
+	if err != nil {
+		t.Fatalf("couldn't write README: %s", err)
+	}
+	runGit(t, work, "checkout", "--quiet", "-b", "main")
+	runGit(t, work, "add", "README")
+	runGit(t, work, "commit", "--quiet", "-m", "Initial commit")
+	runGit(t, work, "push", "--quiet", "origin", "main")
+	return remote, work
+}
+
+func TestGitUpdate(t *testing.T) {
+	remote, work := gitRemote(t)
+
+	tmpl := filepath.Join(t.TempDir(), "records.yaml.tmpl")
+	err := os.WriteFile(tmpl, []byte("dynip: {{ .IPv4 }}\n"), 0644)
+	if err != nil {
+		t.Fatalf("couldn't write template: %s", err)
+	}
+
+	g, err := NewGitUpdate(&cfg.GitConfig{
+		Repository: work,
+		Files:      []*cfg.FileTarget{{Template: tmpl, Output: "zones/records.yaml"}},
+		Remote:     "origin",
+	})
+	if err != nil {
+		t.Fatalf("couldn't create git updater: %s", err)
+	}
+	hostname, _ := os.Hostname()
+
+	var tests = []struct {
+		name     string
+		req      *Request
+		prepare  func()
+		outcomes []Outcome
+		subject  string
+		commits  int
+	}{
+		{"commit and push",
+			&Request{IPv4: "203.0.113.7", PreviousIPv4: "192.0.2.1", Reason: ReasonInterface},
+			nil,
+			[]Outcome{Changed, Changed, Changed},
+			"Update IP of " + hostname + ": 192.0.2.1 → 203.0.113.7",
+			2},
+		{"unchanged",
+			&Request{IPv4: "203.0.113.7", PreviousIPv4: "192.0.2.1"},
+			nil,
+			[]Outcome{Unchanged},
+			"Update IP of " + hostname + ": 192.0.2.1 → 203.0.113.7",
+			2},
+		{"rebase onto remote",
+			&Request{IPv4: "203.0.113.8", PreviousIPv4: "203.0.113.7", IPv6: "2001:db8::7"},
+			func() {
+				// someone else pushes in the meantime
+				other := filepath.Join(t.TempDir(), "other")
+				runGit(t, work, "clone", "--quiet", remote, other)
+				os.WriteFile(filepath.Join(other, "README"), []byte("managed by GitOps. Review required\n"), 0644)
+				runGit(t, other, "commit", "--quiet", "-am", "Require reviews")
+				runGit(t, other, "push", "--quiet", "origin", "main")
+			},
+			[]Outcome{Changed, Changed, Changed},
+			"Update IP of " + hostname + ": 203.0.113.7 → 203.0.113.8, 2001:db8::7",
+			4},
+		{"dry run",
+			&Request{IPv4: "203.0.113.9", PreviousIPv4: "203.0.113.8", DryRun: true},
+			nil,
+			[]Outcome{Changed, Changed},
+			"Update IP of " + hostname + ": 203.0.113.7 → 203.0.113.8, 2001:db8::7",
+			4},
+		{"push rejected",
+			&Request{IPv4: "203.0.113.9", PreviousIPv4: "203.0.113.8"},
+			func() {
+				hook := filepath.Join(remote, "hooks", "pre-receive")
+				os.WriteFile(hook, []byte("#!/bin/sh\necho branch is protected >&2\nexit 1\n"), 0755)
+			},
+			[]Outcome{Changed, Changed, Failed},
+			"Update IP of " + hostname + ": 203.0.113.7 → 203.0.113.8, 2001:db8::7",
+			4},
+		{"push retried",
+			&Request{IPv4: "203.0.113.9", PreviousIPv4: "203.0.113.8"},
+			func() {
+				os.Remove(filepath.Join(remote, "hooks", "pre-receive"))
+			},
+			[]Outcome{Unchanged, Changed},
+			"Update IP of " + hostname + ": 203.0.113.8 → 203.0.113.9",
+			5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.prepare != nil {
+				test.prepare()
+			}
+
+			res, err := g.Apply(context.Background(), test.req)
+			for _, tr := range res.Targets {
+				t.Logf("%s: %s: %s", tr.Target, tr.Outcome, tr.Message)
+			}
+			if (res.Count(Failed) > 0) != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(res.Targets) != len(test.outcomes) {
+				t.Fatalf("unexpected result: %v", res.Targets)
+			}
+			for i, o := range test.outcomes {
+				if res.Targets[i].Outcome != o {
+					t.Fatalf("unexpected outcome of %s: got %s, want %s", res.Targets[i].Target, res.Targets[i].Outcome, o)
+				}
+			}
+
+			subject := runGit(t, remote, "log", "-1", "--format=%s", "main")
+			if subject != test.subject {
+				t.Fatalf("unexpected subject: got %q, want %q", subject, test.subject)
+			}
+			if count := runGit(t, remote, "rev-list", "--count", "main"); count != strconv.Itoa(test.commits) {
+				t.Fatalf("unexpected number of commits: got %s, want %d", count, test.commits)
+			}
+		})
+	}
+
+	// the remote has the file as well as the commits of others
+	if content := runGit(t, remote, "show", "main:zones/records.yaml"); content != "dynip: 203.0.113.9" {
+		t.Fatalf("unexpected content: %q", content)
+	}
+	if readme := runGit(t, remote, "show", "main:README"); !strings.Contains(readme, "Review required") {
+		t.Fatalf("commit of others lost: %q", readme)
+	}
+	if author := runGit(t, remote, "log", "-1", "--format=%an <%ae>", "main"); author != "dynip-ng <dynip-ng@"+hostname+">" {
+		t.Fatalf("unexpected author: %s", author)
+	}
+}
+
+func TestGitUpdateMessage(t *testing.T) {
+	_, work := gitRemote(t)
+
+	tmpl := filepath.Join(t.TempDir(), "upstream.conf.tmpl")
+	err := os.WriteFile(tmpl, []byte("server {{ . }}:443;\n"), 0644)
+	if err != nil {
+		t.Fatalf("couldn't write template: %s", err)
+	}
+
+	g, err := NewGitUpdate(&cfg.GitConfig{
+		Repository:  work,
+		Files:       []*cfg.FileTarget{{Template: tmpl, Output: "upstream.conf"}},
+		Message:     "proxy: point upstream at {{ .IPv4 }}\n\nReason: {{ env \"DYNIP_TEST_TICKET\" }}",
+		AuthorName:  "Gateway",
+		AuthorEmail: "gateway@example.com",
+	})
+	if err != nil {
+		t.Fatalf("couldn't create git updater: %s", err)
+	}
+	t.Setenv("DYNIP_TEST_TICKET", "OPS-42")
+
+	_, err = g.Apply(context.Background(), &Request{IPv4: "203.0.113.7"})
+	if err != nil {
+		t.Fatalf("update failed: %s", err)
+	}
+
+	// the dry run previews the configured message
+	res, err := g.Apply(context.Background(), &Request{IPv4: "203.0.113.8", DryRun: true})
+	if err != nil {
+		t.Fatalf("dry run failed: %s", err)
+	}
+	preview := res.Targets[len(res.Targets)-1]
+	if preview.Target != "commit" || preview.Message != "would commit proxy: point upstream at 203.0.113.8" {
+		t.Fatalf("unexpected preview: %+v", preview)
+	}
+
+	// without a remote, the commit stays local
+	msg := runGit(t, work, "log", "-1", "--format=%an <%ae>%n%B")
+	expected := "Gateway <gateway@example.com>\nproxy: point upstream at 203.0.113.7\n\nReason: OPS-42"
+	if msg != expected {
+		t.Fatalf("unexpected commit: got %q, want %q", msg, expected)
+	}
+	if status := runGit(t, work, "status", "--porcelain"); status != "" {
+		t.Fatalf("working tree not clean: %s", status)
+	}
+}
+
+func TestGitUpdateNewBranch(t *testing.T) {
+	remote, work := gitRemote(t)
+
+	tmpl := filepath.Join(t.TempDir(), "records.yaml.tmpl")
+	err := os.WriteFile(tmpl, []byte("dynip: {{ .IPv4 }}\n"), 0644)
+	if err != nil {
+		t.Fatalf("couldn't write template: %s", err)
+	}
+
+	// the branch doesn't exist on the remote before the first push
+	g, err := NewGitUpdate(&cfg.GitConfig{
+		Repository: work,
+		Files:      []*cfg.FileTarget{{Template: tmpl, Output: "records.yaml"}},
+		Remote:     "origin",
+		Branch:     "dynip",
+	})
+	if err != nil {
+		t.Fatalf("couldn't create git updater: %s", err)
+	}
+
+	for i, ip := range []string{"203.0.113.7", "203.0.113.8"} {
+		res, err := g.Apply(context.Background(), &Request{IPv4: ip})
+		if err != nil {
+			t.Fatalf("[%d] update failed: %s", i, err)
+		}
+		t.Log(res)
+
+		if content := runGit(t, remote, "show", "dynip:records.yaml"); content != "dynip: "+ip {
+			t.Fatalf("[%d] unexpected content on the remote: %s", i, content)
+		}
+	}
+	if count := runGit(t, remote, "rev-list", "--count", "dynip"); count != "3" {
+		t.Fatalf("unexpected number of commits on the remote: got %s, want 3", count)
+	}
+	if upstream := runGit(t, work, "rev-parse", "--abbrev-ref", "@{upstream}"); upstream != "origin/dynip" {
+		t.Fatalf("unexpected upstream: got %q, want %q", upstream, "origin/dynip")
+	}
+}
@@ -0,0 +1,207 @@
+package update
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/logging"
+	log "github.com/els0r/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultHostsMarker = "dynip-ng"
+	defaultHostsFormat = cfg.HostsFormatHosts
+)
+
+// HostsUpdate points names at the IP in the file of a local resolver, such as /etc/hosts
+// or a dnsmasq or unbound include. The entries are kept in a fenced block, which is
+// appended to the file if it doesn't have one yet
+type HostsUpdate struct {
+	Instance
+
+	path   string
+	format string
+	names  []string
+	begin  string
+	end    string
+	reload string
+
+	log log.Logger
+}
+
+// NewHostsUpdate creates a hosts updater
+func NewHostsUpdate(cfg *cfg.HostsConfig) (*HostsUpdate, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("hosts update must have a file")
+	}
+	if len(cfg.Names) == 0 {
+		return nil, fmt.Errorf("hosts update must have names")
+	}
+
+	h := &HostsUpdate{
+		path:   cfg.Path,
+		format: cfg.Format,
+		names:  cfg.Names,
+		reload: cfg.Reload,
+		log:    logging.Get(),
+	}
+	if h.format == "" {
+		h.format = defaultHostsFormat
+	}
+	if _, ok := hostsFormats[h.format]; !ok {
+		return nil, fmt.Errorf("unsupported format %q", h.format)
+	}
+
+	marker := cfg.Marker
+	if marker == "" {
+		marker = defaultHostsMarker
+	}
+	h.begin, h.end = "# BEGIN "+marker, "# END "+marker
+	return h, nil
+}
+
+// hostsFormats render the entries pointing names at the IPs of a request
+var hostsFormats = map[string]func(names, ips []string) []string{
+	cfg.HostsFormatHosts: func(names, ips []string) []string {
+		var lines []string
+		for _, ip := range ips {
+			lines = append(lines, ip+" "+strings.Join(names, " "))
+		}
+		return lines
+	},
+	cfg.HostsFormatDnsmasqAddress: func(names, ips []string) []string {
+		var lines []string
+		for _, name := range names {
+			for _, ip := range ips {
+				lines = append(lines, fmt.Sprintf("address=/%s/%s", name, ip))
+			}
+		}
+		return lines
+	},
+	cfg.HostsFormatDnsmasqHostRecord: func(names, ips []string) []string {
+		return []string{"host-record=" + strings.Join(append(append([]string{}, names...), ips...), ",")}
+	},
+	cfg.HostsFormatUnbound: func(names, ips []string) []string {
+		var lines []string
+		for _, name := range names {
+			for _, ip := range ips {
+				rrtype := "A"
+				if strings.Contains(ip, ":") {
+					rrtype = "AAAA"
+				}
+				lines = append(lines, fmt.Sprintf("local-data: \"%s %s %s\"", dns.Fqdn(name), rrtype, ip))
+			}
+		}
+		return lines
+	},
+}
+
+// Name returns a human-readable identifier for the updater
+func (h *HostsUpdate) Name() string {
+	return h.Label("hosts updater")
+}
+
+// Update points the names at IP
+func (h *HostsUpdate) Update(ctx context.Context, IP string) error {
+	req, err := NewRequest(IP)
+	if err != nil {
+		return err
+	}
+	_, err = h.Apply(ctx, req)
+	return err
+}
+
+// Apply points the names at the IPs of the request. The block is replaced as a whole, so
+// entries of an address family which isn't part of the request are removed. The file is
+// only written if the block changed, in which case the reload command is run
+func (h *HostsUpdate) Apply(ctx context.Context, req *Request) (*Result, error) {
+	err := req.Validate()
+	if err != nil {
+		return nil, err
+	}
+	h.log.Debugf("updating %s entries in %s", h.format, h.path)
+
+	res := new(Result)
+	target := fmt.Sprintf("%s (%s)", h.path, strings.Join(h.names, ", "))
+
+	data, err := os.ReadFile(h.path)
+	if err != nil && !os.IsNotExist(err) {
+		res.Add(target, Failed, "%s", err)
+		return res, res.Err()
+	}
+
+	block := append([]string{h.begin}, hostsFormats[h.format](h.names, req.IPs())...)
+	block = append(block, h.end)
+
+	updated, err := replaceBlock(data, block)
+	if err != nil {
+		res.Add(target, Failed, "%s", err)
+		return res, res.Err()
+	}
+	ips := strings.Join(req.IPs(), ", ")
+	switch {
+	case bytes.Equal(data, updated):
+		res.Add(target, Unchanged, "already point to %s", ips)
+		return res, nil
+	case req.DryRun:
+		res.Add(target, Changed, "would point to %s", ips)
+		return res, nil
+	}
+
+	err = writeFileAtomic(h.path, updated)
+	if err != nil {
+		res.Add(target, Failed, "%s", err)
+		return res, res.Err()
+	}
+	res.Add(target, Changed, "point to %s", ips)
+
+	if h.reload != "" {
+		err = runCommand(ctx, h.reload)
+		if err != nil {
+			res.Add("reload", Failed, "%s", err)
+			return res, res.Err()
+		}
+		h.log.Debugf("ran reload command %q", h.reload)
+	}
+	return res, nil
+}
+
+// replaceBlock replaces the lines from the first to the last line of block in data with
+// block. If data has no such block, it is appended
+func replaceBlock(data []byte, block []string) ([]byte, error) {
+	begin, end := block[0], block[len(block)-1]
+
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+
+	start, stop := -1, -1
+	for i, line := range lines {
+		switch strings.TrimSpace(line) {
+		case begin:
+			if start >= 0 {
+				return nil, fmt.Errorf("%q found more than once", begin)
+			}
+			start = i
+		case end:
+			if start >= 0 && stop < 0 {
+				stop = i
+			}
+		}
+	}
+	switch {
+	case start < 0:
+		lines = append(lines, block...)
+	case stop < 0:
+		return nil, fmt.Errorf("%q not found after %q", end, begin)
+	default:
+		lines = append(lines[:start], append(block, lines[stop+1:]...)...)
+	}
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
@@ -0,0 +1,131 @@
+package update
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+)
+
+var testHosts = `127.0.0.1 localhost
+::1 localhost ip6-localhost
+
+# BEGIN dynip-ng
+192.0.2.1 dynip.example.org
+# END dynip-ng
+192.168.1.10 nas.lan
+`
+
+func TestHostsUpdate(t *testing.T) {
+	names := []string{"dynip.example.org", "www.example.org"}
+
+	var tests = []struct {
+		name       string
+		cfg        *cfg.HostsConfig
+		initial    string
+		req        *Request
+		expected   string
+		shouldPass bool
+	}{
+		{"replace block",
+			&cfg.HostsConfig{Names: names},
+			testHosts,
+			&Request{IPv4: "203.0.113.7", IPv6: "2001:db8::7"},
+			`127.0.0.1 localhost
+::1 localhost ip6-localhost
+
+# BEGIN dynip-ng
+203.0.113.7 dynip.example.org www.example.org
+2001:db8::7 dynip.example.org www.example.org
+# END dynip-ng
+192.168.1.10 nas.lan
+`, true},
+		{"append block",
+			&cfg.HostsConfig{Names: names[:1], Marker: "dynip-ng wan"},
+			testHosts,
+			&Request{IPv4: "203.0.113.7"},
+			testHosts + `# BEGIN dynip-ng wan
+203.0.113.7 dynip.example.org
+# END dynip-ng wan
+`, true},
+		{"new file",
+			&cfg.HostsConfig{Names: names, Format: cfg.HostsFormatDnsmasqAddress},
+			"",
+			&Request{IPv4: "203.0.113.7"},
+			`# BEGIN dynip-ng
+address=/dynip.example.org/203.0.113.7
+address=/www.example.org/203.0.113.7
+# END dynip-ng
+`, true},
+		{"dnsmasq host record",
+			&cfg.HostsConfig{Names: names, Format: cfg.HostsFormatDnsmasqHostRecord},
+			"",
+			&Request{IPv4: "203.0.113.7", IPv6: "2001:db8::7"},
+			`# BEGIN dynip-ng
+host-record=dynip.example.org,www.example.org,203.0.113.7,2001:db8::7
+# END dynip-ng
+`, true},
+		{"unbound local data",
+			&cfg.HostsConfig{Names: names[:1], Format: cfg.HostsFormatUnbound},
+			"server:\n",
+			&Request{IPv4: "203.0.113.7", IPv6: "2001:db8::7"},
+			`server:
+# BEGIN dynip-ng
+local-data: "dynip.example.org. A 203.0.113.7"
+local-data: "dynip.example.org. AAAA 2001:db8::7"
+# END dynip-ng
+`, true},
+		{"unchanged",
+			&cfg.HostsConfig{Names: names[:1]},
+			testHosts,
+			&Request{IPv4: "192.0.2.1"},
+			testHosts, true},
+		{"dry run",
+			&cfg.HostsConfig{Names: names},
+			testHosts,
+			&Request{IPv4: "203.0.113.7", DryRun: true},
+			testHosts, true},
+		{"unterminated block",
+			&cfg.HostsConfig{Names: names},
+			"# BEGIN dynip-ng\n192.0.2.1 dynip.example.org\n",
+			&Request{IPv4: "203.0.113.7"},
+			"# BEGIN dynip-ng\n192.0.2.1 dynip.example.org\n", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "hosts")
+			if test.initial != "" {
+				err := os.WriteFile(path, []byte(test.initial), 0644)
+				if err != nil {
+					t.Fatalf("couldn't write file: %s", err)
+				}
+			}
+			test.cfg.Path = path
+
+			h, err := NewHostsUpdate(test.cfg)
+			if err != nil {
+				t.Fatalf("couldn't create hosts updater: %s", err)
+			}
+			res, err := h.Apply(context.Background(), test.req)
+			if test.shouldPass {
+				if err != nil {
+					t.Fatalf("hosts update failed: %s", err)
+				}
+				t.Log(res)
+			} else {
+				if err == nil {
+					t.Fatalf("hosts update should have failed but didn't")
+				}
+				t.Logf("provoked expected error: %s", err)
+			}
+
+			data, _ := os.ReadFile(path)
+			if string(data) != test.expected {
+				t.Fatalf("unexpected content:\n%s\nwant:\n%s", data, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package update
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	log "github.com/els0r/log"
+)
+
+// Middleware wraps a destination to add behavior to its updates, such as timeouts or
+// retries
+type Middleware func(next Destination) Destination
+
+// Chained is a destination which can also be used as an Updater
+type Chained interface {
+	Destination
+	Updater
+}
+
+// Chain wraps d in all middlewares. The first middleware is the outermost one, i.e. it
+// sees each update first. The returned destination keeps the name of d
+func Chain(d Destination, mws ...Middleware) Chained {
+	for i := len(mws) - 1; i >= 0; i-- {
+		d = mws[i](d)
+	}
+	if c, ok := d.(Chained); ok {
+		return c
+	}
+	return &destinationUpdater{d}
+}
+
+// destinationUpdater adds the Update method to destinations which don't have one, such
+// as those returned by middlewares of other packages
+type destinationUpdater struct {
+	Destination
+}
+
+func (d *destinationUpdater) unwrap() Destination {
+	return d.Destination
+}
+
+// Update runs the destination with the IP assigned to its address family
+func (d *destinationUpdater) Update(ctx context.Context, IP string) error {
+	req, err := NewRequest(IP)
+	if err != nil {
+		return err
+	}
+	_, err = d.Apply(ctx, req)
+	return err
+}
+
+// Middlewares returns the middlewares configured for a destination, in the order in
+// which they are chained: rate limit, retry, timeout
+func Middlewares(c cfg.MiddlewareConfig) []Middleware {
+	var mws []Middleware
+	if c.RateLimit > 0 {
+		mws = append(mws, RateLimit(c.RateLimit))
+	}
+	if c.Retry != nil && c.Retry.Attempts > 1 {
+		mws = append(mws, Retry(c.Retry.Attempts, c.Retry.Backoff))
+	}
+	if c.Timeout > 0 {
+		mws = append(mws, Timeout(c.Timeout))
+	}
+	return mws
+}
+
+// applyFunc is a destination made up of a name and an update function. It is
+// returned by the middlewares
+type applyFunc struct {
+	name  string
+	apply func(ctx context.Context, req *Request) (*Result, error)
+
+	// next is the wrapped destination
+	next Destination
+}
+
+func (a *applyFunc) unwrap() Destination {
+	return a.next
+}
+
+func (a *applyFunc) Name() string {
+	return a.name
+}
+
+func (a *applyFunc) Apply(ctx context.Context, req *Request) (*Result, error) {
+	return a.apply(ctx, req)
+}
+
+// Update runs the chain with the IP assigned to its address family
+func (a *applyFunc) Update(ctx context.Context, IP string) error {
+	req, err := NewRequest(IP)
+	if err != nil {
+		return err
+	}
+	_, err = a.apply(ctx, req)
+	return err
+}
+
+// Timeout cancels the context of an update attempt after d. Destinations are expected
+// to return once their context is done
+func Timeout(d time.Duration) Middleware {
+	return func(next Destination) Destination {
+		return &applyFunc{
+			name: next.Name(),
+			next: next,
+			apply: func(ctx context.Context, req *Request) (*Result, error) {
+				ctx, cancel := context.WithTimeout(ctx, d)
+				defer cancel()
+
+				return next.Apply(ctx, req)
+			},
+		}
+	}
+}
+
+// Retry runs an update up to attempts times until it succeeds. It waits for backoff
+// before the first retry and doubles the wait with each further one
+func Retry(attempts int, backoff time.Duration) Middleware {
+	return func(next Destination) Destination {
+		return &applyFunc{
+			name: next.Name(),
+			next: next,
+			apply: func(ctx context.Context, req *Request) (*Result, error) {
+				delay := backoff
+				for attempt := 1; ; attempt++ {
+					res, err := next.Apply(ctx, req)
+					if err == nil || attempt >= attempts {
+						return res, err
+					}
+
+					select {
+					case <-ctx.Done():
+						return res, err
+					case <-time.After(delay):
+					}
+					delay *= 2
+				}
+			},
+		}
+	}
+}
+
+// RateLimit allows at most one update every interval. Updates which come in earlier wait
+// for their turn. They fail if their context ends before that
+func RateLimit(interval time.Duration) Middleware {
+	return func(next Destination) Destination {
+		var (
+			mu   sync.Mutex
+			last time.Time
+		)
+		return &applyFunc{
+			name: next.Name(),
+			next: next,
+			apply: func(ctx context.Context, req *Request) (*Result, error) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				if !last.IsZero() {
+					wait := time.Until(last.Add(interval))
+					if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+						return nil, fmt.Errorf("rate limited: next update allowed in %s", wait.Round(time.Second))
+					}
+					if wait > 0 {
+						select {
+						case <-ctx.Done():
+							return nil, ctx.Err()
+						case <-time.After(wait):
+						}
+					}
+				}
+				last = time.Now()
+				return next.Apply(ctx, req)
+			},
+		}
+	}
+}
+
+// Logging logs the start and the duration of each update, the outcome of each target
+// and errors. Changes are logged at info level, unchanged targets at debug level
+func Logging(logger log.Logger) Middleware {
+	return func(next Destination) Destination {
+		name := next.Name()
+		return &applyFunc{
+			name: name,
+			next: next,
+			apply: func(ctx context.Context, req *Request) (*Result, error) {
+				logger.Debugf("running %s", name)
+				tstart := time.Now()
+
+				res, err := next.Apply(ctx, req)
+				if res != nil {
+					for _, t := range res.Targets {
+						switch t.Outcome {
+						case Changed, Removed:
+							logger.Infof("%s: %s %s: %s", name, t.Target, t.Outcome, t.Message)
+						case Failed:
+							// part of the error
+						default:
+							logger.Debugf("%s: %s %s: %s", name, t.Target, t.Outcome, t.Message)
+						}
+					}
+				}
+				if err != nil {
+					logger.Errorf("%s: %s", name, err)
+					return res, err
+				}
+				logger.Debugf("%s finished in %s", name, time.Since(tstart))
+				return res, nil
+			},
+		}
+	}
+}
+
+// metrics stores the counters of all destinations, keyed by their name. They are
+// published via expvar
+var (
+	metricsMu sync.Mutex
+	metrics   = expvar.NewMap("dynip_destinations")
+)
+
+// Metrics counts the updates of a destination, their errors and the outcomes of its
+// targets, and records the duration of the last update. The counters are published
+// via expvar under dynip_destinations, keyed by the destination's name
+func Metrics() Middleware {
+	return func(next Destination) Destination {
+		name := next.Name()
+
+		metricsMu.Lock()
+		m, ok := metrics.Get(name).(*expvar.Map)
+		if !ok {
+			m = new(expvar.Map)
+			metrics.Set(name, m)
+		}
+		metricsMu.Unlock()
+
+		return &applyFunc{
+			name: name,
+			next: next,
+			apply: func(ctx context.Context, req *Request) (*Result, error) {
+				tstart := time.Now()
+				res, err := next.Apply(ctx, req)
+
+				m.Add("updates", 1)
+				if err != nil {
+					m.Add("errors", 1)
+				}
+				if res != nil {
+					for _, t := range res.Targets {
+						m.Add("targets_"+t.Outcome.String(), 1)
+					}
+				}
+				duration := new(expvar.Float)
+				duration.Set(time.Since(tstart).Seconds())
+				m.Set("last_duration_seconds", duration)
+				return res, err
+			},
+		}
+	}
+}
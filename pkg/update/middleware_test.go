@@ -0,0 +1,206 @@
+package update
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+)
+
+// fails the first `failures` applies and records the context of each call
+type flakyDestination struct {
+	name     string
+	failures int
+	calls    int
+	deadline bool
+}
+
+func (f *flakyDestination) Name() string { return f.name }
+
+func (f *flakyDestination) Apply(ctx context.Context, req *Request) (*Result, error) {
+	f.calls++
+	_, f.deadline = ctx.Deadline()
+
+	res := new(Result)
+	if f.calls <= f.failures {
+		res.Add("record", Failed, "attempt %d failed", f.calls)
+		return res, res.Err()
+	}
+	res.Add("record", Changed, "points to %s", req.IP())
+	return res, nil
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next Destination) Destination {
+			return &applyFunc{
+				name: next.Name(),
+				apply: func(ctx context.Context, req *Request) (*Result, error) {
+					order = append(order, name)
+					return next.Apply(ctx, req)
+				},
+			}
+		}
+	}
+
+	d := Chain(&flakyDestination{name: "flaky"}, trace("outer"), trace("inner"))
+	if d.Name() != "flaky" {
+		t.Fatalf("unexpected name: %s", d.Name())
+	}
+
+	// the chain can be used as an updater as well
+	err := d.Update(context.Background(), "203.0.113.7")
+	if err != nil {
+		t.Fatalf("update failed: %s", err)
+	}
+	if fmt.Sprint(order) != "[outer inner]" {
+		t.Fatalf("unexpected order: %v", order)
+	}
+}
+
+// destination without an Update method, as returned by middlewares of other packages
+type bareDestination struct {
+	next Destination
+}
+
+func (b *bareDestination) Name() string { return b.next.Name() }
+
+func (b *bareDestination) Apply(ctx context.Context, req *Request) (*Result, error) {
+	return b.next.Apply(ctx, req)
+}
+
+func TestChainBareDestination(t *testing.T) {
+	f := &flakyDestination{name: "flaky"}
+	bare := func(next Destination) Destination { return &bareDestination{next} }
+
+	// the chain can be used as an updater even if the outermost destination isn't one
+	var u Updater = Chain(f, bare)
+	err := u.Update(context.Background(), "203.0.113.7")
+	if err != nil {
+		t.Fatalf("update failed: %s", err)
+	}
+	if f.calls != 1 {
+		t.Fatalf("unexpected number of calls: got %d, want 1", f.calls)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var tests = []struct {
+		name       string
+		failures   int
+		attempts   int
+		calls      int
+		shouldPass bool
+	}{
+		{"first attempt succeeds", 0, 3, 1, true},
+		{"retry succeeds", 2, 3, 3, true},
+		{"attempts exhausted", 3, 3, 3, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := &flakyDestination{failures: test.failures}
+			d := Chain(f, Retry(test.attempts, time.Millisecond))
+
+			_, err := d.Apply(context.Background(), &Request{IPv4: "203.0.113.7"})
+			if test.shouldPass != (err == nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if f.calls != test.calls {
+				t.Fatalf("unexpected number of calls: got %d, want %d", f.calls, test.calls)
+			}
+		})
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	f := &flakyDestination{}
+	_, err := Chain(f, Timeout(time.Second)).Apply(context.Background(), &Request{IPv4: "203.0.113.7"})
+	if err != nil {
+		t.Fatalf("apply failed: %s", err)
+	}
+	if !f.deadline {
+		t.Fatalf("destination was run without a deadline")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	f := &flakyDestination{}
+	d := Chain(f, RateLimit(time.Hour))
+
+	req := &Request{IPv4: "203.0.113.7"}
+	_, err := d.Apply(context.Background(), req)
+	if err != nil {
+		t.Fatalf("apply failed: %s", err)
+	}
+
+	// the next update isn't allowed before the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = d.Apply(ctx, req)
+	if err == nil {
+		t.Fatalf("rate limited apply should have failed but didn't")
+	}
+	if f.calls != 1 {
+		t.Fatalf("unexpected number of calls: got %d, want 1", f.calls)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	f := &flakyDestination{name: "metrics test", failures: 1}
+	d := Chain(f, Metrics())
+
+	req := &Request{IPv4: "203.0.113.7"}
+	for i := 0; i < 2; i++ {
+		d.Apply(context.Background(), req)
+	}
+
+	m := metrics.Get("metrics test").(*expvar.Map)
+	expected := map[string]string{
+		"updates":           "2",
+		"errors":            "1",
+		"targets_failed":    "1",
+		"targets_changed":   "1",
+		"targets_unchanged": "",
+	}
+	for key, value := range expected {
+		var got string
+		if v := m.Get(key); v != nil {
+			got = v.String()
+		}
+		if got != value {
+			t.Fatalf("unexpected value of %s: got %q, want %q", key, got, value)
+		}
+	}
+}
+
+func TestMiddlewares(t *testing.T) {
+	var tests = []struct {
+		name     string
+		cfg      cfg.MiddlewareConfig
+		expected int
+	}{
+		{"none", cfg.MiddlewareConfig{}, 0},
+		{"timeout", cfg.MiddlewareConfig{Timeout: time.Second}, 1},
+		{"single attempt", cfg.MiddlewareConfig{Retry: &cfg.RetryConfig{Attempts: 1}}, 0},
+		{"all", cfg.MiddlewareConfig{
+			Timeout:   time.Second,
+			RateLimit: time.Minute,
+			Retry:     &cfg.RetryConfig{Attempts: 3, Backoff: time.Second},
+		}, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mws := Middlewares(test.cfg)
+			if len(mws) != test.expected {
+				t.Fatalf("unexpected number of middlewares: got %d, want %d", len(mws), test.expected)
+			}
+		})
+	}
+}
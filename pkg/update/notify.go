@@ -0,0 +1,88 @@
+package update
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// Notifier is a destination which reports updates, e.g. by sending a message, instead of
+// storing the IP. Notifiers are run after all other destinations and are told about
+// their outcome via Request.Notification
+type Notifier interface {
+	Destination
+
+	// Notify sends the notification
+	Notify(ctx context.Context, n *Notification) error
+}
+
+// IsNotifier checks whether d is a Notifier or wraps one, e.g. in middleware
+func IsNotifier(d Destination) bool {
+	for d != nil {
+		if _, ok := d.(Notifier); ok {
+			return true
+		}
+		w, ok := d.(interface{ unwrap() Destination })
+		if !ok {
+			return false
+		}
+		d = w.unwrap()
+	}
+	return false
+}
+
+// DestinationResult is the outcome of updating a destination
+type DestinationResult struct {
+	Name   string
+	Result *Result
+	Err    error
+}
+
+// Notification describes an update for notifiers
+type Notification struct {
+	// IPs of the update. Either of them may be empty
+	IPv4 string
+	IPv6 string
+
+	// IPs before the update. Empty if unknown
+	PreviousIPv4 string
+	PreviousIPv6 string
+
+	// Reason states what triggered the update
+	Reason Reason
+
+	// Hostname of the machine running the update
+	Hostname string
+
+	// Timestamp of the update
+	Timestamp time.Time
+
+	// Results of the destinations which were updated
+	Results []DestinationResult
+}
+
+// NewNotification creates a notification for req. The results of the destinations are
+// added by the caller
+func NewNotification(req *Request) *Notification {
+	hostname, _ := os.Hostname()
+	return &Notification{
+		IPv4:         req.IPv4,
+		IPv6:         req.IPv6,
+		PreviousIPv4: req.PreviousIPv4,
+		PreviousIPv6: req.PreviousIPv6,
+		Reason:       req.Reason,
+		Hostname:     hostname,
+		Timestamp:    time.Now(),
+	}
+}
+
+// Failed returns the number of destinations which failed to update
+func (n *Notification) Failed() int {
+	var failed int
+	for _, r := range n.Results {
+		if r.Err != nil {
+			failed++
+		}
+	}
+	return failed
+}
@@ -0,0 +1,359 @@
+package update
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/logging"
+	log "github.com/els0r/log"
+)
+
+// patchGroup is the name of the group of a pattern selecting the addresses to replace
+const patchGroup = "ip"
+
+var (
+	ipv4Pattern = regexp.MustCompile(`\d{1,3}(?:\.\d{1,3}){3}`)
+	ipv6Pattern = regexp.MustCompile(`[0-9A-Fa-f]{0,4}(?::[0-9A-Fa-f]{0,4}){2,7}`)
+)
+
+// PatchUpdate replaces the IPs in parts of an existing file, such as an sshd_config which
+// is also edited by other tools. All other content is left untouched
+type PatchUpdate struct {
+	Instance
+
+	path    string
+	markers *cfg.PatchMarkers
+	pattern *regexp.Regexp
+	reload  string
+
+	log log.Logger
+}
+
+// NewPatchUpdate creates a patch updater
+func NewPatchUpdate(cfg *cfg.PatchConfig) (*PatchUpdate, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("patch update must have a file")
+	}
+	if cfg.Markers == nil && cfg.Pattern == "" {
+		return nil, fmt.Errorf("patch update must have markers or a pattern")
+	}
+
+	p := &PatchUpdate{
+		path:    cfg.Path,
+		markers: cfg.Markers,
+		reload:  cfg.Reload,
+		log:     logging.Get(),
+	}
+	if cfg.Pattern != "" {
+		var err error
+		p.pattern, err = regexp.Compile(cfg.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// Name returns a human-readable identifier for the updater
+func (p *PatchUpdate) Name() string {
+	return p.Label("patch updater")
+}
+
+// Update replaces the addresses of the address family of IP with IP
+func (p *PatchUpdate) Update(ctx context.Context, IP string) error {
+	req, err := NewRequest(IP)
+	if err != nil {
+		return err
+	}
+	_, err = p.Apply(ctx, req)
+	return err
+}
+
+// Apply replaces addresses in the patched lines with the IP of the request of the same
+// address family. Addresses in the ip group of the pattern are always replaced. Of the
+// other addresses, only the previous IP is replaced, or the single address of the family
+// if the previous IP isn't known or found. Address families without an address in the
+// patched lines are skipped. The file is only written if it changed, in which case the
+// reload command is run
+func (p *PatchUpdate) Apply(ctx context.Context, req *Request) (*Result, error) {
+	err := req.Validate()
+	if err != nil {
+		return nil, err
+	}
+	p.log.Debugf("patching file: %s", p.path)
+
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+
+	res := new(Result)
+	lines := strings.SplitAfter(string(data), "\n")
+	selected, err := p.selectLines(lines)
+	if err != nil {
+		res.Add(p.path, Failed, "%s", err)
+		return res, res.Err()
+	}
+
+	patched := make([]string, len(lines))
+	copy(patched, lines)
+
+	var changed bool
+	for _, IP := range req.IPs() {
+		ip := net.ParseIP(IP)
+		family, previous := "IPv4", net.ParseIP(req.PreviousIPv4)
+		if ip.To4() == nil {
+			family, previous = "IPv6", net.ParseIP(req.PreviousIPv6)
+		}
+		target := fmt.Sprintf("%s (%s)", p.path, family)
+
+		found := p.findAddresses(lines, selected, ip.To4() != nil)
+		if len(found) == 0 {
+			res.Add(target, Skipped, "no %s address in the patched lines", family)
+			continue
+		}
+		replace, err := pick(found, ip, previous)
+		if err != nil {
+			res.Add(target, Failed, "%s", err)
+			continue
+		}
+		if len(replace) == 0 {
+			res.Add(target, Unchanged, "already set to %s", IP)
+			continue
+		}
+
+		// replace from the back, so that the positions of the other addresses in a line
+		// stay valid
+		for i := len(replace) - 1; i >= 0; i-- {
+			a := replace[i]
+			patched[a.line] = patched[a.line][:a.start] + IP + patched[a.line][a.end:]
+		}
+		changed = true
+		if req.DryRun {
+			res.Add(target, Changed, "would set %d of %d addresses to %s", len(replace), len(found), IP)
+		} else {
+			res.Add(target, Changed, "set %d of %d addresses to %s", len(replace), len(found), IP)
+		}
+	}
+	if !changed {
+		return res, res.Err()
+	}
+
+	// preview the changes
+	for i := range lines {
+		if lines[i] != patched[i] {
+			p.log.Debugf("%s:%d\n-%s+%s", p.path, i+1, withNewline(lines[i]), withNewline(patched[i]))
+		}
+	}
+	if req.DryRun {
+		return res, res.Err()
+	}
+
+	err = writeFileAtomic(p.path, []byte(strings.Join(patched, "")))
+	if err != nil {
+		res.Add(p.path, Failed, "%s", err)
+		return res, res.Err()
+	}
+	if p.reload != "" {
+		err = runCommand(ctx, p.reload)
+		if err != nil {
+			res.Add("reload", Failed, "%s", err)
+			return res, res.Err()
+		}
+		p.log.Debugf("ran reload command %q", p.reload)
+	}
+	return res, res.Err()
+}
+
+// selectLines returns the indices of the lines between the markers and of the lines
+// matching the pattern. The marker lines themselves aren't selected
+func (p *PatchUpdate) selectLines(lines []string) ([]int, error) {
+	var (
+		selected []int
+		inside   bool
+		sections int
+	)
+	for i, line := range lines {
+		if p.markers != nil {
+			switch {
+			case !inside && strings.Contains(line, p.markers.Begin):
+				inside = true
+				sections++
+				continue
+			case inside && strings.Contains(line, p.markers.End):
+				inside = false
+				continue
+			}
+		}
+		if inside || (p.pattern != nil && p.pattern.MatchString(strings.TrimRight(line, "\r\n"))) {
+			selected = append(selected, i)
+		}
+	}
+	if p.markers != nil {
+		if sections == 0 {
+			return nil, fmt.Errorf("begin marker %q not found", p.markers.Begin)
+		}
+		if inside {
+			return nil, fmt.Errorf("end marker %q not found", p.markers.End)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no lines to patch")
+	}
+	return selected, nil
+}
+
+// address is an address found in the patched lines
+type address struct {
+	line       int
+	start, end int
+	ip         net.IP
+
+	// captured is set if the address is part of the ip group of the pattern
+	captured bool
+}
+
+// findAddresses returns the addresses of the address family in the selected lines. In
+// lines matched by a pattern with an ip group, only the addresses in the group are
+// returned. Loopback and unspecified addresses, such as 127.0.0.1 or ::, are only
+// returned if they are part of the group
+func (p *PatchUpdate) findAddresses(lines []string, selected []int, v4 bool) []address {
+	group := -1
+	if p.pattern != nil {
+		group = p.pattern.SubexpIndex(patchGroup)
+	}
+
+	var found []address
+	for _, i := range selected {
+		line := strings.TrimRight(lines[i], "\r\n")
+
+		var groups [][]int
+		if group > 0 {
+			for _, m := range p.pattern.FindAllStringSubmatchIndex(line, -1) {
+				if m[2*group] >= 0 {
+					groups = append(groups, m[2*group:2*group+2])
+				}
+			}
+		}
+		captured := func(start, end int) bool {
+			for _, g := range groups {
+				if start >= g[0] && end <= g[1] {
+					return true
+				}
+			}
+			return false
+		}
+
+		for _, loc := range lineAddresses(line, v4) {
+			a := address{line: i, start: loc[0], end: loc[1], ip: net.ParseIP(line[loc[0]:loc[1]])}
+			a.captured = captured(a.start, a.end)
+			switch {
+			case a.captured:
+			case len(groups) > 0:
+				// the pattern selects the addresses of the line
+				continue
+			case a.ip.IsLoopback() || a.ip.IsUnspecified():
+				continue
+			}
+			found = append(found, a)
+		}
+	}
+	return found
+}
+
+// pick returns the addresses to replace with IP. Captured addresses are always replaced.
+// Of the others, those matching previous are replaced. If there are none, a single
+// address is taken to be the one to replace, unless IP is set already. Several
+// addresses can't be told apart and are rejected
+func pick(found []address, IP, previous net.IP) ([]address, error) {
+	var (
+		take         = make([]bool, len(found))
+		others       []int
+		matched, set bool
+	)
+	for i, a := range found {
+		switch {
+		case a.captured:
+			take[i] = true
+		case previous != nil && a.ip.Equal(previous):
+			take[i], matched = true, true
+		default:
+			set = set || a.ip.Equal(IP)
+			others = append(others, i)
+		}
+	}
+	switch {
+	case matched || set || len(others) == 0:
+	case len(others) == 1:
+		take[others[0]] = true
+	default:
+		return nil, fmt.Errorf("%d addresses in the patched lines and none of them is the previous IP. Select the one to replace with an %q group in the pattern", len(others), patchGroup)
+	}
+
+	var replace []address
+	for i, a := range found {
+		if take[i] && !a.ip.Equal(IP) {
+			replace = append(replace, a)
+		}
+	}
+	return replace, nil
+}
+
+// lineAddresses returns the positions of the addresses of the address family in line.
+// Matches which are part of a longer token or aren't valid addresses are left out
+func lineAddresses(line string, v4 bool) [][]int {
+	re := ipv4Pattern
+	if !v4 {
+		re = ipv6Pattern
+	}
+	var locs [][]int
+	for _, loc := range re.FindAllStringIndex(line, -1) {
+		if isAddress(line, loc[0], loc[1], v4) {
+			locs = append(locs, loc)
+		}
+	}
+	return locs
+}
+
+// isAddress checks that line[start:end] is a standalone address of the given family.
+// Network prefixes such as 10.0.0.0/8 aren't considered addresses
+func isAddress(line string, start, end int, v4 bool) bool {
+	ip := net.ParseIP(line[start:end])
+	if ip == nil || (ip.To4() != nil) != v4 {
+		return false
+	}
+	if end < len(line) && line[end] == '/' {
+		return false
+	}
+
+	// the match must not continue an adjacent token, e.g. 1.2.3.4.5
+	continues := func(c byte) bool {
+		if v4 {
+			return c >= '0' && c <= '9' || c == '.'
+		}
+		return c == ':' || c == '.' ||
+			c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+	}
+	if start > 0 && continues(line[start-1]) {
+		return false
+	}
+	if end < len(line) && continues(line[end]) {
+		// a trailing dot ends a sentence rather than the address
+		if !(line[end] == '.' && (end+1 == len(line) || !continues(line[end+1]))) {
+			return false
+		}
+	}
+	return true
+}
+
+func withNewline(line string) string {
+	if strings.HasSuffix(line, "\n") {
+		return line
+	}
+	return line + "\n"
+}
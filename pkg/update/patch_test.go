@@ -0,0 +1,184 @@
+package update
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+)
+
+var testSSHDConfig = `# managed by hand
+Port 22
+ListenAddress 192.0.2.1
+ListenAddress [2001:db8::1]:22
+ListenAddress 127.0.0.1
+ListenAddress ::
+# BEGIN dynip-ng
+Match Address 192.0.2.1,10.0.0.0/8
+# END dynip-ng
+AllowUsers admin@192.0.2.1 backup@198.51.100.2
+`
+
+func TestPatchUpdate(t *testing.T) {
+	markers := &cfg.PatchMarkers{Begin: "# BEGIN dynip-ng", End: "# END dynip-ng"}
+
+	var tests = []struct {
+		name       string
+		cfg        *cfg.PatchConfig
+		req        *Request
+		expected   string
+		shouldPass bool
+	}{
+		{"markers",
+			&cfg.PatchConfig{Markers: markers},
+			&Request{IPv4: "203.0.113.7"},
+			`# managed by hand
+Port 22
+ListenAddress 192.0.2.1
+ListenAddress [2001:db8::1]:22
+ListenAddress 127.0.0.1
+ListenAddress ::
+# BEGIN dynip-ng
+Match Address 203.0.113.7,10.0.0.0/8
+# END dynip-ng
+AllowUsers admin@192.0.2.1 backup@198.51.100.2
+`, true},
+		{"pattern with both families",
+			&cfg.PatchConfig{Pattern: `^ListenAddress (192|\[)`},
+			&Request{IPv4: "203.0.113.7", IPv6: "2001:db8::7"},
+			`# managed by hand
+Port 22
+ListenAddress 203.0.113.7
+ListenAddress [2001:db8::7]:22
+ListenAddress 127.0.0.1
+ListenAddress ::
+# BEGIN dynip-ng
+Match Address 192.0.2.1,10.0.0.0/8
+# END dynip-ng
+AllowUsers admin@192.0.2.1 backup@198.51.100.2
+`, true},
+		{"loopback and unspecified addresses are left alone",
+			&cfg.PatchConfig{Pattern: `^ListenAddress`},
+			&Request{IPv4: "203.0.113.7", IPv6: "2001:db8::7"},
+			strings.NewReplacer(
+				"ListenAddress 192.0.2.1", "ListenAddress 203.0.113.7",
+				"[2001:db8::1]", "[2001:db8::7]",
+			).Replace(testSSHDConfig), true},
+		{"previous address among several",
+			&cfg.PatchConfig{Pattern: `^AllowUsers`},
+			&Request{IPv4: "203.0.113.7", PreviousIPv4: "198.51.100.2"},
+			strings.Replace(testSSHDConfig, "backup@198.51.100.2", "backup@203.0.113.7", 1), true},
+		{"previous address in several lines",
+			&cfg.PatchConfig{Pattern: `^(ListenAddress|AllowUsers)`, Markers: markers},
+			&Request{IPv4: "203.0.113.7", PreviousIPv4: "192.0.2.1"},
+			strings.ReplaceAll(testSSHDConfig, "192.0.2.1", "203.0.113.7"), true},
+		{"several addresses without previous address",
+			&cfg.PatchConfig{Pattern: `^AllowUsers`},
+			&Request{IPv4: "203.0.113.7"},
+			testSSHDConfig, false},
+		{"several addresses without previous address in the file",
+			&cfg.PatchConfig{Pattern: `^AllowUsers`},
+			&Request{IPv4: "203.0.113.7", PreviousIPv4: "192.0.2.99"},
+			testSSHDConfig, false},
+		{"ip group",
+			&cfg.PatchConfig{Pattern: `^AllowUsers .*backup@(?P<ip>\S+)`},
+			&Request{IPv4: "203.0.113.7"},
+			strings.Replace(testSSHDConfig, "backup@198.51.100.2", "backup@203.0.113.7", 1), true},
+		{"ip group ignores the previous address",
+			&cfg.PatchConfig{Pattern: `^AllowUsers .*backup@(?P<ip>\S+)`},
+			&Request{IPv4: "203.0.113.7", PreviousIPv4: "192.0.2.1"},
+			strings.Replace(testSSHDConfig, "backup@198.51.100.2", "backup@203.0.113.7", 1), true},
+		{"unchanged",
+			&cfg.PatchConfig{Pattern: `^AllowUsers`},
+			&Request{IPv4: "192.0.2.1"},
+			testSSHDConfig, true},
+		{"dry run",
+			&cfg.PatchConfig{Markers: markers},
+			&Request{IPv4: "203.0.113.7", DryRun: true},
+			testSSHDConfig, true},
+		{"missing markers",
+			&cfg.PatchConfig{Markers: &cfg.PatchMarkers{Begin: "# BEGIN other", End: "# END other"}},
+			&Request{IPv4: "203.0.113.7"},
+			testSSHDConfig, false},
+		{"no matching lines",
+			&cfg.PatchConfig{Pattern: `^PermitRootLogin`},
+			&Request{IPv4: "203.0.113.7"},
+			testSSHDConfig, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "sshd_config")
+			err := os.WriteFile(path, []byte(testSSHDConfig), 0600)
+			if err != nil {
+				t.Fatalf("couldn't write file: %s", err)
+			}
+			test.cfg.Path = path
+
+			p, err := NewPatchUpdate(test.cfg)
+			if err != nil {
+				t.Fatalf("couldn't create patch updater: %s", err)
+			}
+			res, err := p.Apply(context.Background(), test.req)
+			if test.shouldPass {
+				if err != nil {
+					t.Fatalf("patch failed: %s", err)
+				}
+				t.Log(res)
+			} else {
+				if err == nil {
+					t.Fatalf("patch should have failed but didn't")
+				}
+				t.Logf("provoked expected error: %s", err)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("couldn't read file: %s", err)
+			}
+			if string(data) != test.expected {
+				t.Fatalf("unexpected content:\n%s\nwant:\n%s", data, test.expected)
+			}
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatalf("couldn't stat file: %s", err)
+			}
+			if fi.Mode().Perm() != 0600 {
+				t.Fatalf("file mode wasn't preserved: %s", fi.Mode())
+			}
+		})
+	}
+}
+
+func TestLineAddresses(t *testing.T) {
+	var tests = []struct {
+		name     string
+		line     string
+		v4       bool
+		expected []string
+	}{
+		{"address with port", "Listen 192.0.2.1:443", true, []string{"192.0.2.1"}},
+		{"several addresses", "from 192.0.2.1,198.51.100.2 to 127.0.0.1", true, []string{"192.0.2.1", "198.51.100.2", "127.0.0.1"}},
+		{"network", "allow 192.0.2.0/24;", true, nil},
+		{"end of sentence", "connect to 192.0.2.1.", true, []string{"192.0.2.1"}},
+		{"longer token", "oid 1.3.6.1.4.1", true, nil},
+		{"invalid address", "version 300.1.2.3", true, nil},
+		{"other family", "left=192.0.2.1,2001:db8::1", false, []string{"2001:db8::1"}},
+		{"time of day", "at 12:30:45", false, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var found []string
+			for _, loc := range lineAddresses(test.line, test.v4) {
+				found = append(found, test.line[loc[0]:loc[1]])
+			}
+			if strings.Join(found, " ") != strings.Join(test.expected, " ") {
+				t.Fatalf("unexpected addresses: got %v, want %v", found, test.expected)
+			}
+		})
+	}
+}
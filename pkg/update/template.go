@@ -0,0 +1,99 @@
+package update
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"text/template"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TemplateData is passed to the templates of the file updater. Printing it directly,
+// as in {{ . }}, outputs the preferred IP of the update
+type TemplateData struct {
+	// IPs the destination is updated with. Either of them may be empty
+	IPv4 string
+	IPv6 string
+
+	// IPs the destination was last updated with. Empty if unknown
+	PreviousIPv4 string
+	PreviousIPv6 string
+
+	// Interface is the monitored network interface. Empty if the IP was pushed
+	Interface string
+
+	// Hostname of the machine running the update
+	Hostname string
+
+	// Timestamp of the update
+	Timestamp time.Time
+}
+
+// newTemplateData fills the template data from an update request
+func newTemplateData(req *Request, now time.Time) *TemplateData {
+	hostname, _ := os.Hostname()
+	return &TemplateData{
+		IPv4:         req.IPv4,
+		IPv6:         req.IPv6,
+		PreviousIPv4: req.PreviousIPv4,
+		PreviousIPv6: req.PreviousIPv6,
+		Interface:    req.Interface,
+		Hostname:     hostname,
+		Timestamp:    now,
+	}
+}
+
+// String returns the IPv4 address if there is one, the IPv6 address otherwise
+func (d *TemplateData) String() string {
+	if d.IPv4 != "" {
+		return d.IPv4
+	}
+	return d.IPv6
+}
+
+// templateFuncs are the helpers available in templates
+var templateFuncs = map[string]interface{}{
+	// cidr returns the network of ip with a prefix of bits, e.g. 2001:db8::/64
+	"cidr": func(ip string, bits int) (string, error) {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return "", fmt.Errorf("invalid IP address %q", ip)
+		}
+		size := 8 * net.IPv6len
+		if parsed.To4() != nil {
+			parsed, size = parsed.To4(), 8*net.IPv4len
+		}
+		if bits < 0 || bits > size {
+			return "", fmt.Errorf("invalid prefix length %d for %s", bits, ip)
+		}
+		network := &net.IPNet{IP: parsed.Mask(net.CIDRMask(bits, size)), Mask: net.CIDRMask(bits, size)}
+		return network.String(), nil
+	},
+	// reverse returns the name of ip in the reverse DNS tree, e.g.
+	// 7.113.0.203.in-addr.arpa.
+	"reverse": func(ip string) (string, error) {
+		return dns.ReverseAddr(ip)
+	},
+	// env returns the value of an environment variable
+	"env": os.Getenv,
+}
+
+// renderer executes a parsed template
+type renderer interface {
+	Execute(wr io.Writer, data interface{}) error
+}
+
+// parseTemplate parses the template file at path. With html set, the output is escaped
+// for use in HTML documents
+func parseTemplate(path string, html bool) (renderer, error) {
+	name := filepath.Base(path)
+	if html {
+		return htmltemplate.New(name).Funcs(htmltemplate.FuncMap(templateFuncs)).ParseFiles(path)
+	}
+	return template.New(name).Funcs(template.FuncMap(templateFuncs)).ParseFiles(path)
+}
@@ -0,0 +1,72 @@
+package update
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTemplate(t *testing.T) {
+	data := &TemplateData{
+		IPv4:         "203.0.113.7",
+		IPv6:         "2001:db8:1:2::7",
+		PreviousIPv4: "203.0.113.1",
+		Interface:    "eth0",
+		Hostname:     "gateway",
+		Timestamp:    time.Date(2019, 5, 17, 12, 0, 0, 0, time.UTC),
+	}
+	os.Setenv("DYNIP_TEST_DOMAIN", "example.org")
+
+	var tests = []struct {
+		name       string
+		template   string
+		html       bool
+		expected   string
+		shouldPass bool
+	}{
+		{"bare IP", "{{ . }}", false, "203.0.113.7", true},
+		{"bare IPv6", "{{ .IPv6 }}", false, "2001:db8:1:2::7", true},
+		{"previous IP", "{{ .PreviousIPv4 }} -> {{ .IPv4 }}", false, "203.0.113.1 -> 203.0.113.7", true},
+		{"context", "{{ .Hostname }}@{{ .Interface }} {{ .Timestamp.Format \"2006-01-02\" }}", false, "gateway@eth0 2019-05-17", true},
+		{"IPv6 network", "{{ cidr .IPv6 64 }}", false, "2001:db8:1:2::/64", true},
+		{"IPv4 network", "{{ cidr .IPv4 24 }}", false, "203.0.113.0/24", true},
+		{"reverse name", "{{ reverse .IPv4 }}", false, "7.113.0.203.in-addr.arpa.", true},
+		{"environment", "{{ env \"DYNIP_TEST_DOMAIN\" }}", false, "example.org", true},
+		{"no escaping", "<a href=\"{{ env \"DYNIP_TEST_DOMAIN\" }}?a=1&b=2\">", false, "<a href=\"example.org?a=1&b=2\">", true},
+		{"HTML escaping", "<p>{{ \"a&b\" }}</p>", true, "<p>a&amp;b</p>", true},
+		{"invalid prefix", "{{ cidr .IPv4 33 }}", false, "", false},
+		{"invalid IP", "{{ reverse .PreviousIPv6 }}", false, "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "template")
+			err := os.WriteFile(path, []byte(test.template), 0644)
+			if err != nil {
+				t.Fatalf("couldn't write template: %s", err)
+			}
+
+			templ, err := parseTemplate(path, test.html)
+			if err != nil {
+				t.Fatalf("couldn't parse template: %s", err)
+			}
+			var buf bytes.Buffer
+			err = templ.Execute(&buf, data)
+			if !test.shouldPass {
+				if err == nil {
+					t.Fatalf("rendering should have failed but didn't: %q", buf.String())
+				}
+				t.Logf("provoked expected error: %s", err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("couldn't render template: %s", err)
+			}
+			if buf.String() != test.expected {
+				t.Fatalf("unexpected output: got %q, want %q", buf.String(), test.expected)
+			}
+		})
+	}
+}
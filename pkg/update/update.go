@@ -1,10 +1,176 @@
 // Package update is responsible for updating destinations using IP
 package update
 
-import "context"
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/logging"
+)
 
 // Updater is an interface that takes a configuration and updates the IP
 type Updater interface {
 	Update(ctx context.Context, IP string) error
 	Name() string
 }
+
+// Factory creates the updater for a destination from the config
+type Factory func(dest *cfg.Destination) (Updater, error)
+
+// Registration describes a destination type: how its settings are decoded and
+// validated, and how its updater is constructed
+type Registration struct {
+	// New returns a pointer to the settings a destination's configuration is
+	// decoded into
+	New func() interface{}
+
+	// Validate checks the decoded settings. Optional
+	Validate func(settings interface{}) error
+
+	// Create constructs the updater
+	Create Factory
+}
+
+// Instance stores the name of the destination an updater was created for. Updaters embed
+// it to be named after their destination (see Named)
+type Instance struct {
+	name string
+}
+
+// SetName sets the name of the destination
+func (i *Instance) SetName(name string) {
+	i.name = name
+}
+
+// Label returns the human-readable identifier of an updater of kind `kind`. The
+// destination's name is added if one was set
+func (i *Instance) Label(kind string) string {
+	if i.name == "" {
+		return kind
+	}
+	return fmt.Sprintf("%s (%s)", kind, i.name)
+}
+
+// Named is implemented by updaters which carry the name of their destination. NewUpdaters
+// calls SetName for destinations which were named in the config, i.e. whose name differs
+// from their type. Without it, all updaters of a type share the same name
+type Named interface {
+	SetName(name string)
+}
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+func init() {
+	// built-in destinations. Their settings are validated by package cfg
+	Register("cloudflare", Registration{
+		New: func() interface{} { return new(cfg.CloudflareAPI) },
+		Create: func(dest *cfg.Destination) (Updater, error) {
+			return NewCloudFlareUpdate(dest.Settings.(*cfg.CloudflareAPI))
+		},
+	})
+	Register("cloudflareLists", Registration{
+		New: func() interface{} { return new(cfg.CloudflareListsConfig) },
+		Create: func(dest *cfg.Destination) (Updater, error) {
+			return NewCloudFlareListUpdate(dest.Settings.(*cfg.CloudflareListsConfig))
+		},
+	})
+	Register("file", Registration{
+		New: func() interface{} { return new(cfg.FileConfig) },
+		Create: func(dest *cfg.Destination) (Updater, error) {
+			return NewFileUpdate(dest.Settings.(*cfg.FileConfig))
+		},
+	})
+	Register("zonefile", Registration{
+		New: func() interface{} { return new(cfg.ZoneFileConfig) },
+		Create: func(dest *cfg.Destination) (Updater, error) {
+			return NewZoneFileUpdate(dest.Settings.(*cfg.ZoneFileConfig))
+		},
+	})
+	Register("patch", Registration{
+		New: func() interface{} { return new(cfg.PatchConfig) },
+		Create: func(dest *cfg.Destination) (Updater, error) {
+			return NewPatchUpdate(dest.Settings.(*cfg.PatchConfig))
+		},
+	})
+	Register("hosts", Registration{
+		New: func() interface{} { return new(cfg.HostsConfig) },
+		Create: func(dest *cfg.Destination) (Updater, error) {
+			return NewHostsUpdate(dest.Settings.(*cfg.HostsConfig))
+		},
+	})
+	Register("firewall", Registration{
+		New: func() interface{} { return new(cfg.FirewallConfig) },
+		Create: func(dest *cfg.Destination) (Updater, error) {
+			return NewFirewallUpdate(dest.Settings.(*cfg.FirewallConfig))
+		},
+	})
+	Register("wireguard", Registration{
+		New: func() interface{} { return new(cfg.WireGuardConfig) },
+		Create: func(dest *cfg.Destination) (Updater, error) {
+			return NewWireGuardUpdate(dest.Settings.(*cfg.WireGuardConfig))
+		},
+	})
+	Register("git", Registration{
+		New: func() interface{} { return new(cfg.GitConfig) },
+		Create: func(dest *cfg.Destination) (Updater, error) {
+			return NewGitUpdate(dest.Settings.(*cfg.GitConfig))
+		},
+	})
+}
+
+// Register adds a destination type under `typ`. Destinations of that type can then be
+// configured like the built-in ones. Register is meant to be called from an init
+// function and panics if the type is registered twice
+func Register(typ string, r Registration) {
+	if r.Create == nil {
+		panic("update: destination type " + typ + " has no constructor")
+	}
+	cfg.RegisterDestinationType(typ, cfg.DestinationType{
+		New:      r.New,
+		Validate: r.Validate,
+	})
+	registerFactory(typ, r.Create)
+}
+
+func registerFactory(typ string, create Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if _, exists := factories[typ]; exists {
+		panic("update: destination type " + typ + " registered twice")
+	}
+	factories[typ] = create
+}
+
+// NewUpdaters creates an updater for each destination in the config. Updaters of
+// destinations with a middleware configuration are wrapped in the configured middlewares
+func NewUpdaters(dests cfg.DestinationsConfig) ([]Updater, error) {
+	var updaters []Updater
+	for _, dest := range dests {
+		factoriesMu.RLock()
+		create, ok := factories[dest.Type]
+		factoriesMu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("destination type %q is not supported", dest.Type)
+		}
+
+		u, err := create(dest)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", dest.Name, err)
+		}
+		if n, ok := u.(Named); ok && dest.Name != dest.Type {
+			n.SetName(dest.Name)
+		}
+		if mws := Middlewares(dest.Middleware); len(mws) > 0 {
+			u = Chain(AsDestination(u), mws...)
+		}
+		updaters = append(updaters, u)
+		logging.Get().Debugf("Initialized %s", u.Name())
+	}
+	return updaters, nil
+}
@@ -0,0 +1,190 @@
+package update
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+)
+
+func TestNewUpdatersCloudflareAccounts(t *testing.T) {
+	dests := cfg.DestinationsConfig{
+		{Type: "cloudflare", Name: "personal", Settings: &cfg.CloudflareAPI{Access: cfg.CloudflareAccess{Token: "token1"}}},
+		{Type: "cloudflare", Name: "client-a", Settings: &cfg.CloudflareAPI{Access: cfg.CloudflareAccess{Key: "key", Email: "ops@example.com"}}},
+	}
+
+	updaters, err := NewUpdaters(dests)
+	if err != nil {
+		t.Fatalf("couldn't create updaters: %s", err)
+	}
+	if len(updaters) != 2 {
+		t.Fatalf("unexpected number of updaters: got %d, want 2", len(updaters))
+	}
+
+	expected := []string{"cloudflare updater (personal)", "cloudflare updater (client-a)"}
+	for i, u := range updaters {
+		if u.Name() != expected[i] {
+			t.Fatalf("unexpected updater name: got %q, want %q", u.Name(), expected[i])
+		}
+	}
+}
+
+// settings and updater of a destination type registered from outside the package
+type webhookSettings struct {
+	URL string `yaml:"url"`
+}
+
+type webhookUpdate struct {
+	Instance
+
+	url string
+}
+
+func (w *webhookUpdate) Update(_ context.Context, _ string) error { return nil }
+func (w *webhookUpdate) Name() string                             { return w.Label("webhook " + w.url) }
+
+func init() {
+	Register("testWebhook", Registration{
+		New: func() interface{} { return new(webhookSettings) },
+		Validate: func(settings interface{}) error {
+			if settings.(*webhookSettings).URL == "" {
+				return fmt.Errorf("testWebhook: no URL provided")
+			}
+			return nil
+		},
+		Create: func(dest *cfg.Destination) (Updater, error) {
+			return &webhookUpdate{url: dest.Settings.(*webhookSettings).URL}, nil
+		},
+	})
+}
+
+func TestRegister(t *testing.T) {
+	var tests = []struct {
+		name       string
+		config     string
+		updaters   []string
+		shouldPass bool
+	}{
+		{
+			"list of destinations",
+			`
+destinations:
+    - type: testWebhook
+      url: https://example.com/hook
+    - type: file
+      name: caddy
+      template: /path/to/template
+      output: /path/to/output
+`,
+			[]string{"webhook https://example.com/hook", "file updater (caddy)"},
+			true,
+		},
+		{
+			"named destinations of a registered type",
+			`
+destinations:
+    - type: testWebhook
+      name: primary
+      url: https://example.com/hook
+    - type: testWebhook
+      name: fallback
+      url: https://example.com/hook
+`,
+			[]string{"webhook https://example.com/hook (primary)", "webhook https://example.com/hook (fallback)"},
+			true,
+		},
+		{
+			"several destinations of the same type",
+			`
+destinations:
+    - type: file
+      name: caddy
+      template: /path/to/Caddyfile.tmpl
+      output: /etc/caddy/Caddyfile
+    - type: file
+      name: nginx
+      template: /path/to/include.conf.tmpl
+      output: /etc/nginx/conf.d/include.conf
+    - type: file
+      template: /path/to/template
+      output: /path/to/output
+`,
+			[]string{"file updater (caddy)", "file updater (nginx)", "file updater"},
+			true,
+		},
+		{
+			"duplicate names",
+			`
+destinations:
+    - type: file
+      name: caddy
+      template: /path/to/Caddyfile.tmpl
+      output: /etc/caddy/Caddyfile
+    - type: file
+      name: caddy
+      template: /path/to/include.conf.tmpl
+      output: /etc/nginx/conf.d/include.conf
+`,
+			nil,
+			false,
+		},
+		{
+			"mapping of destinations",
+			`
+destinations:
+    testWebhook:
+        url: https://example.com/hook
+`,
+			[]string{"webhook https://example.com/hook"},
+			true,
+		},
+		{
+			"invalid settings",
+			`
+destinations:
+    - type: testWebhook
+`,
+			nil,
+			false,
+		},
+		{
+			"unknown type",
+			`
+destinations:
+    - type: carrierPigeon
+`,
+			nil,
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := cfg.Parse(strings.NewReader("---\nlisten:\n    iface: eth0\n" + test.config))
+			if !test.shouldPass {
+				if err == nil {
+					t.Fatalf("config should have been rejected but wasn't")
+				}
+				t.Logf("provoked expected error: %s", err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("couldn't parse config: %s", err)
+			}
+
+			updaters, err := NewUpdaters(c.Destinations)
+			if err != nil {
+				t.Fatalf("couldn't create updaters: %s", err)
+			}
+			var names []string
+			for _, u := range updaters {
+				names = append(names, u.Name())
+			}
+			if fmt.Sprint(names) != fmt.Sprint(test.updaters) {
+				t.Fatalf("unexpected updaters: got %v, want %v", names, test.updaters)
+			}
+		})
+	}
+}
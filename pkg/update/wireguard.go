@@ -0,0 +1,300 @@
+package update
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/logging"
+	log "github.com/els0r/log"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// WireGuardUpdate points the endpoint of WireGuard peers at the IP. WireGuard resolves
+// endpoint names only once, so peers of a host with a dynamic IP have to be updated
+// explicitly
+type WireGuardUpdate struct {
+	Instance
+
+	configs []string
+	peers   []wgtypes.Key
+	port    int
+	live    bool
+
+	// open connects to the WireGuard interfaces of the host
+	open func() (wgClient, error)
+
+	log log.Logger
+}
+
+// wgClient configures running WireGuard interfaces. It is implemented by wgctrl.Client
+type wgClient interface {
+	Device(name string) (*wgtypes.Device, error)
+	ConfigureDevice(name string, cfg wgtypes.Config) error
+	Close() error
+}
+
+// NewWireGuardUpdate creates a WireGuard updater
+func NewWireGuardUpdate(cfg *cfg.WireGuardConfig) (*WireGuardUpdate, error) {
+	if len(cfg.Configs) == 0 {
+		return nil, fmt.Errorf("wireguard update must have configuration files")
+	}
+	if len(cfg.Peers) == 0 {
+		return nil, fmt.Errorf("wireguard update must have peers")
+	}
+
+	w := &WireGuardUpdate{
+		configs: cfg.Configs,
+		port:    cfg.Port,
+		live:    cfg.Live,
+		open: func() (wgClient, error) {
+			return wgctrl.New()
+		},
+		log: logging.Get(),
+	}
+	for _, peer := range cfg.Peers {
+		key, err := wgtypes.ParseKey(peer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key %q: %w", peer, err)
+		}
+		w.peers = append(w.peers, key)
+	}
+	return w, nil
+}
+
+// Name returns a human-readable identifier for the updater
+func (w *WireGuardUpdate) Name() string {
+	return w.Label("wireguard updater")
+}
+
+// Update points the endpoints of the peers at IP
+func (w *WireGuardUpdate) Update(ctx context.Context, IP string) error {
+	req, err := NewRequest(IP)
+	if err != nil {
+		return err
+	}
+	_, err = w.Apply(ctx, req)
+	return err
+}
+
+// Apply points the endpoints of the peers at an IP of the request. Endpoints keep their
+// address family if the request has an IP of that family. Configuration files are only
+// written if an endpoint changed
+func (w *WireGuardUpdate) Apply(_ context.Context, req *Request) (*Result, error) {
+	err := req.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	res := new(Result)
+	endpoints := make(map[string]map[wgtypes.Key]*net.UDPAddr)
+	for _, path := range w.configs {
+		endpoints[path] = w.updateConfig(path, req, res)
+	}
+	if w.live && !req.DryRun {
+		w.updateDevices(endpoints, res)
+	}
+	return res, res.Err()
+}
+
+// wgPeer is a [Peer] section of a wg-quick configuration file
+type wgPeer struct {
+	key      string
+	endpoint int
+}
+
+// updateConfig sets the endpoints of the peers in the configuration file at path. It
+// returns the endpoints of the peers which were found
+func (w *WireGuardUpdate) updateConfig(path string, req *Request, res *Result) map[wgtypes.Key]*net.UDPAddr {
+	w.log.Debugf("updating WireGuard configuration %s", path)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		res.Add(path, Failed, "%s", err)
+		return nil
+	}
+	lines := strings.Split(string(data), "\n")
+
+	// collect the peers and the lines of their endpoints
+	var (
+		peers   []*wgPeer
+		current *wgPeer
+	)
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			current = nil
+			if strings.EqualFold(trimmed, "[Peer]") {
+				current = &wgPeer{endpoint: -1}
+				peers = append(peers, current)
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(trimmed, "=")
+		if current == nil || !ok {
+			continue
+		}
+		value, _ = splitComment(value)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "publickey":
+			current.key = strings.TrimSpace(value)
+		case "endpoint":
+			current.endpoint = i
+		}
+	}
+
+	var changed bool
+	endpoints := make(map[wgtypes.Key]*net.UDPAddr)
+	for _, key := range w.peers {
+		target := fmt.Sprintf("%s peer %.8s", path, key)
+
+		var peer *wgPeer
+		for _, p := range peers {
+			if p.key == key.String() {
+				peer = p
+			}
+		}
+		switch {
+		case peer == nil:
+			res.Add(target, Failed, "peer not found")
+			continue
+		case peer.endpoint < 0:
+			res.Add(target, Failed, "peer has no endpoint")
+			continue
+		}
+
+		line := lines[peer.endpoint]
+		eq := strings.Index(line, "=")
+		value, comment := splitComment(line[eq+1:])
+		endpoint, err := w.endpoint(strings.TrimSpace(value), req)
+		if err != nil {
+			res.Add(target, Failed, "%s", err)
+			continue
+		}
+		endpoints[key] = endpoint
+
+		if strings.TrimSpace(value) == endpoint.String() {
+			res.Add(target, Unchanged, "endpoint is %s", endpoint)
+			continue
+		}
+		lines[peer.endpoint] = line[:eq+1] + " " + endpoint.String() + comment
+		changed = true
+		if req.DryRun {
+			res.Add(target, Changed, "endpoint would be %s", endpoint)
+			continue
+		}
+		res.Add(target, Changed, "endpoint is %s", endpoint)
+	}
+	if !changed || req.DryRun {
+		return endpoints
+	}
+
+	err = writeFileAtomic(path, []byte(strings.Join(lines, "\n")))
+	if err != nil {
+		res.Add(path, Failed, "%s", err)
+	}
+	return endpoints
+}
+
+// splitComment splits a trailing comment off value. The comment is returned with the
+// whitespace in front of it, so that it can be appended to a new value as it was
+func splitComment(value string) (string, string) {
+	c := strings.Index(value, "#")
+	if c < 0 {
+		return value, ""
+	}
+	v := strings.TrimRight(value[:c], " \t")
+	return v, value[len(v):]
+}
+
+// endpoint returns the new endpoint of a peer whose endpoint is currently `current`
+func (w *WireGuardUpdate) endpoint(current string, req *Request) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(current)
+	if err != nil && w.port == 0 {
+		return nil, fmt.Errorf("invalid endpoint %q: %w", current, err)
+	}
+
+	// keep the address family of the endpoint if possible
+	IP := req.IP()
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() == nil && req.IPv6 != "" {
+			IP = req.IPv6
+		} else if ip.To4() != nil && req.IPv4 != "" {
+			IP = req.IPv4
+		}
+	}
+
+	addr := &net.UDPAddr{IP: net.ParseIP(IP), Port: w.port}
+	if addr.Port == 0 {
+		addr.Port, err = strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port in endpoint %q", current)
+		}
+	}
+	return addr, nil
+}
+
+// updateDevices sets the endpoints on the running interfaces, which are named after
+// their configuration files
+func (w *WireGuardUpdate) updateDevices(endpoints map[string]map[wgtypes.Key]*net.UDPAddr, res *Result) {
+	client, err := w.open()
+	if err != nil {
+		res.Add("wireguard", Failed, "couldn't connect to WireGuard: %s", err)
+		return
+	}
+	defer client.Close()
+
+	for _, path := range w.configs {
+		if len(endpoints[path]) == 0 {
+			continue
+		}
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+		dev, err := client.Device(name)
+		if err != nil {
+			res.Add("interface "+name, Failed, "%s", err)
+			continue
+		}
+		for _, key := range w.peers {
+			endpoint, ok := endpoints[path][key]
+			if !ok {
+				continue
+			}
+			target := fmt.Sprintf("interface %s peer %.8s", name, key)
+
+			var peer *wgtypes.Peer
+			for i := range dev.Peers {
+				if dev.Peers[i].PublicKey == key {
+					peer = &dev.Peers[i]
+				}
+			}
+			switch {
+			case peer == nil:
+				res.Add(target, Failed, "peer not found")
+				continue
+			case peer.Endpoint != nil && peer.Endpoint.IP.Equal(endpoint.IP) && peer.Endpoint.Port == endpoint.Port:
+				res.Add(target, Unchanged, "endpoint is %s", endpoint)
+				continue
+			}
+
+			err = client.ConfigureDevice(name, wgtypes.Config{
+				Peers: []wgtypes.PeerConfig{{
+					PublicKey:  key,
+					UpdateOnly: true,
+					Endpoint:   endpoint,
+				}},
+			})
+			if err != nil {
+				res.Add(target, Failed, "%s", err)
+				continue
+			}
+			res.Add(target, Changed, "endpoint is %s", endpoint)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package update
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	testHubKey   = "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+	testOtherKey = "TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0="
+)
+
+var testWGConfig = `[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 10.200.0.2/24
+
+[Peer]
+# hub
+PublicKey = ` + testHubKey + `
+Endpoint = hub.example.org:51820
+AllowedIPs = 10.200.0.0/24
+
+[Peer]
+PublicKey = ` + testOtherKey + ` # spoke
+Endpoint = 198.51.100.1:51820   # fixed address
+AllowedIPs = 10.200.1.0/24
+`
+
+// fakeWGClient stores the peers of a single interface
+type fakeWGClient struct {
+	name       string
+	peers      []wgtypes.Peer
+	configured []wgtypes.PeerConfig
+}
+
+func (f *fakeWGClient) Device(name string) (*wgtypes.Device, error) {
+	if name != f.name {
+		return nil, fmt.Errorf("interface %s doesn't exist", name)
+	}
+	return &wgtypes.Device{Name: name, Peers: f.peers}, nil
+}
+
+func (f *fakeWGClient) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	f.configured = append(f.configured, cfg.Peers...)
+	return nil
+}
+
+func (f *fakeWGClient) Close() error { return nil }
+
+func TestWireGuardUpdate(t *testing.T) {
+	hubKey, _ := wgtypes.ParseKey(testHubKey)
+	otherKey, _ := wgtypes.ParseKey(testOtherKey)
+
+	var tests = []struct {
+		name       string
+		port       int
+		peers      []string
+		req        *Request
+		endpoint   string
+		live       int
+		shouldPass bool
+	}{
+		{"name replaced", 0, []string{testHubKey}, &Request{IPv4: "203.0.113.7", IPv6: "2001:db8::7"}, "203.0.113.7:51820", 1, true},
+		{"IPv6 and port", 51821, []string{testHubKey}, &Request{IPv6: "2001:db8::7"}, "[2001:db8::7]:51821", 1, true},
+		{"unchanged live endpoint", 0, []string{testHubKey}, &Request{IPv4: "192.0.2.1"}, "192.0.2.1:51820", 0, true},
+		{"dry run", 0, []string{testHubKey}, &Request{IPv4: "203.0.113.7", DryRun: true}, "hub.example.org:51820", 0, true},
+		{"comments", 0, []string{testHubKey, testOtherKey}, &Request{IPv4: "203.0.113.7"}, "203.0.113.7:51820", 2, true},
+		{"peer not found", 0, []string{testHubKey, "HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw="}, &Request{IPv4: "203.0.113.7"}, "203.0.113.7:51820", 1, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "wg0.conf")
+			err := os.WriteFile(path, []byte(testWGConfig), 0600)
+			if err != nil {
+				t.Fatalf("couldn't write config: %s", err)
+			}
+
+			w, err := NewWireGuardUpdate(&cfg.WireGuardConfig{
+				Configs: []string{path},
+				Peers:   test.peers,
+				Port:    test.port,
+				Live:    true,
+			})
+			if err != nil {
+				t.Fatalf("couldn't create wireguard updater: %s", err)
+			}
+			client := &fakeWGClient{name: "wg0", peers: []wgtypes.Peer{{
+				PublicKey: hubKey,
+				Endpoint:  &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51820},
+			}, {
+				PublicKey: otherKey,
+				Endpoint:  &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 51820},
+			}}}
+			w.open = func() (wgClient, error) { return client, nil }
+
+			res, err := w.Apply(context.Background(), test.req)
+			if test.shouldPass {
+				if err != nil {
+					t.Fatalf("wireguard update failed: %s", err)
+				}
+				t.Log(res)
+			} else {
+				if err == nil {
+					t.Fatalf("wireguard update should have failed but didn't")
+				}
+				t.Logf("provoked expected error: %s", err)
+			}
+
+			// only the endpoints of the configured peers change
+			expected := testWGConfig
+			if test.endpoint != "hub.example.org:51820" {
+				expected = strings.Replace(expected, "hub.example.org:51820", test.endpoint, 1)
+				if len(test.peers) == 2 && test.shouldPass {
+					expected = strings.Replace(expected, "198.51.100.1:51820   # fixed", test.endpoint+"   # fixed", 1)
+				}
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("couldn't read config: %s", err)
+			}
+			if string(data) != expected {
+				t.Fatalf("unexpected config:\n%s\nwant:\n%s", data, expected)
+			}
+
+			if len(client.configured) != test.live {
+				t.Fatalf("unexpected live updates: %v", client.configured)
+			}
+			for _, pc := range client.configured {
+				if (pc.PublicKey != hubKey && pc.PublicKey != otherKey) || !pc.UpdateOnly || pc.Endpoint.String() != test.endpoint {
+					t.Fatalf("unexpected live update: %+v", pc)
+				}
+			}
+		})
+	}
+}
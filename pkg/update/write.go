@@ -0,0 +1,82 @@
+package update
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic replaces the file at path with data. The content is written to a
+// temporary file in the same directory, synced to disk and then renamed over the
+// original, so readers never see a partially written file. Mode and ownership of an
+// existing file are carried over. If path is a symlink, the file it points to is replaced
+// and the link is kept
+func writeFileAtomic(path string, data []byte) error {
+	var (
+		mode  os.FileMode = 0644
+		owner *fileOwner
+	)
+
+	// the rename would replace the link rather than its target
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		path = resolved
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	fi, err := os.Stat(path)
+	if err == nil {
+		mode = fi.Mode().Perm()
+		owner = ownerOf(fi)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, "."+base+".tmp*")
+	if err != nil {
+		return err
+	}
+
+	// make sure the temporary file doesn't stay around if anything goes wrong
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		return err
+	}
+	if owner != nil {
+		if err = owner.apply(tmp); err != nil {
+			return err
+		}
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	committed = true
+
+	// persist the rename itself. Not all platforms support syncing directories,
+	// which is why errors are ignored here
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package update
+
+import "os"
+
+// fileOwner is not supported on this platform
+type fileOwner struct{}
+
+func ownerOf(fi os.FileInfo) *fileOwner { return nil }
+
+func (o *fileOwner) apply(f *os.File) error { return nil }
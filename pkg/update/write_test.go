@@ -0,0 +1,64 @@
+package update
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomicSymlink(t *testing.T) {
+	dir := t.TempDir()
+
+	// the zone file lives elsewhere, e.g. in a chroot, and is linked into place
+	target := filepath.Join(dir, "chroot", "db.example.org")
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		t.Fatalf("couldn't create directory: %s", err)
+	}
+	err = os.WriteFile(target, []byte("old"), 0640)
+	if err != nil {
+		t.Fatalf("couldn't write file: %s", err)
+	}
+	link := filepath.Join(dir, "db.example.org")
+	err = os.Symlink(target, link)
+	if err != nil {
+		t.Fatalf("couldn't create symlink: %s", err)
+	}
+
+	err = writeFileAtomic(link, []byte("new"))
+	if err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+
+	fi, err := os.Lstat(link)
+	if err != nil {
+		t.Fatalf("couldn't stat link: %s", err)
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("symlink was replaced by a %s", fi.Mode().Type())
+	}
+	data, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatalf("couldn't read target: %s", err)
+	}
+	if string(data) != "new" {
+		t.Fatalf("unexpected content of the target: got %q, want %q", data, "new")
+	}
+	fi, err = os.Stat(target)
+	if err != nil {
+		t.Fatalf("couldn't stat target: %s", err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Fatalf("file mode wasn't preserved: %s", fi.Mode())
+	}
+
+	// no temporary files are left behind next to the link or the target
+	for _, d := range []string{dir, filepath.Dir(target)} {
+		entries, _ := os.ReadDir(d)
+		for _, e := range entries {
+			if e.Name() != "chroot" && e.Name() != "db.example.org" {
+				t.Fatalf("unexpected file in %s: %s", d, e.Name())
+			}
+		}
+	}
+}
@@ -0,0 +1,30 @@
+//go:build unix
+
+package update
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner stores the user and group owning a file
+type fileOwner struct {
+	uid, gid int
+}
+
+func ownerOf(fi os.FileInfo) *fileOwner {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return &fileOwner{uid: int(st.Uid), gid: int(st.Gid)}
+}
+
+func (o *fileOwner) apply(f *os.File) error {
+	// only attempt to change ownership if it differs from the one of the
+	// creating process. Unprivileged users can't chown to someone else
+	if o.uid == os.Getuid() && o.gid == os.Getgid() {
+		return nil
+	}
+	return f.Chown(o.uid, o.gid)
+}
@@ -0,0 +1,417 @@
+package update
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/els0r/dynip-ng/pkg/logging"
+	log "github.com/els0r/log"
+	"github.com/miekg/dns"
+)
+
+// ZoneFileUpdate changes the A/AAAA records of a BIND zone file in place and increments
+// the serial of the zone's SOA record
+type ZoneFileUpdate struct {
+	Instance
+
+	path    string
+	origin  string
+	records []string
+	reload  string
+
+	// now returns the current time and is used to derive the SOA serial
+	now func() time.Time
+
+	log log.Logger
+}
+
+// NewZoneFileUpdate creates a zone file updater
+func NewZoneFileUpdate(cfg *cfg.ZoneFileConfig) (*ZoneFileUpdate, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("zone file update must have a zone file")
+	}
+
+	z := &ZoneFileUpdate{
+		path:   cfg.Path,
+		origin: dns.Fqdn(cfg.Origin),
+		reload: cfg.Reload,
+		now:    time.Now,
+		log:    logging.Get(),
+	}
+
+	// normalize all owner names so they can be compared to the parsed records
+	for _, r := range cfg.Records {
+		z.records = append(z.records, ownerName(r, z.origin))
+	}
+	return z, nil
+}
+
+// ownerName turns a record name as it is written in a zone file into its canonical,
+// fully qualified representation
+func ownerName(name, origin string) string {
+	if name == "@" {
+		return dns.CanonicalName(origin)
+	}
+	if dns.IsFqdn(name) {
+		return dns.CanonicalName(name)
+	}
+	return dns.CanonicalName(name + "." + origin)
+}
+
+// Name returns a human-readable identifier for the updater
+func (z *ZoneFileUpdate) Name() string {
+	return z.Label("zonefile updater")
+}
+
+// Update sets the records from the config to `ip`. The zone file is only rewritten if
+// at least one record changed, in which case the SOA serial is incremented and the
+// reload command is run
+func (z *ZoneFileUpdate) Update(ctx context.Context, IP string) error {
+	req, err := NewRequest(IP)
+	if err != nil {
+		return err
+	}
+	_, err = z.Apply(ctx, req)
+	return err
+}
+
+// Apply sets the A records from the config to the IPv4 address and the AAAA records to
+// the IPv6 address of the request. Only the addresses of the affected records and the
+// SOA serial are replaced. Comments, directives and formatting are left as they are. The
+// zone file is only written if at least one record changed, in which case the reload
+// command is run
+func (z *ZoneFileUpdate) Apply(ctx context.Context, req *Request) (*Result, error) {
+	err := req.Validate()
+	if err != nil {
+		return nil, err
+	}
+	z.log.Debugf("updating zone file: %s", z.path)
+
+	data, err := os.ReadFile(z.path)
+	if err != nil {
+		return nil, err
+	}
+
+	records, soa, err := parseZoneEntries(data, z.origin, z.path)
+	if err != nil {
+		return nil, err
+	}
+
+	res := new(Result)
+	var edits []zoneEdit
+	if req.IPv4 != "" {
+		edits = append(edits, z.setRecords(records, net.ParseIP(req.IPv4), req.PreviousIPv4, req.DryRun, res)...)
+	}
+	if req.IPv6 != "" {
+		edits = append(edits, z.setRecords(records, net.ParseIP(req.IPv6), req.PreviousIPv6, req.DryRun, res)...)
+	}
+	if len(edits) == 0 {
+		z.log.Debugf("records in %s already point to %s. Nothing to do", z.path, strings.Join(req.IPs(), ", "))
+		return res, res.Err()
+	}
+	if req.DryRun {
+		return res, res.Err()
+	}
+
+	// bump the serial so that secondaries pick up the change
+	serial := nextSerial(soa.rr.(*dns.SOA).Serial, z.now())
+	edit, err := soa.serialEdit(serial)
+	if err != nil {
+		return nil, err
+	}
+	edits = append(edits, edit)
+
+	err = writeFileAtomic(z.path, applyZoneEdits(data, edits))
+	if err != nil {
+		return nil, err
+	}
+	z.log.Debugf("wrote zone file %s with serial %d", z.path, serial)
+
+	if z.reload != "" {
+		err = runCommand(ctx, z.reload)
+		if err != nil {
+			res.Add("reload", Failed, "%s", err)
+			return res, res.Err()
+		}
+		z.log.Debugf("ran reload command %q", z.reload)
+	}
+	return res, res.Err()
+}
+
+// setRecords points the configured records of the address family of ip to ip. If an
+// owner name has several records of that type, e.g. for round robin, only one of them
+// is replaced: the one pointing to previous if there is one, the first one otherwise.
+// Nothing is replaced if one of them points to ip already. The outcome of each record
+// is added to res. It returns the edits of the zone file
+func (z *ZoneFileUpdate) setRecords(records []*zoneRecord, ip net.IP, previous string, dryRun bool, res *Result) []zoneEdit {
+	rrtype := dns.TypeA
+	if ip.To4() == nil {
+		rrtype = dns.TypeAAAA
+	}
+	typeName := dns.TypeToString[rrtype]
+	previousIP := net.ParseIP(previous)
+
+	var edits []zoneEdit
+	for _, name := range z.records {
+		target := typeName + " " + name
+
+		var (
+			rrset    []*zoneRecord
+			current  *zoneRecord
+			replaced *zoneRecord
+		)
+		for _, r := range records {
+			hdr := r.rr.Header()
+			if hdr.Rrtype != rrtype || dns.CanonicalName(hdr.Name) != name {
+				continue
+			}
+			rrset = append(rrset, r)
+			if r.address().Equal(ip) {
+				current = r
+			}
+			if previousIP != nil && r.address().Equal(previousIP) && replaced == nil {
+				replaced = r
+			}
+		}
+
+		switch {
+		case len(rrset) == 0:
+			res.Add(target, Failed, "record was not found")
+			continue
+		case current != nil:
+			res.Add(target, Unchanged, "already points to %s", ip)
+			continue
+		case replaced == nil:
+			replaced = rrset[0]
+		}
+
+		edits = append(edits, replaced.addressEdit(ip))
+		z.log.Debugf("set %s record '%s' from '%s' to IP address '%s'", typeName, name, replaced.address(), ip)
+		if dryRun {
+			res.Add(target, Changed, "would point to %s", ip)
+			continue
+		}
+		res.Add(target, Changed, "points to %s", ip)
+	}
+	return edits
+}
+
+// zoneEntry is a directive or a resource record of a zone file. An entry spans several
+// lines if it uses parentheses
+type zoneEntry struct {
+	// offset of the entry in the zone file
+	offset int
+	text   string
+
+	// tokens are the positions of the fields of the entry in text, excluding
+	// comments and parentheses
+	tokens [][2]int
+}
+
+func (e *zoneEntry) token(i int) string {
+	return e.text[e.tokens[i][0]:e.tokens[i][1]]
+}
+
+// splitZone splits a zone file into its entries. Lines without fields, such as comments,
+// are skipped
+func splitZone(data []byte) []*zoneEntry {
+	var (
+		entries []*zoneEntry
+		start   int
+		depth   int
+		tokens  [][2]int
+	)
+	text := string(data)
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == ';':
+			// skip the comment up to the end of the line
+			for i+1 < len(text) && text[i+1] != '\n' {
+				i++
+			}
+		case c == '(':
+			depth++
+		case c == ')':
+			if depth > 0 {
+				depth--
+			}
+		case c == '\n':
+			if depth > 0 {
+				continue
+			}
+			if len(tokens) > 0 {
+				entries = append(entries, &zoneEntry{offset: start, text: text[start:i], tokens: tokens})
+			}
+			start, tokens = i+1, nil
+		case c == ' ' || c == '\t' || c == '\r':
+		default:
+			// a field, possibly quoted
+			begin := i
+			quoted := c == '"'
+			for i+1 < len(text) {
+				next := text[i+1]
+				if quoted {
+					if next == '\\' {
+						i += 2
+						continue
+					}
+					i++
+					if next == '"' {
+						break
+					}
+					continue
+				}
+				if strings.IndexByte(" \t\r\n;()", next) >= 0 {
+					break
+				}
+				i++
+			}
+			tokens = append(tokens, [2]int{begin - start, i + 1 - start})
+		}
+	}
+	if len(tokens) > 0 {
+		entries = append(entries, &zoneEntry{offset: start, text: text[start:], tokens: tokens})
+	}
+	return entries
+}
+
+// zoneRecord is a resource record together with the entry it was parsed from
+type zoneRecord struct {
+	*zoneEntry
+	rr dns.RR
+}
+
+// address returns the IP of an A or AAAA record
+func (r *zoneRecord) address() net.IP {
+	switch rr := r.rr.(type) {
+	case *dns.A:
+		return rr.A
+	case *dns.AAAA:
+		return rr.AAAA
+	}
+	return nil
+}
+
+// addressEdit replaces the address of an A or AAAA record, which is its last field
+func (r *zoneRecord) addressEdit(ip net.IP) zoneEdit {
+	last := r.tokens[len(r.tokens)-1]
+	return zoneEdit{start: r.offset + last[0], end: r.offset + last[1], text: ip.String()}
+}
+
+// serialEdit replaces the serial of an SOA record, which is the third field after the
+// type
+func (r *zoneRecord) serialEdit(serial uint32) (zoneEdit, error) {
+	// skip the owner name, which might be called soa as well
+	first := 0
+	if !startsBlank(r.text) {
+		first = 1
+	}
+	for i := first; i+3 < len(r.tokens); i++ {
+		if strings.EqualFold(r.token(i), "SOA") {
+			t := r.tokens[i+3]
+			return zoneEdit{start: r.offset + t[0], end: r.offset + t[1], text: strconv.FormatUint(uint64(serial), 10)}, nil
+		}
+	}
+	return zoneEdit{}, fmt.Errorf("couldn't locate the serial of the SOA record")
+}
+
+// zoneEdit replaces the bytes between start and end of a zone file with text
+type zoneEdit struct {
+	start, end int
+	text       string
+}
+
+// applyZoneEdits returns data with the edits applied. Edits must not overlap
+func applyZoneEdits(data []byte, edits []zoneEdit) []byte {
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+
+	var (
+		buf  bytes.Buffer
+		last int
+	)
+	for _, e := range edits {
+		buf.Write(data[last:e.start])
+		buf.WriteString(e.text)
+		last = e.end
+	}
+	buf.Write(data[last:])
+	return buf.Bytes()
+}
+
+func startsBlank(text string) bool {
+	return text != "" && (text[0] == ' ' || text[0] == '\t')
+}
+
+// parseZoneEntries parses the resource records of a zone file entry by entry, so that
+// each record can be located in the file. Records in files included with $INCLUDE
+// aren't read. It returns the records and the zone's SOA record
+func parseZoneEntries(data []byte, origin, path string) ([]*zoneRecord, *zoneRecord, error) {
+	var (
+		records []*zoneRecord
+		soa     *zoneRecord
+		owner   string
+	)
+	for _, e := range splitZone(data) {
+		first := e.token(0)
+		if strings.HasPrefix(first, "$") {
+			if strings.EqualFold(first, "$ORIGIN") && len(e.tokens) > 1 {
+				origin = ownerName(e.token(1), origin)
+			}
+			continue
+		}
+
+		// entries starting with blanks belong to the previous owner name
+		text := e.text
+		if startsBlank(text) {
+			if owner == "" {
+				return nil, nil, fmt.Errorf("%s:%d: record without owner name", path, lineOf(data, e.offset))
+			}
+			text = owner + text
+		} else {
+			owner = ownerName(first, origin)
+		}
+
+		// the TTL is irrelevant for locating the record
+		zp := dns.NewZoneParser(strings.NewReader("$TTL 3600\n"+text), origin, path)
+		rr, ok := zp.Next()
+		if err := zp.Err(); err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %w", path, lineOf(data, e.offset), err)
+		}
+		if !ok {
+			continue
+		}
+
+		r := &zoneRecord{zoneEntry: e, rr: rr}
+		if _, isSOA := rr.(*dns.SOA); isSOA && soa == nil {
+			soa = r
+		}
+		records = append(records, r)
+	}
+	if soa == nil {
+		return nil, nil, fmt.Errorf("zone %s has no SOA record", strings.TrimSuffix(origin, "."))
+	}
+	return records, soa, nil
+}
+
+// lineOf returns the line number of offset in data
+func lineOf(data []byte, offset int) int {
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// nextSerial returns the serial following cur in YYYYMMDDnn format. If cur is already
+// at or past today's first serial, it is incremented by one
+func nextSerial(cur uint32, now time.Time) uint32 {
+	first := uint32(now.Year()*1000000 + int(now.Month())*10000 + now.Day()*100)
+	if cur < first {
+		return first
+	}
+	return cur + 1
+}
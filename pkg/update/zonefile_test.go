@@ -0,0 +1,336 @@
+package update
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/els0r/dynip-ng/pkg/cfg"
+	"github.com/miekg/dns"
+)
+
+var testZone = `$ORIGIN example.org.
+$TTL 3600
+@       IN SOA ns1.example.org. hostmaster.example.org. 2019010101 7200 3600 1209600 3600
+@       IN NS  ns1.example.org.
+@       IN A   192.0.2.1
+ns1     IN A   192.0.2.53
+dynip   IN A   192.0.2.1
+dynip   IN A   192.0.2.2
+dynip   IN AAAA 2001:db8::1
+`
+
+func TestNextSerial(t *testing.T) {
+	now := time.Date(2019, 5, 17, 12, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		name     string
+		current  uint32
+		expected uint32
+	}{
+		{"older date", 2019010101, 2019051700},
+		{"plain counter", 42, 2019051700},
+		{"same day", 2019051700, 2019051701},
+		{"future date", 2019051899, 2019051900},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := nextSerial(test.current, now)
+			if got != test.expected {
+				t.Fatalf("unexpected serial: got %d, want %d", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestZoneFileUpdate(t *testing.T) {
+
+	var tests = []struct {
+		name       string
+		IP         string
+		records    []string
+		serial     uint32
+		shouldPass bool
+	}{
+		{"update IPv4", "203.0.113.7", []string{"@", "dynip"}, 2019051700, true},
+		{"update IPv6", "2001:db8::2", []string{"dynip"}, 2019051700, true},
+		{"unchanged", "192.0.2.53", []string{"ns1"}, 2019010101, true},
+		{"fully qualified record", "203.0.113.7", []string{"dynip.example.org."}, 2019051700, true},
+		{"record not found", "203.0.113.7", []string{"notAvailable"}, 2019010101, false},
+		{"record type not found", "2001:db8::2", []string{"ns1"}, 2019010101, false},
+		{"invalid IP", "not-an-ip", []string{"dynip"}, 2019010101, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db.example.org")
+			err := os.WriteFile(path, []byte(testZone), 0640)
+			if err != nil {
+				t.Fatalf("couldn't write zone file: %s", err)
+			}
+
+			z, err := NewZoneFileUpdate(&cfg.ZoneFileConfig{
+				Path:    path,
+				Origin:  "example.org",
+				Records: test.records,
+			})
+			if err != nil {
+				t.Fatalf("couldn't create zone file updater: %s", err)
+			}
+			z.now = func() time.Time { return time.Date(2019, 5, 17, 12, 0, 0, 0, time.UTC) }
+
+			err = z.Update(context.Background(), test.IP)
+			if test.shouldPass {
+				if err != nil {
+					t.Fatalf("zone file update failed: %s", err)
+				}
+			} else {
+				if err == nil {
+					t.Fatalf("zone file update should have failed but didn't")
+				}
+				t.Logf("provoked expected error: %s", err)
+			}
+
+			// check the zone that was written
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("couldn't read zone file: %s", err)
+			}
+			rrs, soa, err := parseZone(data, "example.org.", path)
+			if err != nil {
+				t.Fatalf("couldn't parse updated zone file: %s", err)
+			}
+			if soa.Serial != test.serial {
+				t.Fatalf("unexpected serial: got %d, want %d", soa.Serial, test.serial)
+			}
+
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatalf("couldn't stat zone file: %s", err)
+			}
+			if fi.Mode().Perm() != 0640 {
+				t.Fatalf("file mode wasn't preserved: %s", fi.Mode())
+			}
+
+			if !test.shouldPass {
+				return
+			}
+			orig, _, err := parseZone([]byte(testZone), "example.org.", path)
+			if err != nil {
+				t.Fatalf("couldn't parse test zone: %s", err)
+			}
+			for _, record := range test.records {
+				name := ownerName(record, "example.org.")
+
+				// round robin records of the same name are kept
+				ips, before := zoneAddresses(rrs, name, test.IP), zoneAddresses(orig, name, test.IP)
+				var found bool
+				for _, ip := range ips {
+					found = found || ip == test.IP
+				}
+				if !found || len(ips) != len(before) {
+					t.Fatalf("record %s should point to %s, got %v", name, test.IP, ips)
+				}
+			}
+		})
+	}
+}
+
+func TestZoneFileApply(t *testing.T) {
+	req := &Request{IPv4: "203.0.113.7", IPv6: "2001:db8::2"}
+
+	var tests = []struct {
+		name    string
+		dryRun  bool
+		changed int
+		serial  uint32
+	}{
+		{"dual-stack", false, 2, 2019051700},
+		{"dry run", true, 2, 2019010101},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db.example.org")
+			err := os.WriteFile(path, []byte(testZone), 0640)
+			if err != nil {
+				t.Fatalf("couldn't write zone file: %s", err)
+			}
+
+			z, err := NewZoneFileUpdate(&cfg.ZoneFileConfig{
+				Path:    path,
+				Origin:  "example.org",
+				Records: []string{"dynip"},
+			})
+			if err != nil {
+				t.Fatalf("couldn't create zone file updater: %s", err)
+			}
+			z.now = func() time.Time { return time.Date(2019, 5, 17, 12, 0, 0, 0, time.UTC) }
+
+			r := *req
+			r.DryRun = test.dryRun
+			res, err := z.Apply(context.Background(), &r)
+			if err != nil {
+				t.Fatalf("zone file update failed: %s", err)
+			}
+			if res.Count(Changed) != test.changed || len(res.Targets) != test.changed {
+				t.Fatalf("unexpected result: %s", res)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("couldn't read zone file: %s", err)
+			}
+			_, soa, err := parseZone(data, "example.org.", path)
+			if err != nil {
+				t.Fatalf("couldn't parse updated zone file: %s", err)
+			}
+			if soa.Serial != test.serial {
+				t.Fatalf("unexpected serial: got %d, want %d", soa.Serial, test.serial)
+			}
+		})
+	}
+}
+
+// parseZone reads all resource records of a zone and returns them together with the
+// zone's SOA record
+func parseZone(data []byte, origin, path string) ([]dns.RR, *dns.SOA, error) {
+	var (
+		rrs []dns.RR
+		soa *dns.SOA
+	)
+
+	zp := dns.NewZoneParser(bytes.NewReader(data), origin, path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if s, isSOA := rr.(*dns.SOA); isSOA && soa == nil {
+			soa = s
+		}
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, nil, err
+	}
+	if soa == nil {
+		return nil, nil, fmt.Errorf("zone %s has no SOA record", strings.TrimSuffix(origin, "."))
+	}
+	return rrs, soa, nil
+}
+
+var testFormattedZone = `; zone of example.org, maintained by hand
+$TTL 3600
+$ORIGIN example.org.
+@   IN  SOA ns1.example.org. hostmaster.example.org. (
+            2019010101 ; serial
+            7200       ; refresh
+            3600       ; retry
+            1209600    ; expire
+            3600 )     ; minimum
+    IN  NS  ns1        ; primary
+ns1 IN  A   192.0.2.53
+; round robin, only the dynamic address changes
+www     300 IN A 192.0.2.1
+www     300 IN A 192.0.2.2
+        300 IN AAAA 2001:db8::1 ; same owner
+txt     IN  TXT "192.0.2.1 ; not a comment"
+$INCLUDE /etc/bind/db.static
+$ORIGIN lab.example.org.
+gw      A   192.0.2.1
+`
+
+func TestZoneFileInPlace(t *testing.T) {
+	var tests = []struct {
+		name     string
+		records  []string
+		req      *Request
+		expected string
+	}{
+		{"round robin with previous IP",
+			[]string{"www"},
+			&Request{IPv4: "203.0.113.7", PreviousIPv4: "192.0.2.2", IPv6: "2001:db8::7"},
+			strings.NewReplacer(
+				"2019010101 ; serial", "2019051700 ; serial",
+				"www     300 IN A 192.0.2.2", "www     300 IN A 203.0.113.7",
+				"AAAA 2001:db8::1 ;", "AAAA 2001:db8::7 ;",
+			).Replace(testFormattedZone)},
+		{"round robin without previous IP",
+			[]string{"www"},
+			&Request{IPv4: "203.0.113.7"},
+			strings.NewReplacer(
+				"2019010101 ; serial", "2019051700 ; serial",
+				"www     300 IN A 192.0.2.1", "www     300 IN A 203.0.113.7",
+			).Replace(testFormattedZone)},
+		{"round robin member already set",
+			[]string{"www"},
+			&Request{IPv4: "192.0.2.2", PreviousIPv4: "192.0.2.1"},
+			testFormattedZone},
+		{"name below a second origin",
+			[]string{"gw.lab.example.org.", "ns1"},
+			&Request{IPv4: "203.0.113.7"},
+			strings.NewReplacer(
+				"2019010101 ; serial", "2019051700 ; serial",
+				"gw      A   192.0.2.1", "gw      A   203.0.113.7",
+				"ns1 IN  A   192.0.2.53", "ns1 IN  A   203.0.113.7",
+			).Replace(testFormattedZone)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db.example.org")
+			err := os.WriteFile(path, []byte(testFormattedZone), 0640)
+			if err != nil {
+				t.Fatalf("couldn't write zone file: %s", err)
+			}
+
+			z, err := NewZoneFileUpdate(&cfg.ZoneFileConfig{
+				Path:    path,
+				Origin:  "example.org",
+				Records: test.records,
+			})
+			if err != nil {
+				t.Fatalf("couldn't create zone file updater: %s", err)
+			}
+			z.now = func() time.Time { return time.Date(2019, 5, 17, 12, 0, 0, 0, time.UTC) }
+
+			res, err := z.Apply(context.Background(), test.req)
+			if err != nil {
+				t.Fatalf("zone file update failed: %s", err)
+			}
+			t.Log(res)
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("couldn't read zone file: %s", err)
+			}
+			if string(data) != test.expected {
+				t.Fatalf("unexpected zone file:\n%s\nwant:\n%s", data, test.expected)
+			}
+		})
+	}
+}
+
+// zoneAddresses returns the addresses of name which are of the same family as ip
+func zoneAddresses(rrs []dns.RR, name, ip string) []string {
+	var ips []string
+	for _, rr := range rrs {
+		if !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+		switch r := rr.(type) {
+		case *dns.A:
+			if !strings.Contains(ip, ":") {
+				ips = append(ips, r.A.String())
+			}
+		case *dns.AAAA:
+			if strings.Contains(ip, ":") {
+				ips = append(ips, r.AAAA.String())
+			}
+		}
+	}
+	return ips
+}